@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ACLActionReject = "reject"
+	ACLActionDrop   = "drop"
+)
+
+// AccessList is the allow and deny lists of the sources sending to a proxy or listener.
+// The list of a listener is checked together with the list of its proxy, both are shared
+// with the server transports and updated in place on reload
+type AccessList struct {
+	sync.Mutex
+	// the access list of the proxy, nil for the access list of proxy
+	parent *AccessList
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	// empty if the action of the parent is used
+	action string
+}
+
+func NewAccessList(parent *AccessList) *AccessList {
+	return &AccessList{parent: parent}
+}
+
+// Update replace the lists and the action, all the sources are allowed if config is nil
+func (a *AccessList) Update(config *ACLConfig) error {
+	var allow, deny []*net.IPNet
+	action := ""
+	if config != nil {
+		var err error
+		if allow, err = parseIPNets(config.Allow); err != nil {
+			return err
+		}
+		if deny, err = parseIPNets(config.Deny); err != nil {
+			return err
+		}
+		if action, err = parseACLAction(config.Action); err != nil {
+			return err
+		}
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.allow, a.deny, a.action = allow, deny, action
+	return nil
+}
+
+// Check check if the source address is allowed by this list and the list of the parent,
+// drop is true if the messages from the denied source are discarded without response
+func (a *AccessList) Check(addr string) (allowed bool, drop bool) {
+	if a == nil {
+		return true, false
+	}
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	denied, action := a.isDenied(ip)
+	if a.parent != nil {
+		parentDenied, parentAction := a.parent.isDenied(ip)
+		denied = denied || parentDenied
+		if action == "" {
+			action = parentAction
+		}
+	}
+	return !denied, denied && action == ACLActionDrop
+}
+
+func (a *AccessList) isDenied(ip net.IP) (bool, string) {
+	a.Lock()
+	defer a.Unlock()
+	if ip == nil {
+		return len(a.allow) > 0, a.action
+	}
+	if containsNetIP(a.deny, ip) {
+		return true, a.action
+	}
+	return len(a.allow) > 0 && !containsNetIP(a.allow, ip), a.action
+}
+
+// parseACLAction check the action, empty action means the action of the parent
+func parseACLAction(action string) (string, error) {
+	switch strings.ToLower(action) {
+	case "":
+		return "", nil
+	case ACLActionReject:
+		return ACLActionReject, nil
+	case ACLActionDrop:
+		return ACLActionDrop, nil
+	}
+	return "", fmt.Errorf("invalid acl action %s, must be reject or drop", action)
+}
+
+// parseIPNets parse the addresses in IP or CIDR format
+func parseIPNets(addrs []string) ([]*net.IPNet, error) {
+	r := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s, expect IP or CIDR", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			r = append(r, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s, expect IP or CIDR", addr)
+		}
+		r = append(r, ipNet)
+	}
+	return r, nil
+}
+
+// containsIP check if the address is in any of the networks
+func containsIP(ipNets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	return ip != nil && containsNetIP(ipNets, ip)
+}
+
+func containsNetIP(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// createForbiddenResponse create the 403 to the request from the denied source, false is
+// returned if the message is a response or an ACK which can't be answered
+func createForbiddenResponse(msg *Message) ([]byte, bool) {
+	if method, err := msg.GetMethod(); !msg.IsRequest() || err != nil || method == "ACK" {
+		return nil, false
+	}
+	b, err := NewResponseOf(msg, 403, "Forbidden").Bytes()
+	return b, err == nil
+}
+
+// SetACL update the access list checked by all the listeners of the proxy
+func (p *Proxy) SetACL(config *ACLConfig) error {
+	if err := p.acl.Update(config); err != nil {
+		zap.L().Error("Invalid acl of proxy", zap.String("name", p.name), zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
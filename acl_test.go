@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessListCheck(t *testing.T) {
+	proxyACL := NewAccessList(nil)
+	if err := proxyACL.Update(&ACLConfig{Deny: []string{"10.0.0.1"}, Action: "drop"}); err != nil {
+		t.Fatal(err)
+	}
+	listenACL := NewAccessList(proxyACL)
+	if err := listenACL.Update(&ACLConfig{Allow: []string{"10.0.0.0/24", "2001:db8::/32"}}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr    string
+		allowed bool
+		drop    bool
+	}{{"10.0.0.2", true, false},
+		{"10.0.0.1", false, true},
+		{"10.0.1.1", false, true},
+		{"[2001:db8::1]", true, false},
+		{"invalid", false, true}}
+	for _, test := range tests {
+		if allowed, drop := listenACL.Check(test.addr); allowed != test.allowed || drop != test.drop {
+			t.Errorf("expect %v/%v for %s but get %v/%v", test.allowed, test.drop, test.addr, allowed, drop)
+		}
+	}
+
+	listenACL.Update(&ACLConfig{Action: "reject"})
+	if allowed, drop := listenACL.Check("10.0.0.1"); allowed || drop {
+		t.Errorf("the action of listen doesn't override the action of proxy")
+	}
+	if allowed, _ := listenACL.Check("10.0.1.1"); !allowed {
+		t.Errorf("the source is denied after the allow list is removed")
+	}
+	var nilACL *AccessList
+	if allowed, _ := nilACL.Check("10.0.0.1"); !allowed {
+		t.Errorf("the source is denied without acl")
+	}
+	if err := listenACL.Update(&ACLConfig{Deny: []string{"10.0.0.256"}}); err == nil {
+		t.Errorf("the invalid address is accepted")
+	}
+}
+
+func TestUDPDeniedSource(t *testing.T) {
+	startTestBackend(t, 15961, 15960, 200, "OK")
+	listen := ListenConfig{Address: "127.0.0.1",
+		UdpPort:  15960,
+		ACL:      &ACLConfig{Deny: []string{"127.0.0.1"}},
+		Backends: []BackendConfig{{Address: "udp://127.0.0.1:15961"}}}
+	proxy := NewProxy("test.com", 60, []ListenConfig{listen}, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	request := "OPTIONS sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%%d;branch=z9hG4bK776asdha%d\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301790\r\nTo: <sip:bob@test.com>\r\nCall-ID: a84b4c76e66730@test.com\r\nCSeq: %d OPTIONS\r\nContent-Length: 0\r\n\r\n"
+	response := sendTestRequest(t, 15960, fmt.Sprintf(request, 1, 1))
+	if response.response.statusCode != 403 {
+		t.Errorf("expect 403 for the denied source but get %d", response.response.statusCode)
+	}
+
+	// the acl is changed without restarting the listen
+	listen.ACL = &ACLConfig{Deny: []string{"127.0.0.1"}, Action: "drop"}
+	if err := proxy.Reload([]ListenConfig{listen}, NewPreConfigRoute(), NewPreConfigHostResolver()); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteToUDP([]byte(fmt.Sprintf(fmt.Sprintf(request, 2, 2), conn.LocalAddr().(*net.UDPAddr).Port)), &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 15960})
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, _, err := conn.ReadFromUDP(make([]byte, 4096)); err == nil {
+		t.Errorf("the request from the denied source is answered in drop mode")
+	}
+
+	listen.ACL = &ACLConfig{Allow: []string{"127.0.0.0/8"}}
+	if err := proxy.Reload([]ListenConfig{listen}, NewPreConfigRoute(), NewPreConfigHostResolver()); err != nil {
+		t.Fatal(err)
+	}
+	response = sendTestRequest(t, 15960, fmt.Sprintf(request, 3, 3))
+	if response.response.statusCode != 200 {
+		t.Errorf("expect the request from the allowed source is forwarded but get %d", response.response.statusCode)
+	}
+}
+
+func TestTCPDeniedSource(t *testing.T) {
+	listens := []ListenConfig{{Address: "127.0.0.1", TcpPort: 15962}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.SetACL(&ACLConfig{Allow: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:15962")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "OPTIONS sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/TCP 127.0.0.1:5060;branch=z9hG4bK776asdhb1\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301791\r\nTo: <sip:bob@test.com>\r\nCall-ID: a84b4c76e66731@test.com\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := ParseMessage(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.response.statusCode != 403 {
+		t.Errorf("expect 403 for the source out of the allow list but get %d", response.response.statusCode)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the connection of the denied source is not closed after the 403: %v", err)
+	}
+}
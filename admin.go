@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// AdminServer exposes the runtime state of the proxies as JSON over HTTP
+type AdminServer struct {
+	sync.Mutex
+	addr    string
+	proxies []*Proxy
+	mux     *http.ServeMux
+}
+
+type TransportInfo struct {
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+}
+
+type ListenInfo struct {
+	Address    string          `json:"address"`
+	Via        string          `json:"via,omitempty"`
+	Transports []TransportInfo `json:"transports"`
+	Backends   []string        `json:"backends"`
+}
+
+type ProxyInfo struct {
+	Id      int          `json:"id"`
+	Name    string       `json:"name"`
+	Listens []ListenInfo `json:"listens"`
+}
+
+type BackendInfo struct {
+	Listen  string   `json:"listen"`
+	Policy  string   `json:"policy"`
+	Members []string `json:"members"`
+	// the health of the members if the health check is configured
+	Health []BackendHealthInfo `json:"health,omitempty"`
+}
+
+func NewAdminServer(addr string, proxies []*Proxy) *AdminServer {
+	admin := &AdminServer{addr: addr, proxies: proxies, mux: http.NewServeMux()}
+	admin.mux.HandleFunc("GET /proxies", admin.handleProxies)
+	admin.mux.HandleFunc("GET /proxies/{id}", admin.handleProxy)
+	admin.mux.HandleFunc("GET /proxies/{id}/backends", admin.handleBackends)
+	admin.mux.HandleFunc("GET /proxies/{id}/self-learn-routes", admin.handleSelfLearnRoutes)
+	admin.mux.HandleFunc("GET /proxies/{id}/preconfig-routes", admin.handlePreConfigRoutes)
+	admin.mux.HandleFunc("GET /proxies/{id}/sessions", admin.handleSessions)
+	admin.mux.HandleFunc("GET /proxies/{id}/rate-limits", admin.handleRateLimits)
+	admin.mux.HandleFunc("GET /proxies/{id}/registrations", admin.handleRegistrations)
+	admin.mux.HandleFunc("GET /proxies/{id}/trunks", admin.handleTrunks)
+	admin.mux.Handle("GET /metrics", promhttp.Handler())
+	return admin
+}
+
+// SetProxies replace the proxies after the configuration is reloaded
+func (a *AdminServer) SetProxies(proxies []*Proxy) {
+	a.Lock()
+	defer a.Unlock()
+	a.proxies = proxies
+}
+
+func (a *AdminServer) getProxies() []*Proxy {
+	a.Lock()
+	defer a.Unlock()
+	return a.proxies
+}
+
+// EnableReload serve "POST /reload" to reload the configuration, the proxies are
+// returned if the reload succeeds
+func (a *AdminServer) EnableReload(reload func() error) {
+	a.mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.handleProxies(w, r)
+	})
+}
+
+// Start listen on the admin address and serve the admin API in background
+func (a *AdminServer) Start() error {
+	ln, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		zap.L().Error("Fail to listen on admin address", zap.String("addr", a.addr), zap.String("error", err.Error()))
+		return err
+	}
+	zap.L().Info("Succeed to listen on admin address", zap.String("addr", a.addr))
+	go func() {
+		err := http.Serve(ln, a.mux)
+		if err != nil {
+			zap.L().Error("admin server exits", zap.String("addr", a.addr), zap.String("error", err.Error()))
+		}
+	}()
+	return nil
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *AdminServer) handleProxies(w http.ResponseWriter, r *http.Request) {
+	result := make([]ProxyInfo, 0)
+	for id, proxy := range a.getProxies() {
+		result = append(result, proxy.GetProxyInfo(id))
+	}
+	a.writeJSON(w, result)
+}
+
+func (a *AdminServer) handleProxy(w http.ResponseWriter, r *http.Request) {
+	if id, proxy, ok := a.findProxy(w, r); ok {
+		a.writeJSON(w, proxy.GetProxyInfo(id))
+	}
+}
+
+func (a *AdminServer) handleBackends(w http.ResponseWriter, r *http.Request) {
+	if _, proxy, ok := a.findProxy(w, r); ok {
+		a.writeJSON(w, proxy.GetBackendInfos())
+	}
+}
+
+func (a *AdminServer) handleSelfLearnRoutes(w http.ResponseWriter, r *http.Request) {
+	if _, proxy, ok := a.findProxy(w, r); ok {
+		a.writeJSON(w, proxy.selfLearnRoute.GetRoutes())
+	}
+}
+
+func (a *AdminServer) handlePreConfigRoutes(w http.ResponseWriter, r *http.Request) {
+	if _, proxy, ok := a.findProxy(w, r); ok {
+		a.writeJSON(w, proxy.preConfigRoute.GetRouteItems())
+	}
+}
+
+func (a *AdminServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if _, proxy, ok := a.findProxy(w, r); ok {
+		a.writeJSON(w, proxy.GetSessions())
+	}
+}
+
+func (a *AdminServer) handleRateLimits(w http.ResponseWriter, r *http.Request) {
+	if _, proxy, ok := a.findProxy(w, r); ok {
+		a.writeJSON(w, proxy.GetRateLimitInfo())
+	}
+}
+
+func (a *AdminServer) handleRegistrations(w http.ResponseWriter, r *http.Request) {
+	if _, proxy, ok := a.findProxy(w, r); ok {
+		bindings, err := proxy.GetBindings()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.writeJSON(w, bindings)
+	}
+}
+
+func (a *AdminServer) handleTrunks(w http.ResponseWriter, r *http.Request) {
+	if _, proxy, ok := a.findProxy(w, r); ok {
+		a.writeJSON(w, proxy.GetTrunkInfos())
+	}
+}
+
+// findProxy find the proxy by the {id} in the request path, the id is the
+// index of the proxy in the configuration file
+func (a *AdminServer) findProxy(w http.ResponseWriter, r *http.Request) (int, *Proxy, bool) {
+	proxies := a.getProxies()
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 0 || id >= len(proxies) {
+		http.Error(w, fmt.Sprintf("no such proxy %s", r.PathValue("id")), http.StatusNotFound)
+		return 0, nil, false
+	}
+	return id, proxies[id], true
+}
+
+func (a *AdminServer) writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
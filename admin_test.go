@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func createTestAdminServer() *AdminServer {
+	listens := []ListenConfig{{Address: "127.0.0.1",
+		UdpPort:  15060,
+		Backends: []BackendConfig{{Address: "udp://127.0.0.1:15070"}}}}
+	preConfigRoute := NewPreConfigRoute()
+	preConfigRoute.AddRouteItem("udp", "test.com", "10.0.0.1:3456")
+	resolver := NewPreConfigHostResolver()
+	proxy := NewProxy("test.com", 60, listens, true, preConfigRoute, resolver, NewSelfLearnRoute(), true, false, nil)
+	return NewAdminServer(":0", []*Proxy{proxy})
+}
+
+func TestAdminGetProxies(t *testing.T) {
+	admin := createTestAdminServer()
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/proxies", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	proxies := make([]ProxyInfo, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &proxies); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxies) != 1 || proxies[0].Name != "test.com" || len(proxies[0].Listens) != 1 {
+		t.Fail()
+	}
+	if len(proxies[0].Listens[0].Backends) != 1 || proxies[0].Listens[0].Backends[0] != "udp://127.0.0.1:15070" {
+		t.Fail()
+	}
+}
+
+func TestAdminGetPreConfigRoutes(t *testing.T) {
+	admin := createTestAdminServer()
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/proxies/0/preconfig-routes", nil))
+	routes := make([]PreRouteItemInfo, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &routes); err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].Host != "10.0.0.1" || routes[0].Port != 3456 {
+		t.Fail()
+	}
+}
+
+func TestAdminProxyNotFound(t *testing.T) {
+	admin := createTestAdminServer()
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/proxies/3/sessions", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fail()
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultNonceExpire       = 300
+	defaultLookupCacheExpire = 60
+	// the failed lookups are cached shortly to not block the workers on a down endpoint
+	lookupFailureExpire = 5 * time.Second
+	maxLookupCacheSize  = 10000
+)
+
+// SupportedDigestAlgorithms is the digest algorithms can be offered in the challenge
+var SupportedDigestAlgorithms = []string{"SHA-256", "MD5"}
+
+var errUnknownUser = errors.New("unknown user")
+
+// DigestAuthenticator challenge the requests with 407 (Proxy Authentication Required) and
+// verify the Proxy-Authorization in the retried requests. The nonce is signed by a secret
+// created at startup, so no state is kept for the challenges, only the nonce counts used
+// with the nonces are kept to reject the replayed credentials
+type DigestAuthenticator struct {
+	sync.Mutex
+	realm       string
+	algorithms  []string
+	credentials map[string]string
+	lookupURL   string
+	httpClient  *http.Client
+	trusted     []*net.IPNet
+	nonceExpire time.Duration
+	secret      []byte
+	// the highest nonce count used with each nonce which is not expired
+	usedNonces map[string]uint64
+	lastSweep  time.Time
+	// the results of the password lookups by username
+	lookups           map[string]*passwordLookup
+	lookupCacheExpire time.Duration
+}
+
+type passwordLookup struct {
+	password string
+	err      error
+	expire   time.Time
+}
+
+func NewDigestAuthenticator(config *AuthConfig) (*DigestAuthenticator, error) {
+	algorithms, err := parseDigestAlgorithms(config.Algorithms)
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := parseIPNets(config.Trusted)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]string)
+	if config.CredentialsFile != "" {
+		if credentials, err = loadCredentials(config.CredentialsFile); err != nil {
+			return nil, err
+		}
+	}
+	nonceExpire := config.NonceExpire
+	if nonceExpire <= 0 {
+		nonceExpire = defaultNonceExpire
+	}
+	lookupCacheExpire := config.LookupCacheExpire
+	if lookupCacheExpire <= 0 {
+		lookupCacheExpire = defaultLookupCacheExpire
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &DigestAuthenticator{realm: config.Realm,
+		algorithms:        algorithms,
+		credentials:       credentials,
+		lookupURL:         config.LookupURL,
+		httpClient:        &http.Client{Timeout: 2 * time.Second},
+		trusted:           trusted,
+		nonceExpire:       time.Duration(nonceExpire) * time.Second,
+		secret:            secret,
+		usedNonces:        make(map[string]uint64),
+		lookups:           make(map[string]*passwordLookup),
+		lookupCacheExpire: time.Duration(lookupCacheExpire) * time.Second}, nil
+}
+
+// parseDigestAlgorithms check the configured algorithms, both SHA-256 and MD5 are offered
+// if no algorithm is configured
+func parseDigestAlgorithms(algorithms []string) ([]string, error) {
+	if len(algorithms) == 0 {
+		return SupportedDigestAlgorithms, nil
+	}
+	r := make([]string, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		i := slices.IndexFunc(SupportedDigestAlgorithms, func(s string) bool {
+			return strings.EqualFold(s, algorithm)
+		})
+		if i == -1 {
+			return nil, fmt.Errorf("unsupported digest algorithm %s, must be MD5 or SHA-256", algorithm)
+		}
+		r = append(r, SupportedDigestAlgorithms[i])
+	}
+	return r, nil
+}
+
+// loadCredentials load the "username:password" lines from the file, the empty lines and
+// the lines started with # are skipped
+func loadCredentials(fileName string) (map[string]string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	credentials := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, password, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("invalid credential at line %d of %s, expect username:password", lineNo, fileName)
+		}
+		credentials[username] = password
+	}
+	return credentials, scanner.Err()
+}
+
+// IsTrusted check if the requests from the address are not challenged
+func (a *DigestAuthenticator) IsTrusted(addr string) bool {
+	return containsIP(a.trusted, addr)
+}
+
+// createNonce create a nonce made of the timestamp and its signature
+func (a *DigestAuthenticator) createNonce(now time.Time) string {
+	timestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestamp, uint64(now.Unix()))
+	return hex.EncodeToString(timestamp) + hex.EncodeToString(a.sign(timestamp))
+}
+
+// checkNonce check if the nonce is created by this authenticator and is not expired, stale
+// is true if the nonce is created by this authenticator but it is expired
+func (a *DigestAuthenticator) checkNonce(nonce string, now time.Time) (valid bool, stale bool) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) <= 8 || !hmac.Equal(b[8:], a.sign(b[:8])) {
+		return false, false
+	}
+	created := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	if now.Sub(created) > a.nonceExpire {
+		return false, true
+	}
+	return true, false
+}
+
+// useNonceCount record the nonce count used with the nonce, false is returned if the count
+// is not greater than the counts used before. The credentials without qop have no nonce
+// count, so their nonce can be used only once
+func (a *DigestAuthenticator) useNonceCount(nonce string, nc string, now time.Time) bool {
+	var count uint64
+	if nc != "" {
+		c, err := strconv.ParseUint(nc, 16, 64)
+		if err != nil || c == 0 {
+			return false
+		}
+		count = c
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.sweepNonces(now)
+	if used, ok := a.usedNonces[nonce]; ok && count <= used {
+		return false
+	}
+	a.usedNonces[nonce] = count
+	return true
+}
+
+// sweepNonces remove the expired nonces, they can't be used any more
+func (a *DigestAuthenticator) sweepNonces(now time.Time) {
+	if now.Sub(a.lastSweep) < a.nonceExpire {
+		return
+	}
+	a.lastSweep = now
+	for nonce := range a.usedNonces {
+		if valid, _ := a.checkNonce(nonce, now); !valid {
+			delete(a.usedNonces, nonce)
+		}
+	}
+}
+
+func (a *DigestAuthenticator) sign(timestamp []byte) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(timestamp)
+	return mac.Sum(nil)[:16]
+}
+
+// getPassword get the password of the user from the credentials file or the lookup
+// endpoint, errUnknownUser is returned if the user is not found. The results of the
+// lookups are cached, so the endpoint is not called for each request
+func (a *DigestAuthenticator) getPassword(username string) (string, error) {
+	if password, ok := a.credentials[username]; ok {
+		return password, nil
+	}
+	if a.lookupURL == "" {
+		return "", errUnknownUser
+	}
+	now := time.Now()
+	a.Lock()
+	lookup, ok := a.lookups[username]
+	a.Unlock()
+	if ok && now.Before(lookup.expire) {
+		return lookup.password, lookup.err
+	}
+	password, err := a.lookupPassword(username)
+	lookup = &passwordLookup{password: password, err: err, expire: now.Add(a.lookupCacheExpire)}
+	if err != nil && !errors.Is(err, errUnknownUser) {
+		lookup.expire = now.Add(lookupFailureExpire)
+	}
+	a.Lock()
+	defer a.Unlock()
+	if len(a.lookups) >= maxLookupCacheSize {
+		for name, lookup := range a.lookups {
+			if !now.Before(lookup.expire) {
+				delete(a.lookups, name)
+			}
+		}
+	}
+	if len(a.lookups) < maxLookupCacheSize {
+		a.lookups[username] = lookup
+	}
+	return password, err
+}
+
+// lookupPassword get the password of the user from the lookup endpoint
+func (a *DigestAuthenticator) lookupPassword(username string) (string, error) {
+	u, err := url.Parse(a.lookupURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("username", username)
+	query.Set("realm", a.realm)
+	u.RawQuery = query.Encode()
+	resp, err := a.httpClient.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errUnknownUser
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fail to look up user %s, status %d", username, resp.StatusCode)
+	}
+	r := struct {
+		Password string `json:"password"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", err
+	}
+	return r.Password, nil
+}
+
+// Verify check the Proxy-Authorization headers of this realm in the request, stale is true
+// if the credentials are correct but the nonce is expired
+func (a *DigestAuthenticator) Verify(msg *Message) (authorized bool, stale bool) {
+	method, err := msg.GetMethod()
+	if err != nil {
+		return false, false
+	}
+	// the digest uri is computed by the client with the Request-URI it sends, it is
+	// compared before the Request-URI is changed by the header rules or topology hiding
+	requestURI, err := msg.GetReceivedRequestURI()
+	if err != nil {
+		return false, false
+	}
+	for _, header := range msg.headers {
+		if !msg.isSameHeader(header.name, "Proxy-Authorization") {
+			continue
+		}
+		value, ok := header.value.(string)
+		if !ok {
+			continue
+		}
+		params, ok := parseDigestCredentials(value)
+		if !ok || params["realm"] != a.realm {
+			continue
+		}
+		ok, isStale := a.verifyCredentials(method, requestURI, params)
+		if ok && !isStale {
+			return true, false
+		}
+		stale = stale || (ok && isStale)
+	}
+	return false, stale
+}
+
+// verifyCredentials verify the response in the credentials for the Request-URI, stale is
+// true if the nonce is expired. The nonce count used before with the nonce is rejected
+func (a *DigestAuthenticator) verifyCredentials(method string, requestURI *AddrSpec, params map[string]string) (ok bool, stale bool) {
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	i := slices.IndexFunc(a.algorithms, func(s string) bool {
+		return strings.EqualFold(s, algorithm)
+	})
+	if i == -1 {
+		return false, false
+	}
+	username, nonce, uri, response := params["username"], params["nonce"], params["uri"], params["response"]
+	if username == "" || nonce == "" || uri == "" || response == "" {
+		return false, false
+	}
+	if digestURI, err := ParseAddrSpec(uri); err != nil || digestURI.String() != requestURI.String() {
+		zap.L().Info("the digest uri is not the Request-URI", zap.String("uri", uri), zap.String("requestURI", requestURI.String()))
+		return false, false
+	}
+	valid, stale := a.checkNonce(nonce, time.Now())
+	if !valid && !stale {
+		return false, false
+	}
+	password, err := a.getPassword(username)
+	if err != nil {
+		if !errors.Is(err, errUnknownUser) {
+			zap.L().Error("fail to get password", zap.String("username", username), zap.String("error", err.Error()))
+		}
+		return false, false
+	}
+	newHash := md5.New
+	if a.algorithms[i] == "SHA-256" {
+		newHash = sha256.New
+	}
+	ha1 := digestHash(newHash, username+":"+a.realm+":"+password)
+	ha2 := digestHash(newHash, method+":"+uri)
+	var expected string
+	switch qop := params["qop"]; qop {
+	case "":
+		expected = digestHash(newHash, ha1+":"+nonce+":"+ha2)
+	case "auth":
+		if params["nc"] == "" || params["cnonce"] == "" {
+			return false, false
+		}
+		expected = digestHash(newHash, strings.Join([]string{ha1, nonce, params["nc"], params["cnonce"], qop, ha2}, ":"))
+	default:
+		return false, false
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(response))) != 1 {
+		zap.L().Info("wrong digest response", zap.String("username", username), zap.String("realm", a.realm))
+		return false, false
+	}
+	if !stale && !a.useNonceCount(nonce, params["nc"], time.Now()) {
+		zap.L().Info("the nonce count is used before", zap.String("username", username), zap.String("nc", params["nc"]))
+		return false, false
+	}
+	return true, stale
+}
+
+func digestHash(newHash func() hash.Hash, s string) string {
+	h := newHash()
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Challenge create the 407 response with a Proxy-Authenticate header for each algorithm
+func (a *DigestAuthenticator) Challenge(msg *Message, stale bool) *Message {
+	response := NewResponseOf(msg, 407, "Proxy Authentication Required")
+	nonce := a.createNonce(time.Now())
+	for _, algorithm := range a.algorithms {
+		challenge := fmt.Sprintf("Digest realm=\"%s\", nonce=\"%s\", algorithm=%s, qop=\"auth\"", a.realm, nonce, algorithm)
+		if stale {
+			challenge += ", stale=true"
+		}
+		response.AddHeader("Proxy-Authenticate", challenge)
+	}
+	return response
+}
+
+// RemoveCredentials remove the Proxy-Authorization headers of this realm from the request
+// before it is forwarded, the credentials of the other realms are kept
+func (a *DigestAuthenticator) RemoveCredentials(msg *Message) {
+	headers := make([]*Header, 0, len(msg.headers))
+	for _, header := range msg.headers {
+		if msg.isSameHeader(header.name, "Proxy-Authorization") {
+			if value, ok := header.value.(string); ok {
+				if params, ok := parseDigestCredentials(value); ok && params["realm"] == a.realm {
+					continue
+				}
+			}
+		}
+		headers = append(headers, header)
+	}
+	msg.headers = headers
+}
+
+// parseDigestCredentials parse the parameters of the "Digest" credentials, the quotes of
+// the values are removed and the names are in lower case
+func parseDigestCredentials(value string) (map[string]string, bool) {
+	scheme, rest, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok || !strings.EqualFold(scheme, "Digest") {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		name, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			return nil, false
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		after = strings.TrimSpace(after)
+		var v string
+		if strings.HasPrefix(after, "\"") {
+			end := strings.IndexByte(after[1:], '"')
+			if end == -1 {
+				return nil, false
+			}
+			v, after = after[1:end+1], after[end+2:]
+		} else if pos := strings.IndexByte(after, ','); pos != -1 {
+			v, after = strings.TrimSpace(after[:pos]), after[pos:]
+		} else {
+			v, after = strings.TrimSpace(after), ""
+		}
+		params[name] = v
+		after = strings.TrimSpace(after)
+		rest = strings.TrimSpace(strings.TrimPrefix(after, ","))
+	}
+	return params, true
+}
+
+// findProxyItem find the listener owning the server transport
+func (p *Proxy) findProxyItem(transport ServerTransport) *ProxyItem {
+	for _, item := range p.getItems() {
+		if _, err := item.FindTransport(func(t ServerTransport) bool { return t == transport }); err == nil {
+			return item
+		}
+	}
+	return nil
+}
+
+// isInSession check if the request is in a dialog and its session is bound to a backend
+// by this proxy, the To tag alone is not trusted since anyone can add it
+func (p *Proxy) isInSession(msg *Message) bool {
+	if isOutOfDialogRequest(msg) {
+		return false
+	}
+	sessionId, err := msg.GetSessionId()
+	if err != nil {
+		return false
+	}
+	_, err = p.sessionBackends.GetBackend(sessionId)
+	return err == nil
+}
+
+// rejectUnauthenticated challenge the request from the untrusted source if the
+// authentication is configured on the listener receiving it, the ACK, CANCEL and the
+// requests in the existing sessions are not challenged. true is returned if the request
+// is answered with 407
+func (p *Proxy) rejectUnauthenticated(msg *Message, peerAddr string) bool {
+	if msg.ReceivedFrom == nil {
+		return false
+	}
+	if method, err := msg.GetMethod(); err != nil || method == "ACK" || method == "CANCEL" || p.isInSession(msg) {
+		return false
+	}
+	item := p.findProxyItem(msg.ReceivedFrom)
+	if item == nil || item.authenticator == nil || item.authenticator.IsTrusted(peerAddr) {
+		return false
+	}
+	authorized, stale := item.authenticator.Verify(msg)
+	if authorized {
+		item.authenticator.RemoveCredentials(msg)
+		return false
+	}
+	callId, _ := msg.GetCallID()
+	zap.L().Info("challenge the request from untrusted source", zap.String("peerAddr", peerAddr), zap.String("call-id", callId), zap.Bool("stale", stale))
+	p.sendProxyResponse(item.authenticator.Challenge(msg, stale))
+	return true
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRequestURI is the Request-URI of the request created by createTestRequest
+const testRequestURI = "sip:bob@biloxi.example.com"
+
+func createTestAuthenticator(t *testing.T, config AuthConfig) *DigestAuthenticator {
+	fileName := filepath.Join(t.TempDir(), "credentials")
+	if err := os.WriteFile(fileName, []byte("# test users\nalice:secret\n\nbob:pa:ss\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Realm = "test.com"
+	config.CredentialsFile = fileName
+	a, err := NewDigestAuthenticator(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// createTestCredentials create the Proxy-Authorization value of the user for the request
+// to the uri with the nonce count nc
+func createTestCredentials(newHash func() hash.Hash, algorithm string, method string, uri string, username string, password string, realm string, nonce string, nc string) string {
+	ha1 := digestHash(newHash, username+":"+realm+":"+password)
+	ha2 := digestHash(newHash, method+":"+uri)
+	response := digestHash(newHash, ha1+":"+nonce+":"+nc+":0a4f113b:auth:"+ha2)
+	return fmt.Sprintf("Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"%s\", response=\"%s\", algorithm=%s, qop=auth, nc=%s, cnonce=\"0a4f113b\"", username, realm, nonce, uri, response, algorithm, nc)
+}
+
+func TestParseDigestCredentials(t *testing.T) {
+	params, ok := parseDigestCredentials(`Digest username="alice", realm="test, com", nonce="abc", uri="sip:bob@test.com", algorithm=SHA-256,qop=auth`)
+	if !ok {
+		t.Fatal("fail to parse the digest credentials")
+	}
+	if params["username"] != "alice" || params["realm"] != "test, com" || params["algorithm"] != "SHA-256" || params["qop"] != "auth" {
+		t.Errorf("wrong digest parameters %v", params)
+	}
+	if _, ok := parseDigestCredentials(`Basic YWxpY2U6c2VjcmV0`); ok {
+		t.Errorf("the basic credentials are parsed as digest")
+	}
+}
+
+func TestDigestAuthenticatorVerify(t *testing.T) {
+	a := createTestAuthenticator(t, AuthConfig{})
+	nonce := a.createNonce(time.Now())
+	tests := []struct {
+		newHash   func() hash.Hash
+		algorithm string
+		username  string
+		password  string
+		realm     string
+		nonce     string
+		expect    bool
+	}{{md5.New, "MD5", "alice", "secret", "test.com", nonce, true},
+		{sha256.New, "SHA-256", "bob", "pa:ss", "test.com", nonce, true},
+		{md5.New, "MD5", "alice", "wrong", "test.com", nonce, false},
+		{md5.New, "MD5", "carol", "secret", "test.com", nonce, false},
+		{md5.New, "MD5", "alice", "secret", "other.com", nonce, false},
+		{md5.New, "MD5", "alice", "secret", "test.com", nonce[:len(nonce)-2] + "00", false}}
+	for i, test := range tests {
+		request := createTestRequest("INVITE")
+		request.AddHeader("Proxy-Authorization", createTestCredentials(test.newHash, test.algorithm, "INVITE", testRequestURI, test.username, test.password, test.realm, test.nonce, fmt.Sprintf("%08x", i+1)))
+		if authorized, _ := a.Verify(request); authorized != test.expect {
+			t.Errorf("case %d: expect %v but get %v", i, test.expect, authorized)
+		}
+	}
+
+	expired := a.createNonce(time.Now().Add(-time.Hour))
+	request := createTestRequest("INVITE")
+	request.AddHeader("Proxy-Authorization", createTestCredentials(md5.New, "MD5", "INVITE", testRequestURI, "alice", "secret", "test.com", expired, "00000001"))
+	if authorized, stale := a.Verify(request); authorized || !stale {
+		t.Errorf("the expired nonce is not stale")
+	}
+}
+
+func TestDigestAuthenticatorRejectsReplay(t *testing.T) {
+	a := createTestAuthenticator(t, AuthConfig{})
+	nonce := a.createNonce(time.Now())
+	verify := func(uri string, nc string) bool {
+		request := createTestRequest("INVITE")
+		request.AddHeader("Proxy-Authorization", createTestCredentials(md5.New, "MD5", "INVITE", uri, "alice", "secret", "test.com", nonce, nc))
+		authorized, _ := a.Verify(request)
+		return authorized
+	}
+	if !verify(testRequestURI, "00000001") {
+		t.Fatal("the first use of the nonce is rejected")
+	}
+	if verify(testRequestURI, "00000001") {
+		t.Errorf("the replayed nonce count is accepted")
+	}
+	if !verify(testRequestURI, "00000002") {
+		t.Errorf("the next nonce count is rejected")
+	}
+	if verify("sip:carol@biloxi.example.com", "00000003") {
+		t.Errorf("the credentials for another uri are accepted")
+	}
+}
+
+func TestDigestAuthenticatorVerifyReceivedRequestURI(t *testing.T) {
+	a := createTestAuthenticator(t, AuthConfig{})
+	request := createTestRequest("INVITE")
+	request.AddHeader("Proxy-Authorization", createTestCredentials(md5.New, "MD5", "INVITE", testRequestURI, "alice", "secret", "test.com", a.createNonce(time.Now()), "00000001"))
+	// the Request-URI is rewritten by the header rules before the authentication
+	rewritten, _ := ParseAddrSpec("sip:bob@10.0.0.1")
+	request.SetRequestURI(rewritten)
+	if authorized, _ := a.Verify(request); !authorized {
+		t.Errorf("the credentials for the received Request-URI are rejected")
+	}
+}
+
+func TestDigestAuthenticatorLookup(t *testing.T) {
+	var lookups atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		if r.URL.Query().Get("username") != "dave" || r.URL.Query().Get("realm") != "test.com" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"password": "lookup"}`))
+	}))
+	defer server.Close()
+
+	a := createTestAuthenticator(t, AuthConfig{LookupURL: server.URL, Algorithms: []string{"sha-256"}})
+	if password, err := a.getPassword("dave"); err != nil || password != "lookup" {
+		t.Errorf("fail to look up the password: %v", err)
+	}
+	if _, err := a.getPassword("erin"); err != errUnknownUser {
+		t.Errorf("the unknown user is found: %v", err)
+	}
+	a.getPassword("dave")
+	a.getPassword("erin")
+	if n := lookups.Load(); n != 2 {
+		t.Errorf("expect the lookups are cached but the endpoint is called %d times", n)
+	}
+	request := createTestRequest("INVITE")
+	request.AddHeader("Proxy-Authorization", createTestCredentials(md5.New, "MD5", "INVITE", testRequestURI, "alice", "secret", "test.com", a.createNonce(time.Now()), "00000001"))
+	if authorized, _ := a.Verify(request); authorized {
+		t.Errorf("the algorithm not offered is accepted")
+	}
+}
+
+func TestDigestAuthenticatorIsTrusted(t *testing.T) {
+	a := createTestAuthenticator(t, AuthConfig{Trusted: []string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"}})
+	for addr, expect := range map[string]bool{"10.1.2.3": true,
+		"192.168.1.1":    true,
+		"192.168.1.2":    false,
+		"[2001:db8::1]":  true,
+		"172.16.0.1":     false,
+		"not-an-address": false} {
+		if a.IsTrusted(addr) != expect {
+			t.Errorf("expect %v for %s", expect, addr)
+		}
+	}
+}
+
+func TestProxyChallengesUntrustedSource(t *testing.T) {
+	received := startTestBackend(t, 15861, 15860, 200, "OK")
+	fileName := filepath.Join(t.TempDir(), "credentials")
+	if err := os.WriteFile(fileName, []byte("alice:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	listens := []ListenConfig{{Address: "127.0.0.1",
+		UdpPort:  15860,
+		Auth:     &AuthConfig{Realm: "test.com", CredentialsFile: fileName, Algorithms: []string{"MD5"}},
+		Backends: []BackendConfig{{Address: "udp://127.0.0.1:15861"}}}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := "OPTIONS sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%%d;branch=z9hG4bK776asdh%s\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301780\r\nTo: <sip:bob@test.com>\r\nCall-ID: a84b4c76e66720@test.com\r\nCSeq: %d OPTIONS\r\n%sContent-Length: 0\r\n\r\n"
+	response := sendTestRequest(t, 15860, fmt.Sprintf(request, "a1", 1, ""))
+	if response.response.statusCode != 407 {
+		t.Fatalf("expect 407 but get %d", response.response.statusCode)
+	}
+	challenge, err := response.GetHeaderValue("Proxy-Authenticate")
+	if err != nil {
+		t.Fatal("no Proxy-Authenticate in the 407")
+	}
+	params, ok := parseDigestCredentials(challenge.(string))
+	if !ok || params["realm"] != "test.com" || params["nonce"] == "" {
+		t.Fatalf("invalid challenge %v", challenge)
+	}
+
+	credentials := createTestCredentials(md5.New, "MD5", "OPTIONS", "sip:bob@test.com", "alice", "secret", "test.com", params["nonce"], "00000001")
+	response = sendTestRequest(t, 15860, fmt.Sprintf(request, "a2", 2, "Proxy-Authorization: "+credentials+"\r\n"))
+	if response.response.statusCode != 200 {
+		t.Fatalf("expect the authorized request is forwarded but get %d", response.response.statusCode)
+	}
+	select {
+	case msg := <-received:
+		if _, err := msg.GetHeader("Proxy-Authorization"); err == nil {
+			t.Errorf("the credentials are forwarded to the backend")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("the request is not received by the backend")
+	}
+
+	startTestBackend(t, 15863, 15862, 200, "OK")
+	listens = []ListenConfig{{Address: "127.0.0.1",
+		UdpPort:  15862,
+		Auth:     &AuthConfig{Realm: "test.com", CredentialsFile: fileName, Trusted: []string{"127.0.0.0/8"}},
+		Backends: []BackendConfig{{Address: "udp://127.0.0.1:15863"}}}}
+	proxy = NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	response = sendTestRequest(t, 15862, fmt.Sprintf(request, "a3", 3, ""))
+	if response.response.statusCode != 200 {
+		t.Errorf("expect the request from trusted source is forwarded but get %d", response.response.statusCode)
+	}
+	if _, err := response.GetHeader("Proxy-Authenticate"); err == nil {
+		t.Errorf("the trusted request is challenged")
+	}
+}
+
+func TestProxyChallengesInDialogRequestWithoutSession(t *testing.T) {
+	startTestBackend(t, 16217, 16216, 200, "OK")
+	fileName := filepath.Join(t.TempDir(), "credentials")
+	if err := os.WriteFile(fileName, []byte("alice:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	listens := []ListenConfig{{Address: "127.0.0.1",
+		UdpPort:  16216,
+		Auth:     &AuthConfig{Realm: "test.com", CredentialsFile: fileName},
+		Backends: []BackendConfig{{Address: "udp://127.0.0.1:16217"}}}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := "OPTIONS sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%%d;branch=z9hG4bK776asdh%s\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301781\r\nTo: <sip:bob@test.com>;tag=314159\r\nCall-ID: a84b4c76e66721@test.com\r\nCSeq: %d OPTIONS\r\nContent-Length: 0\r\n\r\n"
+	response := sendTestRequest(t, 16216, fmt.Sprintf(request, "b1", 1))
+	if response.response.statusCode != 407 {
+		t.Fatalf("expect the request with a To tag but no session is challenged but get %d", response.response.statusCode)
+	}
+
+	sessionId, err := response.GetSessionId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.sessionBackends.AddBackend(sessionId, proxy.getItems()[0].backend, 60)
+	response = sendTestRequest(t, 16216, fmt.Sprintf(request, "b2", 2))
+	if response.response.statusCode != 200 {
+		t.Errorf("expect the request in the session is forwarded but get %d", response.response.statusCode)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,6 +28,21 @@ type RoundRobinBackend struct {
 	index      int
 	backends   []Backend
 	backendMap map[string]Backend
+	// the address of the backends taken out of rotation by the health check
+	downBackends map[string]bool
+	// how to select the backend for a message, see BackendPolicy
+	policy BackendPolicy
+	// the weight of the backends, the default weight is 1
+	weights map[string]int
+	// the current weights of the smooth weighted round robin
+	currentWeights map[string]int
+	// the number of outstanding transactions of the backends
+	outstanding map[string]int
+	// the transactions sent to backends, the key is the Via branch of the request
+	transactions map[string]*outstandingTransaction
+	lastPurge    time.Time
+	// the configured backends, the key is the configured address
+	sources map[string]*BackendConfig
 	//backendChangeListenerMgr *BackendChangeListenerMgr
 	//dialogBasedBackend       *DialogBasedBackend
 }
@@ -35,13 +53,28 @@ type UDPBackend struct {
 }
 
 type TCPBackend struct {
+	// serialize the writes to the connection
+	sync.Mutex
 	localAddr             string
 	backendAddr           string
 	conn                  net.Conn
 	connectionEstablished ConnectionEstablishedFunc
+	// not nil if the backend is connected with TLS
+	tlsConfig *tls.Config
+}
+
+// SRVBackend is the backend configured without port, its servers are located by the
+// SRV records of the hostname and tried in the order of priority and weight
+type SRVBackend struct {
+	protocol              string
+	host                  string
+	localAddr             string
+	tlsConfig             *tls.Config
+	connectionEstablished ConnectionEstablishedFunc
 }
 
 type BackendFactory struct {
+	sync.Mutex
 	backends map[string]Backend
 }
 
@@ -60,8 +93,8 @@ func createViaConfig(via string) *ViaConfig {
 	if err != nil {
 		return nil
 	}
-	// check if the scheme is tcp or udp
-	if u.Scheme != "tcp" && u.Scheme != "udp" {
+	// check if the scheme is tcp, udp or tls
+	if _, ok := DialableProtocol[u.Scheme]; !ok {
 		return nil
 	}
 	host, s_port, _ := net.SplitHostPort(u.Host)
@@ -81,6 +114,8 @@ func NewBackendFactory() *BackendFactory {
 }
 
 func (bf *BackendFactory) CreateUDPBackend(localAddr string, hostport string) (Backend, error) {
+	bf.Lock()
+	defer bf.Unlock()
 	key := fmt.Sprintf("udp:%s-%s", localAddr, hostport)
 	if backend, ok := bf.backends[key]; ok {
 		return backend, nil
@@ -94,6 +129,8 @@ func (bf *BackendFactory) CreateUDPBackend(localAddr string, hostport string) (B
 }
 
 func (bf *BackendFactory) CreateTCPBackend(localAddr string, hostport string, connectionEstablished ConnectionEstablishedFunc) (Backend, error) {
+	bf.Lock()
+	defer bf.Unlock()
 	key := fmt.Sprintf("tcp:%s-%s", localAddr, hostport)
 	if backend, ok := bf.backends[key]; ok {
 		return backend, nil
@@ -106,6 +143,26 @@ func (bf *BackendFactory) CreateTCPBackend(localAddr string, hostport string, co
 	return backend, nil
 }
 
+func (bf *BackendFactory) CreateTLSBackend(localAddr string, hostport string, tlsConfig *tls.Config, connectionEstablished ConnectionEstablishedFunc) (Backend, error) {
+	bf.Lock()
+	defer bf.Unlock()
+	key := fmt.Sprintf("tls:%s-%s", localAddr, hostport)
+	if backend, ok := bf.backends[key]; ok {
+		return backend, nil
+	}
+	backend, err := NewTLSBackend(localAddr, hostport, tlsConfig, connectionEstablished)
+	if err != nil {
+		return nil, err
+	}
+	bf.backends[key] = backend
+	return backend, nil
+}
+
+func (bf *BackendFactory) RemoveTLSBackend(localAddr string, hostport string) (Backend, error) {
+	key := fmt.Sprintf("tls:%s-%s", localAddr, hostport)
+	return bf.removeBackend(key)
+}
+
 func (bf *BackendFactory) RemoveTCPBackend(localAddr string, hostport string) (Backend, error) {
 	key := fmt.Sprintf("tcp:%s-%s", localAddr, hostport)
 	return bf.removeBackend(key)
@@ -118,6 +175,8 @@ func (bf *BackendFactory) RemoveUDPBackend(localAddr string, hostport string) (B
 }
 
 func (bf *BackendFactory) removeBackend(key string) (Backend, error) {
+	bf.Lock()
+	defer bf.Unlock()
 
 	if backend, ok := bf.backends[key]; ok {
 		delete(bf.backends, key)
@@ -126,53 +185,175 @@ func (bf *BackendFactory) removeBackend(key string) (Backend, error) {
 	return nil, fmt.Errorf("fail to find backend %s", key)
 }
 
-func CreateRoundRobinBackend(backends []BackendConfig, connectionEstablished ConnectionEstablishedFunc) (*RoundRobinBackend, error) {
+// CreateRoundRobinBackend create the backends in round robin, the tlsConfig is used by the tls:// backends
+func CreateRoundRobinBackend(backends []BackendConfig, tlsConfig *tls.Config, connectionEstablished ConnectionEstablishedFunc) (*RoundRobinBackend, error) {
 	zap.L().Info("create round robin backend", zap.Any("backends", backends))
 	if len(backends) <= 0 {
 		return nil, fmt.Errorf("no backends")
 	}
 	rrBackend := NewRoundRobinBackend()
+	if err := rrBackend.UpdateBackends(backends, tlsConfig, connectionEstablished); err != nil {
+		return nil, err
+	}
+	return rrBackend, nil
+}
+
+// UpdateBackends add the configured backends which are not added yet and remove the
+// backends which are not configured anymore, the members of the unchanged backends are
+// kept so the sessions bound to them are not affected
+func (rb *RoundRobinBackend) UpdateBackends(backends []BackendConfig, tlsConfig *tls.Config, connectionEstablished ConnectionEstablishedFunc) error {
+	configured := make(map[string]BackendConfig)
 	for _, backendConf := range backends {
-		localBindAddress := net.JoinHostPort(backendConf.LocalAddress, "0")
-		u, err := url.Parse(backendConf.Address)
+		configured[backendConf.Address] = backendConf
+	}
+	for address, source := range rb.getSources() {
+		if backendConf, ok := configured[address]; !ok || backendConf.LocalAddress != source.LocalAddress {
+			rb.removeSource(source)
+		}
+	}
+	for _, backendConf := range backends {
+		if source, ok := rb.getSources()[backendConf.Address]; ok {
+			rb.setSourceWeight(source, backendConf.Weight)
+			continue
+		}
+		if err := rb.addSource(backendConf, tlsConfig, connectionEstablished); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rb *RoundRobinBackend) getSources() map[string]*BackendConfig {
+	rb.Lock()
+	defer rb.Unlock()
+	return maps.Clone(rb.sources)
+}
+
+// isSource check if the backend is still configured, the members of the hostname are
+// not changed anymore after the hostname backend is removed
+func (rb *RoundRobinBackend) isSource(source *BackendConfig) bool {
+	rb.Lock()
+	defer rb.Unlock()
+	return rb.sources[source.Address] == source
+}
+
+// addSource add the members of the configured backend
+func (rb *RoundRobinBackend) addSource(backendConf BackendConfig, tlsConfig *tls.Config, connectionEstablished ConnectionEstablishedFunc) error {
+	localBindAddress := net.JoinHostPort(backendConf.LocalAddress, "0")
+	u, err := url.Parse(backendConf.Address)
+	if err != nil {
+		zap.L().Error("Fail to parse url address", zap.String("address", backendConf.Address))
+		return err
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "tls" {
+		return fmt.Errorf("unsupported protocol %s", u.Scheme)
+	}
+	source := &backendConf
+	rb.Lock()
+	rb.sources[backendConf.Address] = source
+	rb.Unlock()
+
+	pos := strings.LastIndex(u.Host, ":")
+	if pos == -1 {
+		zap.L().Info("add backend located by SRV records", zap.String("host", u.Host), zap.String("protocol", u.Scheme))
+		rb.AddWeightedBackend(NewSRVBackend(u.Scheme, u.Host, localBindAddress, clientTLSConfigFor(tlsConfig, u.Host), connectionEstablished), backendConf.Weight)
+		return nil
+	}
+	host := u.Host[0:pos]
+	port := u.Host[pos+1:]
+	zap.L().Info("add backend", zap.String("host", host), zap.String("port", port), zap.String("protocol", u.Scheme))
+	if isIPAddress(host) {
+		var backend Backend
+		var err error
+		if u.Scheme == "udp" {
+			backend, err = backendFactory.CreateUDPBackend(localBindAddress, u.Host)
+		} else if u.Scheme == "tls" {
+			backend, err = backendFactory.CreateTLSBackend(localBindAddress, u.Host, clientTLSConfigFor(tlsConfig, host), connectionEstablished)
+		} else {
+			backend, err = backendFactory.CreateTCPBackend(localBindAddress, u.Host, connectionEstablished)
+		}
 		if err != nil {
-			zap.L().Error("Fail to parse url address", zap.String("address", backendConf.Address))
-			return nil, err
-		}
-
-		if u.Scheme == "udp" || u.Scheme == "tcp" {
-			pos := strings.LastIndex(u.Host, ":")
-			if pos == -1 {
-				zap.L().Error("Fail to find port number", zap.String("address", u.Host))
-			} else {
-				host := u.Host[0:pos]
-				port := u.Host[pos+1:]
-				zap.L().Info("add backend", zap.String("host", host), zap.String("port", port), zap.String("protocol", u.Scheme))
-				if isIPAddress(host) {
-					var backend Backend
-					var err error
-					if u.Scheme == "udp" {
-						backend, err = backendFactory.CreateUDPBackend(localBindAddress, u.Host)
-					} else {
-						backend, err = backendFactory.CreateTCPBackend(localBindAddress, u.Host, connectionEstablished)
-					}
-					if err != nil {
-						return nil, err
-					}
-					rrBackend.AddBackend(backend)
-				} else {
-					zap.L().Info("add host to dynamic resolver", zap.String("host", host))
-
-					dynamicHostResolver.ResolveHost(host, func(hostname string, newIPs []string, removedIPs []string) {
-						rrBackend.hostIPChanged(u.Scheme, localBindAddress, hostname, newIPs, removedIPs, port, connectionEstablished)
-					})
-				}
+			return err
+		}
+		rb.AddWeightedBackend(backend, backendConf.Weight)
+	} else {
+		zap.L().Info("add host to dynamic resolver", zap.String("host", host))
+
+		dynamicHostResolver.ResolveHost(host, func(hostname string, newIPs []string, removedIPs []string) {
+			if rb.isSource(source) {
+				rb.hostIPChanged(u.Scheme, localBindAddress, hostname, newIPs, removedIPs, port, rb.getSourceWeight(source), clientTLSConfigFor(tlsConfig, hostname), connectionEstablished)
+			}
+		})
+	}
+	return nil
+}
+
+// removeSource remove the members of the configured backend
+func (rb *RoundRobinBackend) removeSource(source *BackendConfig) {
+	zap.L().Info("remove backend", zap.String("address", source.Address))
+	rb.Lock()
+	delete(rb.sources, source.Address)
+	rb.Unlock()
+
+	localBindAddress := net.JoinHostPort(source.LocalAddress, "0")
+	for _, member := range getSourceMembers(source) {
+		rb.RemoveBackend(member)
+		if u, err := url.Parse(member); err == nil {
+			switch u.Scheme {
+			case "udp":
+				backendFactory.RemoveUDPBackend(localBindAddress, u.Host)
+			case "tcp":
+				backendFactory.RemoveTCPBackend(localBindAddress, u.Host)
+			case "tls":
+				backendFactory.RemoveTLSBackend(localBindAddress, u.Host)
 			}
-		} else {
-			return nil, fmt.Errorf("unsupported protocol %s", u.Scheme)
 		}
 	}
-	return rrBackend, nil
+}
+
+func (rb *RoundRobinBackend) getSourceWeight(source *BackendConfig) int {
+	rb.Lock()
+	defer rb.Unlock()
+	return source.Weight
+}
+
+// setSourceWeight change the weight of the members of the configured backend
+func (rb *RoundRobinBackend) setSourceWeight(source *BackendConfig, weight int) {
+	members := getSourceMembers(source)
+	rb.Lock()
+	defer rb.Unlock()
+	if source.Weight == weight {
+		return
+	}
+	source.Weight = weight
+	for _, member := range members {
+		if _, ok := rb.backendMap[member]; ok {
+			rb.weights[member] = max(weight, 1)
+		}
+	}
+}
+
+// getSourceMembers get the addresses of the members created from the configured backend,
+// a hostname backend has a member for every IP address of the host
+func getSourceMembers(source *BackendConfig) []string {
+	u, err := url.Parse(source.Address)
+	if err != nil {
+		return nil
+	}
+	pos := strings.LastIndex(u.Host, ":")
+	if pos == -1 {
+		return []string{fmt.Sprintf("%s://%s", u.Scheme, u.Host)}
+	}
+	host := u.Host[0:pos]
+	port := u.Host[pos+1:]
+	if isIPAddress(host) {
+		return []string{fmt.Sprintf("%s://%s", u.Scheme, u.Host)}
+	}
+	members := make([]string, 0)
+	for _, ip := range dynamicHostResolver.GetAddrsOfHost(host) {
+		members = append(members, fmt.Sprintf("%s://%s", u.Scheme, net.JoinHostPort(ip, port)))
+	}
+	return members
 }
 
 func NewUDPBackend(localhostport string, hostport string) (*UDPBackend, error) {
@@ -204,6 +385,7 @@ func (b *UDPBackend) Send(msg *Message) (Backend, error) {
 
 	n, err := b.udpConn.Write(bytes)
 	if err == nil {
+		messageSent("udp", getListenLabel(b.udpConn.LocalAddr(), true), msg)
 		zap.L().Info("Succeed send message to UDP backend", zap.String("address", b.backendAddr), zap.String("localAddress", b.udpConn.LocalAddr().String()), zap.Int("bytes", n))
 		return b, err
 	} else {
@@ -235,12 +417,24 @@ func NewTCPBackend(localhostport string, hostport string, connectionEstablished
 		connectionEstablished: connectionEstablished}, nil
 }
 
+// NewTLSBackend creates a backend connected with TLS
+func NewTLSBackend(localhostport string, hostport string, tlsConfig *tls.Config, connectionEstablished ConnectionEstablishedFunc) (*TCPBackend, error) {
+	zap.L().Info("create tls backend", zap.String("localhostport", localhostport), zap.String("hostport", hostport))
+	return &TCPBackend{localAddr: localhostport,
+		backendAddr:           hostport,
+		conn:                  nil,
+		connectionEstablished: connectionEstablished,
+		tlsConfig:             tlsConfig}, nil
+}
+
 func (t *TCPBackend) Send(msg *Message) (Backend, error) {
 	b, err := msg.Bytes()
 	if err != nil {
 		return nil, err
 	}
 
+	t.Lock()
+	defer t.Unlock()
 	zap.L().Info("send message to TCP backend with conn", zap.String("backendAddr", t.backendAddr), zap.Any("conn", t.conn))
 
 	for i := 0; i < 2; i++ {
@@ -254,6 +448,7 @@ func (t *TCPBackend) Send(msg *Message) (Backend, error) {
 
 		_, err := t.conn.Write(b)
 		if err == nil {
+			messageSent(getConnProtocol(t.conn), getListenLabel(t.conn.LocalAddr(), true), msg)
 			zap.L().Debug("Succeed to send message to TCP backend", zap.String("backendAddr", t.backendAddr), zap.String("localAddress", t.conn.LocalAddr().String()), zap.String("message", string(b)))
 			return t, nil
 		}
@@ -271,6 +466,16 @@ func (t *TCPBackend) connect() error {
 		t.conn = nil
 		return err
 	}
+	if t.tlsConfig != nil {
+		tlsConn, err := tlsHandshake(conn, t.tlsConfig, tlsHandshakeTimeout)
+		if err != nil {
+			zap.L().Error("Fail to make TLS handshake with backend", zap.String("backendAddr", t.backendAddr), zap.String("error", err.Error()))
+			conn.Close()
+			t.conn = nil
+			return err
+		}
+		conn = tlsConn
+	}
 	zap.L().Info("Succeed to connect backend", zap.String("backendAddr", t.backendAddr), zap.String("remotAddr", conn.LocalAddr().String()))
 	t.conn = conn
 	t.connectionEstablished(conn)
@@ -278,25 +483,94 @@ func (t *TCPBackend) connect() error {
 }
 
 func (t *TCPBackend) GetAddress() string {
+	if t.tlsConfig != nil {
+		return fmt.Sprintf("tls://%s", t.backendAddr)
+	}
 	return fmt.Sprintf("tcp://%s", t.backendAddr)
 }
 
 func (t *TCPBackend) Close() {
+	t.Lock()
+	defer t.Unlock()
 	if t.conn != nil {
 		t.conn.Close()
 	}
 }
 
+func NewSRVBackend(protocol string, host string, localAddr string, tlsConfig *tls.Config, connectionEstablished ConnectionEstablishedFunc) *SRVBackend {
+	return &SRVBackend{protocol: protocol,
+		host:                  host,
+		localAddr:             localAddr,
+		tlsConfig:             tlsConfig,
+		connectionEstablished: connectionEstablished}
+}
+
+// Send send the message to the first server which the message can be sent to
+func (b *SRVBackend) Send(msg *Message) (Backend, error) {
+	for _, target := range sipServerLocator.Locate(b.host, 0, b.protocol) {
+		ips := []string{target.Host}
+		if !isIPAddress(target.Host) {
+			ips, _ = sipServerLocator.LookupHost(target.Host)
+		}
+		for _, ip := range ips {
+			hostport := net.JoinHostPort(ip, strconv.Itoa(target.Port))
+			var backend Backend
+			var err error
+			switch target.Protocol {
+			case "udp":
+				backend, err = backendFactory.CreateUDPBackend(b.localAddr, hostport)
+			case "tcp":
+				backend, err = backendFactory.CreateTCPBackend(b.localAddr, hostport, b.connectionEstablished)
+			case "tls":
+				backend, err = backendFactory.CreateTLSBackend(b.localAddr, hostport, b.tlsConfig, b.connectionEstablished)
+			default:
+				err = fmt.Errorf("unsupported protocol %s", target.Protocol)
+			}
+			if err == nil {
+				var r Backend
+				r, err = backend.Send(msg)
+				if err == nil {
+					return r, nil
+				}
+			}
+			zap.L().Error("Fail to send message to server of SRV backend, try next server", zap.String("host", b.host), zap.String("server", hostport), zap.String("error", err.Error()))
+		}
+	}
+	return nil, fmt.Errorf("fail to send message to all the servers of %s", b.GetAddress())
+}
+
+func (b *SRVBackend) GetAddress() string {
+	return fmt.Sprintf("%s://%s", b.protocol, b.host)
+}
+
+func (b *SRVBackend) Close() {
+}
+
 func NewRoundRobinBackend() *RoundRobinBackend {
 	rb := &RoundRobinBackend{index: 0,
-		backends:   make([]Backend, 0),
-		backendMap: make(map[string]Backend)}
+		backends:       make([]Backend, 0),
+		backendMap:     make(map[string]Backend),
+		downBackends:   make(map[string]bool),
+		policy:         PolicyRoundRobin,
+		weights:        make(map[string]int),
+		currentWeights: make(map[string]int),
+		outstanding:    make(map[string]int),
+		transactions:   make(map[string]*outstandingTransaction),
+		lastPurge:      time.Now(),
+		sources:        make(map[string]*BackendConfig)}
 	return rb
 }
 
 func (rb *RoundRobinBackend) AddBackend(backend Backend) {
+	rb.AddWeightedBackend(backend, 1)
+}
+
+// AddWeightedBackend add the backend with the weight used by the round robin and
+// hash policies, the weight less than 1 is treated as 1
+func (rb *RoundRobinBackend) AddWeightedBackend(backend Backend, weight int) {
 	rb.Lock()
 	defer rb.Unlock()
+	rb.weights[backend.GetAddress()] = max(weight, 1)
 	if _, ok := rb.backendMap[backend.GetAddress()]; ok {
 		for index, p := range rb.backends {
 			if backend.GetAddress() == p.GetAddress() {
@@ -347,6 +621,8 @@ func (rb *RoundRobinBackend) RemoveBackend(address string) {
 			}
 		}
 		delete(rb.backendMap, address)
+		delete(rb.weights, address)
+		delete(rb.currentWeights, address)
 	}
 }
 
@@ -361,69 +637,70 @@ func (rb *RoundRobinBackend) GetAllBackend() map[string]Backend {
 	return r
 }
 
+// Send try the backends in rotation in the order selected by the policy until the
+// message is sent successfully
 func (rb *RoundRobinBackend) Send(msg *Message) (Backend, error) {
-	index, err := rb.getNextBackendIndex()
-	if err != nil {
-		zap.L().Error("Fail to send message", zap.String("error", err.Error()))
-		return nil, errors.New("fail to get next backend")
-	}
-
-	n := rb.getBackendCount()
-
-	for ; n > 0; n-- {
-		backend, err := rb.getBackend(index)
-		index++
-		if err == nil && backend != nil {
-			r, err := backend.Send(msg)
-			if err == nil {
-				return r, err
-			}
-		}
-	}
-
-	return nil, errors.New("fail to send msg to all the backend")
+	r, _, err := rb.SendExcept(msg, nil)
+	return r, err
 }
 
-func (rb *RoundRobinBackend) GetAddress() string {
-	rb.Lock()
-	defer rb.Unlock()
+// SendExcept send the message like Send but skip the backends already tried, the
+// address of the member which the message is sent to is also returned
+func (rb *RoundRobinBackend) SendExcept(msg *Message, tried []string) (Backend, string, error) {
+	backends := rb.selectBackends(msg)
+	if len(backends) <= 0 {
+		zap.L().Error("Fail to send message", zap.String("error", "no backend available"))
+		return nil, "", errors.New("fail to get next backend")
+	}
 
-	r := "RoundRobin://"
-	for index, backend := range rb.backends {
-		if index != 0 {
-			r += ","
+	for _, backend := range backends {
+		address := backend.GetAddress()
+		if slices.Contains(tried, address) {
+			continue
 		}
-		r += backend.GetAddress()
+		r, err := backend.Send(msg)
+		if err == nil {
+			backendSends.WithLabelValues(address).Inc()
+			rb.transactionStarted(msg, address)
+			return r, address, err
+		}
+		backendFailures.WithLabelValues(address).Inc()
 	}
-	return r
+
+	return nil, "", errors.New("fail to send msg to all the backend")
 }
 
-func (rb *RoundRobinBackend) getNextBackendIndex() (int, error) {
+// SetBackendUp put the backend back to rotation or take it out of rotation
+func (rb *RoundRobinBackend) SetBackendUp(address string, up bool) {
 	rb.Lock()
 	defer rb.Unlock()
-	n := len(rb.backends)
-	if n <= 0 {
-		return 0, fmt.Errorf("no backend available")
+	if up {
+		delete(rb.downBackends, address)
+		backendUp.WithLabelValues(address).Set(1)
+	} else {
+		rb.downBackends[address] = true
+		backendUp.WithLabelValues(address).Set(0)
 	}
-	rb.index = (rb.index + 1) % n
-	return rb.index, nil
 }
 
-func (rb *RoundRobinBackend) getBackend(index int) (Backend, error) {
+func (rb *RoundRobinBackend) IsBackendUp(address string) bool {
 	rb.Lock()
 	defer rb.Unlock()
-	n := len(rb.backends)
-	if n <= 0 {
-		return nil, fmt.Errorf("no backend available at %d", index)
-	}
-	return rb.backends[index%n], nil
+	return !rb.downBackends[address]
 }
 
-func (rb *RoundRobinBackend) getBackendCount() int {
+func (rb *RoundRobinBackend) GetAddress() string {
 	rb.Lock()
 	defer rb.Unlock()
-	return len(rb.backends)
 
+	r := "RoundRobin://"
+	for index, backend := range rb.backends {
+		if index != 0 {
+			r += ","
+		}
+		r += backend.GetAddress()
+	}
+	return r
 }
 
 func (rb *RoundRobinBackend) hostIPChanged(protocol string,
@@ -431,6 +708,8 @@ func (rb *RoundRobinBackend) hostIPChanged(protocol string,
 	newIPs []string,
 	removedIPs []string,
 	port string,
+	weight int,
+	tlsConfig *tls.Config,
 	connectionEstablished ConnectionEstablishedFunc) {
 	for _, ip := range newIPs {
 		zap.L().Info("find a new IP for host", zap.String("host", hostname), zap.String("ip", ip), zap.String("port", port), zap.String("protocol", protocol))
@@ -439,12 +718,17 @@ func (rb *RoundRobinBackend) hostIPChanged(protocol string,
 		if protocol == "udp" {
 			backend, err := backendFactory.CreateUDPBackend(localhostport, hostport)
 			if err == nil {
-				rb.AddBackend(backend)
+				rb.AddWeightedBackend(backend, weight)
 			}
 		} else if protocol == "tcp" {
 			backend, err := backendFactory.CreateTCPBackend(localhostport, hostport, connectionEstablished)
 			if err == nil {
-				rb.AddBackend(backend)
+				rb.AddWeightedBackend(backend, weight)
+			}
+		} else if protocol == "tls" {
+			backend, err := backendFactory.CreateTLSBackend(localhostport, hostport, tlsConfig, connectionEstablished)
+			if err == nil {
+				rb.AddWeightedBackend(backend, weight)
 			}
 		}
 	}
@@ -458,6 +742,9 @@ func (rb *RoundRobinBackend) hostIPChanged(protocol string,
 		} else if protocol == "tcp" {
 			rb.RemoveBackend(fmt.Sprintf("tcp://%s", hostport))
 			backendFactory.RemoveTCPBackend(localhostport, hostport)
+		} else if protocol == "tls" {
+			rb.RemoveBackend(fmt.Sprintf("tls://%s", hostport))
+			backendFactory.RemoveTLSBackend(localhostport, hostport)
 		}
 	}
 }
@@ -478,16 +765,29 @@ type SessionBasedBackend interface {
 	GetBackend(sessionId string) (Backend, error)
 	AddBackend(sessionId string, backend Backend, expireSeconds int)
 	RemoveSession(sessionId string)
+	// release the connections to the session store
+	Close()
 }
 
 type LocalSessionBasedBackend struct {
+	sync.Mutex
 	timeout time.Duration
 	// map between dialog and the backend
-	backends      map[string]*ExpireBackend
-	nextCleanTime time.Time
+	backends       map[string]*ExpireBackend
+	nextCleanTime  time.Time
+	sessionCountId int
+}
+
+// SessionInfo is the binding between a session and a backend
+type SessionInfo struct {
+	SessionId string    `json:"sessionId"`
+	Backend   string    `json:"backend"`
+	Expire    time.Time `json:"expire"`
 }
 
 type MasterSlaveRedisSessionBasedBackend struct {
+	// protect the masterIndex, pubsubs and closed
+	sync.Mutex
 	// rdbs is a list of Redis clients.
 	// It is used to connect to the Redis server and subscribe to backend updates.
 	rdbs []*redis.Client
@@ -508,6 +808,12 @@ type MasterSlaveRedisSessionBasedBackend struct {
 
 	// retryTimeout is the timeout in milliseconds for retrying to connect to Redis.
 	retryTimeout int
+	// pubsubs is the subscriptions to the Redis channel, they are closed by Close.
+	pubsubs []*redis.PubSub
+	// closed is true after Close is called, the subscriptions are not retried anymore.
+	closed bool
+	// sessionCountId is the id of the session count gauge, it is removed by Close.
+	sessionCountId int
 }
 
 type RedisSessionBackendAddrMgr struct {
@@ -577,6 +883,21 @@ func (rsb *RedisSessionBackendAddrMgr) RemoveBackend(sessionId string) error {
 	}
 }
 
+// Size returns the number of the not expired sessions learnt from Redis
+func (rsb *RedisSessionBackendAddrMgr) Size() int {
+	rsb.Lock()
+	defer rsb.Unlock()
+
+	now := time.Now().Unix()
+	n := 0
+	for _, addrInfo := range rsb.sessionBackendAddrs {
+		if addrInfo.expires > now {
+			n++
+		}
+	}
+	return n
+}
+
 func (rsb *RedisSessionBackendAddrMgr) cleanExpiredSession() {
 	if rsb.nextCleanTime > time.Now().Unix() {
 		return
@@ -599,14 +920,21 @@ func (rsb *RedisSessionBackendAddrMgr) cleanExpiredSession() {
 func NewLocalSessionBasedBackend(timeoutSeconds int64) *LocalSessionBasedBackend {
 	zap.L().Info("set the dialog timeout ", zap.Int64("timeout", timeoutSeconds))
 
-	return &LocalSessionBasedBackend{timeout: time.Duration(timeoutSeconds) * time.Second,
+	dbb := &LocalSessionBasedBackend{timeout: time.Duration(timeoutSeconds) * time.Second,
 		backends:      make(map[string]*ExpireBackend),
 		nextCleanTime: time.Now().Add(time.Duration(timeoutSeconds) * time.Second)}
+	dbb.sessionCountId = sessionCounts.Add(func() float64 {
+		return float64(dbb.Size())
+	}, "local")
+	return dbb
 }
 
 // GetBackend returns the backend related with the sessionId
 // and check if the backend is expired. If the backend is expired, it will be removed from the map.
 func (dbb *LocalSessionBasedBackend) GetBackend(sessionId string) (Backend, error) {
+	dbb.Lock()
+	defer dbb.Unlock()
+
 	if value, ok := dbb.backends[sessionId]; ok {
 		if value.expire.After(time.Now()) {
 			return value.backend, nil
@@ -620,6 +948,9 @@ func (dbb *LocalSessionBasedBackend) GetBackend(sessionId string) (Backend, erro
 // AddBackend adds a backend for the sessionId and set the expire time
 // for the backend. The expire time is set to the timeout value if it is greater than the timeout value.
 func (dbb *LocalSessionBasedBackend) AddBackend(sessionId string, backend Backend, expireSeconds int) {
+	dbb.Lock()
+	defer dbb.Unlock()
+
 	timeout := dbb.timeout
 	// check if the expireSeconds is greater than the timeout value
 	// if it is, set the timeout value to the expireSeconds
@@ -635,9 +966,47 @@ func (dbb *LocalSessionBasedBackend) AddBackend(sessionId string, backend Backen
 // RemoveSession removes the backend related with the sessionId
 // and closes the backend connection.
 func (dbb *LocalSessionBasedBackend) RemoveSession(sessionId string) {
+	dbb.Lock()
+	defer dbb.Unlock()
+
 	delete(dbb.backends, sessionId)
 }
 
+// GetSessions returns all the not expired session to backend bindings
+func (dbb *LocalSessionBasedBackend) GetSessions() []SessionInfo {
+	dbb.Lock()
+	defer dbb.Unlock()
+
+	now := time.Now()
+	r := make([]SessionInfo, 0)
+	for sessionId, v := range dbb.backends {
+		if v.expire.After(now) {
+			r = append(r, SessionInfo{SessionId: sessionId, Backend: v.backend.GetAddress(), Expire: v.expire})
+		}
+	}
+	return r
+}
+
+// Size returns the number of the not expired sessions
+func (dbb *LocalSessionBasedBackend) Size() int {
+	dbb.Lock()
+	defer dbb.Unlock()
+
+	now := time.Now()
+	n := 0
+	for _, v := range dbb.backends {
+		if v.expire.After(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// Close remove the session count gauge, the sessions are kept in memory
+func (dbb *LocalSessionBasedBackend) Close() {
+	sessionCounts.Remove(dbb.sessionCountId)
+}
+
 func (dbb *LocalSessionBasedBackend) cleanExpiredSession() {
 	if dbb.nextCleanTime.After(time.Now()) {
 		return
@@ -719,6 +1088,9 @@ func NewMasterSlaveRedisSessionBasedBackend(redisSessionStore RedisSessionStore,
 			return redisSessionStore.RetryTimeout
 		}(),
 	}
+	rsb.sessionCountId = sessionCounts.Add(func() float64 {
+		return float64(rsb.sessionBackendAddrs.Size())
+	}, "redis-cache")
 	rsb.start()
 	return rsb
 }
@@ -747,7 +1119,7 @@ func (msrsb *MasterSlaveRedisSessionBasedBackend) GetBackend(sessionId string) (
 }
 
 func (rsb *MasterSlaveRedisSessionBasedBackend) subscribeToBackendUpdates(rdb *redis.Client) {
-	for {
+	for !rsb.isClosed() {
 		pubsub := rsb.doSubscribe(rdb)
 		if pubsub != nil {
 			rsb.receiveSubscribeMessage(pubsub)
@@ -777,12 +1149,55 @@ func (rsb *MasterSlaveRedisSessionBasedBackend) doSubscribe(rdb *redis.Client) *
 
 	zap.L().Info("Subscribed to Redis channel for backend updates", zap.String("channel", rsb.redisChannel), zap.String("address", rdb.Options().Addr))
 
+	rsb.Lock()
+	defer rsb.Unlock()
+	if rsb.closed {
+		pubsub.Close()
+		return nil
+	}
+	rsb.pubsubs = append(rsb.pubsubs, pubsub)
 	return pubsub
 }
 
+func (rsb *MasterSlaveRedisSessionBasedBackend) removePubSub(pubsub *redis.PubSub) {
+	rsb.Lock()
+	defer rsb.Unlock()
+	rsb.pubsubs = slices.DeleteFunc(rsb.pubsubs, func(p *redis.PubSub) bool {
+		return p == pubsub
+	})
+}
+
+func (rsb *MasterSlaveRedisSessionBasedBackend) isClosed() bool {
+	rsb.Lock()
+	defer rsb.Unlock()
+	return rsb.closed
+}
+
+// Close closes the subscriptions and the Redis clients, the subscriptions are not retried anymore.
+func (rsb *MasterSlaveRedisSessionBasedBackend) Close() {
+	if rsb == nil {
+		return
+	}
+	rsb.Lock()
+	rsb.closed = true
+	pubsubs := rsb.pubsubs
+	rsb.pubsubs = nil
+	rsb.Unlock()
+
+	for _, pubsub := range pubsubs {
+		pubsub.Close()
+	}
+	for _, rdb := range rsb.rdbs {
+		rdb.Close()
+	}
+	sessionCounts.Remove(rsb.sessionCountId)
+	zap.L().Info("Redis session store is closed", zap.String("channel", rsb.redisChannel))
+}
+
 // receiveSubscribeMessage listens for messages on the Redis PubSub channel.
 // It processes each message by calling sessionBackendUpdated to handle the session updates.
 func (rsb *MasterSlaveRedisSessionBasedBackend) receiveSubscribeMessage(pubsub *redis.PubSub) {
+	defer rsb.removePubSub(pubsub)
 	defer pubsub.Close() // Ensure the PubSub is closed when done
 
 	for {
@@ -861,8 +1276,11 @@ func (rsb *MasterSlaveRedisSessionBasedBackend) ForEachRedis(process func(rdb *r
 		return fmt.Errorf("no Redis clients available")
 	}
 
+	rsb.Lock()
+	masterIndex := rsb.masterIndex
+	rsb.Unlock()
 	for i := range n {
-		index := (rsb.masterIndex + i) % n // Calculate the index of the Redis client to use
+		index := (masterIndex + i) % n // Calculate the index of the Redis client to use
 		rdb := rsb.rdbs[index]
 		if rdb == nil {
 			zap.L().Warn("Redis client is nil, skipping", zap.Int("index", index))
@@ -875,8 +1293,10 @@ func (rsb *MasterSlaveRedisSessionBasedBackend) ForEachRedis(process func(rdb *r
 			}
 		} else {
 			if i > 0 {
+				rsb.Lock()
 				rsb.masterIndex = index // Update master index to the next available Redis client
-				zap.L().Info("Updated redis master index", zap.Int("masterIndex", rsb.masterIndex))
+				rsb.Unlock()
+				zap.L().Info("Updated redis master index", zap.Int("masterIndex", index))
 			}
 			return nil // Exit the loop if processing is successful
 		}
@@ -918,13 +1338,39 @@ func (csb *CompositeSessionBasedBackend) RemoveSession(sessionId string) {
 	}
 }
 
+// Close closes all the session stores
+func (csb *CompositeSessionBasedBackend) Close() {
+	for _, b := range csb.backends {
+		if b != nil {
+			b.Close()
+		}
+	}
+}
+
+// getLocalSessionBasedBackend get the in-memory session store from the session based backend
+func getLocalSessionBasedBackend(backend SessionBasedBackend) *LocalSessionBasedBackend {
+	switch v := backend.(type) {
+	case *LocalSessionBasedBackend:
+		return v
+	case *CompositeSessionBasedBackend:
+		for _, b := range v.backends {
+			if local, ok := b.(*LocalSessionBasedBackend); ok {
+				return local
+			}
+		}
+	}
+	return nil
+}
+
 func getAllBackendAddresses(backend Backend) []string {
 	r := make([]string, 0)
 
 	if v, ok := backend.(*RoundRobinBackend); ok {
+		v.Lock()
 		for _, t := range v.backends {
 			r = append(r, t.GetAddress())
 		}
+		v.Unlock()
 	} else {
 		r = append(r, backend.GetAddress())
 	}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// BackendPolicy is the policy to select the backend of a message
+type BackendPolicy string
+
+const (
+	// select the backends in turn in proportion to their weight
+	PolicyRoundRobin BackendPolicy = "round-robin"
+	// select the backend with the least outstanding transactions in proportion to its weight
+	PolicyLeastOutstanding BackendPolicy = "least-outstanding"
+	// select the backend by the rendezvous hash of the Call-ID, so all the proxy nodes
+	// send the messages of a dialog to the same backend without sharing any state
+	PolicyCallIdHash BackendPolicy = "call-id-hash"
+	// select the backend by the rendezvous hash of the user in the From header
+	PolicyFromUserHash BackendPolicy = "from-user-hash"
+)
+
+// the transaction is not outstanding anymore if no final response is received in this time
+const outstandingTransactionLifetime = 5 * time.Minute
+
+type outstandingTransaction struct {
+	address string
+	start   time.Time
+}
+
+// ParseBackendPolicy parse the policy in the configuration, the round robin is used
+// if no policy is configured
+func ParseBackendPolicy(s string) (BackendPolicy, error) {
+	policy := BackendPolicy(strings.ToLower(strings.TrimSpace(s)))
+	switch policy {
+	case "":
+		return PolicyRoundRobin, nil
+	case PolicyRoundRobin, PolicyLeastOutstanding, PolicyCallIdHash, PolicyFromUserHash:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unsupported backend policy %s", s)
+}
+
+func (rb *RoundRobinBackend) SetPolicy(policy BackendPolicy) {
+	rb.Lock()
+	defer rb.Unlock()
+	rb.policy = policy
+}
+
+func (rb *RoundRobinBackend) GetPolicy() BackendPolicy {
+	rb.Lock()
+	defer rb.Unlock()
+	return rb.policy
+}
+
+// selectBackends get the backends in rotation in the order they should be tried
+func (rb *RoundRobinBackend) selectBackends(msg *Message) []Backend {
+	rb.Lock()
+	defer rb.Unlock()
+
+	backends := make([]Backend, 0, len(rb.backends))
+	for _, backend := range rb.backends {
+		if !rb.downBackends[backend.GetAddress()] {
+			backends = append(backends, backend)
+		}
+	}
+	if len(backends) <= 0 {
+		return backends
+	}
+	switch rb.policy {
+	case PolicyLeastOutstanding:
+		return rb.selectLeastOutstanding(backends)
+	case PolicyCallIdHash:
+		if callId, err := msg.GetCallID(); err == nil {
+			return rb.selectByHash(backends, callId)
+		}
+	case PolicyFromUserHash:
+		if user, err := getFromUser(msg); err == nil {
+			return rb.selectByHash(backends, user)
+		}
+	}
+	return rb.selectWeightedRoundRobin(backends)
+}
+
+func (rb *RoundRobinBackend) getWeight(address string) int {
+	return max(rb.weights[address], 1)
+}
+
+// selectWeightedRoundRobin select the backend by the smooth weighted round robin, the
+// other backends follow it in turn as the fallback
+func (rb *RoundRobinBackend) selectWeightedRoundRobin(backends []Backend) []Backend {
+	total := 0
+	selected := 0
+	for index, backend := range backends {
+		address := backend.GetAddress()
+		weight := rb.getWeight(address)
+		rb.currentWeights[address] += weight
+		total += weight
+		if rb.currentWeights[address] > rb.currentWeights[backends[selected].GetAddress()] {
+			selected = index
+		}
+	}
+	rb.currentWeights[backends[selected].GetAddress()] -= total
+	return append(backends[selected:], backends[:selected]...)
+}
+
+// selectLeastOutstanding order the backends by the outstanding transactions divided by
+// the weight, the backends with same load are tried in turn
+func (rb *RoundRobinBackend) selectLeastOutstanding(backends []Backend) []Backend {
+	rb.index = (rb.index + 1) % len(backends)
+	r := append(backends[rb.index:], backends[:rb.index]...)
+	slices.SortStableFunc(r, func(a, b Backend) int {
+		return rb.outstanding[a.GetAddress()]*rb.getWeight(b.GetAddress()) - rb.outstanding[b.GetAddress()]*rb.getWeight(a.GetAddress())
+	})
+	return r
+}
+
+// selectByHash order the backends by the weighted rendezvous hash of the key, the
+// order only depends on the key and the backends, and only the keys of a removed
+// backend are moved to other backends
+func (rb *RoundRobinBackend) selectByHash(backends []Backend, key string) []Backend {
+	scores := make(map[string]float64)
+	for _, backend := range backends {
+		address := backend.GetAddress()
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(address))
+		// map the hash to (0, 1)
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		scores[address] = -float64(rb.getWeight(address)) / math.Log(u)
+	}
+	r := slices.Clone(backends)
+	slices.SortStableFunc(r, func(a, b Backend) int {
+		if scores[a.GetAddress()] > scores[b.GetAddress()] {
+			return -1
+		} else if scores[a.GetAddress()] < scores[b.GetAddress()] {
+			return 1
+		}
+		return strings.Compare(a.GetAddress(), b.GetAddress())
+	})
+	return r
+}
+
+func getFromUser(msg *Message) (string, error) {
+	from, err := msg.GetFrom()
+	if err != nil {
+		return "", err
+	}
+	addrSpec, err := from.GetAddrSpec()
+	if err != nil {
+		return "", err
+	}
+	if sipUri, err := addrSpec.GetSIPURI(); err == nil {
+		return sipUri.User, nil
+	}
+	return addrSpec.String(), nil
+}
+
+// transactionStarted record the request sent to the backend as outstanding until its
+// final response is received
+func (rb *RoundRobinBackend) transactionStarted(msg *Message, address string) {
+	if !msg.IsRequest() {
+		return
+	}
+	if method, err := msg.GetMethod(); err != nil || method == "ACK" {
+		return
+	}
+	branch, err := msg.GetTopViaBranch()
+	if err != nil {
+		return
+	}
+	rb.Lock()
+	defer rb.Unlock()
+	now := time.Now()
+	if now.Sub(rb.lastPurge) > outstandingTransactionLifetime {
+		rb.lastPurge = now
+		for key, t := range rb.transactions {
+			if now.Sub(t.start) > outstandingTransactionLifetime {
+				rb.removeTransaction(key, t)
+			}
+		}
+	}
+	if _, ok := rb.transactions[branch]; !ok {
+		rb.transactions[branch] = &outstandingTransaction{address: address, start: now}
+		rb.outstanding[address]++
+	}
+}
+
+// TransactionFinished the transaction sent to the backend is finished by a final
+// response or timeout, branch is the Via branch of the request
+func (rb *RoundRobinBackend) TransactionFinished(branch string) {
+	rb.Lock()
+	defer rb.Unlock()
+	if t, ok := rb.transactions[branch]; ok {
+		rb.removeTransaction(branch, t)
+	}
+}
+
+func (rb *RoundRobinBackend) removeTransaction(branch string, t *outstandingTransaction) {
+	delete(rb.transactions, branch)
+	rb.outstanding[t.address]--
+	if rb.outstanding[t.address] <= 0 {
+		delete(rb.outstanding, t.address)
+	}
+}
+
+// GetOutstanding get the number of outstanding transactions of the backend
+func (rb *RoundRobinBackend) GetOutstanding(address string) int {
+	rb.Lock()
+	defer rb.Unlock()
+	return rb.outstanding[address]
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func createTestPolicyBackend(policy BackendPolicy, weights map[string]int, addresses ...string) (*RoundRobinBackend, map[string]*probedBackend) {
+	rb := NewRoundRobinBackend()
+	rb.SetPolicy(policy)
+	backends := make(map[string]*probedBackend)
+	for _, address := range addresses {
+		backends[address] = &probedBackend{address: address}
+		rb.AddWeightedBackend(backends[address], weights[address])
+	}
+	return rb, backends
+}
+
+func createTestPolicyRequest(callId string) *Message {
+	msg := createTestRequest("INVITE")
+	msg.PopVia()
+	via, _ := CreateVia("udp", "127.0.0.1", 5060)
+	msg.AddVia(via)
+	msg.RemoveHeader("Call-ID")
+	msg.AddHeader("Call-ID", callId)
+	return msg
+}
+
+func TestWeightedRoundRobinPolicy(t *testing.T) {
+	rb, backends := createTestPolicyBackend(PolicyRoundRobin, map[string]int{"udp://127.0.0.1:5070": 3}, "udp://127.0.0.1:5070", "udp://127.0.0.1:5071")
+	for i := 0; i < 8; i++ {
+		rb.Send(createTestPolicyRequest(fmt.Sprintf("call-%d", i)))
+	}
+	if backends["udp://127.0.0.1:5070"].count() != 6 || backends["udp://127.0.0.1:5071"].count() != 2 {
+		t.Errorf("the messages are not sent in proportion to the weight")
+	}
+}
+
+func TestLeastOutstandingPolicy(t *testing.T) {
+	rb, backends := createTestPolicyBackend(PolicyLeastOutstanding, nil, "udp://127.0.0.1:5070", "udp://127.0.0.1:5071")
+	first := createTestPolicyRequest("call-1")
+	used, _ := rb.Send(first)
+	for i := 0; i < 4; i++ {
+		msg := createTestPolicyRequest(fmt.Sprintf("call-%d", i+2))
+		r, _ := rb.Send(msg)
+		branch, _ := msg.GetTopViaBranch()
+		rb.TransactionFinished(branch)
+		if r == used {
+			t.Fatalf("the message is sent to the backend with more outstanding transactions")
+		}
+	}
+	if rb.GetOutstanding(used.GetAddress()) != 1 {
+		t.Errorf("the outstanding transactions are not counted")
+	}
+	branch, _ := first.GetTopViaBranch()
+	rb.TransactionFinished(branch)
+	if rb.GetOutstanding(used.GetAddress()) != 0 {
+		t.Errorf("the finished transaction is still outstanding")
+	}
+	if backends["udp://127.0.0.1:5070"].count()+backends["udp://127.0.0.1:5071"].count() != 5 {
+		t.Errorf("unexpected number of sent messages")
+	}
+}
+
+func TestCallIdHashPolicy(t *testing.T) {
+	addresses := []string{"udp://127.0.0.1:5070", "udp://127.0.0.1:5071", "udp://127.0.0.1:5072"}
+	rb1, _ := createTestPolicyBackend(PolicyCallIdHash, nil, addresses...)
+	// another proxy node with the backends in other order
+	rb2, _ := createTestPolicyBackend(PolicyCallIdHash, nil, addresses[2], addresses[0], addresses[1])
+	used := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		callId := fmt.Sprintf("call-%d@atlanta.example.com", i)
+		r1, _ := rb1.Send(createTestPolicyRequest(callId))
+		r2, _ := rb2.Send(createTestPolicyRequest(callId))
+		if r1.GetAddress() != r2.GetAddress() {
+			t.Fatalf("the proxy nodes select different backends for %s", callId)
+		}
+		r, _ := rb1.Send(createTestPolicyRequest(callId))
+		if r != r1 {
+			t.Fatalf("the messages of %s are sent to different backends", callId)
+		}
+		used[r1.GetAddress()] = true
+
+		if r1.GetAddress() != addresses[0] {
+			rb2.SetBackendUp(addresses[0], false)
+			if r, _ := rb2.Send(createTestPolicyRequest(callId)); r.GetAddress() != r1.GetAddress() {
+				t.Errorf("the dialog %s is moved after other backend is down", callId)
+			}
+			rb2.SetBackendUp(addresses[0], true)
+		}
+	}
+	if len(used) != len(addresses) {
+		t.Errorf("the Call-IDs are not distributed to all the backends")
+	}
+}
+
+func TestParseBackendPolicy(t *testing.T) {
+	if policy, err := ParseBackendPolicy(""); err != nil || policy != PolicyRoundRobin {
+		t.Errorf("the default policy is not round robin")
+	}
+	if policy, err := ParseBackendPolicy("From-User-Hash"); err != nil || policy != PolicyFromUserHash {
+		t.Errorf("fail to parse from-user-hash")
+	}
+	if _, err := ParseBackendPolicy("random"); err == nil {
+		t.Errorf("unsupported policy is accepted")
+	}
+}
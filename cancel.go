@@ -0,0 +1,205 @@
+package main
+
+import (
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+// forwardedInvite is an INVITE sent by the proxy with its own Via, it is cancelled
+// through the same transport to the same backend or next hop, see RFC 3261 16.10. It
+// is only accessed in the worker processing the dialog
+type forwardedInvite struct {
+	// the key of the server transaction of the INVITE received from upstream
+	serverTransId string
+	// the INVITE with the Via of the proxy
+	request  *Message
+	reliable bool
+	send     TransactionSendFunc
+	// a provisional response is received, the INVITE can be cancelled only in this state
+	proceeding bool
+	cancelled  bool
+	// the CANCEL is sent and its final response is not received
+	cancelPending bool
+	// the final response of the INVITE is received
+	answered bool
+}
+
+// trackInvite remember the INVITE sent statefully to cancel it later
+func (p *Proxy) trackInvite(msg *Message, reliable bool, send TransactionSendFunc) {
+	if method, _ := msg.GetMethod(); method != "INVITE" {
+		return
+	}
+	branch, err := msg.GetTopViaBranch()
+	if err != nil {
+		return
+	}
+	serverTransId, err := msg.GetUpstreamServerTransaction()
+	if err != nil {
+		return
+	}
+	p.invitesLock.Lock()
+	defer p.invitesLock.Unlock()
+	p.inviteBranches[branch] = &forwardedInvite{serverTransId: serverTransId, request: msg, reliable: reliable, send: send}
+	p.invites[serverTransId] = append(p.invites[serverTransId], branch)
+}
+
+func (p *Proxy) findForwardedInvite(branch string) (*forwardedInvite, bool) {
+	p.invitesLock.Lock()
+	defer p.invitesLock.Unlock()
+	invite, ok := p.inviteBranches[branch]
+	return invite, ok
+}
+
+// removeForwardedInvite forget the INVITE after its final response is received and its
+// CANCEL is finished
+func (p *Proxy) removeForwardedInvite(branch string, invite *forwardedInvite) {
+	if !invite.answered || invite.cancelPending {
+		return
+	}
+	p.invitesLock.Lock()
+	defer p.invitesLock.Unlock()
+	delete(p.inviteBranches, branch)
+	branches := slices.DeleteFunc(p.invites[invite.serverTransId], func(b string) bool {
+		return b == branch
+	})
+	if len(branches) == 0 {
+		delete(p.invites, invite.serverTransId)
+	} else {
+		p.invites[invite.serverTransId] = branches
+	}
+}
+
+// isInviteCancelled check if the INVITE sent with the Via branch is cancelled
+func (p *Proxy) isInviteCancelled(branch string) bool {
+	invite, ok := p.findForwardedInvite(branch)
+	return ok && invite.cancelled
+}
+
+// isCancelledResponse check if the response is of the INVITE cancelled by upstream, it
+// must be checked before the INVITE is forgotten by cancelOnResponse
+func (p *Proxy) isCancelledResponse(msg *Message) bool {
+	branch, err := msg.GetTopViaBranch()
+	return err == nil && p.isInviteCancelled(branch)
+}
+
+// cancelOnResponse track the state of the forwarded INVITE with its response. The
+// response of the CANCEL sent by the proxy is absorbed and true is returned
+func (p *Proxy) cancelOnResponse(msg *Message) bool {
+	branch, err := msg.GetTopViaBranch()
+	if err != nil {
+		return false
+	}
+	invite, ok := p.findForwardedInvite(branch)
+	if !ok {
+		return false
+	}
+	if method, _ := msg.GetMethod(); method == "CANCEL" {
+		if msg.IsFinalResponse() {
+			invite.cancelPending = false
+			p.removeForwardedInvite(branch, invite)
+		}
+		return true
+	}
+	switch {
+	case !msg.IsFinalResponse():
+		if invite.cancelled && !invite.proceeding {
+			p.sendCancel(invite)
+		}
+		invite.proceeding = true
+	default:
+		invite.answered = true
+		p.removeForwardedInvite(branch, invite)
+	}
+	return false
+}
+
+// cancelOnTimeout forget the INVITE without final response, true is returned if the
+// request is the CANCEL sent by the proxy. The INVITE timed out by Timer C after a
+// provisional response is cancelled and not retried, see RFC 3261 16.8
+func (p *Proxy) cancelOnTimeout(request *Message) bool {
+	branch, err := request.GetTopViaBranch()
+	if err != nil {
+		return false
+	}
+	invite, ok := p.findForwardedInvite(branch)
+	if !ok {
+		return false
+	}
+	method, _ := request.GetMethod()
+	if method == "CANCEL" {
+		invite.cancelPending = false
+	} else {
+		invite.answered = true
+		if invite.proceeding && !invite.cancelled {
+			invite.cancelled = true
+			// the branch may be ringing, it must not be retried on the next backend
+			// or server before it is cancelled
+			p.removeBackendFailover(request)
+			p.sendCancel(invite)
+		}
+	}
+	p.removeForwardedInvite(branch, invite)
+	return method == "CANCEL"
+}
+
+// cancelInvite answer the CANCEL of an INVITE forwarded statefully with 200 and cancel
+// the INVITE sent downstream, the 487 of the INVITE is relayed upstream. The CANCEL is
+// processed as other requests if the INVITE is not pending, true is returned if the
+// CANCEL is answered by the proxy
+func (p *Proxy) cancelInvite(msg *Message) bool {
+	if method, _ := msg.GetMethod(); method != "CANCEL" {
+		return false
+	}
+	serverTransId, err := msg.GetServerTransaction()
+	if err != nil {
+		return false
+	}
+	p.invitesLock.Lock()
+	_, ok := p.invites[serverTransId]
+	p.invitesLock.Unlock()
+	if !ok {
+		return false
+	}
+	callId, _ := msg.GetCallID()
+	zap.L().Info("cancel the pending INVITE", zap.String("call-id", callId))
+	p.replyRequest(msg, 200, "OK")
+	p.stopForkingCancelled(serverTransId)
+	p.cancelInviteBranches(serverTransId)
+	return true
+}
+
+// cancelInviteBranches cancel all the INVITEs sent for the INVITE received from upstream
+// and not answered. The INVITE without provisional response is cancelled after its
+// provisional response is received, see RFC 3261 9.1
+func (p *Proxy) cancelInviteBranches(serverTransId string) {
+	p.invitesLock.Lock()
+	invites := make(map[string]*forwardedInvite)
+	for _, branch := range p.invites[serverTransId] {
+		invites[branch] = p.inviteBranches[branch]
+	}
+	p.invitesLock.Unlock()
+	for branch, invite := range invites {
+		if invite.answered || invite.cancelled {
+			continue
+		}
+		invite.cancelled = true
+		// the cancelled INVITE is not retried on the other backends
+		p.takeBackendFailover(branch)
+		if invite.proceeding {
+			p.sendCancel(invite)
+		}
+	}
+}
+
+func (p *Proxy) sendCancel(invite *forwardedInvite) {
+	cancel := NewCancelOf(invite.request)
+	callId, _ := cancel.GetCallID()
+	if err := invite.send(cancel); err != nil {
+		zap.L().Error("Fail to send CANCEL", zap.String("call-id", callId), zap.String("error", err.Error()))
+		return
+	}
+	zap.L().Info("send CANCEL of the forwarded INVITE", zap.String("call-id", callId))
+	invite.cancelPending = true
+	p.addClientTransaction(cancel, invite.reliable, invite.send)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestRingingBackend start a udp backend which answers the INVITE with 180 after
+// the delay, the CANCEL is answered with 200 and the INVITE with 487. The requests and
+// the 180 are returned in the order they are received and sent
+func startTestRingingBackend(t *testing.T, port int, proxyPort int, delay time.Duration) chan *Message {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	proxyAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: proxyPort}
+	send := func(msg *Message) {
+		if b, err := msg.Bytes(); err == nil {
+			conn.WriteToUDP(b, proxyAddr)
+		}
+	}
+	received := make(chan *Message, 100)
+	go func() {
+		var lock sync.Mutex
+		var invite *Message
+		branches := make(map[string]bool)
+		buf := make([]byte, 4096)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			msg, err := ParseMessage(bufio.NewReader(bytes.NewBuffer(buf[0:n])))
+			if err != nil {
+				continue
+			}
+			// the message is parsed again for the test to not share it with the backend
+			record, _ := ParseMessage(bufio.NewReader(bytes.NewBuffer(buf[0:n])))
+			method, _ := msg.GetMethod()
+			branch, _ := msg.GetTopViaBranch()
+			if branches[method+branch] {
+				// the retransmission of the request
+				continue
+			}
+			branches[method+branch] = true
+			lock.Lock()
+			received <- record
+			switch method {
+			case "INVITE":
+				invite = msg
+				time.AfterFunc(delay, func() {
+					lock.Lock()
+					defer lock.Unlock()
+					send(NewResponseOf(msg, 180, "Ringing"))
+					received <- NewResponseOf(record, 180, "Ringing")
+				})
+			case "CANCEL":
+				send(NewResponseOf(msg, 200, "OK"))
+				if invite != nil {
+					send(NewResponseOf(invite, 487, "Request Terminated"))
+				}
+			}
+			lock.Unlock()
+		}
+	}()
+	return received
+}
+
+// sendTestInviteAndCancel send the INVITE and its CANCEL after the response with the
+// status code is received, the INVITE is not cancelled if the status code is 0. The
+// responses are returned until the final response of INVITE which is acknowledged
+func sendTestInviteAndCancel(t *testing.T, proxyPort int, cancelOn int) []*Message {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	proxyAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: proxyPort}
+	request := "%s sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%d;branch=z9hG4bK776asdhc%d\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301820\r\nTo: <sip:bob@test.com>\r\nCall-ID: a84b4c76e66720%d@test.com\r\nCSeq: 1 %s\r\nContent-Length: 0\r\n\r\n"
+	conn.WriteToUDP([]byte(fmt.Sprintf(request, "INVITE", port, cancelOn, cancelOn, "INVITE")), proxyAddr)
+
+	responses := make([]*Message, 0)
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("the INVITE is not answered: %v", err)
+		}
+		response, err := ParseMessage(bufio.NewReader(bytes.NewBuffer(buf[0:n])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, response)
+		if response.response.statusCode == cancelOn {
+			conn.WriteToUDP([]byte(fmt.Sprintf(request, "CANCEL", port, cancelOn, cancelOn, "CANCEL")), proxyAddr)
+		}
+		if method, _ := response.GetMethod(); method == "INVITE" && response.IsFinalResponse() {
+			to, _ := response.GetTo()
+			ack := fmt.Sprintf(request, "ACK", port, cancelOn, cancelOn, "ACK")
+			ack = strings.Replace(ack, "To: <sip:bob@test.com>", fmt.Sprintf("To: %s", to), 1)
+			conn.WriteToUDP([]byte(ack), proxyAddr)
+			return responses
+		}
+	}
+}
+
+func findTestResponse(responses []*Message, method string, statusCode int) int {
+	for i, response := range responses {
+		if m, _ := response.GetMethod(); m == method && response.response.statusCode == statusCode {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestCancelInviteOnBackendReceivingIt(t *testing.T) {
+	first := startTestRingingBackend(t, 16181, 16180, 0)
+	second := startTestRingingBackend(t, 16182, 16180, 0)
+	createFailoverTestProxy(t, 16180, 16181, 16182)
+
+	responses := sendTestInviteAndCancel(t, 16180, 180)
+	cancelled := findTestResponse(responses, "CANCEL", 200)
+	terminated := findTestResponse(responses, "INVITE", 487)
+	if cancelled < 0 || terminated < cancelled {
+		t.Fatalf("expect 200 for the CANCEL and then 487 for the INVITE")
+	}
+	for i, response := range responses {
+		if method, _ := response.GetMethod(); method == "CANCEL" && i != cancelled {
+			t.Errorf("the 200 of the CANCEL from the backend is relayed")
+		}
+	}
+
+	var invited, other chan *Message
+	select {
+	case msg := <-first:
+		invited, other = first, second
+		if method, _ := msg.GetMethod(); method != "INVITE" {
+			t.Fatalf("expect INVITE but get %s", method)
+		}
+	case msg := <-second:
+		invited, other = second, first
+		if method, _ := msg.GetMethod(); method != "INVITE" {
+			t.Fatalf("expect INVITE but get %s", method)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the INVITE is not forwarded")
+	}
+	<-invited
+	select {
+	case msg := <-invited:
+		if method, _ := msg.GetMethod(); method != "CANCEL" {
+			t.Fatalf("expect CANCEL but get %s", method)
+		}
+		if branch, _ := msg.GetTopViaBranch(); branch == "z9hG4bK776asdhc180" {
+			t.Errorf("the CANCEL is not sent with the branch of the forwarded INVITE")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the CANCEL is not sent to the backend receiving the INVITE")
+	}
+	select {
+	case msg := <-other:
+		method, _ := msg.GetMethod()
+		t.Errorf("the %s is sent to the other backend", method)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestCancelInviteBeforeProvisionalResponse(t *testing.T) {
+	received := startTestRingingBackend(t, 16184, 16183, 300*time.Millisecond)
+	createFailoverTestProxy(t, 16183, 16184)
+
+	// the CANCEL is sent to the proxy on the 100 Trying before the backend rings
+	responses := sendTestInviteAndCancel(t, 16183, 100)
+	cancelled := findTestResponse(responses, "CANCEL", 200)
+	ringing := findTestResponse(responses, "INVITE", 180)
+	if cancelled < 0 || (ringing >= 0 && ringing < cancelled) {
+		t.Errorf("the CANCEL is not answered before the provisional response")
+	}
+	if findTestResponse(responses, "INVITE", 487) < 0 {
+		t.Errorf("the INVITE is not terminated")
+	}
+	methods := make([]string, 0)
+	for len(methods) < 3 {
+		select {
+		case msg := <-received:
+			method, _ := msg.GetMethod()
+			if !msg.IsRequest() {
+				method = "180"
+			}
+			methods = append(methods, method)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("the backend receives only %v", methods)
+		}
+	}
+	if methods[0] != "INVITE" || methods[1] != "180" || methods[2] != "CANCEL" {
+		t.Errorf("the CANCEL is sent before the provisional response: %v", methods)
+	}
+}
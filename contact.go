@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Contact is the value of a Contact header, it is either "*" or a list of contact params
+type Contact struct {
+	star   bool
+	params []*ContactParam
+}
+
+// ContactParam is a contact address with the parameters like q and expires
+type ContactParam struct {
+	nameAddr *NameAddr
+	addrSpec *AddrSpec
+	params   []KeyValue
+}
+
+func ParseContact(s string) (*Contact, error) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return &Contact{star: true}, nil
+	}
+	contact := &Contact{params: make([]*ContactParam, 0)}
+	for _, t := range splitContactParams(s) {
+		param, err := ParseContactParam(t)
+		if err != nil {
+			return nil, err
+		}
+		contact.params = append(contact.params, param)
+	}
+	if len(contact.params) == 0 {
+		return nil, errors.New("empty Contact")
+	}
+	return contact, nil
+}
+
+// splitContactParams split the contact params by the commas which are not in the
+// display name or the angle brackets
+func splitContactParams(s string) []string {
+	r := make([]string, 0)
+	quoted, bracketed := false, false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case '<':
+			bracketed = bracketed || !quoted
+		case '>':
+			bracketed = bracketed && quoted
+		case ',':
+			if !quoted && !bracketed {
+				r = append(r, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(r, s[start:])
+}
+
+func ParseContactParam(s string) (*ContactParam, error) {
+	s = strings.TrimSpace(s)
+	r := &ContactParam{params: make([]KeyValue, 0)}
+	params := ""
+	if laquot_pos := strings.IndexByte(s, '<'); laquot_pos != -1 {
+		raquot_pos := strings.IndexByte(s, '>')
+		if raquot_pos == -1 || raquot_pos < laquot_pos {
+			return nil, errors.New("malformatted contact-param")
+		}
+		nameAddr, err := ParseNameAddr(s[0 : raquot_pos+1])
+		if err != nil {
+			return nil, err
+		}
+		r.nameAddr = nameAddr
+		params = strings.TrimSpace(s[raquot_pos+1:])
+	} else {
+		// the parameters after the addr-spec are the header parameters
+		addrSpec := s
+		if pos := strings.IndexByte(s, ';'); pos != -1 {
+			addrSpec, params = s[0:pos], s[pos:]
+		}
+		spec, err := ParseAddrSpec(addrSpec)
+		if err != nil {
+			return nil, err
+		}
+		r.addrSpec = spec
+	}
+	if len(params) == 0 {
+		return r, nil
+	}
+	if params[0] != ';' {
+		return nil, errors.New("invalid contact-param syntax")
+	}
+	for _, value := range strings.Split(params[1:], ";") {
+		kv, err := ParseGenericParam(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		r.params = append(r.params, kv)
+	}
+	return r, nil
+}
+
+// IsStar check if the Contact is "*", it is used to remove all the bindings
+func (c *Contact) IsStar() bool {
+	return c.star
+}
+
+func (c *Contact) GetContactParamCount() int {
+	return len(c.params)
+}
+
+func (c *Contact) GetContactParam(index int) (*ContactParam, error) {
+	if index < 0 || index >= len(c.params) {
+		return nil, fmt.Errorf("index %d is out of bound", index)
+	}
+	return c.params[index], nil
+}
+
+func (c *Contact) String() string {
+	if c.star {
+		return "*"
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	for i, param := range c.params {
+		if i > 0 {
+			fmt.Fprintf(buf, ",")
+		}
+		fmt.Fprintf(buf, "%s", param)
+	}
+	return buf.String()
+}
+
+func (cp *ContactParam) GetAddrSpec() (*AddrSpec, error) {
+	addrSpec := cp.addrSpec
+	if cp.nameAddr != nil {
+		addrSpec = cp.nameAddr.Addr
+	}
+	if addrSpec == nil {
+		return nil, errors.New("no name-addr or addr-spec found")
+	}
+	return addrSpec, nil
+}
+
+func (cp *ContactParam) GetParam(name string) (string, error) {
+	for _, param := range cp.params {
+		if strings.EqualFold(name, param.Key) {
+			return param.Value, nil
+		}
+	}
+	return "", fmt.Errorf("no such param %s", name)
+}
+
+func (cp *ContactParam) SetParam(name string, value string) {
+	for i, param := range cp.params {
+		if strings.EqualFold(name, param.Key) {
+			cp.params[i].Value = value
+			return
+		}
+	}
+	cp.params = append(cp.params, KeyValue{Key: name, Value: value})
+}
+
+// GetExpires get the expires parameter, defValue is returned if it is absent or invalid
+func (cp *ContactParam) GetExpires(defValue int) int {
+	if value, err := cp.GetParam("expires"); err == nil {
+		if expires, err := strconv.Atoi(value); err == nil && expires >= 0 {
+			return expires
+		}
+	}
+	return defValue
+}
+
+// GetQ get the q parameter in range 0 to 1, the default is 1
+func (cp *ContactParam) GetQ() float64 {
+	if value, err := cp.GetParam("q"); err == nil {
+		if q, err := strconv.ParseFloat(value, 64); err == nil && q >= 0 && q <= 1 {
+			return q
+		}
+	}
+	return 1
+}
+
+func (cp *ContactParam) String() string {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if cp.nameAddr != nil {
+		fmt.Fprintf(buf, "%s", cp.nameAddr)
+	} else {
+		// the addr-spec is enclosed in angle brackets to keep its parameters in the URI
+		fmt.Fprintf(buf, "<%s>", cp.addrSpec)
+	}
+	for _, kv := range cp.params {
+		fmt.Fprintf(buf, ";%s", kv)
+	}
+	return buf.String()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseContactHeader(t *testing.T) {
+	contact, err := ParseContact(`"Bob, Mobile" <sip:bob@10.0.0.1:5062;transport=tcp>;expires=60, sip:bob@10.0.0.2;q=0.5`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact.IsStar() || contact.GetContactParamCount() != 2 {
+		t.Fatalf("expect 2 contacts but get %d", contact.GetContactParamCount())
+	}
+	first, _ := contact.GetContactParam(0)
+	if addrSpec, _ := first.GetAddrSpec(); addrSpec.String() != "sip:bob@10.0.0.1:5062;transport=tcp" {
+		t.Errorf("wrong contact URI %s", addrSpec)
+	}
+	if first.GetExpires(3600) != 60 || first.GetQ() != 1 {
+		t.Errorf("wrong expires or q of %s", first)
+	}
+	second, _ := contact.GetContactParam(1)
+	if addrSpec, _ := second.GetAddrSpec(); addrSpec.String() != "sip:bob@10.0.0.2" {
+		t.Errorf("the header parameter is parsed as the URI parameter: %s", addrSpec)
+	}
+	if second.GetExpires(3600) != 3600 || second.GetQ() != 0.5 {
+		t.Errorf("wrong expires or q of %s", second)
+	}
+	if second.String() != "<sip:bob@10.0.0.2>;q=0.5" {
+		t.Errorf("wrong contact %s", second)
+	}
+}
+
+func TestParseStarContactHeader(t *testing.T) {
+	contact, err := ParseContact(" * ")
+	if err != nil || !contact.IsStar() || contact.String() != "*" {
+		t.Errorf("fail to parse the star contact")
+	}
+	if _, err := ParseContact("<sip:bob@10.0.0.1"); err == nil {
+		t.Errorf("the malformatted contact is accepted")
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"sync"
+	"time"
 )
 
 type Dialog struct {
@@ -17,3 +19,63 @@ func NewDialog(callID string, localTag string, remoteTag string) *Dialog {
 func (d *Dialog) String() string {
 	return fmt.Sprintf("%s-%s-%s", d.callID, d.localTag, d.remoteTag)
 }
+
+// DialogTracker keep the INVITE dialogs established through the proxy until they are
+// ended by a BYE or expired, the dialogs are not shared with the other proxies
+type DialogTracker struct {
+	sync.Mutex
+	expire        time.Duration
+	dialogs       map[string]time.Time
+	nextCleanTime time.Time
+}
+
+// the expired dialogs are removed from the dialog tracker in this interval
+const dialogCleanInterval = time.Minute
+
+func NewDialogTracker(expire time.Duration) *DialogTracker {
+	return &DialogTracker{expire: expire, dialogs: make(map[string]time.Time), nextCleanTime: time.Now().Add(dialogCleanInterval)}
+}
+
+// HandleResponse add the dialog on the 2xx response of an INVITE and remove it on the
+// final response of a BYE
+func (t *DialogTracker) HandleResponse(msg *Message) {
+	if !msg.IsResponse() || msg.response.statusCode < 200 {
+		return
+	}
+	method, err := msg.GetMethod()
+	if err != nil || (method != "INVITE" && method != "BYE") {
+		return
+	}
+	dialog, err := msg.GetDialog()
+	if err != nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	if method == "BYE" {
+		delete(t.dialogs, dialog)
+	} else if msg.response.statusCode < 300 {
+		t.dialogs[dialog] = now.Add(t.expire)
+	}
+	if !t.nextCleanTime.After(now) {
+		t.nextCleanTime = now.Add(dialogCleanInterval)
+		t.removeExpired(now)
+	}
+}
+
+// Size get the number of the established dialogs, the expired ones are removed
+func (t *DialogTracker) Size() int {
+	t.Lock()
+	defer t.Unlock()
+	t.removeExpired(time.Now())
+	return len(t.dialogs)
+}
+
+func (t *DialogTracker) removeExpired(now time.Time) {
+	for dialog, expires := range t.dialogs {
+		if !expires.After(now) {
+			delete(t.dialogs, dialog)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// StartDrain reject the requests creating new dialogs with 503 and the Retry-After of
+// retryAfter seconds, the requests of the existing sessions are still forwarded
+func (p *Proxy) StartDrain(retryAfter int) {
+	atomic.StoreInt32(&p.drainRetryAfter, int32(retryAfter))
+	if atomic.CompareAndSwapInt32(&p.draining, 0, 1) {
+		zap.L().Info("start to drain sip proxy", zap.String("name", p.name), zap.Int("retryAfter", retryAfter))
+	}
+}
+
+func (p *Proxy) isDraining() bool {
+	return atomic.LoadInt32(&p.draining) != 0
+}
+
+// rejectNewDialog answer 503 (Service Unavailable) to the request out of any existing
+// session in drain mode, true is returned if the request is rejected
+func (p *Proxy) rejectNewDialog(msg *Message) bool {
+	if !p.isDraining() || !isOutOfDialogRequest(msg) {
+		return false
+	}
+	if sessionId, err := msg.GetSessionId(); err == nil {
+		if _, err := p.sessionBackends.GetBackend(sessionId); err == nil {
+			return false
+		}
+	}
+	callId, _ := msg.GetCallID()
+	zap.L().Info("reject new dialog in drain mode", zap.String("call-id", callId))
+	response := NewResponseOf(msg, 503, "Service Unavailable")
+	if retryAfter := atomic.LoadInt32(&p.drainRetryAfter); retryAfter > 0 {
+		response.AddHeader("Retry-After", strconv.Itoa(int(retryAfter)))
+	}
+	p.sendProxyResponse(response)
+	return true
+}
+
+// isOutOfDialogRequest check if the request has no To tag, the ACK and CANCEL are not
+// counted because they belong to an INVITE transaction
+func isOutOfDialogRequest(msg *Message) bool {
+	if method, err := msg.GetMethod(); err != nil || method == "ACK" || method == "CANCEL" {
+		return false
+	}
+	to, err := msg.GetTo()
+	if err != nil {
+		return false
+	}
+	_, err = to.GetTag()
+	return err != nil
+}
+
+// GetSessionCount get the number of the INVITE dialogs established through this proxy
+// and the server transactions not answered with a final response yet
+func (p *Proxy) GetSessionCount() int {
+	return p.dialogs.Size() + p.serverTransactionMgr.PendingSize()
+}
+
+// Close stop the proxy, close the connections to the peers and the backends and
+// release the session stores
+func (p *Proxy) Close() {
+	p.Stop()
+	p.clientTransMgr.CloseAll()
+	for _, item := range p.getItems() {
+		if item.backend != nil {
+			item.backend.Close()
+		}
+	}
+	p.sessionBackends.Close()
+	zap.L().Info("sip proxy is closed", zap.String("name", p.name))
+}
+
+// waitForShutdown wait for SIGTERM or SIGINT, then drain the proxies until all their
+// sessions are finished or the drain timeout, and close them. A second signal closes
+// the proxies immediately
+func waitForShutdown(getProxies func() []*Proxy, drainTimeout time.Duration, retryAfter int) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	zap.L().Info("signal is received, drain the proxies", zap.String("signal", sig.String()), zap.Duration("drainTimeout", drainTimeout))
+	drainProxies(getProxies(), drainTimeout, retryAfter, signals)
+	dynamicHostResolver.Stop()
+}
+
+// drainProxies put the proxies in drain mode and close them after their sessions are
+// finished, the timeout expires or a value is received from the interrupt channel
+func drainProxies(proxies []*Proxy, drainTimeout time.Duration, retryAfter int, interrupt <-chan os.Signal) {
+	for _, proxy := range proxies {
+		proxy.StartDrain(retryAfter)
+	}
+	deadline := time.NewTimer(drainTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for sessions := countSessions(proxies); sessions > 0; sessions = countSessions(proxies) {
+		zap.L().Info("wait for the sessions to finish", zap.Int("sessions", sessions))
+		select {
+		case <-ticker.C:
+			continue
+		case <-deadline.C:
+			zap.L().Warn("drain timeout, close the remaining sessions", zap.Int("sessions", sessions))
+		case sig := <-interrupt:
+			zap.L().Warn("signal is received again, close the remaining sessions", zap.String("signal", sig.String()), zap.Int("sessions", sessions))
+		}
+		break
+	}
+	for _, proxy := range proxies {
+		proxy.Close()
+	}
+}
+
+func countSessions(proxies []*Proxy) int {
+	n := 0
+	for _, proxy := range proxies {
+		n += proxy.GetSessionCount()
+	}
+	return n
+}
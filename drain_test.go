@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrainRejectsNewDialog(t *testing.T) {
+	startTestBackend(t, 15761, 15760, 200, "OK")
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 15760, Backends: []BackendConfig{{Address: "udp://127.0.0.1:15761"}}}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxy.StartDrain(5)
+
+	response := sendTestRequest(t, 15760, "OPTIONS sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%d;branch=z9hG4bK776asdhe1\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301777\r\nTo: <sip:bob@test.com>\r\nCall-ID: a84b4c76e66714@test.com\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n")
+	if response.response.statusCode != 503 {
+		t.Errorf("expect 503 for the new dialog but get %d", response.response.statusCode)
+	}
+	if retryAfter, err := response.GetHeaderInt("Retry-After"); err != nil || retryAfter != 5 {
+		t.Errorf("no Retry-After in the 503")
+	}
+
+	response = sendTestRequest(t, 15760, "OPTIONS sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%d;branch=z9hG4bK776asdhe2\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301778\r\nTo: <sip:bob@test.com>;tag=314159\r\nCall-ID: a84b4c76e66715@test.com\r\nCSeq: 2 OPTIONS\r\nContent-Length: 0\r\n\r\n")
+	if response.response.statusCode != 200 {
+		t.Errorf("expect the in-dialog request is forwarded but get %d", response.response.statusCode)
+	}
+}
+
+func TestIsOutOfDialogRequest(t *testing.T) {
+	if !isOutOfDialogRequest(createTestRequest("INVITE")) {
+		t.Errorf("the INVITE without To tag is not out of dialog")
+	}
+	if isOutOfDialogRequest(createTestRequest("CANCEL")) {
+		t.Errorf("the CANCEL is out of dialog")
+	}
+	request := createTestRequest("BYE")
+	to, _ := request.GetTo()
+	to.AddParam("tag", "8321234356")
+	if isOutOfDialogRequest(request) {
+		t.Errorf("the request with To tag is out of dialog")
+	}
+}
+
+func TestDrainProxiesWithoutSessions(t *testing.T) {
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 15762}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	drainProxies([]*Proxy{proxy}, 10*time.Second, 5, nil)
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("the proxy without sessions is not closed immediately")
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 15762})
+	if err != nil {
+		t.Fatalf("the listen is not stopped after drain")
+	}
+	conn.Close()
+}
+
+func TestDrainCountsDialogsAndPendingTransactions(t *testing.T) {
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16231}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	proxy.dialogs.HandleResponse(createTestResponse(createTestRequest("OPTIONS"), 200, "200 OK"))
+	proxy.dialogs.HandleResponse(createTestResponse(createTestRequest("INVITE"), 486, "486 Busy Here"))
+	if n := proxy.GetSessionCount(); n != 0 {
+		t.Errorf("expect no session without the established dialog but get %d", n)
+	}
+	proxy.dialogs.HandleResponse(createTestResponse(createTestRequest("INVITE"), 200, "200 OK"))
+	if n := proxy.GetSessionCount(); n != 1 {
+		t.Errorf("expect 1 session for the established dialog but get %d", n)
+	}
+	proxy.dialogs.HandleResponse(createTestResponse(createTestRequest("BYE"), 200, "200 OK"))
+	if n := proxy.GetSessionCount(); n != 0 {
+		t.Errorf("expect the dialog is ended by the BYE but get %d sessions", n)
+	}
+
+	proxy.serverTransactionMgr.HandleRequest(createTestRequest("REGISTER"), true, func(msg *Message) error { return nil })
+	if n := proxy.GetSessionCount(); n != 1 {
+		t.Errorf("expect 1 session for the pending transaction but get %d", n)
+	}
+	proxy.serverTransactionMgr.SendResponse(createTestResponse(createTestRequest("REGISTER"), 200, "200 OK"))
+	if n := proxy.GetSessionCount(); n != 0 {
+		t.Errorf("expect the answered transaction is not counted but get %d sessions", n)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var defaultFailoverCodes = []int{500, 502, 503, 504}
+
+// backendFailover is the context to retry a request on the next member of the
+// RoundRobinBackend, or on the next server located for the next hop if backend is nil.
+// It is only accessed in the worker processing the dialog
+type backendFailover struct {
+	// the request sent to the backend with the Via of the proxy
+	request   *Message
+	transport ServerTransport
+	backend   *RoundRobinBackend
+	config    *FailoverConfig
+	// the address of the members already tried
+	tried     []string
+	sessionId string
+	// the located servers of the next hop not tried yet, in the order of RFC 3263
+	servers []ServerTarget
+	// the fork of the request if it is a branch of the forked request
+	fork *forkContext
+}
+
+// isFailoverCode check if the request should be retried on the next backend after
+// receiving the final response with the status code
+func (c *FailoverConfig) isFailoverCode(statusCode int) bool {
+	if len(c.Codes) == 0 {
+		return slices.Contains(defaultFailoverCodes, statusCode)
+	}
+	return slices.Contains(c.Codes, statusCode)
+}
+
+// findFailoverConfig find the failover configuration of the listener owning the backend
+func (p *Proxy) findFailoverConfig(backend *RoundRobinBackend) *FailoverConfig {
+	for _, item := range p.getItems() {
+		if item.backend == backend {
+			return item.getListenConfig().Failover
+		}
+	}
+	return nil
+}
+
+// addBackendFailover remember the request sent to the member of RoundRobinBackend to
+// retry it on the next member if it fails
+func (p *Proxy) addBackendFailover(msg *Message, transport ServerTransport, backend *RoundRobinBackend, tried []string, sessionId string) {
+	config := p.findFailoverConfig(backend)
+	if config == nil {
+		return
+	}
+	if method, err := msg.GetMethod(); err != nil || method == "ACK" || method == "CANCEL" {
+		return
+	}
+	branch, err := msg.GetTopViaBranch()
+	if err != nil {
+		return
+	}
+	p.failoversLock.Lock()
+	defer p.failoversLock.Unlock()
+	p.failovers[branch] = &backendFailover{request: msg,
+		transport: transport,
+		backend:   backend,
+		config:    config,
+		tried:     tried,
+		sessionId: sessionId}
+}
+
+// addServerFailover remember the request sent to the located server of the next hop to
+// retry it on the next server if it is not answered or answered with 503, see RFC 3263 4.3
+func (p *Proxy) addServerFailover(msg *Message, servers []ServerTarget, fork *forkContext) {
+	if len(servers) == 0 {
+		return
+	}
+	if method, err := msg.GetMethod(); err != nil || method == "ACK" || method == "CANCEL" {
+		return
+	}
+	branch, err := msg.GetTopViaBranch()
+	if err != nil {
+		return
+	}
+	p.failoversLock.Lock()
+	defer p.failoversLock.Unlock()
+	p.failovers[branch] = &backendFailover{request: msg, servers: servers, fork: fork}
+}
+
+// takeBackendFailover remove and return the failover context of the request with the Via branch
+func (p *Proxy) takeBackendFailover(branch string) (*backendFailover, bool) {
+	p.failoversLock.Lock()
+	defer p.failoversLock.Unlock()
+	failover, ok := p.failovers[branch]
+	if ok {
+		delete(p.failovers, branch)
+	}
+	return failover, ok
+}
+
+// removeBackendFailover forget the failover context of the request with the same Via
+// branch, the request is not retried anymore
+func (p *Proxy) removeBackendFailover(msg *Message) {
+	if branch, err := msg.GetTopViaBranch(); err == nil {
+		p.takeBackendFailover(branch)
+	}
+}
+
+// failoverOnResponse retry the request on the next backend if the final response is one
+// of the failover status codes, true is returned if the request is retried and the
+// response should not be relayed upstream
+func (p *Proxy) failoverOnResponse(msg *Message) bool {
+	branch, err := msg.GetTopViaBranch()
+	if err != nil {
+		return false
+	}
+	failover, ok := p.takeBackendFailover(branch)
+	if !ok {
+		return false
+	}
+	if failover.backend == nil {
+		if msg.response.statusCode != 503 {
+			return false
+		}
+		zap.L().Info("server fails the request, try next server", zap.Int("statusCode", msg.response.statusCode))
+		return p.failoverToNextServer(failover)
+	}
+	if !failover.config.isFailoverCode(msg.response.statusCode) {
+		return false
+	}
+	zap.L().Info("backend fails the request, try next backend", zap.String("backend", failover.tried[len(failover.tried)-1]), zap.Int("statusCode", msg.response.statusCode))
+	return p.failoverToNextBackend(failover)
+}
+
+// failoverOnTimeout retry the request on the next backend after the client transaction
+// is timeout, true is returned if the request is retried
+func (p *Proxy) failoverOnTimeout(request *Message) bool {
+	branch, err := request.GetTopViaBranch()
+	if err != nil {
+		return false
+	}
+	failover, ok := p.takeBackendFailover(branch)
+	if !ok {
+		return false
+	}
+	if failover.backend == nil {
+		zap.L().Info("server does not answer the request, try next server")
+		return p.failoverToNextServer(failover)
+	}
+	zap.L().Info("backend does not answer the request, try next backend", zap.String("backend", failover.tried[len(failover.tried)-1]))
+	return p.failoverToNextBackend(failover)
+}
+
+func (p *Proxy) failoverToNextBackend(failover *backendFailover) bool {
+	if failover.config.MaxAttempts > 0 && len(failover.tried) >= failover.config.MaxAttempts {
+		zap.L().Error("no more backend is tried for the request", zap.Int("attempts", len(failover.tried)))
+		return false
+	}
+	msg := failover.request.Clone()
+	msg.PopVia()
+	p.addVia(msg, failover.transport)
+	usedBackend, address, err := failover.backend.SendExcept(p.hideRequestTopology(msg), failover.tried)
+	if err != nil {
+		zap.L().Error("Fail to send the request to the next backend", zap.Strings("tried", failover.tried), zap.String("error", err.Error()))
+		return false
+	}
+	zap.L().Info("succeed to send the request to the next backend", zap.String("backend", address))
+	p.addClientTransaction(msg, !strings.HasPrefix(usedBackend.GetAddress(), "udp"), func(m *Message) error {
+		_, err := usedBackend.Send(p.hideRequestTopology(m))
+		return err
+	})
+	if len(failover.sessionId) > 0 {
+		zap.L().Info("bind session with the next backend", zap.String("sessionId", failover.sessionId), zap.String("backend", usedBackend.GetAddress()))
+		p.sessionBackends.AddBackend(failover.sessionId, usedBackend, msg.GetExpires(0))
+	}
+	tried := append(slices.Clone(failover.tried), address)
+	p.addBackendFailover(msg, failover.transport, failover.backend, tried, failover.sessionId)
+	return true
+}
+
+// failoverToNextServer send the request with a new Via branch to the next located server
+// which can be reached
+func (p *Proxy) failoverToNextServer(failover *backendFailover) bool {
+	msg := failover.request.Clone()
+	branch, _ := msg.GetTopViaBranch()
+	if err := renewTopViaBranch(msg); err != nil {
+		return false
+	}
+	send, server, others, err := p.sendToServers(msg, failover.servers)
+	if err != nil {
+		zap.L().Error("Fail to send the request to the next server", zap.String("error", err.Error()))
+		return false
+	}
+	zap.L().Info("succeed to send the request to the next server", zap.String("host", server.Host), zap.Int("port", server.Port), zap.String("transport", server.Protocol))
+	if failover.fork != nil {
+		newBranch, _ := msg.GetTopViaBranch()
+		p.replaceForkBranch(failover.fork, branch, newBranch)
+	}
+	p.addClientTransaction(msg, !strings.EqualFold(server.Protocol, "udp"), send)
+	p.addServerFailover(msg, others, failover.fork)
+	return true
+}
+
+// renewTopViaBranch replace the top Via of the proxy with the same one with a new branch,
+// the request retried on the next server is a new client transaction
+func renewTopViaBranch(msg *Message) error {
+	via, err := msg.PopVia()
+	if err != nil {
+		return err
+	}
+	viaParam, err := via.GetParam(0)
+	if err != nil {
+		return err
+	}
+	newVia, err := CreateVia(viaParam.Transport, viaParam.Host, viaParam.GetPort())
+	if err != nil {
+		return err
+	}
+	if newParam, err := newVia.GetParam(0); err == nil {
+		newBranch, _ := newParam.GetBranch()
+		newParam.SetBranch(newBranch + "." + msg.GetLoopDetectionHash())
+	}
+	msg.AddVia(newVia)
+	return nil
+}
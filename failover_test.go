@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startTestBackend start a udp backend which answers the requests with the status code
+// to the proxy, the requests are not answered if the status code is 0
+func startTestBackend(t *testing.T, port int, proxyPort int, statusCode int, reason string) chan *Message {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	received := make(chan *Message, 100)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			msg, err := ParseMessage(bufio.NewReader(bytes.NewBuffer(buf[0:n])))
+			if err != nil {
+				continue
+			}
+			received <- msg
+			if method, _ := msg.GetMethod(); statusCode == 0 || method == "ACK" {
+				continue
+			}
+			if b, err := NewResponseOf(msg, statusCode, reason).Bytes(); err == nil {
+				conn.WriteToUDP(b, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: proxyPort})
+			}
+		}
+	}()
+	return received
+}
+
+func createFailoverTestProxy(t *testing.T, proxyPort int, backendPorts ...int) *Proxy {
+	listen := ListenConfig{Address: "127.0.0.1", UdpPort: proxyPort, Failover: &FailoverConfig{Codes: []int{503}}}
+	for _, port := range backendPorts {
+		listen.Backends = append(listen.Backends, BackendConfig{Address: "udp://127.0.0.1:" + strconv.Itoa(port)})
+	}
+	proxy := NewProxy("test.com", 60, []ListenConfig{listen}, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	proxy.clientTransactionMgr.timers = shortTransactionTimers
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+func TestFailoverOnServiceUnavailable(t *testing.T) {
+	failed := startTestBackend(t, 15561, 15560, 503, "Service Unavailable")
+	startTestBackend(t, 15562, 15560, 200, "OK")
+	proxy := createFailoverTestProxy(t, 15560, 15561, 15562)
+
+	response := sendTestRequest(t, 15560, "OPTIONS sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%d;branch=z9hG4bK776asdhdu\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301775\r\nTo: <sip:bob@test.com>\r\nCall-ID: a84b4c76e66712@test.com\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n")
+	if response.response.statusCode != 200 {
+		t.Errorf("expect 200 from the next backend but get %d", response.response.statusCode)
+	}
+	if len(failed) == 0 {
+		t.Errorf("the request is not sent to the first backend")
+	}
+	sessionId, _ := response.GetSessionId()
+	backend, err := proxy.sessionBackends.GetBackend(sessionId)
+	if err != nil || backend.GetAddress() != "udp://127.0.0.1:15562" {
+		t.Errorf("the session is not bound to the backend accepting the request")
+	}
+}
+
+func TestFailoverOnTimeout(t *testing.T) {
+	silent := startTestBackend(t, 15564, 15563, 0, "")
+	startTestBackend(t, 15565, 15563, 200, "OK")
+	createFailoverTestProxy(t, 15563, 15564, 15565)
+
+	response := sendTestRequest(t, 15563, "OPTIONS sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%d;branch=z9hG4bK776asdhdv\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301776\r\nTo: <sip:bob@test.com>\r\nCall-ID: a84b4c76e66713@test.com\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n")
+	if response.response.statusCode != 200 {
+		t.Errorf("expect 200 from the next backend but get %d", response.response.statusCode)
+	}
+	if len(silent) < 2 {
+		t.Errorf("the request is not retransmitted to the first backend before timeout")
+	}
+}
+
+func TestFailoverIsRemovedOnCancelTimeout(t *testing.T) {
+	proxy := createFailoverTestProxy(t, 16225, 16226, 16227)
+	item := proxy.getItems()[0]
+	invite := createTestRequest("INVITE")
+	proxy.addVia(invite, item.transports[0])
+	proxy.trackInvite(invite, false, func(*Message) error { return nil })
+	proxy.addBackendFailover(invite, item.transports[0], item.backend, []string{"udp://127.0.0.1:16226"}, "")
+	branch, _ := invite.GetTopViaBranch()
+	if invite, ok := proxy.findForwardedInvite(branch); ok {
+		invite.cancelled, invite.cancelPending = true, true
+	}
+
+	proxy.clientTransactionTimeout(&ClientTransaction{request: NewCancelOf(invite)})
+	time.Sleep(100 * time.Millisecond)
+	proxy.failoversLock.Lock()
+	defer proxy.failoversLock.Unlock()
+	if len(proxy.failovers) != 0 {
+		t.Errorf("the failover of the cancelled INVITE is kept after the CANCEL is timeout")
+	}
+}
+
+func TestFailoverToNextLocatedServer(t *testing.T) {
+	dnsServer := startTestDNSServer(t, []string{"_sip._udp.failover.test. 60 IN SRV 10 10 16229 127.0.0.1.",
+		"_sip._udp.failover.test. 60 IN SRV 20 10 16230 127.0.0.1."})
+	sipServerLocator.SetDNSServer(dnsServer)
+	t.Cleanup(func() {
+		sipServerLocator.SetDNSServer("")
+	})
+	failed := startTestBackend(t, 16229, 16228, 503, "Service Unavailable")
+	received := startTestBackend(t, 16230, 16228, 200, "OK")
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16228}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxy.selfLearnRoute.AddRoute("failover.test", proxy.getItems()[0].transports[0])
+
+	response := sendTestRequest(t, 16228, "OPTIONS sip:bob@failover.test SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%d;branch=z9hG4bK776asdhdz\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301775\r\nTo: <sip:bob@failover.test>\r\nCall-ID: a84b4c76e66720@test.com\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n")
+	if response.response.statusCode != 200 {
+		t.Errorf("expect 200 from the next located server but get %d", response.response.statusCode)
+	}
+	if len(failed) == 0 || len(received) == 0 {
+		t.Errorf("the request is not sent to the located servers in order")
+	}
+}
+
+func TestNoFailoverOfProceedingInviteOnTimeout(t *testing.T) {
+	next := startTestBackend(t, 16238, 16236, 0, "")
+	proxy := createFailoverTestProxy(t, 16236, 16237, 16238)
+	item := proxy.getItems()[0]
+	invite := createTestRequest("INVITE")
+	proxy.addVia(invite, item.transports[0])
+	sent := make(chan *Message, 10)
+	proxy.trackInvite(invite, false, func(msg *Message) error {
+		sent <- msg
+		return nil
+	})
+	proxy.addBackendFailover(invite, item.transports[0], item.backend, []string{"udp://127.0.0.1:16237"}, "")
+	branch, _ := invite.GetTopViaBranch()
+	if invite, ok := proxy.findForwardedInvite(branch); ok {
+		invite.proceeding = true
+	}
+
+	proxy.clientTransactionTimeout(&ClientTransaction{request: invite})
+	select {
+	case msg := <-sent:
+		if method, _ := msg.GetMethod(); method != "CANCEL" {
+			t.Errorf("expect CANCEL of the proceeding INVITE but get %s", method)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the proceeding INVITE is not cancelled after timeout")
+	}
+	select {
+	case <-next:
+		t.Errorf("the proceeding INVITE is retried on the next backend")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	forkParallel   = "parallel"
+	forkSequential = "sequential"
+)
+
+// forkTarget is a destination of the forked request
+type forkTarget struct {
+	// the Request-URI of the branch, the Request-URI is not changed if it is nil
+	requestURI *AddrSpec
+	// the next hop, it is located from the requestURI if the host is empty
+	host      string
+	port      int
+	transport string
+}
+
+// newContactForkTarget retarget the request to the contact, see RFC 3261 16.6 step 2
+func newContactForkTarget(contact *AddrSpec) forkTarget {
+	return forkTarget{requestURI: contact}
+}
+
+// forkContext is the request forked to multiple targets, the best final response is
+// relayed upstream after all the branches are finished, see RFC 3261 16.7. It is only
+// accessed in the worker processing the dialog
+type forkContext struct {
+	// the request received from upstream
+	request *Message
+	// the key of the server transaction of the request
+	serverTransId string
+	// the protocol on which the request is received
+	protocol string
+	// the targets not tried yet, the groups are tried one after another and the targets
+	// in a group in parallel
+	pending [][]forkTarget
+	// the time to wait for the final responses of a group before the next one is tried
+	branchTimeout time.Duration
+	branchTimer   *time.Timer
+	// the number of the groups tried, the expired timer of a finished group is ignored
+	step int
+	// the Via branches of the proxy which are not finished
+	branches map[string]bool
+	// the branches cancelled by the proxy because they are not answered in time
+	expired map[string]bool
+	// the Request-URIs tried for the request and the number of the 3xx responses followed,
+	// to avoid the redirect loops
+	tried     map[string]bool
+	redirects int
+	// the best final response received so far, the Via of the proxy is removed
+	bestResponse *Message
+	// a final response has been sent upstream
+	answered bool
+	// no more target is tried because the request is answered or cancelled
+	stopped bool
+}
+
+// validateFork check the fork settings when the registrar is updated
+func validateFork(fork string, branchTimeout int) error {
+	if fork != "" && !strings.EqualFold(fork, forkParallel) && !strings.EqualFold(fork, forkSequential) {
+		return fmt.Errorf("invalid fork %s, expect %s or %s", fork, forkParallel, forkSequential)
+	}
+	if branchTimeout < 0 {
+		return fmt.Errorf("branch-timeout must not be negative")
+	}
+	return nil
+}
+
+// forkResponseRank rank the final responses received from the branches, the lower one is
+// better. The 6xx is preferred, then the lowest response class and the 4xx responses
+// affecting the resubmission of the request, see RFC 3261 16.7 step 6
+func forkResponseRank(statusCode int) int {
+	switch {
+	case statusCode >= 600:
+		return 0
+	case statusCode < 400:
+		return 1
+	case statusCode == 401 || statusCode == 407 || statusCode == 415 || statusCode == 420 || statusCode == 484:
+		return 2
+	case statusCode < 500:
+		return 3
+	}
+	return 4
+}
+
+// forkRequest send the request to the groups of targets one after another, the targets
+// which can't be reached are answered with 503 locally
+func (p *Proxy) forkRequest(protocol string, msg *Message, targets [][]forkTarget, branchTimeout time.Duration) {
+	serverTransId, _ := msg.GetServerTransaction()
+	ctx := &forkContext{request: msg,
+		serverTransId: serverTransId,
+		protocol:      protocol,
+		pending:       targets,
+		branchTimeout: branchTimeout,
+		branches:      make(map[string]bool),
+		expired:       make(map[string]bool),
+		tried:         make(map[string]bool)}
+	if requestURI, err := msg.GetRequestURI(); err == nil {
+		ctx.tried[requestURI.String()] = true
+	}
+	p.forkNext(ctx)
+}
+
+// routeToForkHops fork the out-of-dialog request without Route header to the next hops
+// of its configured route, true is returned if the route has more than one next hop
+func (p *Proxy) routeToForkHops(protocol string, msg *Message) bool {
+	if _, err := msg.GetHeader("Route"); err == nil || !isOutOfDialogRequest(msg) {
+		return false
+	}
+	to, err := msg.GetTo()
+	if err != nil {
+		return false
+	}
+	destHost, err := to.GetHost()
+	if err != nil {
+		return false
+	}
+	item, ok := p.preConfigRoute.FindForkRoute(destHost)
+	if !ok {
+		return false
+	}
+	targets := make([][]forkTarget, 0, len(item.nextHops))
+	for _, nextHop := range item.nextHops {
+		hop, err := NewPreRouteItem(item.protocol, item.dest, nextHop)
+		if err != nil {
+			continue
+		}
+		target := forkTarget{host: hop.host, port: hop.port, transport: hop.protocol}
+		if item.fork == forkSequential || len(targets) == 0 {
+			targets = append(targets, []forkTarget{target})
+		} else {
+			targets[0] = append(targets[0], target)
+		}
+	}
+	callId, _ := msg.GetCallID()
+	zap.L().Info("fork the request to the next hops", zap.String("fork", item.fork), zap.Strings("nexthops", item.nextHops), zap.String("call-id", callId))
+	p.forkRequest(protocol, msg, targets, item.branchTimeout)
+	return true
+}
+
+// forkNext send the request to the next group of targets, the groups which can't be
+// reached are skipped. The best final response is relayed if no target is left
+func (p *Proxy) forkNext(ctx *forkContext) {
+	if ctx.branchTimer != nil {
+		ctx.branchTimer.Stop()
+		ctx.branchTimer = nil
+	}
+	for len(ctx.pending) > 0 && !ctx.answered {
+		group := ctx.pending[0]
+		ctx.pending = ctx.pending[1:]
+		ctx.step++
+		for _, target := range group {
+			if err := p.sendForkBranch(ctx, target); err != nil {
+				callId, _ := ctx.request.GetCallID()
+				zap.L().Error("Fail to send the request to the target", zap.String("target", target.String()), zap.String("error", err.Error()), zap.String("call-id", callId))
+				p.updateForkResponse(ctx, NewResponseOf(ctx.request, 503, "Service Unavailable"))
+			}
+		}
+		if len(ctx.branches) > 0 {
+			if len(ctx.pending) > 0 && ctx.branchTimeout > 0 {
+				step := ctx.step
+				ctx.branchTimer = time.AfterFunc(ctx.branchTimeout, func() {
+					p.postTask(ctx.request, func() {
+						p.forkOnBranchTimeout(ctx, step)
+					})
+				})
+			}
+			return
+		}
+	}
+	if len(ctx.branches) == 0 {
+		p.finishFork(ctx)
+	}
+}
+
+// forkOnBranchTimeout cancel the branches of the group which are not answered in time
+// and try the next group
+func (p *Proxy) forkOnBranchTimeout(ctx *forkContext, step int) {
+	if ctx.answered || step != ctx.step {
+		return
+	}
+	callId, _ := ctx.request.GetCallID()
+	zap.L().Info("no final response in the branch timeout, try the next targets", zap.Duration("branch-timeout", ctx.branchTimeout), zap.String("call-id", callId))
+	for branch := range ctx.branches {
+		ctx.expired[branch] = true
+	}
+	p.cancelInviteBranches(ctx.serverTransId)
+	p.forkNext(ctx)
+}
+
+// stopForking not try the pending targets of the request anymore
+func (p *Proxy) stopForking(ctx *forkContext) {
+	ctx.stopped = true
+	ctx.pending = nil
+	if ctx.branchTimer != nil {
+		ctx.branchTimer.Stop()
+		ctx.branchTimer = nil
+	}
+}
+
+// stopForkingCancelled not try the pending targets of the request cancelled by upstream
+func (p *Proxy) stopForkingCancelled(serverTransId string) {
+	p.invitesLock.Lock()
+	branches := slices.Clone(p.invites[serverTransId])
+	p.invitesLock.Unlock()
+	p.forksLock.Lock()
+	defer p.forksLock.Unlock()
+	for _, branch := range branches {
+		if ctx, ok := p.forkBranches[branch]; ok {
+			p.stopForking(ctx)
+		}
+	}
+}
+
+// sendForkBranch send the clone of the request to the target statefully
+func (p *Proxy) sendForkBranch(ctx *forkContext, target forkTarget) error {
+	host, port, transport := target.host, target.port, target.transport
+	if host == "" {
+		sipUri, err := target.requestURI.GetSIPURI()
+		if err != nil {
+			return err
+		}
+		host = sipUri.Host
+		if sipUri.HasPort() {
+			port = sipUri.GetPort()
+		}
+		if sipUri.HasTransport() || sipUri.Scheme == "sips" {
+			transport = sipUri.GetTransport()
+		}
+	}
+	serverTrans, ok := p.selfLearnRoute.GetRoute(host, ctx.protocol)
+	if !ok {
+		var err error
+		if serverTrans, err = p.findTransportByBackendAddr(host, ctx.protocol); err != nil {
+			return err
+		}
+	}
+	msg := ctx.request.Clone()
+	if target.requestURI != nil {
+		msg.SetRequestURI(target.requestURI)
+		ctx.tried[target.requestURI.String()] = true
+	}
+	p.addVia(msg, serverTrans)
+	p.addRecordRoute(msg, serverTrans)
+	branch, err := msg.GetTopViaBranch()
+	if err != nil {
+		return err
+	}
+	if servers, ok := sipServerLocator.LocateCached(host, port, transport); ok {
+		return p.sendForkBranchToServers(ctx, msg, branch, servers)
+	}
+	// the branch is pending until the servers are located in background
+	p.addForkBranch(ctx, branch)
+	go func() {
+		servers := sipServerLocator.Locate(host, port, transport)
+		p.postTask(ctx.request, func() {
+			if ctx.stopped {
+				p.forkBranchFailed(ctx, branch, NewResponseOf(ctx.request, 487, "Request Terminated"))
+			} else if err := p.sendForkBranchToServers(ctx, msg, branch, servers); err != nil {
+				callId, _ := ctx.request.GetCallID()
+				zap.L().Error("Fail to send the request to the target", zap.String("target", target.String()), zap.String("error", err.Error()), zap.String("call-id", callId))
+				p.forkBranchFailed(ctx, branch, NewResponseOf(ctx.request, 503, "Service Unavailable"))
+			}
+		})
+	}()
+	return nil
+}
+
+func (t forkTarget) String() string {
+	if t.requestURI != nil {
+		return t.requestURI.String()
+	}
+	if t.port > 0 {
+		return fmt.Sprintf("%s:%d", t.host, t.port)
+	}
+	return t.host
+}
+
+// sendForkBranchToServers send the branch to the first server which can be reached, the
+// request is retried on the other servers if the server fails it
+func (p *Proxy) sendForkBranchToServers(ctx *forkContext, msg *Message, branch string, servers []ServerTarget) error {
+	send, server, others, err := p.sendToServers(msg, servers)
+	if err != nil {
+		return err
+	}
+	p.addForkBranch(ctx, branch)
+	p.addClientTransaction(msg, !strings.EqualFold(server.Protocol, "udp"), send)
+	p.addServerFailover(msg, others, ctx)
+	return nil
+}
+
+func (p *Proxy) addForkBranch(ctx *forkContext, branch string) {
+	ctx.branches[branch] = true
+	p.forksLock.Lock()
+	defer p.forksLock.Unlock()
+	p.forkBranches[branch] = ctx
+}
+
+// replaceForkBranch replace the branch retried on the next server with its new branch
+func (p *Proxy) replaceForkBranch(ctx *forkContext, branch string, newBranch string) {
+	p.removeForkBranch(ctx, branch)
+	p.addForkBranch(ctx, newBranch)
+}
+
+// forkBranchFailed finish the branch which is not sent with the response generated by
+// the proxy, and try the next targets if all the branches are finished
+func (p *Proxy) forkBranchFailed(ctx *forkContext, branch string, response *Message) {
+	p.removeForkBranch(ctx, branch)
+	p.updateForkResponse(ctx, response)
+	if len(ctx.branches) == 0 {
+		p.forkNext(ctx)
+	}
+}
+
+// findForkBranch find the fork context of the request or response by its top Via branch
+func (p *Proxy) findForkBranch(msg *Message) (*forkContext, string, bool) {
+	branch, err := msg.GetTopViaBranch()
+	if err != nil {
+		return nil, "", false
+	}
+	p.forksLock.Lock()
+	defer p.forksLock.Unlock()
+	ctx, ok := p.forkBranches[branch]
+	return ctx, branch, ok
+}
+
+// forkOnResponse relay the response of a forked request, the provisional and 2xx
+// responses are relayed immediately and the best of the other final responses is relayed
+// after all the targets are tried. The next group of targets is tried after the branches
+// of the current group are finished without 2xx or 6xx. True is returned if the response
+// is processed
+func (p *Proxy) forkOnResponse(msg *Message) bool {
+	ctx, branch, ok := p.findForkBranch(msg)
+	if !ok {
+		return false
+	}
+	statusCode := msg.response.statusCode
+	switch {
+	case statusCode < 200:
+		if statusCode > 100 && !ctx.answered && !p.isInviteCancelled(branch) {
+			msg.PopVia()
+			p.sendProxyResponse(msg)
+		}
+	case statusCode < 300:
+		p.removeForkBranch(ctx, branch)
+		msg.PopVia()
+		p.sendProxyResponse(msg)
+		if !ctx.answered {
+			ctx.answered = true
+			p.stopForking(ctx)
+			p.cancelInviteBranches(ctx.serverTransId)
+		}
+	default:
+		expired := ctx.expired[branch]
+		p.removeForkBranch(ctx, branch)
+		msg.PopVia()
+		if expired && statusCode == 487 {
+			// the branch is cancelled by the proxy instead of upstream
+			p.updateForkResponse(ctx, NewResponseOf(ctx.request, 408, "Request Timeout"))
+		} else {
+			p.updateForkResponse(ctx, msg)
+		}
+		if statusCode >= 600 {
+			// no other target is tried after the 6xx, see RFC 3261 16.7 step 5
+			p.stopForking(ctx)
+			p.cancelInviteBranches(ctx.serverTransId)
+		}
+	}
+	if len(ctx.branches) == 0 {
+		p.forkNext(ctx)
+	}
+	return true
+}
+
+// forkOnTimeout finish the branch without final response with 408, true is returned if
+// the request is a forked request
+func (p *Proxy) forkOnTimeout(request *Message) bool {
+	ctx, branch, ok := p.findForkBranch(request)
+	if !ok {
+		return false
+	}
+	p.removeForkBranch(ctx, branch)
+	response := NewResponseOf(request, 408, "Request Timeout")
+	response.PopVia()
+	p.updateForkResponse(ctx, response)
+	if len(ctx.branches) == 0 {
+		p.forkNext(ctx)
+	}
+	return true
+}
+
+// updateForkResponse keep the best final response of the branches
+func (p *Proxy) updateForkResponse(ctx *forkContext, response *Message) {
+	if ctx.bestResponse == nil || forkResponseRank(response.response.statusCode) < forkResponseRank(ctx.bestResponse.response.statusCode) {
+		ctx.bestResponse = response
+	}
+}
+
+func (p *Proxy) removeForkBranch(ctx *forkContext, branch string) {
+	delete(ctx.branches, branch)
+	delete(ctx.expired, branch)
+	p.forksLock.Lock()
+	defer p.forksLock.Unlock()
+	delete(p.forkBranches, branch)
+}
+
+// finishFork relay the best final response if no 2xx is relayed
+func (p *Proxy) finishFork(ctx *forkContext) {
+	if ctx.answered || ctx.bestResponse == nil {
+		return
+	}
+	ctx.answered = true
+	response := ctx.bestResponse
+	// the 503 is not relayed to avoid the upstream retrying other servers, see RFC 3261 16.7 step 6
+	if response.response.statusCode == 503 {
+		response.response = &StatusLine{version: response.response.version, statusCode: 500, reason: "Server Internal Error"}
+	}
+	p.sendProxyResponse(response)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func createForkTestProxy(t *testing.T, proxyPort int, fork string, branchTimeout time.Duration, nextHopPorts ...int) *Proxy {
+	nextHops := make([]string, 0)
+	for _, port := range nextHopPorts {
+		nextHops = append(nextHops, "127.0.0.1:"+strconv.Itoa(port))
+	}
+	route := NewPreConfigRoute()
+	if err := route.AddForkRouteItem("udp", "test.com", nextHops, fork, branchTimeout); err != nil {
+		t.Fatal(err)
+	}
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: proxyPort}}
+	proxy := NewProxy("test.com", 60, listens, true, route, NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+func receiveTestMethod(t *testing.T, received chan *Message, timeout time.Duration) string {
+	select {
+	case msg := <-received:
+		if !msg.IsRequest() {
+			return strconv.Itoa(msg.response.statusCode)
+		}
+		method, _ := msg.GetMethod()
+		return method
+	case <-time.After(timeout):
+		t.Fatalf("nothing is received in %v", timeout)
+	}
+	return ""
+}
+
+func TestForkInviteInParallel(t *testing.T) {
+	ringing := startTestRingingBackend(t, 16186, 16185, 0)
+	answered := startTestBackend(t, 16187, 16185, 200, "OK")
+	createForkTestProxy(t, 16185, forkParallel, 0, 16186, 16187)
+
+	responses := sendTestInviteAndCancel(t, 16185, 0)
+	if last := responses[len(responses)-1]; last.response.statusCode != 200 {
+		t.Fatalf("expect 200 from the answered branch but get %d", last.response.statusCode)
+	}
+	if method := receiveTestMethod(t, answered, 2*time.Second); method != "INVITE" {
+		t.Errorf("expect INVITE but get %s", method)
+	}
+	for _, expected := range []string{"INVITE", "180", "CANCEL"} {
+		if method := receiveTestMethod(t, ringing, 2*time.Second); method != expected {
+			t.Errorf("expect %s in the ringing branch but get %s", expected, method)
+		}
+	}
+}
+
+func TestForkInviteSequentiallyWithBranchTimeout(t *testing.T) {
+	ringing := startTestRingingBackend(t, 16189, 16188, 0)
+	busy := startTestBackend(t, 16190, 16188, 486, "Busy Here")
+	answered := startTestBackend(t, 16191, 16188, 200, "OK")
+	createForkTestProxy(t, 16188, forkSequential, 300*time.Millisecond, 16189, 16190, 16191)
+
+	start := time.Now()
+	responses := sendTestInviteAndCancel(t, 16188, 0)
+	if last := responses[len(responses)-1]; last.response.statusCode != 200 {
+		t.Fatalf("expect 200 from the last next hop but get %d", last.response.statusCode)
+	}
+	if findTestResponse(responses, "INVITE", 486) >= 0 || findTestResponse(responses, "INVITE", 408) >= 0 {
+		t.Errorf("the final response of the failed branch is relayed")
+	}
+	for _, expected := range []string{"INVITE", "180", "CANCEL"} {
+		if method := receiveTestMethod(t, ringing, 2*time.Second); method != expected {
+			t.Errorf("expect %s in the first branch but get %s", expected, method)
+		}
+	}
+	receiveTestMethod(t, busy, 2*time.Second)
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("the next hop is tried before the branch timeout: %v", elapsed)
+	}
+	receiveTestMethod(t, answered, 2*time.Second)
+}
+
+func TestForkStopsOnGlobalFailure(t *testing.T) {
+	startTestBackend(t, 16193, 16192, 603, "Decline")
+	notTried := startTestBackend(t, 16194, 16192, 200, "OK")
+	createForkTestProxy(t, 16192, forkSequential, 0, 16193, 16194)
+
+	responses := sendTestInviteAndCancel(t, 16192, 0)
+	if last := responses[len(responses)-1]; last.response.statusCode != 603 {
+		t.Fatalf("expect 603 but get %d", last.response.statusCode)
+	}
+	select {
+	case msg := <-notTried:
+		method, _ := msg.GetMethod()
+		t.Errorf("the %s is sent to the next hop after 6xx", method)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
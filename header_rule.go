@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	headerRuleRequest  = "request"
+	headerRuleResponse = "response"
+	headerRuleBoth     = "both"
+
+	headerActionAdd     = "add"
+	headerActionRemove  = "remove"
+	headerActionReplace = "replace"
+	headerActionRewrite = "rewrite"
+
+	// the pseudo header name of the Request-URI in the header actions
+	requestURIHeader = "request-uri"
+)
+
+// HeaderRules is the header manipulation rules of a proxy or listener, the rules of the
+// listener are applied after the rules of its proxy. They are updated in place on reload
+type HeaderRules struct {
+	sync.Mutex
+	rules []*headerRule
+}
+
+// headerRule change the headers of the messages matched by all its conditions
+type headerRule struct {
+	name      string
+	direction string
+	// the methods in upper case, all the methods are matched if it is empty
+	methods []string
+	sources []*net.IPNet
+	headers []headerMatch
+	actions []*headerAction
+}
+
+// headerMatch is matched if any value of the header is matched by the pattern
+type headerMatch struct {
+	header  string
+	pattern *regexp.Regexp
+}
+
+type headerAction struct {
+	action  string
+	header  string
+	value   string
+	pattern *regexp.Regexp
+}
+
+func NewHeaderRules() *HeaderRules {
+	return &HeaderRules{}
+}
+
+// Update replace all the rules, no header is changed if configs is empty
+func (h *HeaderRules) Update(configs []HeaderRuleConfig) error {
+	rules := make([]*headerRule, 0, len(configs))
+	for _, config := range configs {
+		rule, err := compileHeaderRule(config)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.rules = rules
+	return nil
+}
+
+// Apply change the headers of the message received from the source address with the
+// matched rules in order
+func (h *HeaderRules) Apply(msg *Message, source string) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	rules := h.rules
+	h.Unlock()
+	for _, rule := range rules {
+		if !rule.match(msg, source) {
+			continue
+		}
+		callId, _ := msg.GetCallID()
+		zap.L().Debug("apply header rule", zap.String("rule", rule.name), zap.String("call-id", callId))
+		for _, action := range rule.actions {
+			action.apply(msg)
+		}
+	}
+}
+
+func compileHeaderRule(config HeaderRuleConfig) (*headerRule, error) {
+	direction, err := parseHeaderRuleDirection(config.Direction)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := parseIPNets(config.Sources)
+	if err != nil {
+		return nil, err
+	}
+	rule := &headerRule{name: config.Name, direction: direction, sources: sources}
+	for _, method := range config.Methods {
+		rule.methods = append(rule.methods, strings.ToUpper(method))
+	}
+	for header, s := range config.Headers {
+		pattern, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s of header %s: %v", s, header, err)
+		}
+		rule.headers = append(rule.headers, headerMatch{header: header, pattern: pattern})
+	}
+	if len(config.Actions) == 0 {
+		return nil, fmt.Errorf("no actions in header rule %s", config.Name)
+	}
+	for _, actionConfig := range config.Actions {
+		action, err := compileHeaderAction(actionConfig)
+		if err != nil {
+			return nil, err
+		}
+		rule.actions = append(rule.actions, action)
+	}
+	return rule, nil
+}
+
+// parseHeaderRuleDirection get the direction of the rule, the rule is applied to the
+// requests only by default
+func parseHeaderRuleDirection(s string) (string, error) {
+	switch direction := strings.ToLower(s); direction {
+	case "":
+		return headerRuleRequest, nil
+	case headerRuleRequest, headerRuleResponse, headerRuleBoth:
+		return direction, nil
+	}
+	return "", fmt.Errorf("invalid direction %s, expect %s, %s or %s", s, headerRuleRequest, headerRuleResponse, headerRuleBoth)
+}
+
+func compileHeaderAction(config HeaderActionConfig) (*headerAction, error) {
+	action := &headerAction{action: strings.ToLower(config.Action), header: config.Header, value: config.Value}
+	if config.Header == "" {
+		return nil, fmt.Errorf("no header in %s action", config.Action)
+	}
+	isRequestURI := strings.EqualFold(config.Header, requestURIHeader)
+	switch action.action {
+	case headerActionAdd, headerActionRemove:
+		if isRequestURI {
+			return nil, fmt.Errorf("the %s can't be %sed", requestURIHeader, action.action)
+		}
+	case headerActionReplace:
+	case headerActionRewrite:
+		pattern, err := regexp.Compile(config.Pattern)
+		if err != nil || config.Pattern == "" {
+			return nil, fmt.Errorf("invalid pattern %s of rewrite: %v", config.Pattern, err)
+		}
+		action.pattern = pattern
+	default:
+		return nil, fmt.Errorf("invalid action %s, expect %s, %s, %s or %s", config.Action, headerActionAdd, headerActionRemove, headerActionReplace, headerActionRewrite)
+	}
+	if (action.action == headerActionAdd || action.action == headerActionReplace) && config.Value == "" {
+		return nil, fmt.Errorf("no value in %s action of %s", action.action, config.Header)
+	}
+	if isRequestURI && action.action == headerActionReplace {
+		if _, err := ParseAddrSpec(config.Value); err != nil {
+			return nil, fmt.Errorf("invalid %s %s: %v", requestURIHeader, config.Value, err)
+		}
+	}
+	return action, nil
+}
+
+func (r *headerRule) match(msg *Message, source string) bool {
+	if (r.direction == headerRuleRequest && !msg.IsRequest()) || (r.direction == headerRuleResponse && msg.IsRequest()) {
+		return false
+	}
+	if len(r.methods) > 0 {
+		method, err := msg.GetMethod()
+		if err != nil || !slices.Contains(r.methods, strings.ToUpper(method)) {
+			return false
+		}
+	}
+	if len(r.sources) > 0 && !containsNetIP(r.sources, net.ParseIP(strings.Trim(source, "[]"))) {
+		return false
+	}
+	for _, headerMatch := range r.headers {
+		if !slices.ContainsFunc(getHeaderStrings(msg, headerMatch.header), headerMatch.pattern.MatchString) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *headerAction) apply(msg *Message) {
+	if strings.EqualFold(a.header, requestURIHeader) {
+		a.applyRequestURI(msg)
+		return
+	}
+	switch a.action {
+	case headerActionAdd:
+		msg.AddHeader(a.header, a.value)
+	case headerActionRemove:
+		removeAllHeaders(msg, a.header)
+	case headerActionReplace:
+		removeAllHeaders(msg, a.header)
+		msg.AddHeader(a.header, a.value)
+	case headerActionRewrite:
+		values := getHeaderStrings(msg, a.header)
+		removeAllHeaders(msg, a.header)
+		for _, value := range values {
+			msg.AddHeader(a.header, a.pattern.ReplaceAllString(value, a.value))
+		}
+	}
+}
+
+// applyRequestURI replace or rewrite the Request-URI of the request, the Request-URI is
+// not changed if the result is not a valid URI
+func (a *headerAction) applyRequestURI(msg *Message) {
+	requestURI, err := msg.GetRequestURI()
+	if err != nil {
+		return
+	}
+	value := a.value
+	if a.action == headerActionRewrite {
+		value = a.pattern.ReplaceAllString(requestURI.String(), a.value)
+	}
+	addrSpec, err := ParseAddrSpec(value)
+	if err != nil {
+		callId, _ := msg.GetCallID()
+		zap.L().Error("Fail to change the Request-URI", zap.String("value", value), zap.String("call-id", callId))
+		return
+	}
+	msg.SetRequestURI(addrSpec)
+}
+
+// getHeaderStrings get all the values of the header in the order of the message
+func getHeaderStrings(msg *Message, name string) []string {
+	r := make([]string, 0)
+	for _, header := range msg.headers {
+		if !msg.isSameHeader(header.name, name) {
+			continue
+		}
+		if s, ok := header.value.(fmt.Stringer); ok {
+			r = append(r, s.String())
+		} else {
+			r = append(r, fmt.Sprint(header.value))
+		}
+	}
+	return r
+}
+
+func removeAllHeaders(msg *Message, name string) {
+	for {
+		if _, err := msg.RemoveHeader(name); err != nil {
+			return
+		}
+	}
+}
+
+// SetHeaderRules update the header manipulation rules applied to all the messages
+// received by the proxy
+func (p *Proxy) SetHeaderRules(configs []HeaderRuleConfig) error {
+	if err := p.headerRules.Update(configs); err != nil {
+		zap.L().Error("Invalid header rules of proxy", zap.String("name", p.name), zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// applyHeaderRules change the headers of the received message with the rules of the
+// proxy and then the rules of the listener receiving it
+func (p *Proxy) applyHeaderRules(msg *Message, peerAddr string) {
+	p.headerRules.Apply(msg, peerAddr)
+	if msg.ReceivedFrom == nil {
+		return
+	}
+	if item := p.findProxyItem(msg.ReceivedFrom); item != nil {
+		item.headerRules.Apply(msg, peerAddr)
+	}
+}
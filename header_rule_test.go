@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func createTestHeaderRuleInvite() *Message {
+	s := `INVITE sip:bob@biloxi.example.com SIP/2.0
+Via: SIP/2.0/UDP client.atlanta.example.com:5060;branch=z9hG4bK74bf9
+Max-Forwards: 70
+From: Alice <sip:alice@atlanta.example.com>;tag=9fxced76sl
+To: Bob <sip:bob@biloxi.example.com>
+Call-ID: 3848276298220188511@atlanta.example.com
+CSeq: 1 INVITE
+P-Asserted-Identity: <sip:alice@atlanta.example.com>
+User-Agent: Legacy/1.0
+Content-Length: 0
+
+`
+	msg, _ := ParseMessage(create_reader_from_string(s))
+	return msg
+}
+
+func TestHeaderRulesApply(t *testing.T) {
+	rules := NewHeaderRules()
+	err := rules.Update([]HeaderRuleConfig{{Name: "untrusted",
+		Methods: []string{"invite"},
+		Sources: []string{"10.0.0.0/8"},
+		Actions: []HeaderActionConfig{{Action: "remove", Header: "P-Asserted-Identity"}}},
+		{Name: "legacy",
+			Headers: map[string]string{"User-Agent": "^Legacy/"},
+			Actions: []HeaderActionConfig{{Action: "remove", Header: "User-Agent"},
+				{Action: "add", Header: "P-Charging-Vector", Value: "icid-value=1234"},
+				{Action: "rewrite", Header: "From", Pattern: "@atlanta\\.example\\.com", Value: "@example.com"},
+				{Action: "rewrite", Header: "request-uri", Pattern: "^sip:(\\w+)@.*$", Value: "sip:$1@10.0.0.1:5060"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := createTestHeaderRuleInvite()
+	rules.Apply(msg, "192.168.0.1")
+	if _, err := msg.GetHeader("P-Asserted-Identity"); err != nil {
+		t.Errorf("the header is removed for the source not matched")
+	}
+	if _, err := msg.GetHeader("User-Agent"); err == nil {
+		t.Errorf("the User-Agent is not removed")
+	}
+	if values := getHeaderStrings(msg, "P-Charging-Vector"); len(values) != 1 || values[0] != "icid-value=1234" {
+		t.Errorf("wrong P-Charging-Vector %v", values)
+	}
+	if from, _ := msg.GetFrom(); from.String() != "Alice <sip:alice@example.com>;tag=9fxced76sl" {
+		t.Errorf("wrong From %s", from)
+	}
+	if requestURI, _ := msg.GetRequestURI(); requestURI.String() != "sip:bob@10.0.0.1:5060" {
+		t.Errorf("wrong Request-URI %s", requestURI)
+	}
+
+	msg = createTestHeaderRuleInvite()
+	rules.Apply(msg, "10.1.2.3")
+	if _, err := msg.GetHeader("P-Asserted-Identity"); err == nil {
+		t.Errorf("the P-Asserted-Identity of the untrusted source is not removed")
+	}
+	// the legacy rule is not applied to the response
+	rules.Apply(NewResponseOf(msg, 200, "OK"), "10.1.2.3")
+	if len(getHeaderStrings(msg, "P-Charging-Vector")) != 1 {
+		t.Errorf("the request rule is applied to the response")
+	}
+}
+
+func TestHeaderRulesApplyToResponse(t *testing.T) {
+	rules := NewHeaderRules()
+	if err := rules.Update([]HeaderRuleConfig{{Direction: "response",
+		Actions: []HeaderActionConfig{{Action: "replace", Header: "Server", Value: "sipproxy"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	response := NewResponseOf(createTestHeaderRuleInvite(), 200, "OK")
+	response.AddHeader("Server", "Backend/2.0")
+	response.AddHeader("Server", "Backend/2.1")
+	rules.Apply(response, "10.0.0.1")
+	if values := getHeaderStrings(response, "Server"); len(values) != 1 || values[0] != "sipproxy" {
+		t.Errorf("wrong Server %v", values)
+	}
+	if err := rules.Update([]HeaderRuleConfig{{Actions: []HeaderActionConfig{{Action: "add", Header: "request-uri", Value: "sip:bob@test.com"}}}}); err == nil {
+		t.Errorf("the Request-URI is added")
+	}
+}
+
+func TestProxyAppliesHeaderRules(t *testing.T) {
+	received := startTestBackend(t, 16207, 16206, 200, "OK")
+	route := NewPreConfigRoute()
+	route.AddRouteItem("udp", "test.com", "127.0.0.1:16207")
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16206,
+		HeaderRules: []HeaderRuleConfig{{Actions: []HeaderActionConfig{{Action: "remove", Header: "User-Agent"}}}}}}
+	proxy := NewProxy("test.com", 60, listens, true, route, NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	err := proxy.SetHeaderRules([]HeaderRuleConfig{{Direction: "both",
+		Actions: []HeaderActionConfig{{Action: "add", Header: "P-Charging-Vector", Value: "icid-value=1"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	response := sendTestRequest(t, 16206, "OPTIONS sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%d;branch=z9hG4bK776asdhr1\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301830\r\nTo: <sip:bob@test.com>\r\nCall-ID: a84b4c76e66730@test.com\r\nCSeq: 1 OPTIONS\r\nUser-Agent: Legacy/1.0\r\nContent-Length: 0\r\n\r\n")
+	if response.response.statusCode != 200 {
+		t.Fatalf("expect 200 but get %d", response.response.statusCode)
+	}
+	if _, err := response.GetHeader("P-Charging-Vector"); err != nil {
+		t.Errorf("the rule of the proxy is not applied to the response")
+	}
+	select {
+	case msg := <-received:
+		if _, err := msg.GetHeader("User-Agent"); err == nil {
+			t.Errorf("the rule of the listener is not applied to the request")
+		}
+		if values := getHeaderStrings(msg, "P-Charging-Vector"); len(values) != 1 {
+			t.Errorf("the rule of the proxy is not applied to the request: %v", values)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the request is not forwarded")
+	}
+}
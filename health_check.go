@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HealthChecker probe the backends of a RoundRobinBackend with SIP OPTIONS. A backend
+// is taken out of rotation after downThreshold consecutive failed probes, and put
+// back after upThreshold consecutive successful probes
+type HealthChecker struct {
+	sync.Mutex
+	backend       *RoundRobinBackend
+	interval      time.Duration
+	timeout       time.Duration
+	upThreshold   int
+	downThreshold int
+	// the status codes of the probe response counted as failure, any 5xx and 408 if empty
+	failureCodes []int
+	// find the transport whose address is used in the Via of the probes, the responses
+	// of the probes are received by it
+	findTransport func(cond func(serverTransport ServerTransport) bool) (ServerTransport, error)
+	cseq          int
+	// the probes waiting for response, the key is the branch of the probe
+	probes map[string]*healthProbe
+	// the health of the backends, the key is the address of backend
+	states map[string]*backendHealth
+	stop   chan struct{}
+}
+
+type healthProbe struct {
+	address string
+	timer   *time.Timer
+}
+
+type backendHealth struct {
+	up        bool
+	successes int
+	failures  int
+	since     time.Time
+	lastError string
+}
+
+// BackendHealthInfo is the health of a backend for the admin API
+type BackendHealthInfo struct {
+	Address   string    `json:"address"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last-error,omitempty"`
+}
+
+func NewHealthChecker(backend *RoundRobinBackend,
+	config *HealthCheckConfig,
+	findTransport func(cond func(serverTransport ServerTransport) bool) (ServerTransport, error)) *HealthChecker {
+	interval, timeout, upThreshold, downThreshold := config.Interval, config.Timeout, config.UpThreshold, config.DownThreshold
+	if interval <= 0 {
+		interval = 30
+	}
+	if timeout <= 0 {
+		timeout = 5
+	}
+	if upThreshold <= 0 {
+		upThreshold = 2
+	}
+	if downThreshold <= 0 {
+		downThreshold = 3
+	}
+	return &HealthChecker{backend: backend,
+		interval:      time.Duration(interval) * time.Second,
+		timeout:       time.Duration(timeout) * time.Second,
+		upThreshold:   upThreshold,
+		downThreshold: downThreshold,
+		failureCodes:  config.FailureCodes,
+		findTransport: findTransport,
+		cseq:          0,
+		probes:        make(map[string]*healthProbe),
+		states:        make(map[string]*backendHealth),
+		stop:          make(chan struct{})}
+}
+
+// Start probe the backends periodically in background
+func (h *HealthChecker) Start() {
+	zap.L().Info("start health check of backends", zap.String("backend", h.backend.GetAddress()), zap.Duration("interval", h.interval), zap.Duration("timeout", h.timeout))
+	go func() {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			h.probeAll()
+			select {
+			case <-ticker.C:
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (h *HealthChecker) Stop() {
+	close(h.stop)
+}
+
+func (h *HealthChecker) probeAll() {
+	for address, backend := range h.backend.GetAllBackend() {
+		h.probe(address, backend)
+	}
+}
+
+func (h *HealthChecker) probe(address string, backend Backend) {
+	msg, err := h.createProbe(address)
+	if err != nil {
+		zap.L().Error("Fail to create OPTIONS for health check", zap.String("backend", address), zap.String("error", err.Error()))
+		return
+	}
+	branch, _ := msg.GetTopViaBranch()
+	h.Lock()
+	h.probes[branch] = &healthProbe{address: address, timer: time.AfterFunc(h.timeout, func() {
+		h.probeFinished(branch, fmt.Errorf("no response in %v", h.timeout))
+	})}
+	h.Unlock()
+	if _, err := backend.Send(msg); err != nil {
+		h.probeFinished(branch, err)
+	}
+}
+
+func (h *HealthChecker) createProbe(address string) (*Message, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := NewRequest("OPTIONS", "sip:"+u.Host, "SIP/2.0")
+	if err != nil {
+		return nil, err
+	}
+	transport, err := h.findTransport(func(t ServerTransport) bool {
+		return t.GetProtocol() == u.Scheme && !t.IsExit()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no %s transport to send OPTIONS to %s", u.Scheme, address)
+	}
+	via, err := CreateVia(transport.GetProtocol(), transport.GetAddress(), transport.GetPort())
+	if err != nil {
+		return nil, err
+	}
+	tag, _ := CreateTag()
+	callId, _ := CreateTag()
+	h.Lock()
+	h.cseq++
+	cseq := h.cseq
+	h.Unlock()
+	msg.AddVia(via)
+	msg.AddHeader("Max-Forwards", "70")
+	msg.AddHeader("From", fmt.Sprintf("<sip:sipproxy@%s>;tag=%s", transport.GetAddress(), tag))
+	msg.AddHeader("To", fmt.Sprintf("<sip:%s>", u.Host))
+	msg.AddHeader("Call-ID", fmt.Sprintf("%s@%s", callId, transport.GetAddress()))
+	msg.AddHeader("CSeq", fmt.Sprintf("%d OPTIONS", cseq))
+	return msg, nil
+}
+
+// HandleResponse return true if the response is the response of a probe
+func (h *HealthChecker) HandleResponse(msg *Message) bool {
+	branch, err := msg.GetTopViaBranch()
+	if err != nil {
+		return false
+	}
+	h.Lock()
+	_, ok := h.probes[branch]
+	h.Unlock()
+	if !ok {
+		return false
+	}
+	if !msg.IsFinalResponse() {
+		return true
+	}
+	if h.isFailureCode(msg.response.statusCode) {
+		h.probeFinished(branch, fmt.Errorf("%d %s", msg.response.statusCode, msg.response.reason))
+	} else {
+		h.probeFinished(branch, nil)
+	}
+	return true
+}
+
+// isFailureCode check if the probe fails with the status code of the final response
+func (h *HealthChecker) isFailureCode(statusCode int) bool {
+	if len(h.failureCodes) == 0 {
+		return statusCode == 408 || (statusCode >= 500 && statusCode < 600)
+	}
+	return slices.Contains(h.failureCodes, statusCode)
+}
+
+func (h *HealthChecker) probeFinished(branch string, err error) {
+	h.Lock()
+	defer h.Unlock()
+	probe, ok := h.probes[branch]
+	if !ok {
+		return
+	}
+	delete(h.probes, branch)
+	probe.timer.Stop()
+
+	state, ok := h.states[probe.address]
+	if !ok {
+		state = &backendHealth{up: true, since: time.Now()}
+		h.states[probe.address] = state
+	}
+	if err == nil {
+		state.successes++
+		state.failures = 0
+		if !state.up && state.successes >= h.upThreshold {
+			state.up = true
+			state.since = time.Now()
+			zap.L().Info("backend is up", zap.String("backend", probe.address), zap.Int("successes", state.successes))
+			h.backend.SetBackendUp(probe.address, true)
+		}
+	} else {
+		state.failures++
+		state.successes = 0
+		state.lastError = err.Error()
+		zap.L().Warn("health check of backend fails", zap.String("backend", probe.address), zap.Int("failures", state.failures), zap.String("error", err.Error()))
+		if state.up && state.failures >= h.downThreshold {
+			state.up = false
+			state.since = time.Now()
+			zap.L().Error("backend is down", zap.String("backend", probe.address), zap.Int("failures", state.failures))
+			h.backend.SetBackendUp(probe.address, false)
+		}
+	}
+}
+
+// GetHealthInfos get the health of the probed backends
+func (h *HealthChecker) GetHealthInfos() []BackendHealthInfo {
+	h.Lock()
+	defer h.Unlock()
+	r := make([]BackendHealthInfo, 0)
+	for address, state := range h.states {
+		info := BackendHealthInfo{Address: address, State: "up", Since: state.since, LastError: state.lastError}
+		if !state.up {
+			info.State = "down"
+		}
+		r = append(r, info)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Address < r[j].Address
+	})
+	return r
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type probedBackend struct {
+	messageRecorder
+	address string
+}
+
+func (b *probedBackend) Send(msg *Message) (Backend, error) {
+	b.send(msg)
+	return b, nil
+}
+
+func (b *probedBackend) GetAddress() string {
+	return b.address
+}
+
+func (b *probedBackend) Close() {
+}
+
+func createTestHealthChecker(backend Backend) (*HealthChecker, *RoundRobinBackend) {
+	rb := NewRoundRobinBackend()
+	rb.AddBackend(backend)
+	transport := NewTCPServerTransport("127.0.0.1", 5060, false, nil, nil, nil, rb)
+	checker := NewHealthChecker(rb, &HealthCheckConfig{UpThreshold: 1, DownThreshold: 2}, func(cond func(serverTransport ServerTransport) bool) (ServerTransport, error) {
+		return transport, nil
+	})
+	checker.timeout = 20 * time.Millisecond
+	return checker, rb
+}
+
+func TestHealthCheckTakeBackendOutOfRotation(t *testing.T) {
+	backend := &probedBackend{address: "tcp://127.0.0.1:5070"}
+	checker, rb := createTestHealthChecker(backend)
+
+	checker.probeAll()
+	time.Sleep(50 * time.Millisecond)
+	if !rb.IsBackendUp(backend.address) {
+		t.Errorf("the backend is down before reaching the down threshold")
+	}
+	checker.probeAll()
+	time.Sleep(50 * time.Millisecond)
+	if rb.IsBackendUp(backend.address) {
+		t.Fatalf("the backend is not taken out of rotation")
+	}
+	n := backend.count()
+	if _, err := rb.Send(createTestRequest("INVITE")); err == nil || backend.count() != n {
+		t.Errorf("the request is sent to the down backend")
+	}
+	infos := checker.GetHealthInfos()
+	if len(infos) != 1 || infos[0].State != "down" {
+		t.Errorf("unexpected health infos %v", infos)
+	}
+
+	checker.probeAll()
+	probe := backend.last()
+	if method, _ := probe.GetMethod(); method != "OPTIONS" {
+		t.Fatalf("the probe is not OPTIONS")
+	}
+	if !checker.HandleResponse(NewResponseOf(probe, 200, "OK")) {
+		t.Fatalf("the response of the probe is not handled")
+	}
+	if !rb.IsBackendUp(backend.address) {
+		t.Errorf("the backend is not put back to rotation")
+	}
+}
+
+func TestHealthCheckServiceUnavailable(t *testing.T) {
+	backend := &probedBackend{address: "tcp://127.0.0.1:5070"}
+	checker, rb := createTestHealthChecker(backend)
+	for i := 0; i < 2; i++ {
+		checker.probeAll()
+		checker.HandleResponse(NewResponseOf(backend.last(), 503, "Service Unavailable"))
+	}
+	if rb.IsBackendUp(backend.address) {
+		t.Errorf("the backend replying 503 is not taken out of rotation")
+	}
+	if checker.HandleResponse(createTestResponse(createTestRequest("OPTIONS"), 200, "200 OK")) {
+		t.Errorf("the response of other request is handled as probe response")
+	}
+}
+
+func TestHealthCheckFailureCodes(t *testing.T) {
+	backend := &probedBackend{address: "tcp://127.0.0.1:5070"}
+	checker, rb := createTestHealthChecker(backend)
+	for i := 0; i < 2; i++ {
+		checker.probeAll()
+		checker.HandleResponse(NewResponseOf(backend.last(), 500, "Server Internal Error"))
+	}
+	if rb.IsBackendUp(backend.address) {
+		t.Errorf("the backend replying 500 is not taken out of rotation")
+	}
+
+	backend = &probedBackend{address: "tcp://127.0.0.1:5070"}
+	checker, rb = createTestHealthChecker(backend)
+	checker.failureCodes = []int{404}
+	for i := 0; i < 2; i++ {
+		checker.probeAll()
+		checker.HandleResponse(NewResponseOf(backend.last(), 500, "Server Internal Error"))
+	}
+	if !rb.IsBackendUp(backend.address) {
+		t.Errorf("the backend replying the status code not configured is taken out of rotation")
+	}
+	for i := 0; i < 2; i++ {
+		checker.probeAll()
+		checker.HandleResponse(NewResponseOf(backend.last(), 404, "Not Found"))
+	}
+	if rb.IsBackendUp(backend.address) {
+		t.Errorf("the backend replying the configured status code is not taken out of rotation")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	// the bindings of an AOR are kept in the key with this prefix in Redis
+	redisLocationKeyPrefix = "sipproxy:location:"
+	// the expired bindings are removed from the local location store in this interval
+	locationCleanInterval = time.Minute
+	// the max times to retry the update of the bindings changed by other proxy in Redis
+	maxLocationUpdateRetries = 5
+)
+
+// errBindingsNotUpdated is returned by the update function to keep the bindings unchanged
+var errBindingsNotUpdated = errors.New("bindings are not updated")
+
+// Binding is a contact registered for an address of record
+type Binding struct {
+	AOR string `json:"aor"`
+	// the contact URI to which the requests for the AOR are retargeted
+	Contact string    `json:"contact"`
+	Q       float64   `json:"q"`
+	Expires time.Time `json:"expires"`
+	CallId  string    `json:"call-id"`
+	CSeq    int       `json:"cseq"`
+	// the address from which the REGISTER is received
+	Source string `json:"source"`
+}
+
+// LocationStore keep the bindings of the AORs, the expired bindings are never returned
+type LocationStore interface {
+	GetBindings(aor string) ([]*Binding, error)
+	// SetBindings replace the bindings of the AOR, the AOR is removed if bindings is empty
+	SetBindings(aor string, bindings []*Binding) error
+	// UpdateBindings replace the bindings of the AOR with the result of the update function
+	// atomically and return the new bindings, the bindings are not changed if the update
+	// function returns error
+	UpdateBindings(aor string, update func(bindings []*Binding) ([]*Binding, error)) ([]*Binding, error)
+	// GetAllBindings get the bindings of all the AORs
+	GetAllBindings() ([]*Binding, error)
+}
+
+// removeExpiredBindings get the bindings not expired at now
+func removeExpiredBindings(bindings []*Binding, now time.Time) []*Binding {
+	return slices.DeleteFunc(slices.Clone(bindings), func(b *Binding) bool {
+		return !b.Expires.After(now)
+	})
+}
+
+// LocalLocationStore keep the bindings in memory
+type LocalLocationStore struct {
+	sync.Mutex
+	bindings      map[string][]*Binding
+	nextCleanTime time.Time
+}
+
+func NewLocalLocationStore() *LocalLocationStore {
+	return &LocalLocationStore{bindings: make(map[string][]*Binding), nextCleanTime: time.Now().Add(locationCleanInterval)}
+}
+
+func (l *LocalLocationStore) GetBindings(aor string) ([]*Binding, error) {
+	l.Lock()
+	defer l.Unlock()
+	return removeExpiredBindings(l.bindings[aor], time.Now()), nil
+}
+
+func (l *LocalLocationStore) SetBindings(aor string, bindings []*Binding) error {
+	l.Lock()
+	defer l.Unlock()
+	if len(bindings) == 0 {
+		delete(l.bindings, aor)
+	} else {
+		l.bindings[aor] = bindings
+	}
+	l.cleanExpiredBindings()
+	return nil
+}
+
+func (l *LocalLocationStore) UpdateBindings(aor string, update func(bindings []*Binding) ([]*Binding, error)) ([]*Binding, error) {
+	l.Lock()
+	defer l.Unlock()
+	bindings, err := update(removeExpiredBindings(l.bindings[aor], time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	if len(bindings) == 0 {
+		delete(l.bindings, aor)
+	} else {
+		l.bindings[aor] = bindings
+	}
+	l.cleanExpiredBindings()
+	return bindings, nil
+}
+
+func (l *LocalLocationStore) GetAllBindings() ([]*Binding, error) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	r := make([]*Binding, 0)
+	for _, bindings := range l.bindings {
+		r = append(r, removeExpiredBindings(bindings, now)...)
+	}
+	return r, nil
+}
+
+func (l *LocalLocationStore) cleanExpiredBindings() {
+	now := time.Now()
+	if l.nextCleanTime.After(now) {
+		return
+	}
+	l.nextCleanTime = now.Add(locationCleanInterval)
+	for aor, bindings := range l.bindings {
+		if bindings = removeExpiredBindings(bindings, now); len(bindings) == 0 {
+			delete(l.bindings, aor)
+		} else {
+			l.bindings[aor] = bindings
+		}
+	}
+}
+
+// RedisLocationStore keep the bindings of each AOR in a Redis key which expires with its
+// last binding, so the bindings are shared by the proxies using the same Redis. The Redis
+// clients of the session store are used
+type RedisLocationStore struct {
+	sessionStore *MasterSlaveRedisSessionBasedBackend
+}
+
+func NewRedisLocationStore(sessionStore *MasterSlaveRedisSessionBasedBackend) *RedisLocationStore {
+	return &RedisLocationStore{sessionStore: sessionStore}
+}
+
+func (r *RedisLocationStore) GetBindings(aor string) ([]*Binding, error) {
+	var bindings []*Binding
+	err := r.sessionStore.ForEachRedis(func(rdb *redis.Client) error {
+		value, err := rdb.Get(redisLocationKeyPrefix + aor).Bytes()
+		if err == redis.Nil {
+			bindings = nil
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(value, &bindings)
+	})
+	if err != nil {
+		zap.L().Error("Fail to get bindings from redis", zap.String("aor", aor), zap.Error(err))
+		return nil, err
+	}
+	return removeExpiredBindings(bindings, time.Now()), nil
+}
+
+func (r *RedisLocationStore) SetBindings(aor string, bindings []*Binding) error {
+	err := r.sessionStore.ForEachRedis(func(rdb *redis.Client) error {
+		_, err := rdb.Pipelined(func(pipe redis.Pipeliner) error {
+			return saveBindings(pipe, aor, bindings)
+		})
+		return err
+	})
+	if err != nil {
+		zap.L().Error("Fail to save bindings to redis", zap.String("aor", aor), zap.Error(err))
+	}
+	return err
+}
+
+// UpdateBindings update the bindings of the AOR in a transaction which watches the key
+// of the AOR, the update is retried if the bindings are changed by other proxy
+func (r *RedisLocationStore) UpdateBindings(aor string, update func(bindings []*Binding) ([]*Binding, error)) ([]*Binding, error) {
+	key := redisLocationKeyPrefix + aor
+	var result []*Binding
+	notUpdated := false
+	err := r.sessionStore.ForEachRedis(func(rdb *redis.Client) error {
+		for i := 0; i < maxLocationUpdateRetries; i++ {
+			err := rdb.Watch(func(tx *redis.Tx) error {
+				var bindings []*Binding
+				value, err := tx.Get(key).Bytes()
+				if err != nil && err != redis.Nil {
+					return err
+				}
+				if err == nil {
+					if err := json.Unmarshal(value, &bindings); err != nil {
+						return err
+					}
+				}
+				bindings, err = update(removeExpiredBindings(bindings, time.Now()))
+				if err != nil {
+					return err
+				}
+				// the commands are executed only if the key is not changed after WATCH
+				_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+					return saveBindings(pipe, aor, bindings)
+				})
+				result = bindings
+				return err
+			}, key)
+			if err == errBindingsNotUpdated {
+				notUpdated = true
+				return nil
+			}
+			if err != redis.TxFailedErr {
+				return err
+			}
+		}
+		return fmt.Errorf("the bindings of %s are changed concurrently", aor)
+	})
+	if err != nil {
+		zap.L().Error("Fail to update bindings in redis", zap.String("aor", aor), zap.Error(err))
+		return nil, err
+	}
+	if notUpdated {
+		return nil, errBindingsNotUpdated
+	}
+	return result, nil
+}
+
+// saveBindings queue the commands to save the bindings of the AOR in the key which expires
+// with the last binding
+func saveBindings(pipe redis.Pipeliner, aor string, bindings []*Binding) error {
+	key := redisLocationKeyPrefix + aor
+	var expires time.Time
+	for _, binding := range bindings {
+		if binding.Expires.After(expires) {
+			expires = binding.Expires
+		}
+	}
+	ttl := time.Until(expires)
+	if len(bindings) == 0 || ttl <= 0 {
+		pipe.Del(key)
+		return nil
+	}
+	value, err := json.Marshal(bindings)
+	if err != nil {
+		return err
+	}
+	pipe.Set(key, value, ttl)
+	return nil
+}
+
+func (r *RedisLocationStore) GetAllBindings() ([]*Binding, error) {
+	keys := make([]string, 0)
+	err := r.sessionStore.ForEachRedis(func(rdb *redis.Client) error {
+		keys = keys[:0]
+		iter := rdb.Scan(0, redisLocationKeyPrefix+"*", 100).Iterator()
+		for iter.Next() {
+			keys = append(keys, iter.Val())
+		}
+		return iter.Err()
+	})
+	if err != nil {
+		zap.L().Error("Fail to scan bindings in redis", zap.Error(err))
+		return nil, err
+	}
+	result := make([]*Binding, 0)
+	for _, key := range keys {
+		bindings, err := r.GetBindings(strings.TrimPrefix(key, redisLocationKeyPrefix))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, bindings...)
+	}
+	return result, nil
+}
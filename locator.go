@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// ServerTarget is a SIP server found by the RFC 3263 server location
+type ServerTarget struct {
+	Protocol string
+	// hostname or IP address
+	Host string
+	Port int
+}
+
+type srvRecord struct {
+	target   string
+	port     int
+	priority int
+	weight   int
+}
+
+type naptrRecord struct {
+	order       int
+	preference  int
+	protocol    string
+	replacement string
+}
+
+// the failed lookups are cached in this time, so the messages are not blocked by the
+// unavailable DNS server one by one
+const dnsFailureExpire = 10 * time.Second
+
+type dnsCacheItem struct {
+	records []dns.RR
+	err     error
+	expire  time.Time
+}
+
+type hostCacheItem struct {
+	ips    []string
+	err    error
+	expire time.Time
+}
+
+// SipServerLocator locate the SIP servers by NAPTR, SRV and A/AAAA records as
+// described in RFC 3263
+type SipServerLocator struct {
+	sync.Mutex
+	// the DNS server in "host:port" format, the system DNS servers are used if it is empty
+	dnsServer string
+	client    *dns.Client
+	// the client to query again over TCP if the answer over UDP is truncated
+	tcpClient *dns.Client
+	cache     map[string]dnsCacheItem
+	// the addresses found by the system resolver
+	hosts map[string]hostCacheItem
+}
+
+// the NAPTR services of the supported transports
+var naptrServices = map[string]string{"SIP+D2U": "udp",
+	"SIP+D2T":  "tcp",
+	"SIPS+D2T": "tls",
+	"SIP+D2W":  "ws",
+	"SIPS+D2W": "wss"}
+
+var srvPrefixes = map[string]string{"udp": "_sip._udp.", "tcp": "_sip._tcp.", "tls": "_sips._tcp."}
+
+var sipServerLocator = NewSipServerLocator("")
+
+func NewSipServerLocator(dnsServer string) *SipServerLocator {
+	return &SipServerLocator{dnsServer: dnsServer,
+		client:    &dns.Client{Timeout: 2 * time.Second},
+		tcpClient: &dns.Client{Net: "tcp", Timeout: 2 * time.Second},
+		cache:     make(map[string]dnsCacheItem),
+		hosts:     make(map[string]hostCacheItem)}
+}
+
+// SetDNSServer set the DNS server in "host:port" format, the default port 53 is used
+// if no port is specified
+func (l *SipServerLocator) SetDNSServer(dnsServer string) {
+	l.Lock()
+	defer l.Unlock()
+	if dnsServer != "" {
+		if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+			dnsServer = net.JoinHostPort(dnsServer, "53")
+		}
+	}
+	l.dnsServer = dnsServer
+	l.cache = make(map[string]dnsCacheItem)
+	l.hosts = make(map[string]hostCacheItem)
+}
+
+// Locate find the SIP servers of the host in the order they should be tried, the port is
+// 0 if it is not specified and the protocol is empty if no transport is specified.
+// RFC 3263 4.1 and 4.2:
+//   - the numeric IP address or the host with explicit port is used directly
+//   - the SRV records of the transport are used if the transport is specified
+//   - the NAPTR records select the transport if the transport is not specified
+//   - the A/AAAA records with default port are used if no SRV record is found
+func (l *SipServerLocator) Locate(host string, port int, protocol string) []ServerTarget {
+	return l.locate(host, port, protocol, l.query)
+}
+
+// LocateCached find the SIP servers of the host only with the cached DNS answers, false
+// is returned if a DNS query must be sent to locate the servers
+func (l *SipServerLocator) LocateCached(host string, port int, protocol string) ([]ServerTarget, bool) {
+	cached := true
+	targets := l.locate(host, port, protocol, func(name string, qtype uint16) ([]dns.RR, error) {
+		item, ok := l.queryCache(name, qtype)
+		if !ok {
+			cached = false
+			return nil, fmt.Errorf("%s is not cached", name)
+		}
+		return item.records, item.err
+	})
+	return targets, cached
+}
+
+// dnsQuery query the DNS records of the name
+type dnsQuery func(name string, qtype uint16) ([]dns.RR, error)
+
+func (l *SipServerLocator) locate(host string, port int, protocol string, query dnsQuery) []ServerTarget {
+	protocol = strings.ToLower(protocol)
+	defaultProtocol := protocol
+	if defaultProtocol == "" {
+		defaultProtocol = "udp"
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil || port != 0 {
+		return []ServerTarget{{Protocol: defaultProtocol, Host: host, Port: getDefaultPort(defaultProtocol, port)}}
+	}
+	if protocol == "" {
+		if targets := l.locateByNAPTR(host, query); len(targets) > 0 {
+			return targets
+		}
+		for _, p := range []string{"udp", "tcp", "tls"} {
+			if targets := l.locateBySRV(host, p, query); len(targets) > 0 {
+				return targets
+			}
+		}
+	} else if targets := l.locateBySRV(host, protocol, query); len(targets) > 0 {
+		return targets
+	}
+	return []ServerTarget{{Protocol: defaultProtocol, Host: host, Port: getDefaultPort(defaultProtocol, 0)}}
+}
+
+func getDefaultPort(protocol string, port int) int {
+	if port != 0 {
+		return port
+	}
+	if protocol == "tls" || protocol == "wss" {
+		return 5061
+	}
+	return 5060
+}
+
+func (l *SipServerLocator) locateByNAPTR(host string, query dnsQuery) []ServerTarget {
+	records, err := l.lookupNAPTR(host, query)
+	if err != nil {
+		return nil
+	}
+	r := make([]ServerTarget, 0)
+	for _, record := range records {
+		targets := l.locateBySRVName(record.replacement, record.protocol, query)
+		zap.L().Debug("locate sip server by NAPTR", zap.String("host", host), zap.String("replacement", record.replacement), zap.Int("targets", len(targets)))
+		r = append(r, targets...)
+	}
+	return r
+}
+
+func (l *SipServerLocator) locateBySRV(host string, protocol string, query dnsQuery) []ServerTarget {
+	prefix, ok := srvPrefixes[protocol]
+	if !ok {
+		return nil
+	}
+	return l.locateBySRVName(prefix+host, protocol, query)
+}
+
+func (l *SipServerLocator) locateBySRVName(name string, protocol string, query dnsQuery) []ServerTarget {
+	records, err := l.lookupSRV(name, query)
+	if err != nil {
+		return nil
+	}
+	r := make([]ServerTarget, 0)
+	for _, record := range orderSRVRecords(records) {
+		r = append(r, ServerTarget{Protocol: protocol, Host: record.target, Port: record.port})
+	}
+	return r
+}
+
+// orderSRVRecords order the SRV records by priority, and select the records with same
+// priority randomly in proportion to their weight as described in RFC 2782
+func orderSRVRecords(records []srvRecord) []srvRecord {
+	records = slices.Clone(records)
+	slices.SortStableFunc(records, func(a, b srvRecord) int {
+		return a.priority - b.priority
+	})
+	r := make([]srvRecord, 0, len(records))
+	for start := 0; start < len(records); {
+		end := start
+		for end < len(records) && records[end].priority == records[start].priority {
+			end++
+		}
+		group := records[start:end]
+		for len(group) > 0 {
+			total := 0
+			for _, record := range group {
+				total += record.weight
+			}
+			selected := 0
+			if total > 0 {
+				n := rand.Intn(total + 1)
+				sum := 0
+				for i, record := range group {
+					sum += record.weight
+					if sum >= n {
+						selected = i
+						break
+					}
+				}
+			}
+			r = append(r, group[selected])
+			group = slices.Delete(slices.Clone(group), selected, selected+1)
+		}
+		start = end
+	}
+	return r
+}
+
+// LookupHost find the IP addresses of the host by A and AAAA records
+func (l *SipServerLocator) LookupHost(host string) ([]string, error) {
+	if l.getDNSServer() == "" {
+		return l.lookupHostBySystem(host)
+	}
+	r := make([]string, 0)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answers, err := l.query(host, qtype)
+		if err != nil {
+			continue
+		}
+		for _, answer := range answers {
+			switch rr := answer.(type) {
+			case *dns.A:
+				r = append(r, rr.A.String())
+			case *dns.AAAA:
+				r = append(r, rr.AAAA.String())
+			}
+		}
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("no ip address of %s", host)
+	}
+	return r, nil
+}
+
+// lookupHostBySystem find the IP addresses of the host by the system resolver, the
+// addresses are cached for a minute and the failures for dnsFailureExpire
+func (l *SipServerLocator) lookupHostBySystem(host string) ([]string, error) {
+	l.Lock()
+	if item, ok := l.hosts[host]; ok && time.Now().Before(item.expire) {
+		l.Unlock()
+		return item.ips, item.err
+	}
+	l.Unlock()
+
+	item := hostCacheItem{expire: time.Now().Add(time.Minute)}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		item.err = err
+		item.expire = time.Now().Add(dnsFailureExpire)
+	} else {
+		item.ips = make([]string, 0, len(ips))
+		for _, ip := range ips {
+			item.ips = append(item.ips, ip.String())
+		}
+	}
+	l.Lock()
+	l.hosts[host] = item
+	l.Unlock()
+	return item.ips, item.err
+}
+
+func (l *SipServerLocator) lookupNAPTR(host string, query dnsQuery) ([]naptrRecord, error) {
+	answers, err := query(host, dns.TypeNAPTR)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]naptrRecord, 0)
+	for _, answer := range answers {
+		rr, ok := answer.(*dns.NAPTR)
+		if !ok || !strings.EqualFold(rr.Flags, "s") {
+			continue
+		}
+		if protocol, ok := naptrServices[strings.ToUpper(rr.Service)]; ok {
+			r = append(r, naptrRecord{order: int(rr.Order),
+				preference:  int(rr.Preference),
+				protocol:    protocol,
+				replacement: strings.TrimSuffix(rr.Replacement, ".")})
+		}
+	}
+	slices.SortStableFunc(r, func(a, b naptrRecord) int {
+		if a.order != b.order {
+			return a.order - b.order
+		}
+		return a.preference - b.preference
+	})
+	return r, nil
+}
+
+func (l *SipServerLocator) lookupSRV(name string, query dnsQuery) ([]srvRecord, error) {
+	answers, err := query(name, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]srvRecord, 0)
+	for _, answer := range answers {
+		if rr, ok := answer.(*dns.SRV); ok && rr.Target != "." {
+			r = append(r, srvRecord{target: strings.TrimSuffix(rr.Target, "."),
+				port:     int(rr.Port),
+				priority: int(rr.Priority),
+				weight:   int(rr.Weight)})
+		}
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("no SRV record of %s", name)
+	}
+	return r, nil
+}
+
+// query send the DNS query and cache the answers until the minimal TTL is reached, the
+// query is sent again over TCP if the answer over UDP is truncated. The failed query is
+// cached for dnsFailureExpire
+func (l *SipServerLocator) query(name string, qtype uint16) ([]dns.RR, error) {
+	if item, ok := l.queryCache(name, qtype); ok {
+		return item.records, item.err
+	}
+	key := fmt.Sprintf("%s:%d", name, qtype)
+
+	server := l.getDNSServer()
+	if server == "" {
+		config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil || len(config.Servers) == 0 {
+			return nil, fmt.Errorf("no DNS server is available")
+		}
+		server = net.JoinHostPort(config.Servers[0], config.Port)
+	}
+	request := new(dns.Msg)
+	request.SetQuestion(dns.Fqdn(name), qtype)
+	response, _, err := l.client.Exchange(request, server)
+	if err == nil && response.Truncated {
+		response, _, err = l.tcpClient.Exchange(request, server)
+	}
+	if err != nil {
+		zap.L().Error("Fail to query DNS", zap.String("name", name), zap.String("type", dns.TypeToString[qtype]), zap.String("server", server), zap.String("error", err.Error()))
+		l.Lock()
+		l.cache[key] = dnsCacheItem{err: err, expire: time.Now().Add(dnsFailureExpire)}
+		l.Unlock()
+		return nil, err
+	}
+	ttl := uint32(60)
+	answers := make([]dns.RR, 0)
+	for _, answer := range response.Answer {
+		if answer.Header().Rrtype == qtype {
+			answers = append(answers, answer)
+			ttl = min(ttl, answer.Header().Ttl)
+		}
+	}
+	item := dnsCacheItem{records: answers, expire: time.Now().Add(time.Duration(ttl) * time.Second)}
+	if len(answers) == 0 {
+		item.err = fmt.Errorf("no %s record of %s", dns.TypeToString[qtype], name)
+	}
+	l.Lock()
+	l.cache[key] = item
+	l.Unlock()
+	return item.records, item.err
+}
+
+// queryCache get the cached answers of the DNS query, false is returned if the query is
+// not cached or expired
+func (l *SipServerLocator) queryCache(name string, qtype uint16) (dnsCacheItem, bool) {
+	l.Lock()
+	defer l.Unlock()
+	item, ok := l.cache[fmt.Sprintf("%s:%d", name, qtype)]
+	return item, ok && time.Now().Before(item.expire)
+}
+
+func (l *SipServerLocator) getDNSServer() string {
+	l.Lock()
+	defer l.Unlock()
+	return l.dnsServer
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestDNSServer start a DNS server on a random udp port with the records
+func startTestDNSServer(t *testing.T, records []string) string {
+	zone := make(map[string][]dns.RR)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := rr.Header().Name + dns.TypeToString[rr.Header().Rrtype]
+		zone[key] = append(zone[key], rr)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		m.Answer = zone[q.Name+dns.TypeToString[q.Qtype]]
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+	return conn.LocalAddr().String()
+}
+
+var testDNSRecords = []string{"example.test. 60 IN NAPTR 10 50 \"s\" \"SIPS+D2T\" \"\" _sips._tcp.example.test.",
+	"example.test. 60 IN NAPTR 20 50 \"s\" \"SIP+D2U\" \"\" _sip._udp.example.test.",
+	"example.test. 60 IN NAPTR 30 50 \"s\" \"SIP+D2X\" \"\" _sip._x.example.test.",
+	"_sips._tcp.example.test. 60 IN SRV 20 10 5081 sip2.example.test.",
+	"_sips._tcp.example.test. 60 IN SRV 10 10 5071 sip1.example.test.",
+	"_sip._udp.example.test. 60 IN SRV 10 10 5070 sip1.example.test.",
+	"_sip._tcp.srv.test. 60 IN SRV 10 10 5072 sip1.example.test.",
+	"sip1.example.test. 60 IN A 192.0.2.1",
+	"sip2.example.test. 60 IN A 192.0.2.2"}
+
+func TestLocateByNAPTR(t *testing.T) {
+	locator := NewSipServerLocator(startTestDNSServer(t, testDNSRecords))
+	targets := locator.Locate("example.test", 0, "")
+	expected := []ServerTarget{{Protocol: "tls", Host: "sip1.example.test", Port: 5071},
+		{Protocol: "tls", Host: "sip2.example.test", Port: 5081},
+		{Protocol: "udp", Host: "sip1.example.test", Port: 5070}}
+	if len(targets) != len(expected) {
+		t.Fatalf("unexpected targets %v", targets)
+	}
+	for i, target := range targets {
+		if target != expected[i] {
+			t.Errorf("expect %v but get %v", expected[i], target)
+		}
+	}
+}
+
+func TestLocateBySRV(t *testing.T) {
+	locator := NewSipServerLocator(startTestDNSServer(t, testDNSRecords))
+	targets := locator.Locate("srv.test", 0, "")
+	if len(targets) != 1 || targets[0] != (ServerTarget{Protocol: "tcp", Host: "sip1.example.test", Port: 5072}) {
+		t.Errorf("unexpected targets %v", targets)
+	}
+	targets = locator.Locate("example.test", 0, "UDP")
+	if len(targets) != 1 || targets[0] != (ServerTarget{Protocol: "udp", Host: "sip1.example.test", Port: 5070}) {
+		t.Errorf("unexpected targets %v", targets)
+	}
+	// no SRV record, the A record with default port is used
+	targets = locator.Locate("sip2.example.test", 0, "tls")
+	if len(targets) != 1 || targets[0] != (ServerTarget{Protocol: "tls", Host: "sip2.example.test", Port: 5061}) {
+		t.Errorf("unexpected targets %v", targets)
+	}
+}
+
+func TestLocateWithPort(t *testing.T) {
+	locator := NewSipServerLocator(startTestDNSServer(t, testDNSRecords))
+	targets := locator.Locate("example.test", 5090, "")
+	if len(targets) != 1 || targets[0] != (ServerTarget{Protocol: "udp", Host: "example.test", Port: 5090}) {
+		t.Errorf("unexpected targets %v", targets)
+	}
+	targets = locator.Locate("192.0.2.10", 0, "tcp")
+	if len(targets) != 1 || targets[0] != (ServerTarget{Protocol: "tcp", Host: "192.0.2.10", Port: 5060}) {
+		t.Errorf("unexpected targets %v", targets)
+	}
+}
+
+// startTruncatingTestDNSServer start a DNS server answering the records over TCP, the
+// answers over UDP on the same port are truncated and empty
+func startTruncatingTestDNSServer(t *testing.T, records []string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers := make([]dns.RR, 0)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers = append(answers, rr)
+	}
+	udpServer := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Truncated = true
+		w.WriteMsg(m)
+	})}
+	tcpServer := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = answers
+		w.WriteMsg(m)
+	})}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	t.Cleanup(func() {
+		udpServer.Shutdown()
+		tcpServer.Shutdown()
+	})
+	return conn.LocalAddr().String()
+}
+
+func TestQueryTruncatedAnswerOverTCP(t *testing.T) {
+	locator := NewSipServerLocator(startTruncatingTestDNSServer(t, []string{"sip1.example.test. 60 IN A 192.0.2.1"}))
+	ips, err := locator.LookupHost("sip1.example.test")
+	if err != nil || len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Errorf("the truncated answer is not queried again over TCP: %v", ips)
+	}
+}
+
+func TestLookupHostWithDNSServer(t *testing.T) {
+	locator := NewSipServerLocator(startTestDNSServer(t, testDNSRecords))
+	ips, err := locator.LookupHost("sip2.example.test")
+	if err != nil || len(ips) != 1 || ips[0] != "192.0.2.2" {
+		t.Errorf("unexpected ips %v", ips)
+	}
+	if _, err := locator.LookupHost("unknown.example.test"); err == nil {
+		t.Errorf("the unknown host is resolved")
+	}
+}
+
+func TestFailedQueryIsCached(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	locator := NewSipServerLocator(conn.LocalAddr().String())
+	locator.client.Timeout = 100 * time.Millisecond
+	if _, err := locator.LookupHost("sip1.example.test"); err == nil {
+		t.Fatal("the host is resolved by the DNS server not answering")
+	}
+	start := time.Now()
+	if _, err := locator.LookupHost("sip1.example.test"); err == nil {
+		t.Errorf("the cached failure is not returned")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("the failed lookup is not cached, it takes %v", elapsed)
+	}
+}
+
+func TestOrderSRVRecords(t *testing.T) {
+	records := []srvRecord{{target: "backup", priority: 20, weight: 100},
+		{target: "light", priority: 10, weight: 0},
+		{target: "heavy", priority: 10, weight: 100}}
+	heavyFirst := 0
+	for range 1000 {
+		ordered := orderSRVRecords(records)
+		if ordered[2].target != "backup" {
+			t.Fatalf("the record with higher priority value is not the last")
+		}
+		if ordered[0].target == "heavy" {
+			heavyFirst++
+		}
+	}
+	if heavyFirst < 900 {
+		t.Errorf("the weight is not honoured, heavy is first in %d of 1000", heavyFirst)
+	}
+}
+
+func TestLocateCached(t *testing.T) {
+	locator := NewSipServerLocator(startTestDNSServer(t, testDNSRecords))
+	if _, ok := locator.LocateCached("example.test", 0, ""); ok {
+		t.Errorf("the servers are located without DNS query")
+	}
+	if _, ok := locator.LocateCached("192.0.2.10", 0, "tcp"); !ok {
+		t.Errorf("the IP address needs the DNS query")
+	}
+	expected := locator.Locate("example.test", 0, "")
+	targets, ok := locator.LocateCached("example.test", 0, "")
+	if !ok || len(targets) != len(expected) {
+		t.Errorf("the servers are not located with the cached answers: %v", targets)
+	}
+}
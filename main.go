@@ -25,7 +25,7 @@ type HostIp struct {
 
 type ViaConfig struct {
 	Address string
-	// must be tcp or udp
+	// must be tcp, udp or tls
 	Protocol string
 	Port     int
 }
@@ -34,13 +34,219 @@ type BackendConfig struct {
 	Address string `yaml:"address,omitempty"`
 	// local bind address to sending sip message to backend
 	LocalAddress string `yaml:"localAddress,omitempty"`
+	// weight of the backend in the round robin and hash policies, default is 1
+	Weight int `yaml:"weight,omitempty"`
 }
+
+// TLSConfig is the certificate configuration of the TLS transport, all the files are in PEM format
+type TLSConfig struct {
+	// the certificate presented to the peer, it is required by the TLS listener
+	Cert string `yaml:"cert,omitempty"`
+	// the private key of the certificate
+	Key string `yaml:"key,omitempty"`
+	// the CA bundle to verify the certificate of the peer, the system CAs are used if it is empty
+	CA string `yaml:"ca,omitempty"`
+	// True if the TLS listener requires and verifies the client certificate (mutual TLS)
+	VerifyClient bool `yaml:"verify-client,omitempty"`
+	// The name to verify the server certificate, the host of the next hop or backend is used if it is empty
+	ServerName string `yaml:"server-name,omitempty"`
+	// True if the server certificate is not verified, for test only
+	InsecureSkipVerify bool `yaml:"insecure-skip-verify,omitempty"`
+}
+
+// HealthCheckConfig is the configuration of the SIP OPTIONS probes to the backends
+type HealthCheckConfig struct {
+	// seconds between two probes of a backend, default is 30
+	Interval int `yaml:"interval,omitempty"`
+	// seconds to wait for the response of a probe, default is 5
+	Timeout int `yaml:"timeout,omitempty"`
+	// consecutive successful probes to put a down backend back to rotation, default is 2
+	UpThreshold int `yaml:"up-threshold,omitempty"`
+	// consecutive failed probes to take a backend out of rotation, default is 3
+	DownThreshold int `yaml:"down-threshold,omitempty"`
+	// the status codes of the probe response counted as failed probe, default is 408 and
+	// all the 5xx codes. A probe without response in timeout is always a failed probe
+	FailureCodes []int `yaml:"failure-codes,omitempty"`
+}
+
+// FailoverConfig is the configuration to retry the request on the next backend
+type FailoverConfig struct {
+	// the status codes of the final response to retry the request on the next backend,
+	// default is 500, 502, 503 and 504. The request is also retried on timeout
+	Codes []int `yaml:"codes,omitempty"`
+	// the max number of backends tried for a request, default is all the backends
+	MaxAttempts int `yaml:"max-attempts,omitempty"`
+}
+
+// AuthConfig is the configuration to challenge the requests received by the listener
+// with the digest authentication (RFC 3261, RFC 7616)
+type AuthConfig struct {
+	// the realm in the Proxy-Authenticate header
+	Realm string `yaml:"realm"`
+	// the digest algorithms offered in the challenge: MD5 and SHA-256, default is both
+	Algorithms []string `yaml:"algorithms,omitempty"`
+	// the file of the credentials, one "username:password" in each line
+	CredentialsFile string `yaml:"credentials-file,omitempty"`
+	// the HTTP endpoint to look up the password of the user which is not in the
+	// credentials file. It is called with GET <lookup-url>?username=<user>&realm=<realm>
+	// and answers {"password": "..."}, or 404 if the user is unknown
+	LookupURL string `yaml:"lookup-url,omitempty"`
+	// the IPs or CIDRs of the trusted sources, their requests are not challenged
+	Trusted []string `yaml:"trusted,omitempty"`
+	// the seconds in which the nonce is valid, default is 300
+	NonceExpire int `yaml:"nonce-expire,omitempty"`
+	// the seconds in which the password looked up from the lookup-url is cached, default
+	// is 60
+	LookupCacheExpire int `yaml:"lookup-cache-expire,omitempty"`
+}
+
+// RateLimit is a token bucket refilled with rate tokens per second
+type RateLimit struct {
+	Rate float64 `yaml:"rate"`
+	// the max number of tokens in the bucket, default is the rate and at least 1
+	Burst int `yaml:"burst,omitempty"`
+}
+
+// RateLimitConfig is the rate limits of the requests from each source IP, the requests
+// over the limit are answered with 503
+type RateLimitConfig struct {
+	Invite   *RateLimit `yaml:"invite,omitempty"`
+	Register *RateLimit `yaml:"register,omitempty"`
+	// the limit of the requests other than INVITE, REGISTER, ACK and CANCEL
+	Other *RateLimit `yaml:"other,omitempty"`
+	// limit the requests of each From user with the same limits too
+	PerFromUser bool `yaml:"per-from-user,omitempty"`
+	// the seconds in the Retry-After of the 503, default is 5
+	RetryAfter int `yaml:"retry-after,omitempty"`
+	// the source over the limits block-threshold times in block-window seconds (default 10)
+	// is blocked for block-time seconds (default 60), the requests from the blocked source
+	// are dropped silently. The source is never blocked if block-threshold is 0
+	BlockThreshold int `yaml:"block-threshold,omitempty"`
+	BlockWindow    int `yaml:"block-window,omitempty"`
+	BlockTime      int `yaml:"block-time,omitempty"`
+	// the IPs or CIDRs of the sources which are not limited
+	Exempt []string `yaml:"exempt,omitempty"`
+}
+
+// RegistrarConfig is the domains for which the proxy accepts the REGISTER and routes the
+// requests to the registered contacts
+type RegistrarConfig struct {
+	Domains []string `yaml:"domains"`
+	// the expires of the contact if the REGISTER has no expires, default is 3600
+	DefaultExpires int `yaml:"default-expires,omitempty"`
+	// the REGISTER with shorter expires is answered with 423, default is 60
+	MinExpires int `yaml:"min-expires,omitempty"`
+	// the longer expires is reduced to it, default is 7200
+	MaxExpires int `yaml:"max-expires,omitempty"`
+	// parallel (default): the request is forked to all the contacts of the AOR at once
+	// sequential: the contacts are tried in the decreasing q-value order, the contacts
+	// with the same q-value are tried in parallel
+	Fork string `yaml:"fork,omitempty"`
+	// seconds to wait for the final response of the contacts before the next ones are
+	// tried in the sequential forking, 0 waits until the contacts answer
+	BranchTimeout int `yaml:"branch-timeout,omitempty"`
+}
+
+// HeaderRuleConfig change the headers of the messages matched by all its conditions, the
+// conditions not given match all the messages
+type HeaderRuleConfig struct {
+	Name string `yaml:"name,omitempty"`
+	// request (default), response or both
+	Direction string `yaml:"direction,omitempty"`
+	// the methods of the requests, or the methods in the CSeq of the responses
+	Methods []string `yaml:"methods,omitempty"`
+	// the IPs or CIDRs of the sources sending the messages
+	Sources []string `yaml:"sources,omitempty"`
+	// the regular expressions matching a value of the headers, e.g. User-Agent: ^Legacy
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// the changes applied in order to the matched messages
+	Actions []HeaderActionConfig `yaml:"actions"`
+}
+
+// HeaderActionConfig is a change of the header or the Request-URI
+type HeaderActionConfig struct {
+	// add, remove, replace or rewrite
+	Action string `yaml:"action"`
+	// the header name, or request-uri to replace or rewrite the Request-URI
+	Header string `yaml:"header"`
+	// the value of add and replace, or the replacement of rewrite which can refer to the
+	// groups of the pattern with $1
+	Value string `yaml:"value,omitempty"`
+	// the regular expression of rewrite
+	Pattern string `yaml:"pattern,omitempty"`
+}
+
+// RedirectConfig let the proxy follow the 3xx responses of the backends and next hops
+// for the upstream which can't follow them
+type RedirectConfig struct {
+	// the maximum number of the 3xx responses followed for a request, default is 3. The
+	// last 3xx is relayed upstream after the limit is reached
+	MaxRedirects int `yaml:"max-redirects,omitempty"`
+	// the 3xx status codes to follow, default is 300, 301 and 302
+	Codes []int `yaml:"codes,omitempty"`
+}
+
+// TrunkConfig is the registration of the proxy to the registrar of an upstream carrier
+type TrunkConfig struct {
+	Name string `yaml:"name"`
+	// the registrar in host or host:port, it is located by RFC 3263 if no port is given
+	Registrar string `yaml:"registrar"`
+	// the address of record to register, e.g. sip:12345@carrier.com
+	AOR string `yaml:"aor"`
+	// the credentials to answer the digest challenges, the username is the user of the
+	// aor if it is not specified
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// the expires requested in the REGISTER, default is 3600
+	Expires int `yaml:"expires,omitempty"`
+	// udp (default), tcp or tls, the proxy must listen on it
+	Transport string `yaml:"transport,omitempty"`
+}
+
+// ACLConfig is the IP allow and deny lists of the peers sending to the proxy or listener
+type ACLConfig struct {
+	// the IPs or CIDRs allowed to send, all the sources are allowed if it is empty
+	Allow []string `yaml:"allow,omitempty"`
+	// the IPs or CIDRs denied to send, it is checked before the allow list
+	Deny []string `yaml:"deny,omitempty"`
+	// reject (default): answer the requests from the denied sources with 403
+	// drop: discard the messages and the connections from the denied sources silently
+	Action string `yaml:"action,omitempty"`
+}
+
 type ListenConfig struct {
-	Address  string
-	Via      string `yaml:"via,omitempty"`
-	TcpPort  int    `yaml:"tcp-port,omitempty"`
-	UdpPort  int    `yaml:"udp-port,omitempty"`
-	Backends []BackendConfig
+	Address string
+	Via     string `yaml:"via,omitempty"`
+	TcpPort int    `yaml:"tcp-port,omitempty"`
+	UdpPort int    `yaml:"udp-port,omitempty"`
+	TlsPort int    `yaml:"tls-port,omitempty"`
+	// SIP over WebSocket (RFC 7118) ports for the WebRTC clients
+	WsPort  int `yaml:"ws-port,omitempty"`
+	WssPort int `yaml:"wss-port,omitempty"`
+	// the Origins (e.g. https://webrtc.example.com) of the browsers allowed to connect the
+	// ws-port and wss-port, "*" allows all. Only the Origin of the same host is allowed
+	// if it is empty, the clients without Origin are always allowed
+	WsAllowedOrigins []string `yaml:"ws-allowed-origins,omitempty"`
+	// certificates of the tls-port, wss-port and the tls:// backends
+	TLS *TLSConfig `yaml:"tls,omitempty"`
+	// probe the backends with SIP OPTIONS if it is configured
+	HealthCheck *HealthCheckConfig `yaml:"health-check,omitempty"`
+	// the backend selection policy: round-robin (default), least-outstanding,
+	// call-id-hash or from-user-hash
+	Policy string `yaml:"policy,omitempty"`
+	// retry the request on the next backend if it is configured
+	Failover *FailoverConfig `yaml:"failover,omitempty"`
+	// challenge the requests from the untrusted sources if it is configured
+	Auth *AuthConfig `yaml:"auth,omitempty"`
+	// the sources allowed to send to the listener, checked with the acl of the proxy
+	ACL *ACLConfig `yaml:"acl,omitempty"`
+	// change the headers of the messages received by the listener, applied after the
+	// header-rules of the proxy
+	HeaderRules []HeaderRuleConfig `yaml:"header-rules,omitempty"`
+	// hide the Vias, Record-Routes and Contacts of the other side from the peers of the
+	// listener, the listener faces the untrusted domain
+	TopologyHiding bool `yaml:"topology-hiding,omitempty"`
+	Backends       []BackendConfig
 }
 
 type RedisAddress struct {
@@ -81,6 +287,25 @@ type ProxyConfig struct {
 	// If not specified, the route must be recorded in the route header
 	MustRecordRoute   bool               `yaml:"must-record-route,omitempty"`
 	RedisSessionStore *RedisSessionStore `yaml:"redis-session-store,omitempty"`
+	// certificates used when the next hop is connected with TLS
+	TLS *TLSConfig `yaml:"tls,omitempty"`
+	// number of goroutines processing the messages, the messages with the same Call-ID
+	// are always processed by the same goroutine. If not specified, the number of CPUs
+	Workers int `yaml:"workers,omitempty"`
+	// the sources allowed to send to all the listeners of the proxy
+	ACL *ACLConfig `yaml:"acl,omitempty"`
+	// limit the rate of the requests from each source
+	RateLimit *RateLimitConfig `yaml:"rate-limit,omitempty"`
+	// accept the REGISTER for the domains, the bindings are kept in the redis-session-store
+	// if it is configured
+	Registrar *RegistrarConfig `yaml:"registrar,omitempty"`
+	// register the proxy to the upstream carriers
+	Trunks []TrunkConfig `yaml:"trunks,omitempty"`
+	// retry the requests to the Contacts of the 3xx responses instead of relaying them
+	Redirect *RedirectConfig `yaml:"redirect,omitempty"`
+	// change the headers of the messages received by all the listeners before they are
+	// forwarded
+	HeaderRules []HeaderRuleConfig `yaml:"header-rules,omitempty"`
 	// The listens is a list of listen configurations
 	Listens []ListenConfig
 
@@ -90,6 +315,14 @@ type ProxyConfig struct {
 		Dests    []string
 		Protocol string
 		NextHop  string
+		// the request is forked to all the next hops, the nexthop is the first one if
+		// both are given
+		NextHops []string `yaml:"nexthops,omitempty"`
+		// parallel (default) or sequential forking to the nexthops
+		Fork string `yaml:"fork,omitempty"`
+		// seconds to wait for the final response of a next hop before the next one is
+		// tried in the sequential forking, 0 waits until the next hop answers
+		BranchTimeout int `yaml:"branch-timeout,omitempty"`
 	}
 	Hosts []HostIp
 }
@@ -101,6 +334,9 @@ type ProxiesConfigure struct {
 	Proxies []ProxyConfig
 	// Global hosts IPs, used for resolving host names in the SIP messages
 	Hosts []HostIp
+	// The DNS server in "host:port" format for the NAPTR, SRV and A/AAAA queries
+	// If not specified, the DNS servers of the system are used
+	DNSServer string `yaml:"dns-server,omitempty"`
 }
 
 func init() {
@@ -145,17 +381,11 @@ func startProfiling(port int) {
 }
 
 func loadConfigFromReader(reader io.Reader) (*ProxiesConfigure, error) {
-	r := &ProxiesConfigure{}
-
-	decoder := yaml.NewDecoder(reader)
-	err := decoder.Decode(r)
-
+	data, err := io.ReadAll(reader)
 	if err != nil {
 		return nil, err
 	}
-
-	return r, nil
-
+	return parseConfig(data)
 }
 
 func loadConfig(fileName string) (*ProxiesConfigure, error) {
@@ -166,14 +396,12 @@ func loadConfig(fileName string) (*ProxiesConfigure, error) {
 	if len(data) == 0 {
 		return nil, fmt.Errorf("configuration file %s is empty", fileName)
 	}
-	// Check if the file is a valid YAML file
-	p := &ProxiesConfigure{}
-
-	err = yaml.Unmarshal(data, p)
+	// Check if the file is a valid YAML file and the values are valid
+	p, err := parseConfig(data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse configuration file %s: %w", fileName, err)
+		return nil, fmt.Errorf("invalid configuration file %s:\n%w", fileName, err)
 	}
-	return p, err
+	return p, nil
 	/*f, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
@@ -194,8 +422,22 @@ func toKeepNextHopRoute(s string) bool {
 	return slices.Contains(possibleTrueValues, strings.ToLower(s))
 }
 
+// validateConfigFile check the configuration file without starting the proxies
+func validateConfigFile(c *cli.Context) error {
+	configFile := c.String("config")
+	if _, err := loadConfig(configFile); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	fmt.Printf("configuration file %s is valid\n", configFile)
+	return nil
+}
+
 func startProxies(c *cli.Context) error {
-	config, err := loadConfig(c.String("config"))
+	configFile := c.String("config")
+	if configFile == "" {
+		return fmt.Errorf("the configuration file is not specified by --config")
+	}
+	config, err := loadConfig(configFile)
 	if err != nil {
 		return err
 	}
@@ -210,18 +452,32 @@ func startProxies(c *cli.Context) error {
 
 	b, _ := yaml.Marshal(config)
 	zap.L().Debug("Success load configuration file", zap.String("config", string(b)))
-	for _, proxy := range config.Proxies {
-		preConfigRoute := createPreConfigRoute(proxy)
-		resolver := createPreConfigHostResolver(config.Hosts, proxy)
-		zap.L().Info("start sip proxy", zap.String("name", proxy.Name))
-		err = startProxy(proxy, preConfigRoute, resolver)
+	sipServerLocator.SetDNSServer(config.DNSServer)
+	proxies := make([]*Proxy, 0)
+	for _, proxyConfig := range config.Proxies {
+		preConfigRoute := createPreConfigRoute(proxyConfig)
+		resolver := createPreConfigHostResolver(config.Hosts, proxyConfig)
+		zap.L().Info("start sip proxy", zap.String("name", proxyConfig.Name))
+		proxy, err := startProxy(proxyConfig, preConfigRoute, resolver)
 		if err != nil {
 			return err
 		}
+		proxies = append(proxies, proxy)
 	}
-	for {
-		time.Sleep(time.Duration(5 * time.Second))
+	reloader := NewConfigReloader(configFile, config, proxies)
+	if config.Admin.Addr != "" {
+		admin := NewAdminServer(config.Admin.Addr, proxies)
+		admin.EnableReload(reloader.Reload)
+		reloader.SetAdminServer(admin)
+		err = admin.Start()
+		if err != nil {
+			return err
+		}
 	}
+	reloader.HandleSignal()
+	waitForShutdown(reloader.GetProxies, time.Duration(c.Int("drain-timeout"))*time.Second, c.Int("retry-after"))
+	zap.L().Info("sip proxies are shut down")
+	return nil
 }
 
 func getDefaultDialogTimeout() int {
@@ -235,7 +491,7 @@ func getDefaultDialogTimeout() int {
 	return 1200
 }
 
-func startProxy(config ProxyConfig, preConfigRoute *PreConfigRoute, resolver *PreConfigHostResolver) error {
+func startProxy(config ProxyConfig, preConfigRoute *PreConfigRoute, resolver *PreConfigHostResolver) (*Proxy, error) {
 	selfLearnRoute := NewSelfLearnRoute()
 	dialogTimeout := config.DialogTimeout
 	if dialogTimeout <= 0 {
@@ -252,21 +508,50 @@ func startProxy(config ProxyConfig, preConfigRoute *PreConfigRoute, resolver *Pr
 		config.MustRecordRoute,
 		config.RedisSessionStore,
 	)
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.ClientTLSConfig()
+		if err != nil {
+			zap.L().Error("Fail to load tls configuration of proxy", zap.String("name", config.Name), zap.String("error", err.Error()))
+			return nil, err
+		}
+		proxy.SetClientTLSConfig(tlsConfig)
+	}
+	proxy.SetWorkers(config.Workers)
+	if err := proxy.SetACL(config.ACL); err != nil {
+		return nil, err
+	}
+	if err := proxy.SetRateLimit(config.RateLimit); err != nil {
+		return nil, err
+	}
+	if err := proxy.SetRegistrar(config.Registrar); err != nil {
+		return nil, err
+	}
+	if err := proxy.SetRedirect(config.Redirect); err != nil {
+		return nil, err
+	}
+	if err := proxy.SetHeaderRules(config.HeaderRules); err != nil {
+		return nil, err
+	}
 
 	err := proxy.Start()
 	if err == nil {
 		zap.L().Info("Succeed to start proxy", zap.String("name", config.Name))
+		err = proxy.SetTrunks(config.Trunks)
 	} else {
 		zap.L().Error("Fail to start proxy", zap.String("name", config.Name))
 	}
-	return err
+	return proxy, err
 }
 
 func createPreConfigRoute(config ProxyConfig) *PreConfigRoute {
 	preConfigRoute := NewPreConfigRoute()
 	for _, routeItem := range config.Route {
+		nextHops := routeItem.NextHops
+		if routeItem.NextHop != "" {
+			nextHops = append([]string{routeItem.NextHop}, nextHops...)
+		}
 		for _, dest := range routeItem.Dests {
-			preConfigRoute.AddRouteItem(routeItem.Protocol, dest, routeItem.NextHop)
+			preConfigRoute.AddForkRouteItem(routeItem.Protocol, dest, nextHops, routeItem.Fork, time.Duration(routeItem.BranchTimeout)*time.Second)
 		}
 
 	}
@@ -290,10 +575,9 @@ func main() {
 		Usage: "a sip proxy in golang",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:     "config",
-				Aliases:  []string{"c"},
-				Required: true,
-				Usage:    "Load configuration from `FILE`",
+				Name:    "config",
+				Aliases: []string{"c"},
+				Usage:   "Load configuration from `FILE`",
 			},
 			&cli.StringFlag{
 				Name:  "log-file",
@@ -323,12 +607,39 @@ func main() {
 				Usage: "the profiling port number",
 				Value: 0,
 			},
+			&cli.IntFlag{
+				Name:  "drain-timeout",
+				Usage: "seconds to wait for the existing sessions to finish after SIGTERM or SIGINT",
+				Value: 30,
+			},
+			&cli.IntFlag{
+				Name:  "retry-after",
+				Usage: "seconds in the Retry-After of the 503 answered to the new dialogs while draining",
+				Value: 5,
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "validate",
+				Usage: "validate the configuration file and exit",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "config",
+						Aliases:  []string{"c"},
+						Required: true,
+						Usage:    "validate the configuration `FILE`",
+					},
+				},
+				Action: validateConfigFile,
+			},
 		},
 		Action: startProxies,
 	}
 	err := app.Run(os.Args)
 	if err != nil {
 		zap.L().Error("Fail to start application", zap.String("error", err.Error()))
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
 
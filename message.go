@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -36,6 +38,8 @@ type Message struct {
 	headers      []*Header
 	body         []byte
 	ReceivedFrom ServerTransport
+	// the Request-URI before it is changed by the proxy, nil if it is not changed
+	receivedRequestURI *AddrSpec
 }
 
 type compactHeaderNames struct {
@@ -101,12 +105,89 @@ func NewRequest(method string, uri string, version string) (*Message, error) {
 		ReceivedFrom: nil}, nil
 }
 
+// NewResponseOf create a response of the request. The Via, From, To, Call-ID
+// and CSeq are copied from the request, a tag is added to the To header if the
+// request has no To tag and the response is not a 100 (Trying).
 func NewResponseOf(request *Message, statusCode int, reason string) *Message {
-	return &Message{request: nil,
+	response := &Message{request: nil,
 		response:     &StatusLine{version: request.request.version, statusCode: statusCode, reason: reason},
 		headers:      make([]*Header, 0),
 		body:         make([]byte, 0),
 		ReceivedFrom: nil}
+	response.copyHeaders(request, "Via")
+	response.copyHeaders(request, "From")
+	response.copyHeaders(request, "To")
+	response.copyHeaders(request, "Call-ID")
+	response.copyHeaders(request, "CSeq")
+	if statusCode > 100 {
+		if to, err := response.GetTo(); err == nil {
+			if _, err := to.GetTag(); err != nil {
+				if tag, err := CreateTag(); err == nil {
+					to.AddParam("tag", tag)
+				}
+			}
+		}
+	}
+	return response
+}
+
+// NewAckOf create the ACK for a non-2xx final response of the INVITE request.
+// The ACK has the same Request-URI, Call-ID, From, top Via and Route headers
+// as the INVITE, the To header of the response and the CSeq method ACK.
+func NewAckOf(request *Message, response *Message) *Message {
+	ack := &Message{request: &RequestLine{method: "ACK", requestURI: request.request.requestURI, version: request.request.version},
+		response:     nil,
+		headers:      make([]*Header, 0),
+		body:         make([]byte, 0),
+		ReceivedFrom: nil}
+	if via, err := request.GetVia(); err == nil {
+		if viaParam, err := via.GetParam(0); err == nil {
+			ack.AddHeader("Via", viaParam.String())
+		}
+	}
+	ack.AddHeader("Max-Forwards", "70")
+	ack.copyHeaders(request, "From")
+	ack.copyHeaders(response, "To")
+	ack.copyHeaders(request, "Call-ID")
+	if cseq, err := request.GetCSeq(); err == nil {
+		ack.AddHeader("CSeq", fmt.Sprintf("%d ACK", cseq.Seq))
+	}
+	ack.copyHeaders(request, "Route")
+	return ack
+}
+
+// NewCancelOf create the CANCEL of the request sent by the proxy. The CANCEL has the
+// same Request-URI, Call-ID, From, To, top Via and Route headers as the request and
+// the CSeq method CANCEL, see RFC 3261 9.1
+func NewCancelOf(request *Message) *Message {
+	cancel := &Message{request: &RequestLine{method: "CANCEL", requestURI: request.request.requestURI, version: request.request.version},
+		response:     nil,
+		headers:      make([]*Header, 0),
+		body:         make([]byte, 0),
+		ReceivedFrom: nil}
+	if via, err := request.GetVia(); err == nil {
+		if viaParam, err := via.GetParam(0); err == nil {
+			cancel.AddHeader("Via", viaParam.String())
+		}
+	}
+	cancel.AddHeader("Max-Forwards", "70")
+	cancel.copyHeaders(request, "From")
+	cancel.copyHeaders(request, "To")
+	cancel.copyHeaders(request, "Call-ID")
+	if cseq, err := request.GetCSeq(); err == nil {
+		cancel.AddHeader("CSeq", fmt.Sprintf("%d CANCEL", cseq.Seq))
+	}
+	cancel.copyHeaders(request, "Route")
+	return cancel
+}
+
+// copyHeaders copy all the headers with the name from another message
+func (m *Message) copyHeaders(from *Message, name string) {
+	for _, header := range from.headers {
+		if m.isSameHeader(header.name, name) {
+			m.AddHeader(header.name, fmt.Sprintf("%v", header.value))
+		}
+	}
 }
 
 func readLine(reader *bufio.Reader) ([]byte, error) {
@@ -337,6 +418,32 @@ func (m *Message) GetTo() (*To, error) {
 	return nil, errors.New("type of the To header is not string or To")
 }
 
+// GetContacts get all the Contact headers
+// If the header is not a Contact, parse it and set the value to Contact
+func (m *Message) GetContacts() ([]*Contact, error) {
+	r := make([]*Contact, 0)
+	for _, header := range m.headers {
+		if !m.isSameHeader(header.name, "Contact") {
+			continue
+		}
+		if c, ok := header.value.(*Contact); ok {
+			r = append(r, c)
+			continue
+		}
+		s, ok := header.value.(string)
+		if !ok {
+			return nil, errors.New("type of the Contact header is not string or Contact")
+		}
+		c, err := ParseContact(s)
+		if err != nil {
+			return nil, err
+		}
+		header.value = c
+		r = append(r, c)
+	}
+	return r, nil
+}
+
 // Get first route item
 func (m *Message) GetRoute() (*Route, error) {
 	header, err := m.GetHeader("Route")
@@ -626,6 +733,30 @@ func (m *Message) GetRequestURI() (*AddrSpec, error) {
 	return m.request.requestURI, nil
 }
 
+// GetReceivedRequestURI get the Request-URI of the request as it is received, before it
+// is restored, rewritten or retargeted by the proxy
+func (m *Message) GetReceivedRequestURI() (*AddrSpec, error) {
+	if m.receivedRequestURI != nil {
+		return m.receivedRequestURI, nil
+	}
+	return m.GetRequestURI()
+}
+
+// SetRequestURI replace the Request-URI when the request is retargeted, the request
+// line is copied because it is shared with the clones of the message
+func (m *Message) SetRequestURI(requestURI *AddrSpec) error {
+	if m.request == nil {
+		return errors.New("not a request")
+	}
+	if m.receivedRequestURI == nil {
+		m.receivedRequestURI = m.request.requestURI
+	}
+	request := *m.request
+	request.requestURI = requestURI
+	m.request = &request
+	return nil
+}
+
 func (m *Message) IsResponse() bool {
 	return m.response != nil
 }
@@ -931,6 +1062,30 @@ func (m *Message) GetServerTransaction() (string, error) {
 	return fmt.Sprintf("%s-%s-%s", method, sentBy, branch), nil
 }
 
+// GetUpstreamServerTransaction get the server transaction of the request received from
+// upstream after the proxy has added its own Via, it is identified by the second Via
+func (m *Message) GetUpstreamServerTransaction() (string, error) {
+	params := make([]*ViaParam, 0, 2)
+	m.ForEachViaParam(func(viaParam *ViaParam) {
+		params = append(params, viaParam)
+	})
+	if len(params) < 2 {
+		return "", fmt.Errorf("no Via of upstream")
+	}
+	branch, err := params[1].GetBranch()
+	if err != nil {
+		return "", err
+	}
+	method, err := m.GetMethod()
+	if err != nil {
+		return "", err
+	}
+	if method == "CANCEL" || method == "ACK" {
+		method = "INVITE"
+	}
+	return fmt.Sprintf("%s-%s-%s", method, params[1].GetSentBy(), branch), nil
+}
+
 // Get the value of Expires
 func (m *Message) GetExpires(defValue int) int {
 	expires, err := m.GetHeaderInt("Expires")
@@ -940,14 +1095,69 @@ func (m *Message) GetExpires(defValue int) int {
 	return defValue
 }
 
+// GetMaxForwards get the value of Max-Forwards
+func (m *Message) GetMaxForwards() (int, error) {
+	return m.GetHeaderInt("Max-Forwards")
+}
+
+// DecreaseMaxForwards decrease the Max-Forwards by one before the request is forwarded.
+// If the request has no or an invalid Max-Forwards, the Max-Forwards is set to 70
+func (m *Message) DecreaseMaxForwards() {
+	pos, err := m.findHeaderPos("Max-Forwards")
+	if err != nil {
+		m.AddHeader("Max-Forwards", "70")
+		return
+	}
+	maxForwards, err := m.GetMaxForwards()
+	if err != nil {
+		maxForwards = 71
+	}
+	// the header may be shared with the cloned message, replace it instead of changing it
+	m.headers[pos] = &Header{name: m.headers[pos].name, value: strconv.Itoa(maxForwards - 1)}
+}
+
+// GetLoopDetectionHash compute the loop detection part of the branch parameter from
+// the fields which are not changed when the request comes back in a loop:
+//
+//	the To tag, From tag, Call-ID header field, the Request-URI, the
+//	sequence number from the CSeq header field, in addition to any
+//	Proxy-Require and Proxy-Authorization header fields.
+//
+// The topmost Via in RFC 3261 16.6 step 8 is not used because it is changed by the
+// element which sends the request back.
+func (m *Message) GetLoopDetectionHash() string {
+	h := md5.New()
+	requestURI, _ := m.GetRequestURI()
+	fmt.Fprintf(h, "%v\n", requestURI)
+	if to, err := m.GetTo(); err == nil {
+		tag, _ := to.GetTag()
+		fmt.Fprintf(h, "%s\n", tag)
+	}
+	if from, err := m.GetFrom(); err == nil {
+		tag, _ := from.GetTag()
+		fmt.Fprintf(h, "%s\n", tag)
+	}
+	callId, _ := m.GetCallID()
+	fmt.Fprintf(h, "%s\n", callId)
+	if cseq, err := m.GetCSeq(); err == nil {
+		fmt.Fprintf(h, "%d\n", cseq.Seq)
+	}
+	for _, header := range m.headers {
+		if m.isSameHeader(header.name, "Proxy-Require") || m.isSameHeader(header.name, "Proxy-Authorization") {
+			fmt.Fprintf(h, "%s: %v\n", header.name, header.value)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[0:16]
+}
+
 func (m *Message) Clone() *Message {
 	headers := make([]*Header, len(m.headers))
 	copy(headers, m.headers)
 
 	return &Message{request: m.request,
-		response:     m.response,
-		headers:      headers,
-		body:         m.body,
-		ReceivedFrom: m.ReceivedFrom}
+		response:           m.response,
+		headers:            headers,
+		body:               m.body,
+		ReceivedFrom:       m.ReceivedFrom,
+		receivedRequestURI: m.receivedRequestURI}
 }
-
@@ -400,3 +400,43 @@ func TestSessionId(t *testing.T) {
 	}
 }
 
+
+func TestNewResponseOf(t *testing.T) {
+	request := createTestRequest("INVITE")
+	response := NewResponseOf(request, 404, "Not Found")
+	if !response.IsFinalResponse() {
+		t.Fail()
+	}
+	if branch, _ := response.GetTopViaBranch(); branch != "z9hG4bK74bf9" {
+		t.Errorf("the Via is not copied from the request")
+	}
+	if cseq, err := response.GetCSeq(); err != nil || cseq.Method != "INVITE" {
+		t.Errorf("the CSeq is not copied from the request")
+	}
+	to, _ := response.GetTo()
+	if _, err := to.GetTag(); err != nil {
+		t.Errorf("no To tag is added to the final response")
+	}
+	trying := NewResponseOf(request, 100, "Trying")
+	to, _ = trying.GetTo()
+	if _, err := to.GetTag(); err == nil {
+		t.Errorf("To tag is added to the 100 Trying")
+	}
+}
+
+func TestDecreaseMaxForwards(t *testing.T) {
+	msg := createTestRequest("OPTIONS")
+	clone := msg.Clone()
+	msg.DecreaseMaxForwards()
+	if n, err := msg.GetMaxForwards(); err != nil || n != 69 {
+		t.Errorf("the Max-Forwards is not decreased")
+	}
+	if n, _ := clone.GetMaxForwards(); n != 70 {
+		t.Errorf("the Max-Forwards of the cloned message is changed")
+	}
+	msg.RemoveHeader("Max-Forwards")
+	msg.DecreaseMaxForwards()
+	if n, err := msg.GetMaxForwards(); err != nil || n != 70 {
+		t.Errorf("the Max-Forwards is not added")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// gaugeFuncCollector collect the gauges whose values are read from the registered
+// functions, the values of the functions with the same labels are added up
+type gaugeFuncCollector struct {
+	sync.Mutex
+	desc   *prometheus.Desc
+	nextId int
+	funcs  map[int]gaugeFunc
+}
+
+type gaugeFunc struct {
+	labelValues []string
+	value       func() float64
+}
+
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sipproxy_messages_received_total",
+		Help: "SIP messages received by the server transports"},
+		[]string{"protocol", "listen", "method", "status_class"})
+	messagesSent = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sipproxy_messages_sent_total",
+		Help: "SIP messages sent successfully"},
+		[]string{"protocol", "listen", "method", "status_class"})
+	backendSends = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sipproxy_backend_sends_total",
+		Help: "messages sent to the backend members"},
+		[]string{"backend"})
+	backendFailures = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sipproxy_backend_send_failures_total",
+		Help: "messages failed to be sent to the backend members"},
+		[]string{"backend"})
+	backendUp = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "sipproxy_backend_up",
+		Help: "1 if the backend member is in rotation, 0 if it is taken out by the health check"},
+		[]string{"backend"})
+	transactionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{Name: "sipproxy_transaction_duration_seconds",
+		Help:    "time from sending the request to receiving its final response in the client transactions",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 32, 64, 180}},
+		[]string{"method", "status_class"})
+	rateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sipproxy_rate_limited_total",
+		Help: "requests rejected over the rate limits or dropped from the blocked sources"},
+		[]string{"proxy", "class", "reason"})
+	// the Redis session store is counted by the bindings cached in this proxy, the keys
+	// in Redis shared with the other proxies are not counted
+	sessionCounts = newGaugeFuncCollector("sipproxy_sessions",
+		"session to backend bindings kept in this proxy, redis-cache is the local cache of the redis session store",
+		"store")
+	queueDepths = newGaugeFuncCollector("sipproxy_queue_depth",
+		"messages waiting in the queues",
+		"queue", "owner")
+)
+
+func init() {
+	prometheus.MustRegister(sessionCounts, queueDepths)
+}
+
+func newGaugeFuncCollector(name string, help string, labelNames ...string) *gaugeFuncCollector {
+	return &gaugeFuncCollector{desc: prometheus.NewDesc(name, help, labelNames, nil),
+		funcs: make(map[int]gaugeFunc)}
+}
+
+// Add register the function to read the gauge value, the returned id is used to remove it
+func (c *gaugeFuncCollector) Add(value func() float64, labelValues ...string) int {
+	c.Lock()
+	defer c.Unlock()
+	c.nextId++
+	c.funcs[c.nextId] = gaugeFunc{labelValues: labelValues, value: value}
+	return c.nextId
+}
+
+func (c *gaugeFuncCollector) Remove(id int) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.funcs, id)
+}
+
+func (c *gaugeFuncCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *gaugeFuncCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	funcs := make([]gaugeFunc, 0, len(c.funcs))
+	for _, f := range c.funcs {
+		funcs = append(funcs, f)
+	}
+	c.Unlock()
+
+	values := make(map[string]float64)
+	labelValues := make(map[string][]string)
+	for _, f := range funcs {
+		key := strings.Join(f.labelValues, "\x00")
+		values[key] += f.value()
+		labelValues[key] = f.labelValues
+	}
+	for key, value := range values {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, value, labelValues[key]...)
+	}
+}
+
+// the methods counted by their names in the method labels, the others are counted as
+// "other" to keep the label values bounded
+var metricMethods = map[string]bool{"INVITE": true, "ACK": true, "BYE": true, "CANCEL": true,
+	"OPTIONS": true, "REGISTER": true, "PRACK": true, "SUBSCRIBE": true, "NOTIFY": true,
+	"PUBLISH": true, "INFO": true, "REFER": true, "MESSAGE": true, "UPDATE": true}
+
+// getMessageLabels get the method and status class labels of the message, the status
+// class is empty for the request
+func getMessageLabels(msg *Message) (string, string) {
+	if msg.IsRequest() {
+		method, _ := msg.GetMethod()
+		return getMethodLabel(method), ""
+	}
+	method := ""
+	if cseq, err := msg.GetCSeq(); err == nil {
+		method = cseq.Method
+	}
+	return getMethodLabel(method), getStatusClass(msg.response.statusCode)
+}
+
+func getMethodLabel(method string) string {
+	if metricMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+func getStatusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 699 {
+		return "other"
+	}
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+// getListenLabel get the listen label of the local address of the connection, the local
+// port of the connection dialed to the peer is ephemeral, it is replaced with 0 to keep
+// the label values bounded
+func getListenLabel(localAddr net.Addr, dialed bool) string {
+	host, port, err := net.SplitHostPort(localAddr.String())
+	if err != nil {
+		return localAddr.String()
+	}
+	if dialed {
+		port = "0"
+	}
+	return fmt.Sprintf("%s:%s", host, port)
+}
+
+// messageReceived count the message received by the server transport
+func messageReceived(transport ServerTransport, msg *Message) {
+	method, statusClass := getMessageLabels(msg)
+	listen := fmt.Sprintf("%s:%d", transport.GetAddress(), transport.GetPort())
+	messagesReceived.WithLabelValues(transport.GetProtocol(), listen, method, statusClass).Inc()
+}
+
+// messageSent count the message sent successfully with the protocol from the listen
+// address, see getListenLabel
+func messageSent(protocol string, listen string, msg *Message) {
+	method, statusClass := getMessageLabels(msg)
+	messagesSent.WithLabelValues(protocol, listen, method, statusClass).Inc()
+}
+
+// observeTransactionDuration observe the time to get the final response of the
+// client transaction, the status class is "timeout" if no final response is received
+func observeTransactionDuration(method string, statusClass string, start time.Time) {
+	transactionDuration.WithLabelValues(getMethodLabel(method), statusClass).Observe(time.Since(start).Seconds())
+}
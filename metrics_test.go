@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAdminGetMetrics(t *testing.T) {
+	admin := createTestAdminServer()
+	messageSent("udp", "127.0.0.1:5060", createTestRequest("INVITE"))
+	sessionID := sessionCounts.Add(func() float64 { return 0 }, "test")
+	defer sessionCounts.Remove(sessionID)
+	queueID := queueDepths.Add(func() float64 { return 0 }, "test", "test")
+	defer queueDepths.Remove(queueID)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, name := range []string{"sipproxy_messages_sent_total", "sipproxy_sessions", "sipproxy_queue_depth"} {
+		if !strings.Contains(body, name) {
+			t.Errorf("%s is not exported", name)
+		}
+	}
+	if !strings.Contains(body, `listen="127.0.0.1:5060"`) {
+		t.Errorf("the listen label of the sent messages is not exported")
+	}
+}
+
+func TestListenLabel(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	if listen := getListenLabel(addr, false); listen != "10.0.0.1:40000" {
+		t.Errorf("unexpected listen label %s", listen)
+	}
+	if listen := getListenLabel(addr, true); listen != "10.0.0.1:0" {
+		t.Errorf("the ephemeral port is in the listen label %s", listen)
+	}
+}
+
+func TestMessageLabels(t *testing.T) {
+	request := createTestRequest("INVITE")
+	if method, statusClass := getMessageLabels(request); method != "INVITE" || statusClass != "" {
+		t.Errorf("unexpected labels %s %s of request", method, statusClass)
+	}
+	response := createTestResponse(request, 486, "486 Busy Here")
+	if method, statusClass := getMessageLabels(response); method != "INVITE" || statusClass != "4xx" {
+		t.Errorf("unexpected labels %s %s of response", method, statusClass)
+	}
+	request = createTestRequest("X-RANDOM-1234")
+	if method, _ := getMessageLabels(request); method != "other" {
+		t.Errorf("the unknown method is not counted as other but %s", method)
+	}
+	response = createTestResponse(request, 99999, "99999 Bad")
+	if method, statusClass := getMessageLabels(response); method != "other" || statusClass != "other" {
+		t.Errorf("unexpected labels %s %s of the response with unknown method and status", method, statusClass)
+	}
+}
+
+func TestGaugeFuncCollector(t *testing.T) {
+	collector := newGaugeFuncCollector("test_sessions", "test sessions", "store")
+	collector.Add(func() float64 { return 2 }, "local")
+	id := collector.Add(func() float64 { return 3 }, "local")
+	collector.Add(func() float64 { return 5 }, "redis")
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	expected := `
+# HELP test_sessions test sessions
+# TYPE test_sessions gauge
+test_sessions{store="local"} 5
+test_sessions{store="redis"} 5
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	collector.Remove(id)
+	expected = `
+# HELP test_sessions test sessions
+# TYPE test_sessions gauge
+test_sessions{store="local"} 2
+test_sessions{store="redis"} 5
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func countGaugeFuncs(c *gaugeFuncCollector) int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.funcs)
+}
+
+func TestProxyCloseRemovesGauges(t *testing.T) {
+	queues, sessions := countGaugeFuncs(queueDepths), countGaugeFuncs(sessionCounts)
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16224}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if countGaugeFuncs(queueDepths) == queues || countGaugeFuncs(sessionCounts) == sessions {
+		t.Fatal("the gauges of the proxy are not registered")
+	}
+	proxy.Close()
+	if n := countGaugeFuncs(queueDepths); n != queues {
+		t.Errorf("expect %d queue depth gauges after the proxy is closed but get %d", queues, n)
+	}
+	if n := countGaugeFuncs(sessionCounts); n != sessions {
+		t.Errorf("expect %d session count gauges after the proxy is closed but get %d", sessions, n)
+	}
+}
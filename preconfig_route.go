@@ -5,6 +5,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type PreRouteItem struct {
@@ -12,21 +14,37 @@ type PreRouteItem struct {
 	dest     string
 	host     string
 	port     int
+	// all the next hops if the request is forked to them, the first one is host:port
+	nextHops []string
+	// parallel or sequential forking to the next hops
+	fork string
+	// the time to wait for the final response of a next hop in the sequential forking
+	branchTimeout time.Duration
+}
+
+// PreRouteItemInfo is a configured route for the admin API
+type PreRouteItemInfo struct {
+	Dest     string   `json:"dest"`
+	Protocol string   `json:"protocol"`
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	NextHops []string `json:"next-hops,omitempty"`
+	Fork     string   `json:"fork,omitempty"`
 }
 
 type PreConfigRoute struct {
+	sync.Mutex
 	items map[string]*PreRouteItem
 }
 
+// NewPreRouteItem create a route item, the port is 0 if it is not in the nextHop and
+// the port is located by the SRV records of the nextHop
 func NewPreRouteItem(protocol string, dest string, nextHop string) (*PreRouteItem, error) {
 	pos := strings.LastIndex(nextHop, ":")
 	host := ""
-	port := 5060
+	port := 0
 	if pos == -1 {
 		host = nextHop
-		if strings.EqualFold("tls", protocol) {
-			port = 5061
-		}
 	} else {
 		host = nextHop[0:pos]
 		var err error
@@ -48,26 +66,94 @@ func NewPreConfigRoute() *PreConfigRoute {
 func (pcr *PreConfigRoute) AddRouteItem(protocol string, dest string, nextHop string) error {
 	item, err := NewPreRouteItem(protocol, dest, nextHop)
 	if err == nil {
+		pcr.Lock()
+		defer pcr.Unlock()
 		pcr.items[dest] = item
 	}
 	return err
 }
 
+// AddForkRouteItem add the route whose requests are forked to all the next hops in
+// parallel or one after another, the branchTimeout is only used in the sequential forking
+func (pcr *PreConfigRoute) AddForkRouteItem(protocol string, dest string, nextHops []string, fork string, branchTimeout time.Duration) error {
+	if len(nextHops) == 0 {
+		return fmt.Errorf("no nexthop for %s", dest)
+	}
+	for _, nextHop := range nextHops {
+		if _, err := NewPreRouteItem(protocol, dest, nextHop); err != nil {
+			return err
+		}
+	}
+	item, _ := NewPreRouteItem(protocol, dest, nextHops[0])
+	if len(nextHops) > 1 {
+		item.nextHops = nextHops
+		item.fork = strings.ToLower(fork)
+		if item.fork == "" {
+			item.fork = forkParallel
+		}
+		item.branchTimeout = branchTimeout
+	}
+	pcr.Lock()
+	defer pcr.Unlock()
+	pcr.items[dest] = item
+	return nil
+}
+
 func (pcr *PreConfigRoute) FindRoute(dest string) (protocol string, host string, port int, err error) {
+	item, err := pcr.findRouteItem(dest)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return item.protocol, item.host, item.port, nil
+}
+
+// FindForkRoute find the route of the destination which has more than one next hop
+func (pcr *PreConfigRoute) FindForkRoute(dest string) (*PreRouteItem, bool) {
+	item, err := pcr.findRouteItem(dest)
+	if err != nil || len(item.nextHops) == 0 {
+		return nil, false
+	}
+	return item, true
+}
+
+func (pcr *PreConfigRoute) findRouteItem(dest string) (*PreRouteItem, error) {
+	pcr.Lock()
+	defer pcr.Unlock()
 	if item, ok := pcr.items[dest]; ok {
-		return item.protocol, item.host, item.port, nil
+		return item, nil
 	}
 	for _, item := range pcr.items {
 		matched, err := regexp.MatchString(pcr.toRegularExp(item.dest), dest)
 		if matched && err == nil {
-			return item.protocol, item.host, item.port, nil
+			return item, nil
 		}
 	}
 	if item, ok := pcr.items["default"]; ok {
-		return item.protocol, item.host, item.port, nil
+		return item, nil
 	}
 
-	return "", "", 0, fmt.Errorf("fail to find route for %s", dest)
+	return nil, fmt.Errorf("fail to find route for %s", dest)
+}
+
+// GetRouteItems returns all the configured route items
+func (pcr *PreConfigRoute) GetRouteItems() []PreRouteItemInfo {
+	pcr.Lock()
+	defer pcr.Unlock()
+	r := make([]PreRouteItemInfo, 0)
+	for _, item := range pcr.items {
+		r = append(r, PreRouteItemInfo{Dest: item.dest, Protocol: item.protocol, Host: item.host, Port: item.port, NextHops: item.nextHops, Fork: item.fork})
+	}
+	return r
+}
+
+// Replace replace all the route items with the items of other route at once
+func (pcr *PreConfigRoute) Replace(other *PreConfigRoute) {
+	other.Lock()
+	items := other.items
+	other.Unlock()
+	pcr.Lock()
+	defer pcr.Unlock()
+	pcr.items = items
 }
 
 func (pcr *PreConfigRoute) toRegularExp(s string) string {
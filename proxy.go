@@ -1,23 +1,40 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"regexp"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 type ProxyItem struct {
 	sync.Mutex
-	transports []ServerTransport
-	viaConfig  *ViaConfig
-	backend    *RoundRobinBackend
-	msgHandler MessageHandler
+	listenConfig ListenConfig
+	transports   []ServerTransport
+	viaConfig    *ViaConfig
+	backend      *RoundRobinBackend
+	msgHandler   MessageHandler
+	// nil if the health check of the backends is not configured
+	healthChecker *HealthChecker
+	// used to create the backends when the backends are changed by reload
+	clientTLSConfig        *tls.Config
+	backendConnEstablished ConnectionEstablishedFunc
+	// nil if the authentication is not configured
+	authenticator *DigestAuthenticator
+	// the sources allowed to send to the listener
+	acl *AccessList
+	// change the headers of the messages received by the listener
+	headerRules *HeaderRules
 }
 
 // MyName is a structure to hold the name and patterns for matching SIP messages
@@ -109,6 +126,7 @@ func (p *MyName) isMyMessage(msg *Message) bool {
 }
 
 type Proxy struct {
+	name                   string
 	myName                 *MyName
 	listenConfigs          []ListenConfig
 	receivedSupport        bool
@@ -116,13 +134,64 @@ type Proxy struct {
 	preConfigRoute         *PreConfigRoute
 	resolver               *PreConfigHostResolver
 	items                  []*ProxyItem
+	itemsLock              sync.Mutex
 	clientTransMgr         *ClientTransportMgr
 	selfLearnRoute         *SelfLearnRoute
 	mustRecordRoute        bool
-	msgChannel             chan *RawMessage
 	connAcceptedChannel    chan net.Conn
 	sessionBackends        SessionBasedBackend
 	clientTransportFactory *ClientTransportFactory
+	clientTransactionMgr   *ClientTransactionMgr
+	serverTransactionMgr   *ServerTransactionMgr
+	// the number of the message processing goroutines, default is the number of CPUs
+	workerCount int
+	// the message processing goroutines, the messages of a dialog are processed by the
+	// same worker selected by the hash of Call-ID
+	workers []*proxyWorker
+	// 1 after the workers are started, no message is queued to the workers before it
+	workersStarted int32
+	// the requests which can be retried on the next backend, the key is the Via branch
+	failovers     map[string]*backendFailover
+	failoversLock sync.Mutex
+	// closed when the proxy is stopped
+	stop chan struct{}
+	// 1 if the proxy is draining, the new dialogs are rejected
+	draining        int32
+	drainRetryAfter int32
+	// the sources allowed to send to all the listeners
+	acl *AccessList
+	// limit the requests from each source before they are queued to the workers
+	rateLimiter *RateLimiter
+	registrar   *Registrar
+	// the forked requests keyed by the Via branch of each fork
+	forkBranches map[string]*forkContext
+	forksLock    sync.Mutex
+	// the INVITEs sent statefully keyed by the Via branch of the proxy, and their Via
+	// branches keyed by the server transaction of the INVITE received from upstream
+	inviteBranches map[string]*forwardedInvite
+	invites        map[string][]string
+	invitesLock    sync.Mutex
+	// change the headers of the messages received by all the listeners
+	headerRules *HeaderRules
+	// follow the 3xx responses instead of relaying them if it is not nil
+	redirect     *RedirectConfig
+	redirectLock sync.Mutex
+	// the registrations of the proxy to the upstream carriers
+	trunks     []*Register
+	trunksLock sync.Mutex
+	// the topologies hidden by the listeners with topology-hiding, kept for the dialogs
+	topologyStore TopologyStore
+	dialogExpire  time.Duration
+	// the INVITE dialogs established through the proxy, waited for in drain mode
+	dialogs *DialogTracker
+}
+
+// proxyWorker process the messages and the timer tasks of the dialogs assigned to it in order
+type proxyWorker struct {
+	msgChannel chan *RawMessage
+	// tasks from the timers which must be run in the message processing goroutine
+	taskChannel  chan func()
+	queueDepthId int
 }
 
 func NewProxy(name string,
@@ -136,7 +205,8 @@ func NewProxy(name string,
 	mustRecordRoute bool,
 	redisSessionStore *RedisSessionStore) *Proxy {
 
-	proxy := &Proxy{myName: NewMyName(name),
+	proxy := &Proxy{name: name,
+		myName:                 NewMyName(name),
 		listenConfigs:          listenConfigs,
 		receivedSupport:        receivedSupport,
 		keepNextHopRoute:       keepNextHopRoute,
@@ -146,13 +216,26 @@ func NewProxy(name string,
 		clientTransMgr:         nil,
 		selfLearnRoute:         selfLearnRoute,
 		mustRecordRoute:        mustRecordRoute,
-		msgChannel:             make(chan *RawMessage, 10000),
 		connAcceptedChannel:    make(chan net.Conn),
 		sessionBackends:        nil,
-		clientTransportFactory: NewClientTransportFactory(resolver)}
+		workerCount:            runtime.NumCPU(),
+		workers:                make([]*proxyWorker, 0),
+		clientTransportFactory: NewClientTransportFactory(resolver),
+		serverTransactionMgr:   NewServerTransactionMgr(),
+		failovers:              make(map[string]*backendFailover),
+		stop:                   make(chan struct{}),
+		acl:                    NewAccessList(nil),
+		rateLimiter:            NewRateLimiter(name),
+		headerRules:            NewHeaderRules(),
+		forkBranches:           make(map[string]*forkContext),
+		inviteBranches:         make(map[string]*forwardedInvite),
+		invites:                make(map[string][]string),
+		dialogExpire:           time.Duration(dialogExpire) * time.Second,
+		dialogs:                NewDialogTracker(time.Duration(dialogExpire) * time.Second)}
+	proxy.clientTransactionMgr = NewClientTransactionMgr(proxy.clientTransactionTimeout)
 
 	for _, listenConf := range listenConfigs {
-		item, err := NewProxyItem(listenConf, receivedSupport, proxy, selfLearnRoute, proxy)
+		item, err := NewProxyItem(listenConf, receivedSupport, proxy, selfLearnRoute, proxy, proxy.acl)
 		if err == nil {
 			proxy.items = append(proxy.items, item)
 		}
@@ -168,7 +251,7 @@ func NewProxy(name string,
 	if redisSessionStore != nil {
 		findBackendByAddr := func(backendAddr string) (Backend, error) {
 			// find the backend by address
-			for _, item := range proxy.items {
+			for _, item := range proxy.getItems() {
 				backend, err := item.findBackendByAddr(backendAddr)
 				if err == nil {
 					zap.L().Info("succeed to find backend by address get from redis", zap.String("backendAddr", backendAddr))
@@ -178,19 +261,37 @@ func NewProxy(name string,
 			return nil, fmt.Errorf("fail to find backend by address %s", backendAddr)
 		}
 		zap.L().Info("use redis session store for dialog and transaction", zap.Any("redisAddr", redisSessionStore), zap.Int64("dialogExpire", dialogExpire))
-		sessionBackends := []SessionBasedBackend{NewLocalSessionBasedBackend(dialogExpire), NewMasterSlaveRedisSessionBasedBackend(*redisSessionStore, dialogExpire, findBackendByAddr)}
+		redisBackend := NewMasterSlaveRedisSessionBasedBackend(*redisSessionStore, dialogExpire, findBackendByAddr)
+		sessionBackends := []SessionBasedBackend{NewLocalSessionBasedBackend(dialogExpire), redisBackend}
 		proxy.sessionBackends = NewCompositeSessionBasedBackend(sessionBackends)
+		if redisBackend != nil {
+			proxy.registrar = NewRegistrar(name, NewRedisLocationStore(redisBackend))
+			proxy.topologyStore = NewRedisTopologyStore(redisBackend)
+		}
 	} else {
 		zap.L().Info("use local session store for dialog and transaction")
 		proxy.sessionBackends = NewLocalSessionBasedBackend(dialogExpire)
 	}
+	if proxy.registrar == nil {
+		proxy.registrar = NewRegistrar(name, NewLocalLocationStore())
+	}
+	if proxy.topologyStore == nil {
+		proxy.topologyStore = NewLocalTopologyStore()
+	}
 
-	go proxy.receiveAndProcessMessage()
 	return proxy
 }
 
+// SetWorkers set the number of message processing goroutines, it must be called before Start
+func (p *Proxy) SetWorkers(n int) {
+	if n > 0 {
+		p.workerCount = n
+	}
+}
+
 func (p *Proxy) Start() error {
-	for _, item := range p.items {
+	p.startWorkers()
+	for _, item := range p.getItems() {
 		err := item.Start()
 		if err != nil {
 			return err
@@ -199,34 +300,169 @@ func (p *Proxy) Start() error {
 	return nil
 }
 
+// Stop stop all the listens and the message processing workers of the proxy
+func (p *Proxy) Stop() {
+	zap.L().Info("stop sip proxy", zap.String("name", p.name))
+	p.SetTrunks(nil)
+	for _, item := range p.getItems() {
+		item.Stop()
+	}
+	for _, worker := range p.workers {
+		queueDepths.Remove(worker.queueDepthId)
+	}
+	close(p.stop)
+}
+
+func (p *Proxy) getItems() []*ProxyItem {
+	p.itemsLock.Lock()
+	defer p.itemsLock.Unlock()
+	return p.items
+}
+
+// GetProxyInfo get the listeners and backends of the proxy for the admin API
+func (p *Proxy) GetProxyInfo(id int) ProxyInfo {
+	info := ProxyInfo{Id: id, Name: p.name, Listens: make([]ListenInfo, 0)}
+	for _, item := range p.getItems() {
+		info.Listens = append(info.Listens, item.GetListenInfo())
+	}
+	return info
+}
+
+// GetBackendInfos get the backend members of every listener
+func (p *Proxy) GetBackendInfos() []BackendInfo {
+	r := make([]BackendInfo, 0)
+	for _, item := range p.getItems() {
+		if item.backend == nil {
+			continue
+		}
+		members := make([]string, 0)
+		for addr := range item.backend.GetAllBackend() {
+			members = append(members, addr)
+		}
+		slices.Sort(members)
+		info := BackendInfo{Listen: item.getListenConfig().Address, Policy: string(item.backend.GetPolicy()), Members: members}
+		if item.healthChecker != nil {
+			info.Health = item.healthChecker.GetHealthInfos()
+		}
+		r = append(r, info)
+	}
+	return r
+}
+
+// GetSessions get the session to backend bindings kept in this proxy
+func (p *Proxy) GetSessions() []SessionInfo {
+	if local := getLocalSessionBasedBackend(p.sessionBackends); local != nil {
+		return local.GetSessions()
+	}
+	return make([]SessionInfo, 0)
+}
+
+// SetClientTLSConfig set the certificates used to connect the next hop with TLS
+func (p *Proxy) SetClientTLSConfig(tlsConfig *tls.Config) {
+	p.clientTransportFactory.SetTLSConfig(tlsConfig)
+}
+
 func (p *Proxy) HandleRawMessage(msg *RawMessage) {
-	p.msgChannel <- msg
+	messageReceived(msg.From, msg.Message)
+	if p.limitRate(msg) {
+		return
+	}
+	worker := p.getWorker(msg.Message)
+	if worker == nil {
+		zap.L().Warn("drop the message received before the proxy is started", zap.String("proxy", p.name))
+		return
+	}
+	select {
+	case worker.msgChannel <- msg:
+	case <-p.stop:
+	}
 }
 
 // ConnectionAccepted implement ConnectionAcceptedListener interface
 func (p *Proxy) ConnectionAccepted(conn net.Conn) {
-	p.connAcceptedChannel <- conn
+	select {
+	case p.connAcceptedChannel <- conn:
+	case <-p.stop:
+		conn.Close()
+	}
 }
 
-func (p *Proxy) receiveAndProcessMessage() {
+func (p *Proxy) startWorkers() {
+	workers := make([]*proxyWorker, 0, p.workerCount)
+	for i := 0; i < p.workerCount; i++ {
+		worker := &proxyWorker{msgChannel: make(chan *RawMessage, 10000), taskChannel: make(chan func(), 1000)}
+		workers = append(workers, worker)
+		worker.queueDepthId = queueDepths.Add(func() float64 {
+			return float64(len(worker.msgChannel))
+		}, "proxy-message", p.name)
+		go p.receiveAndProcessMessage(worker)
+	}
+	p.workers = workers
+	atomic.StoreInt32(&p.workersStarted, 1)
+	zap.L().Info("start message processing workers", zap.String("proxy", p.name), zap.Int("workers", p.workerCount))
+	go p.acceptConnections()
+}
+
+// getWorker get the worker of the dialog by the hash of Call-ID, nil is returned if
+// the workers are not started
+func (p *Proxy) getWorker(msg *Message) *proxyWorker {
+	if atomic.LoadInt32(&p.workersStarted) == 0 {
+		return nil
+	}
+	callId, _ := msg.GetCallID()
+	h := fnv.New32a()
+	h.Write([]byte(callId))
+	return p.workers[h.Sum32()%uint32(len(p.workers))]
+}
+
+// postTask run the task in the worker processing the dialog of the message, the task
+// is dropped if the proxy is not started or is stopped
+func (p *Proxy) postTask(msg *Message, task func()) {
+	worker := p.getWorker(msg)
+	if worker == nil {
+		return
+	}
+	select {
+	case worker.taskChannel <- task:
+	case <-p.stop:
+	}
+}
+
+func (p *Proxy) receiveAndProcessMessage(worker *proxyWorker) {
 	for {
 		select {
-		case rawMsg := <-p.msgChannel:
+		case rawMsg := <-worker.msgChannel:
 			msg, err := p.handleRawMessage(rawMsg)
 			if err == nil {
-				p.handleMessage(rawMsg.From.GetProtocol(), msg, rawMsg.Backend, rawMsg.Via)
+				p.handleMessage(rawMsg.From.GetProtocol(), msg, rawMsg.PeerAddr, rawMsg.Backend, rawMsg.Via)
 				p.handleSession(msg)
 			}
 
-		case conn := <-p.connAcceptedChannel:
-			host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+		case task := <-worker.taskChannel:
+			task()
+
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Proxy) acceptConnections() {
+	for {
+		var conn net.Conn
+		select {
+		case conn = <-p.connAcceptedChannel:
+		case <-p.stop:
+			return
+		}
+		host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err == nil {
+			port_i, err := strconv.Atoi(port)
 			if err == nil {
-				port_i, err := strconv.Atoi(port)
+				trans, err := p.clientTransMgr.GetTransport(getConnProtocol(conn), host, port_i, "")
 				if err == nil {
-					trans, err := p.clientTransMgr.GetTransport("tcp", host, port_i, "")
-					if err == nil {
-						trans.primary, _ = NewTCPClientTransportWithConn(conn)
-					}
+					client, _ := NewTCPClientTransportWithConn(conn)
+					trans.SetPrimary(client)
 				}
 			}
 		}
@@ -260,9 +496,10 @@ func (p *Proxy) handleRawMessage(rawMessage *RawMessage) (*Message, error) {
 			// create a transport for transaction in tcp connection
 			transId, err := msg.GetClientTransaction()
 			if err == nil {
-				trans, err := p.clientTransMgr.GetTransport("tcp", host, port, transId)
+				trans, err := p.clientTransMgr.GetTransport(getConnProtocol(rawMessage.TcpConn), host, port, transId)
 				if err == nil {
-					trans.primary, _ = NewTCPClientTransportWithConn(rawMessage.TcpConn)
+					client, _ := NewTCPClientTransportWithConn(rawMessage.TcpConn)
+					trans.SetPrimary(client)
 				} else {
 					zap.L().Error("fail to get tcp transport", zap.String("host", host), zap.Int("port", port), zap.String("transactionId", transId), zap.String("error", err.Error()))
 				}
@@ -271,15 +508,43 @@ func (p *Proxy) handleRawMessage(rawMessage *RawMessage) (*Message, error) {
 			}
 		}
 	}
+	if msg.IsRequest() && rawMessage.ConnTransport != nil {
+		p.addConnTransport(msg, rawMessage)
+	}
 	// The proxy will inspect the URI in the topmost Route header
 	// field value.  If it indicates this proxy, the proxy removes it
 	// from the Route header field (this route node has been
 	// reached).
 
+	p.restoreRequestTopology(msg)
 	p.tryRemoveTopRoute(rawMessage)
 	return msg, nil
 }
 
+// ConnTransportClosed forget the addresses of the peer of the closed connection
+func (p *Proxy) ConnTransportClosed(client ClientTransport) {
+	p.clientTransMgr.RemoveConnTransport(client)
+}
+
+// addConnTransport route the responses and the requests to the peer back over the
+// connection on which the request is received. The Via host is the random invalid
+// domain name for the WebSocket clients, it is also used in the Contact of the client
+func (p *Proxy) addConnTransport(msg *Message, rawMessage *RawMessage) {
+	protocol := rawMessage.From.GetProtocol()
+	p.clientTransMgr.AddTransport(protocol, rawMessage.PeerAddr, rawMessage.PeerPort, rawMessage.ConnTransport)
+	host, port, _, err := p.getNextReponseHop(msg)
+	if err != nil {
+		zap.L().Error("fail to get host/port of the next response", zap.String("error", err.Error()))
+		return
+	}
+	p.clientTransMgr.AddTransport(protocol, strings.Trim(host, "[]"), port, rawMessage.ConnTransport)
+	if via, err := msg.GetVia(); err == nil {
+		if viaParam, err := via.GetParam(0); err == nil && viaParam.Host != host {
+			p.clientTransMgr.AddTransport(protocol, viaParam.Host, viaParam.GetPort(), rawMessage.ConnTransport)
+		}
+	}
+}
+
 func (p *Proxy) tryRemoveTopRoute(rawMessage *RawMessage) {
 	msg := rawMessage.Message
 
@@ -336,6 +601,17 @@ func (p *Proxy) isSameAddress(addr1 string, addr2 string) bool {
 
 }
 
+// isHealthCheckResponse check if the response is the response of the OPTIONS probe
+// sent by the health checker
+func (p *Proxy) isHealthCheckResponse(msg *Message) bool {
+	for _, item := range p.getItems() {
+		if item.healthChecker != nil && item.healthChecker.HandleResponse(msg) {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *Proxy) handleSession(msg *Message) {
 	if !msg.IsResponse() {
 		return
@@ -354,7 +630,7 @@ func (p *Proxy) handleSession(msg *Message) {
 
 }
 
-func (p *Proxy) handleMessage(protocol string, msg *Message, backend Backend, viaConfig *ViaConfig) {
+func (p *Proxy) handleMessage(protocol string, msg *Message, peerAddr string, backend Backend, viaConfig *ViaConfig) {
 	callId, _ := msg.GetCallID()
 	if zap.L().Core().Enabled(zap.DebugLevel) {
 		zap.L().Debug("Received a message", zap.String("localHost", msg.ReceivedFrom.GetAddress()), zap.Int("port", msg.ReceivedFrom.GetPort()), zap.String("message", msg.String()))
@@ -362,49 +638,241 @@ func (p *Proxy) handleMessage(protocol string, msg *Message, backend Backend, vi
 		zap.L().Info("Received a message", zap.String("localHost", msg.ReceivedFrom.GetAddress()), zap.Int("port", msg.ReceivedFrom.GetPort()), zap.String("call-id", callId))
 	}
 	if msg.IsRequest() {
+		if _, forward := p.serverTransactionMgr.HandleRequest(msg, protocol != "udp", p.forwardResponse); !forward {
+			return
+		}
+		p.applyHeaderRules(msg, peerAddr)
+		if maxForwards, err := msg.GetMaxForwards(); err == nil && maxForwards <= 0 {
+			zap.L().Error("Max-Forwards of the request reaches zero", zap.String("call-id", callId))
+			p.replyRequest(msg, 483, "Too Many Hops")
+			return
+		}
+		if p.isLoopedRequest(msg) {
+			zap.L().Error("loop is detected for the request", zap.String("call-id", callId))
+			p.replyRequest(msg, 482, "Loop Detected")
+			return
+		}
+		if p.rejectUnauthenticated(msg, peerAddr) {
+			return
+		}
+		if p.rejectNewDialog(msg) {
+			return
+		}
+		if p.handleRegister(msg, peerAddr) || p.cancelInvite(msg) {
+			return
+		}
+		msg.DecreaseMaxForwards()
+		if method, _ := msg.GetMethod(); method == "INVITE" {
+			// stop the retransmission of the INVITE from upstream
+			p.replyRequest(msg, 100, "Trying")
+		}
+		if p.routeToContacts(protocol, msg) || p.routeToForkHops(protocol, msg) {
+			return
+		}
 		host, port, transport, err := p.getNextRequestHop(msg)
+		isMine := err != nil && p.myName.isMyMessage(msg)
+		if err != nil && !isMine {
+			host, port, transport, err = p.getNextRequestHopByRequestURI(msg)
+		}
 		if err == nil {
 			zap.L().Info("Get next hop for request", zap.String("host", host), zap.Int("port", port), zap.String("transport", transport))
 			serverTrans, ok := p.selfLearnRoute.GetRoute(host, protocol)
-
+			if !ok {
+				serverTrans = p.findHidingTransport(msg, protocol)
+				ok = serverTrans != nil
+			}
 			if ok {
 				p.addVia(msg, serverTrans)
 				p.addRecordRoute(msg, serverTrans)
 			}
-			p.sendRequest(host, port, transport, msg)
-		} else if p.myName.isMyMessage(msg) {
+			p.sendRequest(host, port, transport, msg, ok)
+		} else if isMine {
 			zap.L().Info("it is my request", zap.String("call-id", callId))
 			p.sendToBackend(protocol, msg, backend, viaConfig)
 		} else {
 			zap.L().Error("Not my message, fail to route the message")
+			p.replyRequest(msg, 404, "Not Found")
 		}
 	} else {
+		if p.isHealthCheckResponse(msg) || p.isTrunkResponse(msg) {
+			return
+		}
+		p.restoreResponseTopology(msg)
+		ct, forward := p.clientTransactionMgr.HandleResponse(msg)
+		if !forward {
+			zap.L().Info("response is absorbed by client transaction", zap.String("call-id", callId))
+			return
+		}
+		// tracked before the response is relayed and retransmitted by the server transaction
+		p.dialogs.HandleResponse(msg)
+		p.applyHeaderRules(msg, peerAddr)
+		cancelled := p.isCancelledResponse(msg)
+		if p.cancelOnResponse(msg) {
+			return
+		}
+		if msg.IsFinalResponse() {
+			p.backendTransactionFinished(msg)
+			if p.failoverOnResponse(msg) {
+				return
+			}
+			if !cancelled && p.recurseOnRedirect(msg, ct) {
+				return
+			}
+		}
+		if p.forkOnResponse(msg) {
+			return
+		}
+		// the proxy has sent its own 100 (Trying) to upstream
+		if msg.response.statusCode == 100 {
+			return
+		}
 		msg.PopVia()
-		host, port, transport, err := p.getNextReponseHop(msg)
+		p.sendProxyResponse(msg)
+	}
+}
 
-		if err != nil {
-			zap.L().Error("Fail to find the next hop for response", zap.String("message", msg.String()))
-		} else {
-			p.sendResponse(host, port, transport, msg)
+// replyRequest answer the received request with a response generated by the proxy
+func (p *Proxy) replyRequest(request *Message, statusCode int, reason string) {
+	if method, _ := request.GetMethod(); method == "ACK" {
+		return
+	}
+	callId, _ := request.GetCallID()
+	zap.L().Info("reply request", zap.Int("statusCode", statusCode), zap.String("reason", reason), zap.String("call-id", callId))
+	p.sendProxyResponse(NewResponseOf(request, statusCode, reason))
+}
+
+// replyForwardedRequest answer the request to which the proxy has added its own Via
+func (p *Proxy) replyForwardedRequest(request *Message, statusCode int, reason string) {
+	if method, _ := request.GetMethod(); method == "ACK" {
+		return
+	}
+	callId, _ := request.GetCallID()
+	zap.L().Info("reply forwarded request", zap.Int("statusCode", statusCode), zap.String("reason", reason), zap.String("call-id", callId))
+	response := NewResponseOf(request, statusCode, reason)
+	response.PopVia()
+	p.sendProxyResponse(response)
+}
+
+// sendProxyResponse send the response through its server transaction or statelessly
+// if no server transaction is found
+func (p *Proxy) sendProxyResponse(msg *Message) {
+	msg = p.hideResponseTopology(msg)
+	if !p.serverTransactionMgr.SendResponse(msg) {
+		p.forwardResponse(msg)
+	}
+}
+
+// clientTransactionTimeout answer 408 to upstream if no final response is received
+func (p *Proxy) clientTransactionTimeout(ct *ClientTransaction) {
+	p.postTask(ct.GetRequest(), func() {
+		if p.cancelOnTimeout(ct.GetRequest()) {
+			// the INVITE is cancelled, it must not be retried on the next backend
+			p.removeBackendFailover(ct.GetRequest())
+			return
+		}
+		p.backendTransactionFinished(ct.GetRequest())
+		if p.failoverOnTimeout(ct.GetRequest()) {
+			return
+		}
+		if p.forkOnTimeout(ct.GetRequest()) {
+			return
 		}
+		p.replyForwardedRequest(ct.GetRequest(), 408, "Request Timeout")
+	})
+}
+
+// backendTransactionFinished the transaction of the request or response is not
+// outstanding in the backend anymore
+func (p *Proxy) backendTransactionFinished(msg *Message) {
+	branch, err := msg.GetTopViaBranch()
+	if err != nil {
+		return
+	}
+	for _, item := range p.getItems() {
+		if item.backend != nil {
+			item.backend.TransactionFinished(branch)
+		}
+	}
+}
+
+// forwardResponse send the response to the next hop found in the top Via
+func (p *Proxy) forwardResponse(msg *Message) error {
+	host, port, transport, err := p.getNextReponseHop(msg)
+	if err != nil {
+		zap.L().Error("Fail to find the next hop for response", zap.String("message", msg.String()))
+		return err
 	}
+	return p.sendResponse(host, port, transport, msg)
 }
 
+// addClientTransaction create the client transaction for the request sent by the
+// proxy with its own Via, the ACK has no client transaction. The INVITE is tracked to
+// cancel it with the same send function
+func (p *Proxy) addClientTransaction(msg *Message, reliable bool, send TransactionSendFunc) {
+	if method, err := msg.GetMethod(); err != nil || method == "ACK" {
+		return
+	}
+	if _, err := p.clientTransactionMgr.AddTransaction(msg, reliable, send); err != nil {
+		zap.L().Error("Fail to create client transaction", zap.String("error", err.Error()))
+		return
+	}
+	p.trackInvite(msg, reliable, send)
+}
+
+// addVia add the Via of the proxy, the loop detection hash of the request is appended
+// to the branch parameter
 func (p *Proxy) addVia(msg *Message, transport ServerTransport) (*Via, error) {
 	via, err := CreateVia(transport.GetProtocol(), transport.GetAddress(), transport.GetPort())
 	if err == nil {
+		if viaParam, err := via.GetParam(0); err == nil {
+			branch, _ := viaParam.GetBranch()
+			viaParam.SetBranch(branch + "." + msg.GetLoopDetectionHash())
+		}
 		msg.AddVia(via)
 	}
 	return via, nil
 }
 
+// isLoopedRequest check if the request has been forwarded by the proxy before without
+// any change which affects the routing, see RFC 3261 16.3 step 4
+func (p *Proxy) isLoopedRequest(msg *Message) bool {
+	suffix := "." + msg.GetLoopDetectionHash()
+	looped := false
+	msg.ForEachViaParam(func(viaParam *ViaParam) {
+		if looped || !p.isMyViaParam(viaParam) {
+			return
+		}
+		branch, err := viaParam.GetBranch()
+		looped = err == nil && strings.HasSuffix(branch, suffix)
+	})
+	return looped
+}
+
+// isMyViaParam check if the sent-by of the Via is one of the transports of the proxy
+func (p *Proxy) isMyViaParam(viaParam *ViaParam) bool {
+	for _, item := range p.getItems() {
+		_, err := item.FindTransport(func(transport ServerTransport) bool {
+			return strings.EqualFold(transport.GetProtocol(), viaParam.Transport) &&
+				transport.GetPort() == viaParam.GetPort() &&
+				p.isSameAddress(transport.GetAddress(), viaParam.Host)
+		})
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *Proxy) addRecordRoute(msg *Message, transport ServerTransport) {
-	// if no Record-Route header is found and the mustRecordRoute is false, no need to add Record-Route header
-	if _, err := msg.GetHeader("Record-Route"); err != nil && !p.mustRecordRoute {
+	// if no Record-Route header is found and the mustRecordRoute is false, no need to add Record-Route header.
+	// The dialog through a listener hiding the topology is always record-routed for its
+	// in-dialog requests to be restored by the proxy
+	hiding := isOutOfDialogRequest(msg) && (p.hidesTopology(transport) || p.hidesTopology(msg.ReceivedFrom))
+	if _, err := msg.GetHeader("Record-Route"); err != nil && !p.mustRecordRoute && !hiding {
 		return
 	}
 
-	msg.AddRecordRoute(CreateRecordRoute(transport.GetAddress(), transport.GetPort()))
+	msg.AddRecordRoute(CreateRecordRoute(transport.GetAddress(), transport.GetPort(), transport.GetProtocol()))
 }
 
 func (p *Proxy) sendToBackend(protocol string, msg *Message, preferBackend Backend, viaConfig *ViaConfig) {
@@ -412,6 +880,7 @@ func (p *Proxy) sendToBackend(protocol string, msg *Message, preferBackend Backe
 	backendItem := p.findBackendProxyItem(protocol)
 	if backendItem == nil && preferBackend == nil {
 		zap.L().Error("Fail to find the backend for my message", zap.String("message", msg.String()))
+		p.replyRequest(msg, 503, "Service Unavailable")
 	} else {
 		sessionId, _ := msg.GetSessionId()
 		backend, transport, err := p.findBackendBySessionId(protocol, sessionId)
@@ -445,17 +914,34 @@ func (p *Proxy) sendToBackend(protocol string, msg *Message, preferBackend Backe
 				transport = backendItem.transports[0]
 			}
 		}
+		if backend == nil {
+			zap.L().Error("Fail to find backend for my message", zap.String("message", msg.String()))
+			p.replyRequest(msg, 503, "Service Unavailable")
+			return
+		}
 		if transport != nil {
 			p.addVia(msg, transport)
 			p.addRecordRoute(msg, transport)
 		}
-		if backend == nil {
-			zap.L().Error("Fail to find backend for my message", zap.String("message", msg.String()))
-			return
+		var usedBackend Backend
+		address := ""
+		rb, isRoundRobin := backend.(*RoundRobinBackend)
+		if isRoundRobin {
+			usedBackend, address, err = rb.SendExcept(p.hideRequestTopology(msg), nil)
+		} else {
+			usedBackend, err = backend.Send(p.hideRequestTopology(msg))
 		}
-		usedBackend, err := backend.Send(msg)
 		if err == nil {
 			zap.L().Debug("succeed to send the message to the backend", zap.String("backend", usedBackend.GetAddress()), zap.String("message", msg.String()))
+			if transport != nil {
+				p.addClientTransaction(msg, !strings.HasPrefix(usedBackend.GetAddress(), "udp"), func(m *Message) error {
+					_, err := usedBackend.Send(p.hideRequestTopology(m))
+					return err
+				})
+				if isRoundRobin {
+					p.addBackendFailover(msg, transport, rb, []string{address}, sessionId)
+				}
+			}
 			if len(sessionId) > 0 {
 				// bind the backend with the transaction
 				zap.L().Info("bind session with backend", zap.String("sessionId", sessionId), zap.String("backend", usedBackend.GetAddress()))
@@ -463,6 +949,11 @@ func (p *Proxy) sendToBackend(protocol string, msg *Message, preferBackend Backe
 			}
 		} else {
 			zap.L().Error("Fail to send the message to the backend", zap.String("backend", backend.GetAddress()), zap.String("message", msg.String()))
+			if transport != nil {
+				p.replyForwardedRequest(msg, 503, "Service Unavailable")
+			} else {
+				p.replyRequest(msg, 503, "Service Unavailable")
+			}
 		}
 	}
 }
@@ -482,7 +973,7 @@ func (p *Proxy) findTransportByViaConfig(viaConfig *ViaConfig) (ServerTransport,
 	if viaConfig == nil {
 		return nil, fmt.Errorf("no via config")
 	}
-	for _, item := range p.items {
+	for _, item := range p.getItems() {
 		transport, err := item.FindTransport(func(transport ServerTransport) bool {
 			return transport.GetProtocol() == viaConfig.Protocol && transport.GetAddress() == viaConfig.Address && transport.GetPort() == viaConfig.Port
 		})
@@ -495,7 +986,7 @@ func (p *Proxy) findTransportByViaConfig(viaConfig *ViaConfig) (ServerTransport,
 }
 
 func (p *Proxy) findTransportByBackendAddr(addr string, preferProtocol string) (ServerTransport, error) {
-	for _, item := range p.items {
+	for _, item := range p.getItems() {
 		transport, err := item.FindTransport(func(serverTransport ServerTransport) bool {
 			return serverTransport.GetAddress() == addr
 		})
@@ -505,7 +996,7 @@ func (p *Proxy) findTransportByBackendAddr(addr string, preferProtocol string) (
 		}
 	}
 
-	for _, item := range p.items {
+	for _, item := range p.getItems() {
 		transport, err := item.FindTransport(func(serverTransport ServerTransport) bool {
 			return serverTransport.GetProtocol() == preferProtocol
 		})
@@ -518,7 +1009,7 @@ func (p *Proxy) findTransportByBackendAddr(addr string, preferProtocol string) (
 }
 
 func (p *Proxy) findBackendProxyItem(protocol string) *ProxyItem {
-	for _, item := range p.items {
+	for _, item := range p.getItems() {
 		if item.backend != nil && strings.HasPrefix(item.backend.GetAddress(), protocol) {
 			return item
 		}
@@ -563,16 +1054,43 @@ func (P *Proxy) getNextRequestHopByRoute(msg *Message) (host string, port int, t
 	}
 	addr := routeParam.GetAddress().GetAddress()
 	if addr.IsSIPURI() {
+		// the transport and port are located by DNS if they are not in the URI
 		sipUri, _ := addr.GetSIPURI()
-		transport = sipUri.GetTransport()
+		if sipUri.HasTransport() || sipUri.Scheme == "sips" {
+			transport = sipUri.GetTransport()
+		}
 		host = sipUri.Host
-		port = sipUri.GetPort()
+		if sipUri.HasPort() {
+			port = sipUri.GetPort()
+		}
 	} else {
 		err = fmt.Errorf("address %v is not a sip URI", addr)
 	}
 	return
 }
 
+// getNextRequestHopByRequestURI get the next hop from the SIP Request-URI if neither Route
+// nor configured route is found for the request which is not sent to the proxy itself, the
+// servers of the host are located by RFC 3263 as described in RFC 3261 16.6 step 6
+func (p *Proxy) getNextRequestHopByRequestURI(msg *Message) (host string, port int, transport string, err error) {
+	requestURI, err := msg.GetRequestURI()
+	if err != nil {
+		return
+	}
+	sipUri, err := requestURI.GetSIPURI()
+	if err != nil {
+		return
+	}
+	if sipUri.HasTransport() || sipUri.Scheme == "sips" {
+		transport = sipUri.GetTransport()
+	}
+	host = sipUri.Host
+	if sipUri.HasPort() {
+		port = sipUri.GetPort()
+	}
+	return
+}
+
 func (p *Proxy) getNextReponseHop(msg *Message) (host string, port int, protocol string, err error) {
 	via, err := msg.GetVia()
 	if err != nil {
@@ -619,20 +1137,66 @@ func (p *Proxy) findClientTransport(host string, port int, protocol string, tran
 	return p.clientTransMgr.GetTransport(protocol, host, port, transId)
 }
 
-func (p *Proxy) sendRequest(host string, port int, protocol string, msg *Message) {
+// sendRequest send the request to the next hop, a client transaction is created
+// if the proxy adds its own Via to the request. The servers of the next hop are
+// located by RFC 3263 and the next server is tried if the request can't be sent
+func (p *Proxy) sendRequest(host string, port int, protocol string, msg *Message, stateful bool) {
+	p.locateServers(msg, host, port, protocol, func(servers []ServerTarget) {
+		send, server, others, err := p.sendToServers(msg, servers)
+		if err != nil {
+			if stateful {
+				p.replyForwardedRequest(msg, 503, "Service Unavailable")
+			} else {
+				p.replyRequest(msg, 503, "Service Unavailable")
+			}
+			return
+		}
+		if stateful {
+			p.addClientTransaction(msg, !strings.EqualFold(server.Protocol, "udp"), send)
+			p.addServerFailover(msg, others, nil)
+		}
+	})
+}
+
+// locateServers locate the servers of the next hop and pass them to done in the worker
+// processing the dialog of the message. The servers are located in background if the
+// DNS answers are not cached, so the other dialogs of the worker are not blocked by the
+// DNS queries
+func (p *Proxy) locateServers(msg *Message, host string, port int, protocol string, done func(servers []ServerTarget)) {
+	if servers, ok := sipServerLocator.LocateCached(host, port, protocol); ok {
+		done(servers)
+		return
+	}
+	go func() {
+		servers := sipServerLocator.Locate(host, port, protocol)
+		p.postTask(msg, func() {
+			done(servers)
+		})
+	}()
+}
 
-	t, err := p.findClientTransport(host, port, protocol, "")
-	if err == nil {
-		if t.Send(msg) != nil {
-			callId, _ := msg.GetCallID()
-			zap.L().Error("Fail to send message", zap.String("call-id", callId))
+// sendToServers send the request to the first server which can be reached, the servers
+// after it are returned to retry the request on them, see RFC 3263 4.3
+func (p *Proxy) sendToServers(msg *Message, servers []ServerTarget) (TransactionSendFunc, ServerTarget, []ServerTarget, error) {
+	callId, _ := msg.GetCallID()
+	err := fmt.Errorf("no server is found")
+	for i, server := range servers {
+		var t ClientTransport
+		t, err = p.findClientTransport(server.Host, server.Port, server.Protocol, "")
+		if err != nil {
+			zap.L().Error("Fail to find the transport to send request message", zap.String("host", server.Host), zap.Int("port", server.Port), zap.String("transport", server.Protocol), zap.String("call-id", callId))
+			continue
 		}
-	} else {
-		zap.L().Error("Fail to find the transport to send request message", zap.String("host", host), zap.Int("port", port), zap.String("transport", protocol), zap.String("message", msg.String()))
+		send := p.hidingTopology(t.Send)
+		if err = send(msg); err == nil {
+			return send, server, servers[i+1:], nil
+		}
+		zap.L().Error("Fail to send message, try next server", zap.String("host", server.Host), zap.Int("port", server.Port), zap.String("transport", server.Protocol), zap.String("call-id", callId))
 	}
+	return nil, ServerTarget{}, nil, err
 }
 
-func (p *Proxy) sendResponse(host string, port int, protocol string, msg *Message) {
+func (p *Proxy) sendResponse(host string, port int, protocol string, msg *Message) error {
 	transId, _ := msg.GetClientTransaction()
 	t, err := p.findClientTransport(host, port, protocol, transId)
 	if err == nil {
@@ -640,10 +1204,10 @@ func (p *Proxy) sendResponse(host string, port int, protocol string, msg *Messag
 			// remove the transport from the client transaction manager
 			p.clientTransMgr.RemoveTransport(protocol, host, port, transId)
 		}
-		t.Send(msg)
-	} else {
-		zap.L().Error("Fail to find the transport to send response", zap.String("host", host), zap.Int("port", port), zap.String("transport", protocol), zap.String("message", msg.String()))
+		return t.Send(msg)
 	}
+	zap.L().Error("Fail to find the transport to send response", zap.String("host", host), zap.Int("port", port), zap.String("transport", protocol), zap.String("message", msg.String()))
+	return err
 }
 
 // NewProxyItem create a sip proxy
@@ -651,13 +1215,25 @@ func NewProxyItem(listenConfig ListenConfig,
 	receivedSupport bool,
 	connAcceptedListener ConnectionAcceptedListener,
 	selfLearnRoute *SelfLearnRoute,
-	msgHandler MessageHandler) (*ProxyItem, error) {
+	msgHandler MessageHandler,
+	proxyACL *AccessList) (*ProxyItem, error) {
 	zap.L().Info("NewProxyItem", zap.Any("listenConfig", listenConfig), zap.Bool("receivedSupport", receivedSupport))
 
-	proxyItem := &ProxyItem{transports: make([]ServerTransport, 0),
-		viaConfig:  createViaConfig(listenConfig.Via),
-		backend:    nil,
-		msgHandler: msgHandler,
+	proxyItem := &ProxyItem{listenConfig: listenConfig,
+		transports:  make([]ServerTransport, 0),
+		viaConfig:   createViaConfig(listenConfig.Via),
+		backend:     nil,
+		msgHandler:  msgHandler,
+		acl:         NewAccessList(proxyACL),
+		headerRules: NewHeaderRules(),
+	}
+	if err := proxyItem.acl.Update(listenConfig.ACL); err != nil {
+		zap.L().Error("Invalid acl of listen", zap.String("address", listenConfig.Address), zap.String("error", err.Error()))
+		return nil, err
+	}
+	if err := proxyItem.headerRules.Update(listenConfig.HeaderRules); err != nil {
+		zap.L().Error("Invalid header rules of listen", zap.String("address", listenConfig.Address), zap.String("error", err.Error()))
+		return nil, err
 	}
 
 	connectionEstablished := func(conn net.Conn) {
@@ -665,23 +1241,90 @@ func NewProxyItem(listenConfig ListenConfig,
 		proxyItem.connectionEstablished(conn, receivedSupport, selfLearnRoute)
 	}
 
-	proxyItem.backend, _ = CreateRoundRobinBackend(listenConfig.Backends, connectionEstablished)
+	var serverTLSConfig, clientTLSConfig *tls.Config
+	if listenConfig.TLS != nil {
+		var err error
+		if listenConfig.TlsPort > 0 || listenConfig.WssPort > 0 {
+			serverTLSConfig, err = listenConfig.TLS.ServerTLSConfig()
+		}
+		if err == nil {
+			clientTLSConfig, err = listenConfig.TLS.ClientTLSConfig()
+		}
+		if err != nil {
+			zap.L().Error("Fail to load tls configuration", zap.String("address", listenConfig.Address), zap.String("error", err.Error()))
+			return nil, err
+		}
+	}
+	policy, err := ParseBackendPolicy(listenConfig.Policy)
+	if err != nil {
+		zap.L().Error("Invalid backend policy", zap.String("address", listenConfig.Address), zap.String("policy", listenConfig.Policy))
+		return nil, err
+	}
+	if listenConfig.Auth != nil {
+		proxyItem.authenticator, err = NewDigestAuthenticator(listenConfig.Auth)
+		if err != nil {
+			zap.L().Error("Fail to load authentication configuration", zap.String("address", listenConfig.Address), zap.String("error", err.Error()))
+			return nil, err
+		}
+	}
+	proxyItem.clientTLSConfig = clientTLSConfig
+	proxyItem.backendConnEstablished = connectionEstablished
+	proxyItem.backend, _ = CreateRoundRobinBackend(listenConfig.Backends, clientTLSConfig, connectionEstablished)
+	if proxyItem.backend != nil {
+		proxyItem.backend.SetPolicy(policy)
+	}
+	if proxyItem.backend != nil && listenConfig.HealthCheck != nil {
+		proxyItem.healthChecker = NewHealthChecker(proxyItem.backend, listenConfig.HealthCheck, proxyItem.FindTransport)
+	}
 
 	if listenConfig.UdpPort > 0 {
 		udpServerTrans, err := NewUDPServerTransport(listenConfig.Address, listenConfig.UdpPort, receivedSupport, selfLearnRoute, proxyItem.viaConfig, proxyItem.backend)
 		if err == nil {
+			udpServerTrans.SetAccessList(proxyItem.acl)
 			proxyItem.transports = append(proxyItem.transports, udpServerTrans)
 		}
 	}
 
 	if listenConfig.TcpPort > 0 {
-		proxyItem.transports = append(proxyItem.transports, NewTCPServerTransport(listenConfig.Address, listenConfig.TcpPort, receivedSupport, connAcceptedListener, selfLearnRoute, proxyItem.viaConfig, proxyItem.backend))
+		tcpServerTrans := NewTCPServerTransport(listenConfig.Address, listenConfig.TcpPort, receivedSupport, connAcceptedListener, selfLearnRoute, proxyItem.viaConfig, proxyItem.backend)
+		tcpServerTrans.SetAccessList(proxyItem.acl)
+		proxyItem.transports = append(proxyItem.transports, tcpServerTrans)
+	}
+
+	if listenConfig.TlsPort > 0 {
+		if serverTLSConfig == nil {
+			zap.L().Error("No certificate is configured for tls-port", zap.String("address", listenConfig.Address), zap.Int("port", listenConfig.TlsPort))
+			return nil, fmt.Errorf("no tls configuration for tls-port %d", listenConfig.TlsPort)
+		}
+		tlsServerTrans := NewTLSServerTransport(listenConfig.Address, listenConfig.TlsPort, receivedSupport, connAcceptedListener, selfLearnRoute, proxyItem.viaConfig, proxyItem.backend, serverTLSConfig)
+		tlsServerTrans.SetAccessList(proxyItem.acl)
+		proxyItem.transports = append(proxyItem.transports, tlsServerTrans)
+	}
+
+	if listenConfig.WsPort > 0 {
+		wsServerTrans := NewWSServerTransport(listenConfig.Address, listenConfig.WsPort, receivedSupport, selfLearnRoute, proxyItem.viaConfig, proxyItem.backend, nil)
+		wsServerTrans.SetAccessList(proxyItem.acl)
+		wsServerTrans.SetAllowedOrigins(listenConfig.WsAllowedOrigins)
+		proxyItem.transports = append(proxyItem.transports, wsServerTrans)
+	}
+
+	if listenConfig.WssPort > 0 {
+		if serverTLSConfig == nil {
+			zap.L().Error("No certificate is configured for wss-port", zap.String("address", listenConfig.Address), zap.Int("port", listenConfig.WssPort))
+			return nil, fmt.Errorf("no tls configuration for wss-port %d", listenConfig.WssPort)
+		}
+		wssServerTrans := NewWSServerTransport(listenConfig.Address, listenConfig.WssPort, receivedSupport, selfLearnRoute, proxyItem.viaConfig, proxyItem.backend, serverTLSConfig)
+		wssServerTrans.SetAccessList(proxyItem.acl)
+		wssServerTrans.SetAllowedOrigins(listenConfig.WsAllowedOrigins)
+		proxyItem.transports = append(proxyItem.transports, wssServerTrans)
 	}
 
 	return proxyItem, nil
 }
 
 func (p *ProxyItem) FindTransport(cond func(serverTransport ServerTransport) bool) (ServerTransport, error) {
+	p.Lock()
+	defer p.Unlock()
 	for _, transport := range p.transports {
 		if cond(transport) {
 			return transport, nil
@@ -691,6 +1334,31 @@ func (p *ProxyItem) FindTransport(cond func(serverTransport ServerTransport) boo
 
 }
 
+// GetListenInfo get the server transports and backends of the listener
+func (p *ProxyItem) GetListenInfo() ListenInfo {
+	p.Lock()
+	defer p.Unlock()
+
+	info := ListenInfo{Address: p.listenConfig.Address,
+		Transports: make([]TransportInfo, 0),
+		Backends:   make([]string, 0)}
+	if p.viaConfig != nil {
+		info.Via = p.viaConfig.String()
+	}
+	for _, transport := range p.transports {
+		if transport.IsExit() {
+			continue
+		}
+		info.Transports = append(info.Transports, TransportInfo{Protocol: transport.GetProtocol(),
+			Address: transport.GetAddress(),
+			Port:    transport.GetPort()})
+	}
+	if p.backend != nil {
+		info.Backends = append(info.Backends, getAllBackendAddresses(p.backend)...)
+	}
+	return info
+}
+
 func (p *ProxyItem) findBackendByAddr(address string) (Backend, error) {
 	if p.backend == nil {
 		return nil, fmt.Errorf("no backend for proxy item")
@@ -732,6 +1400,69 @@ func (p *ProxyItem) Start() error {
 			return err
 		}
 	}
+	if p.healthChecker != nil {
+		p.healthChecker.Start()
+	}
 	return nil
 }
 
+// Stop stop listening and the health check, the established connections are kept
+func (p *ProxyItem) Stop() {
+	p.Lock()
+	transports := slices.Clone(p.transports)
+	p.Unlock()
+	for _, trans := range transports {
+		trans.Stop()
+	}
+	if p.healthChecker != nil {
+		p.healthChecker.Stop()
+	}
+}
+
+func (p *ProxyItem) getListenConfig() ListenConfig {
+	p.Lock()
+	defer p.Unlock()
+	return p.listenConfig
+}
+
+// updateACL apply the changed acl of the listen without restarting the transports
+func (p *ProxyItem) updateACL(listenConfig ListenConfig) error {
+	if err := p.acl.Update(listenConfig.ACL); err != nil {
+		zap.L().Error("Invalid acl of listen", zap.String("address", listenConfig.Address), zap.String("error", err.Error()))
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.listenConfig.ACL = listenConfig.ACL
+	return nil
+}
+
+// updateHeaderRules apply the changed header rules of the listen without restarting the
+// transports
+func (p *ProxyItem) updateHeaderRules(listenConfig ListenConfig) error {
+	if err := p.headerRules.Update(listenConfig.HeaderRules); err != nil {
+		zap.L().Error("Invalid header rules of listen", zap.String("address", listenConfig.Address), zap.String("error", err.Error()))
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.listenConfig.HeaderRules = listenConfig.HeaderRules
+	return nil
+}
+
+// updateBackends apply the changed backends, policy and failover of the listen without
+// restarting the transports
+func (p *ProxyItem) updateBackends(listenConfig ListenConfig) error {
+	policy, err := ParseBackendPolicy(listenConfig.Policy)
+	if err != nil {
+		zap.L().Error("Invalid backend policy", zap.String("address", listenConfig.Address), zap.String("policy", listenConfig.Policy))
+		return err
+	}
+	p.backend.SetPolicy(policy)
+	err = p.backend.UpdateBackends(listenConfig.Backends, p.clientTLSConfig, p.backendConnEstablished)
+	p.Lock()
+	defer p.Unlock()
+	p.listenConfig = listenConfig
+	return err
+}
+
@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestIsMyMessage(t *testing.T) {
@@ -123,3 +125,140 @@ test`
 
 }
 
+
+// sendTestRequest send the request to the udp port of the proxy and wait for its response,
+// the %d in the request is replaced with the local port
+func sendTestRequest(t *testing.T, proxyPort int, request string) *Message {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.WriteToUDP([]byte(fmt.Sprintf(request, port)), &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: proxyPort})
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := ParseMessage(bufio.NewReader(bytes.NewBuffer(buf[0:n])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestReplyNotFoundForUnroutableRequest(t *testing.T) {
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 15260}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	response := sendTestRequest(t, 15260, "OPTIONS tel:+15551234 SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%d;branch=z9hG4bK776asdhds\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301774\r\nTo: <sip:bob@unknown.com>\r\nCall-ID: a84b4c76e66710@test.com\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n")
+	if response.response.statusCode != 404 {
+		t.Errorf("expect 404 but get %d", response.response.statusCode)
+	}
+	if callId, _ := response.GetCallID(); callId != "a84b4c76e66710@test.com" {
+		t.Errorf("the Call-ID is not copied from the request")
+	}
+}
+
+func TestRouteByRequestURI(t *testing.T) {
+	received := startTestBackend(t, 16223, 16222, 200, "OK")
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16222}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	response := sendTestRequest(t, 16222, "OPTIONS sip:bob@127.0.0.1:16223 SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%d;branch=z9hG4bK776asdhru\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301775\r\nTo: <sip:bob@other.com>\r\nCall-ID: a84b4c76e66712@test.com\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n")
+	if response.response.statusCode != 200 {
+		t.Errorf("expect the request is routed by the Request-URI but get %d", response.response.statusCode)
+	}
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Errorf("the request is not received by the host of the Request-URI")
+	}
+}
+
+func TestReplyTooManyHops(t *testing.T) {
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 15262}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	response := sendTestRequest(t, 15262, "OPTIONS sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%d;branch=z9hG4bK776asdhdt\r\nMax-Forwards: 0\r\nFrom: <sip:alice@test.com>;tag=1928301774\r\nTo: <sip:bob@test.com>\r\nCall-ID: a84b4c76e66711@test.com\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n")
+	if response.response.statusCode != 483 {
+		t.Errorf("expect 483 but get %d", response.response.statusCode)
+	}
+}
+
+func TestIsLoopedRequest(t *testing.T) {
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 15264}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	msg := createTestRequest("INVITE")
+	if proxy.isLoopedRequest(msg) {
+		t.Errorf("the request is not forwarded by the proxy")
+	}
+	proxy.addVia(msg, proxy.items[0].transports[0])
+	if !proxy.isLoopedRequest(msg) {
+		t.Errorf("the loop is not detected")
+	}
+	// spiral: the request comes back with a different Request-URI
+	msg.request.requestURI, _ = ParseAddrSpec("sip:carol@biloxi.example.com")
+	if proxy.isLoopedRequest(msg) {
+		t.Errorf("the spiral is detected as loop")
+	}
+}
+
+func TestWorkerShardingByCallId(t *testing.T) {
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 15264}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	proxy.SetWorkers(4)
+	proxy.startWorkers()
+	if len(proxy.workers) != 4 {
+		t.Fatalf("expect 4 workers but get %d", len(proxy.workers))
+	}
+	used := make(map[*proxyWorker]bool)
+	for i := 0; i < 20; i++ {
+		request := createTestPolicyRequest(fmt.Sprintf("call-%d@atlanta.example.com", i))
+		response := NewResponseOf(request, 200, "OK")
+		worker := proxy.getWorker(request)
+		if proxy.getWorker(response) != worker {
+			t.Fatalf("the messages of the same dialog are processed by different workers")
+		}
+		used[worker] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("the dialogs are not distributed to the workers")
+	}
+}
+
+func TestPostTaskBeforeStartAndAfterStop(t *testing.T) {
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16232}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	request := createTestRequest("INVITE")
+	proxy.postTask(request, func() {
+		t.Errorf("the task is run before the proxy is started")
+	})
+
+	proxy.SetWorkers(1)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxy.Stop()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2000; i++ {
+			proxy.postTask(request, func() {})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the tasks are blocked after the proxy is stopped")
+	}
+}
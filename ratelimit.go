@@ -0,0 +1,369 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRateLimitRetryAfter = 5
+	defaultBlockWindow         = 10
+	defaultBlockTime           = 60
+	// the idle buckets and the expired offenders are removed in this interval
+	rateLimitSweepInterval = time.Minute
+	// the least recently used bucket is removed if a new bucket is created when the
+	// number of buckets reaches it, so the spoofed sources can't grow the buckets
+	// without limit
+	maxRateLimitBuckets = 100000
+)
+
+// RateLimitClasses is the classes of the requests limited separately
+var RateLimitClasses = []string{"invite", "register", "other"}
+
+type rateLimitResult int
+
+const (
+	rateAllowed rateLimitResult = iota
+	// over the limit, answered with 503
+	rateLimited
+	// the source is blocked, dropped silently
+	rateBlocked
+)
+
+// RateLimiter limit the requests from each source IP and optionally each From user with
+// the token buckets, the source over the limits too often is blocked for a while
+type RateLimiter struct {
+	sync.Mutex
+	proxyName      string
+	limits         map[string]*RateLimit
+	perFromUser    bool
+	retryAfter     int
+	blockThreshold int
+	blockWindow    time.Duration
+	blockTime      time.Duration
+	exempt         []*net.IPNet
+	buckets        map[string]*list.Element
+	// the buckets from the most recently used to the least recently used
+	bucketList *list.List
+	maxBuckets int
+	offenders  map[string]*rateOffender
+	counters   map[string]*RateLimitCounters
+	lastSweep  time.Time
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// rateOffender is the source which is over the limits in the current block window
+type rateOffender struct {
+	violations   int
+	windowStart  time.Time
+	blockedUntil time.Time
+}
+
+// RateLimitCounters is the number of the requests of a class checked by the rate limiter
+type RateLimitCounters struct {
+	Allowed uint64 `json:"allowed"`
+	Limited uint64 `json:"limited"`
+	Blocked uint64 `json:"blocked"`
+}
+
+type BlockedSourceInfo struct {
+	Source       string    `json:"source"`
+	BlockedUntil time.Time `json:"blocked-until"`
+}
+
+// RateLimitInfo is the counters and the blocked sources shown in the admin API
+type RateLimitInfo struct {
+	Enabled        bool                         `json:"enabled"`
+	Counters       map[string]RateLimitCounters `json:"counters"`
+	BlockedSources []BlockedSourceInfo          `json:"blocked-sources"`
+}
+
+func NewRateLimiter(proxyName string) *RateLimiter {
+	r := &RateLimiter{proxyName: proxyName,
+		limits:     make(map[string]*RateLimit),
+		buckets:    make(map[string]*list.Element),
+		bucketList: list.New(),
+		maxBuckets: maxRateLimitBuckets,
+		offenders:  make(map[string]*rateOffender),
+		counters:   make(map[string]*RateLimitCounters)}
+	for _, class := range RateLimitClasses {
+		r.counters[class] = &RateLimitCounters{}
+	}
+	return r
+}
+
+// Update replace the limits, the requests are not limited if config is nil. The
+// buckets and the blocked sources are kept
+func (r *RateLimiter) Update(config *RateLimitConfig) error {
+	limits := make(map[string]*RateLimit)
+	var exempt []*net.IPNet
+	perFromUser, retryAfter, blockThreshold := false, defaultRateLimitRetryAfter, 0
+	blockWindow, blockTime := defaultBlockWindow, defaultBlockTime
+	if config != nil {
+		configured := []*RateLimit{config.Invite, config.Register, config.Other}
+		for i, class := range RateLimitClasses {
+			limit := configured[i]
+			if limit == nil {
+				continue
+			}
+			if err := validateRateLimit(limit); err != nil {
+				return fmt.Errorf("invalid rate limit of %s: %w", class, err)
+			}
+			limits[class] = limit
+		}
+		var err error
+		if exempt, err = parseIPNets(config.Exempt); err != nil {
+			return err
+		}
+		perFromUser, blockThreshold = config.PerFromUser, config.BlockThreshold
+		if config.RetryAfter > 0 {
+			retryAfter = config.RetryAfter
+		}
+		if config.BlockWindow > 0 {
+			blockWindow = config.BlockWindow
+		}
+		if config.BlockTime > 0 {
+			blockTime = config.BlockTime
+		}
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.limits, r.exempt, r.perFromUser, r.retryAfter = limits, exempt, perFromUser, retryAfter
+	r.blockThreshold = blockThreshold
+	r.blockWindow = time.Duration(blockWindow) * time.Second
+	r.blockTime = time.Duration(blockTime) * time.Second
+	return nil
+}
+
+func validateRateLimit(limit *RateLimit) error {
+	if limit.Rate <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	if limit.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	return nil
+}
+
+// getRateLimitClass get the class of the request, the ACK and CANCEL are not limited
+// because they belong to the INVITE transactions
+func getRateLimitClass(method string) string {
+	switch method {
+	case "ACK", "CANCEL":
+		return ""
+	case "INVITE":
+		return "invite"
+	case "REGISTER":
+		return "register"
+	}
+	return "other"
+}
+
+// Check check the request from the source, a token is taken from the buckets of the
+// source IP and the From user if the request is allowed
+func (r *RateLimiter) Check(sourceIP string, fromUser string, method string, now time.Time) rateLimitResult {
+	class := getRateLimitClass(method)
+	r.Lock()
+	defer r.Unlock()
+	if len(r.limits) == 0 || containsIP(r.exempt, sourceIP) {
+		return rateAllowed
+	}
+	r.sweep(now)
+	if offender, ok := r.offenders[sourceIP]; ok && now.Before(offender.blockedUntil) {
+		if class != "" {
+			r.counters[class].Blocked++
+			rateLimitedRequests.WithLabelValues(r.proxyName, class, "blocked").Inc()
+		}
+		return rateBlocked
+	}
+	limit, ok := r.limits[class]
+	if class == "" || !ok {
+		return rateAllowed
+	}
+	keys := []string{class + "/ip/" + sourceIP}
+	if r.perFromUser && fromUser != "" {
+		keys = append(keys, class+"/user/"+fromUser)
+	}
+	buckets := make([]*tokenBucket, 0, len(keys))
+	for _, key := range keys {
+		bucket := r.getBucket(key, limit, now)
+		if bucket.tokens < 1 {
+			r.counters[class].Limited++
+			rateLimitedRequests.WithLabelValues(r.proxyName, class, "limited").Inc()
+			r.addViolation(sourceIP, now)
+			return rateLimited
+		}
+		buckets = append(buckets, bucket)
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	r.counters[class].Allowed++
+	return rateAllowed
+}
+
+// getBucket get the bucket refilled to now, a new bucket is full. The least recently
+// used bucket is removed if the number of buckets reaches the maximum
+func (r *RateLimiter) getBucket(key string, limit *RateLimit, now time.Time) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = max(1, limit.Rate)
+	}
+	element, ok := r.buckets[key]
+	if !ok {
+		if r.bucketList.Len() >= r.maxBuckets {
+			r.removeBucket(r.bucketList.Back())
+		}
+		bucket := &tokenBucket{key: key, tokens: burst, last: now}
+		r.buckets[key] = r.bucketList.PushFront(bucket)
+		return bucket
+	}
+	r.bucketList.MoveToFront(element)
+	bucket := element.Value.(*tokenBucket)
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = min(burst, bucket.tokens+elapsed*limit.Rate)
+		bucket.last = now
+	}
+	return bucket
+}
+
+// addViolation count the request over the limits from the source and block the source
+// if it reaches the block threshold in the block window
+func (r *RateLimiter) addViolation(sourceIP string, now time.Time) {
+	if r.blockThreshold <= 0 {
+		return
+	}
+	offender, ok := r.offenders[sourceIP]
+	if !ok || now.Sub(offender.windowStart) > r.blockWindow {
+		offender = &rateOffender{windowStart: now}
+		r.offenders[sourceIP] = offender
+	}
+	offender.violations++
+	if offender.violations >= r.blockThreshold {
+		offender.blockedUntil = now.Add(r.blockTime)
+		offender.violations = 0
+		zap.L().Warn("source is blocked for exceeding the rate limits", zap.String("proxy", r.proxyName), zap.String("source", sourceIP), zap.Duration("blockTime", r.blockTime))
+	}
+}
+
+// sweep remove the buckets idle in the sweep interval and the offenders which are
+// neither blocked nor in the block window, the removed buckets are created full again
+func (r *RateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	r.lastSweep = now
+	for element := r.bucketList.Back(); element != nil; element = r.bucketList.Back() {
+		if now.Sub(element.Value.(*tokenBucket).last) <= rateLimitSweepInterval {
+			break
+		}
+		r.removeBucket(element)
+	}
+	for source, offender := range r.offenders {
+		if now.After(offender.blockedUntil) && now.Sub(offender.windowStart) > r.blockWindow {
+			delete(r.offenders, source)
+		}
+	}
+}
+
+func (r *RateLimiter) removeBucket(element *list.Element) {
+	r.bucketList.Remove(element)
+	delete(r.buckets, element.Value.(*tokenBucket).key)
+}
+
+func (r *RateLimiter) getRetryAfter() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.retryAfter
+}
+
+// GetRateLimitInfo get the counters of the classes and the blocked sources
+func (r *RateLimiter) GetRateLimitInfo() RateLimitInfo {
+	r.Lock()
+	defer r.Unlock()
+	info := RateLimitInfo{Enabled: len(r.limits) > 0,
+		Counters:       make(map[string]RateLimitCounters),
+		BlockedSources: make([]BlockedSourceInfo, 0)}
+	for class, counters := range r.counters {
+		info.Counters[class] = *counters
+	}
+	now := time.Now()
+	for source, offender := range r.offenders {
+		if now.Before(offender.blockedUntil) {
+			info.BlockedSources = append(info.BlockedSources, BlockedSourceInfo{Source: source, BlockedUntil: offender.blockedUntil})
+		}
+	}
+	sort.Slice(info.BlockedSources, func(i, j int) bool {
+		return info.BlockedSources[i].Source < info.BlockedSources[j].Source
+	})
+	return info
+}
+
+// SetRateLimit update the rate limits of the requests received by the proxy
+func (p *Proxy) SetRateLimit(config *RateLimitConfig) error {
+	if err := p.rateLimiter.Update(config); err != nil {
+		zap.L().Error("Invalid rate limit of proxy", zap.String("name", p.name), zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// GetRateLimitInfo get the rate limit counters and the blocked sources of the proxy
+func (p *Proxy) GetRateLimitInfo() RateLimitInfo {
+	return p.rateLimiter.GetRateLimitInfo()
+}
+
+// limitRate check the request against the rate limits before it is queued to the
+// workers, true is returned if the request is answered with 503 or dropped
+func (p *Proxy) limitRate(rawMsg *RawMessage) bool {
+	msg := rawMsg.Message
+	if !msg.IsRequest() {
+		return false
+	}
+	// the retransmissions are absorbed by their server transactions without tokens
+	if _, ok := p.serverTransactionMgr.GetTransaction(msg); ok {
+		return false
+	}
+	method, _ := msg.GetMethod()
+	fromUser, _ := getFromUser(msg)
+	switch p.rateLimiter.Check(rawMsg.PeerAddr, fromUser, method, time.Now()) {
+	case rateBlocked:
+		return true
+	case rateLimited:
+		callId, _ := msg.GetCallID()
+		zap.L().Info("reject the request over the rate limit", zap.String("peerAddr", rawMsg.PeerAddr), zap.String("method", method), zap.String("call-id", callId))
+		response := NewResponseOf(msg, 503, "Service Unavailable")
+		response.AddHeader("Retry-After", strconv.Itoa(p.rateLimiter.getRetryAfter()))
+		replyRawMessage(rawMsg, response)
+		return true
+	}
+	return false
+}
+
+// replyRawMessage send the response back to the peer over the connection or the server
+// transport on which the request is received
+func replyRawMessage(rawMsg *RawMessage, response *Message) {
+	if rawMsg.ConnTransport != nil {
+		rawMsg.ConnTransport.Send(response)
+		return
+	}
+	if rawMsg.TcpConn != nil {
+		if b, err := response.Bytes(); err == nil {
+			rawMsg.TcpConn.Write(b)
+		}
+		return
+	}
+	rawMsg.From.Send(rawMsg.PeerAddr, rawMsg.PeerPort, response)
+}
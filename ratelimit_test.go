@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	r := NewRateLimiter("test.com")
+	if err := r.Update(&RateLimitConfig{Invite: &RateLimit{Rate: 1, Burst: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, expect := range []rateLimitResult{rateAllowed, rateAllowed, rateLimited} {
+		if result := r.Check("10.0.0.1", "alice", "INVITE", now); result != expect {
+			t.Errorf("INVITE %d: expect %v but get %v", i, expect, result)
+		}
+	}
+	if result := r.Check("10.0.0.2", "alice", "INVITE", now); result != rateAllowed {
+		t.Errorf("the INVITE from another source is limited")
+	}
+	if result := r.Check("10.0.0.1", "alice", "OPTIONS", now); result != rateAllowed {
+		t.Errorf("the request without limit is limited")
+	}
+	if result := r.Check("10.0.0.1", "alice", "ACK", now); result != rateAllowed {
+		t.Errorf("the ACK is limited")
+	}
+	if result := r.Check("10.0.0.1", "alice", "INVITE", now.Add(time.Second)); result != rateAllowed {
+		t.Errorf("the bucket is not refilled")
+	}
+	info := r.GetRateLimitInfo()
+	if !info.Enabled || info.Counters["invite"].Allowed != 4 || info.Counters["invite"].Limited != 1 {
+		t.Errorf("wrong counters %v", info.Counters)
+	}
+}
+
+func TestRateLimiterBucketsAreBounded(t *testing.T) {
+	r := NewRateLimiter("test.com")
+	r.maxBuckets = 2
+	if err := r.Update(&RateLimitConfig{Invite: &RateLimit{Rate: 1, Burst: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, source := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3"} {
+		r.Check(source, "", "INVITE", now)
+	}
+	if len(r.buckets) != 2 || r.bucketList.Len() != 2 {
+		t.Fatalf("expect 2 buckets but get %d", len(r.buckets))
+	}
+	if _, ok := r.buckets["invite/ip/10.0.0.2"]; ok {
+		t.Errorf("the least recently used bucket is not removed")
+	}
+	if result := r.Check("10.0.0.1", "", "INVITE", now); result != rateLimited {
+		t.Errorf("the recently used bucket is removed")
+	}
+}
+
+func TestRateLimiterPerFromUser(t *testing.T) {
+	r := NewRateLimiter("test.com")
+	if err := r.Update(&RateLimitConfig{Register: &RateLimit{Rate: 1}, PerFromUser: true}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if result := r.Check("10.0.0.1", "alice", "REGISTER", now); result != rateAllowed {
+		t.Errorf("the first REGISTER is limited")
+	}
+	if result := r.Check("10.0.0.2", "alice", "REGISTER", now); result != rateLimited {
+		t.Errorf("the REGISTER of the same user from another source is not limited")
+	}
+	if result := r.Check("10.0.0.2", "bob", "REGISTER", now); result != rateAllowed {
+		t.Errorf("the REGISTER of another user is limited")
+	}
+}
+
+func TestRateLimiterBlocksOffender(t *testing.T) {
+	r := NewRateLimiter("test.com")
+	err := r.Update(&RateLimitConfig{Other: &RateLimit{Rate: 1},
+		BlockThreshold: 2,
+		BlockTime:      30,
+		Exempt:         []string{"10.0.1.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, expect := range []rateLimitResult{rateAllowed, rateLimited, rateLimited, rateBlocked} {
+		if result := r.Check("10.0.0.1", "", "OPTIONS", now); result != expect {
+			t.Errorf("OPTIONS %d: expect %v but get %v", i, expect, result)
+		}
+	}
+	if result := r.Check("10.0.0.1", "", "INVITE", now.Add(10*time.Second)); result != rateBlocked {
+		t.Errorf("the request of other class from the blocked source is not dropped")
+	}
+	if info := r.GetRateLimitInfo(); len(info.BlockedSources) != 1 || info.BlockedSources[0].Source != "10.0.0.1" {
+		t.Errorf("wrong blocked sources %v", info.BlockedSources)
+	}
+	if result := r.Check("10.0.0.1", "", "OPTIONS", now.Add(31*time.Second)); result != rateAllowed {
+		t.Errorf("the source is still blocked after the block time")
+	}
+	for i := 0; i < 5; i++ {
+		if result := r.Check("10.0.1.1", "", "OPTIONS", now); result != rateAllowed {
+			t.Errorf("the exempt source is limited")
+		}
+	}
+	r.Update(nil)
+	if result := r.Check("10.0.0.1", "", "OPTIONS", now); result != rateAllowed {
+		t.Errorf("the request is limited after the rate limit is removed")
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	startTestBackend(t, 16061, 16060, 200, "OK")
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16060, Backends: []BackendConfig{{Address: "udp://127.0.0.1:16061"}}}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.SetRateLimit(&RateLimitConfig{Other: &RateLimit{Rate: 0.1}, RetryAfter: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	request := "OPTIONS sip:bob@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%%d;branch=z9hG4bK776asdhc%d\r\nMax-Forwards: 70\r\nFrom: <sip:alice@test.com>;tag=1928301800\r\nTo: <sip:bob@test.com>\r\nCall-ID: a84b4c76e66740@test.com\r\nCSeq: %d OPTIONS\r\nContent-Length: 0\r\n\r\n"
+	if response := sendTestRequest(t, 16060, fmt.Sprintf(request, 1, 1)); response.response.statusCode != 200 {
+		t.Errorf("expect the first request is forwarded but get %d", response.response.statusCode)
+	}
+	response := sendTestRequest(t, 16060, fmt.Sprintf(request, 2, 2))
+	if response.response.statusCode != 503 {
+		t.Errorf("expect 503 over the rate limit but get %d", response.response.statusCode)
+	}
+	if retryAfter, err := response.GetHeaderInt("Retry-After"); err != nil || retryAfter != 10 {
+		t.Errorf("no Retry-After in the 503")
+	}
+
+	admin := NewAdminServer(":0", []*Proxy{proxy})
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/proxies/0/rate-limits", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expect 200 but get %d", w.Code)
+	}
+	info := RateLimitInfo{}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Counters["other"].Allowed != 1 || info.Counters["other"].Limited != 1 {
+		t.Errorf("wrong counters %v", info.Counters)
+	}
+}
+
+func TestRateLimitSkipsRetransmission(t *testing.T) {
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16233}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.SetRateLimit(&RateLimitConfig{Other: &RateLimit{Rate: 0.1}, RetryAfter: 10}); err != nil {
+		t.Fatal(err)
+	}
+	request := createTestRequest("OPTIONS")
+	proxy.serverTransactionMgr.HandleRequest(request, true, func(msg *Message) error { return nil })
+	for i := 0; i < 3; i++ {
+		if proxy.limitRate(&RawMessage{Message: createTestRequest("OPTIONS"), PeerAddr: "127.0.0.1"}) {
+			t.Fatalf("the retransmission is limited")
+		}
+	}
+	if info := proxy.GetRateLimitInfo(); info.Counters["other"].Allowed != 0 {
+		t.Errorf("the retransmissions consume the tokens %v", info.Counters)
+	}
+}
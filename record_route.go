@@ -127,10 +127,15 @@ func (r *RecRoute) String() string {
 }
 
 // CreateRecordRoute Create a RecordRoute header with the given address and port
-// The address should be a valid SIP URI, e.g., "sip:example.com"
-func CreateRecordRoute(address string, port int) *RecordRoute {
+// The address should be a valid SIP URI, e.g., "sip:example.com". The transport
+// parameter is added for the protocols other than udp, so the in-dialog requests are
+// sent to the proxy with the same protocol
+func CreateRecordRoute(address string, port int, protocol string) *RecordRoute {
 	addr := NewAddrSpec()
 	addr.sipURI = &SIPURI{Scheme: "sip", Host: address, port: port}
+	if protocol != "" && !strings.EqualFold(protocol, "udp") {
+		addr.sipURI.AddParameter("transport", strings.ToLower(protocol))
+	}
 	addr.sipURI.AddParameter("lr", "")
 	nameAddr := &NameAddr{DisplayName: "", Addr: addr}
 	recRoute := NewRecRoute(nameAddr)
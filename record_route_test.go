@@ -14,3 +14,14 @@ func TestParseRecordRoute(t *testing.T) {
 	fmt.Printf("%v\n", recordRoute)
 
 }
+
+func TestCreateRecordRouteWithTransport(t *testing.T) {
+	for protocol, expected := range map[string]string{"udp": "<sip:10.0.0.1:5060;lr>",
+		"tcp": "<sip:10.0.0.1:5060;transport=tcp;lr>",
+		"TLS": "<sip:10.0.0.1:5060;transport=tls;lr>",
+		"wss": "<sip:10.0.0.1:5060;transport=wss;lr>"} {
+		if s := CreateRecordRoute("10.0.0.1", 5060, protocol).String(); s != expected {
+			t.Errorf("expect %s but get %s", expected, s)
+		}
+	}
+}
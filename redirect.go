@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+const defaultMaxRedirects = 3
+
+var defaultRedirectCodes = []int{300, 301, 302}
+
+// isRedirectCode check if the 3xx response with the status code is followed by the proxy
+func (c *RedirectConfig) isRedirectCode(statusCode int) bool {
+	if len(c.Codes) == 0 {
+		return slices.Contains(defaultRedirectCodes, statusCode)
+	}
+	return slices.Contains(c.Codes, statusCode)
+}
+
+func (c *RedirectConfig) getMaxRedirects() int {
+	if c.MaxRedirects > 0 {
+		return c.MaxRedirects
+	}
+	return defaultMaxRedirects
+}
+
+func validateRedirect(config *RedirectConfig) error {
+	if config.MaxRedirects < 0 {
+		return fmt.Errorf("max-redirects must not be negative")
+	}
+	for _, code := range config.Codes {
+		if code < 300 || code > 399 {
+			return fmt.Errorf("invalid redirect code %d, expect 3xx", code)
+		}
+	}
+	return nil
+}
+
+// SetRedirect enable or disable following the 3xx responses, the 3xx responses are
+// relayed upstream if config is nil
+func (p *Proxy) SetRedirect(config *RedirectConfig) error {
+	if config != nil {
+		if err := validateRedirect(config); err != nil {
+			zap.L().Error("Invalid redirect of proxy", zap.String("name", p.name), zap.String("error", err.Error()))
+			return err
+		}
+	}
+	p.redirectLock.Lock()
+	defer p.redirectLock.Unlock()
+	p.redirect = config
+	return nil
+}
+
+func (p *Proxy) getRedirect() *RedirectConfig {
+	p.redirectLock.Lock()
+	defer p.redirectLock.Unlock()
+	return p.redirect
+}
+
+// recurseOnRedirect retry the request to the Contacts of the 3xx response instead of
+// relaying it, see RFC 3261 16.5 and 16.7 step 4. The 3xx is kept as the best response
+// and relayed if the Contacts fail, or if the Contacts can't be tried because of the
+// recursion limit or a loop. True is returned if the request is retried
+func (p *Proxy) recurseOnRedirect(msg *Message, ct *ClientTransaction) bool {
+	config := p.getRedirect()
+	if config == nil || !config.isRedirectCode(msg.response.statusCode) {
+		return false
+	}
+	callId, _ := msg.GetCallID()
+	ctx, branch, forked := p.findForkBranch(msg)
+	if forked && ctx.answered {
+		return false
+	}
+	if !forked {
+		if ct == nil {
+			return false
+		}
+		ctx = p.newRedirectContext(ct.GetRequest())
+	}
+	if ctx.redirects >= config.getMaxRedirects() {
+		zap.L().Info("relay the redirect after too many recursions", zap.Int("redirects", ctx.redirects), zap.String("call-id", callId))
+		return false
+	}
+	targets := p.getRedirectTargets(ctx, msg)
+	if len(targets) == 0 {
+		zap.L().Info("relay the redirect without new contact to try", zap.String("call-id", callId))
+		return false
+	}
+	zap.L().Info("follow the redirect to the contacts", zap.Int("statusCode", msg.response.statusCode), zap.Int("groups", len(targets)), zap.String("call-id", callId))
+	ctx.redirects++
+	if forked {
+		p.removeForkBranch(ctx, branch)
+	}
+	msg.PopVia()
+	p.updateForkResponse(ctx, msg)
+	ctx.pending = append(targets, ctx.pending...)
+	if len(ctx.branches) == 0 {
+		p.forkNext(ctx)
+	}
+	return true
+}
+
+// newRedirectContext create the fork context to retry the request sent to a single
+// destination, the Via and Record-Route of the proxy are removed from the request
+func (p *Proxy) newRedirectContext(request *Message) *forkContext {
+	msg := request.Clone()
+	if via, err := msg.PopVia(); err == nil {
+		if viaParam, err := via.GetParam(0); err == nil {
+			p.removeMyRecordRoute(msg, viaParam.Host, viaParam.GetPort())
+		}
+	}
+	serverTransId, _ := msg.GetServerTransaction()
+	protocol := "udp"
+	if msg.ReceivedFrom != nil {
+		protocol = msg.ReceivedFrom.GetProtocol()
+	}
+	ctx := &forkContext{request: msg,
+		serverTransId: serverTransId,
+		protocol:      protocol,
+		branches:      make(map[string]bool),
+		expired:       make(map[string]bool),
+		tried:         make(map[string]bool)}
+	if requestURI, err := msg.GetRequestURI(); err == nil {
+		ctx.tried[requestURI.String()] = true
+	}
+	return ctx
+}
+
+// removeMyRecordRoute remove the top Record-Route added by the proxy with the address
+func (p *Proxy) removeMyRecordRoute(msg *Message, host string, port int) {
+	recordRoute, err := msg.GetRecordRoute()
+	if err != nil || recordRoute.GetRecRouteCount() != 1 {
+		return
+	}
+	recRoute, _ := recordRoute.GetRecRoute(0)
+	sipUri, err := recRoute.GetNameAddr().Addr.GetSIPURI()
+	if err == nil && sipUri.Host == host && sipUri.GetPort() == port {
+		msg.PopRecordRoute()
+	}
+}
+
+// getRedirectTargets get the Contacts of the 3xx response which are not tried for the
+// request and are not the proxy itself. The Contacts are grouped by q-value in the
+// decreasing order
+func (p *Proxy) getRedirectTargets(ctx *forkContext, msg *Message) [][]forkTarget {
+	contacts, err := msg.GetContacts()
+	if err != nil {
+		return nil
+	}
+	params := make([]*ContactParam, 0)
+	for _, contact := range contacts {
+		for i := 0; i < contact.GetContactParamCount(); i++ {
+			param, err := contact.GetContactParam(i)
+			if err != nil {
+				continue
+			}
+			addrSpec, err := param.GetAddrSpec()
+			if err != nil || ctx.tried[addrSpec.String()] || p.isMyURI(addrSpec) {
+				continue
+			}
+			ctx.tried[addrSpec.String()] = true
+			params = append(params, param)
+		}
+	}
+	slices.SortStableFunc(params, func(a, b *ContactParam) int {
+		if a.GetQ() > b.GetQ() {
+			return -1
+		} else if a.GetQ() < b.GetQ() {
+			return 1
+		}
+		return 0
+	})
+	targets := make([][]forkTarget, 0)
+	for i, param := range params {
+		addrSpec, _ := param.GetAddrSpec()
+		if i == 0 || param.GetQ() != params[i-1].GetQ() {
+			targets = append(targets, make([]forkTarget, 0))
+		}
+		targets[len(targets)-1] = append(targets[len(targets)-1], newContactForkTarget(addrSpec))
+	}
+	return targets
+}
+
+// isMyURI check if the SIP URI is one of the transports of the proxy, the request
+// redirected to it loops back
+func (p *Proxy) isMyURI(addrSpec *AddrSpec) bool {
+	sipUri, err := addrSpec.GetSIPURI()
+	if err != nil {
+		return false
+	}
+	for _, item := range p.getItems() {
+		_, err := item.FindTransport(func(transport ServerTransport) bool {
+			return transport.GetPort() == sipUri.GetPort() && p.isSameAddress(transport.GetAddress(), sipUri.Host)
+		})
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
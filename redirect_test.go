@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTestRedirectBackend start a udp backend which answers the requests with 302 and
+// the Contact header
+func startTestRedirectBackend(t *testing.T, port int, proxyPort int, contact string) chan *Message {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	received := make(chan *Message, 100)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			msg, err := ParseMessage(bufio.NewReader(bytes.NewBuffer(buf[0:n])))
+			if err != nil {
+				continue
+			}
+			if method, _ := msg.GetMethod(); method != "ACK" {
+				response := NewResponseOf(msg, 302, "Moved Temporarily")
+				response.AddHeader("Contact", contact)
+				if b, err := response.Bytes(); err == nil {
+					conn.WriteToUDP(b, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: proxyPort})
+				}
+			}
+			received <- msg
+		}
+	}()
+	return received
+}
+
+func countTestRequests(received chan *Message, method string, timeout time.Duration) int {
+	count := 0
+	for {
+		select {
+		case msg := <-received:
+			if m, _ := msg.GetMethod(); m == method {
+				count++
+			}
+		case <-time.After(timeout):
+			return count
+		}
+	}
+}
+
+func TestFollowRedirectInQValueOrder(t *testing.T) {
+	startTestRedirectBackend(t, 16197, 16196, "<sip:bob@127.0.0.1:16198>;q=0.5, <sip:bob@127.0.0.1:16199>;q=1.0")
+	notTried := startTestBackend(t, 16198, 16196, 200, "OK")
+	answered := startTestBackend(t, 16199, 16196, 200, "OK")
+	proxy := createForkTestProxy(t, 16196, "", 0, 16197)
+	if err := proxy.SetRedirect(&RedirectConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := sendTestInviteAndCancel(t, 16196, 0)
+	if last := responses[len(responses)-1]; last.response.statusCode != 200 {
+		t.Fatalf("expect 200 from the redirected contact but get %d", last.response.statusCode)
+	}
+	if findTestResponse(responses, "INVITE", 302) >= 0 {
+		t.Errorf("the redirect is relayed")
+	}
+	msg := <-answered
+	if requestURI, _ := msg.GetRequestURI(); requestURI.String() != "sip:bob@127.0.0.1:16199" {
+		t.Errorf("the request is not retargeted to the contact: %s", requestURI)
+	}
+	if count := countTestRequests(notTried, "INVITE", 200*time.Millisecond); count != 0 {
+		t.Errorf("the contact with lower q-value is tried after 2xx")
+	}
+}
+
+func TestRelayRedirectOnLoopAndRecursionLimit(t *testing.T) {
+	looped := startTestRedirectBackend(t, 16201, 16200, "<sip:bob@127.0.0.1:16201>")
+	proxy := createForkTestProxy(t, 16200, "", 0, 16201)
+	if err := proxy.SetRedirect(&RedirectConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	responses := sendTestInviteAndCancel(t, 16200, 0)
+	if last := responses[len(responses)-1]; last.response.statusCode != 302 {
+		t.Errorf("expect the looped redirect is relayed but get %d", last.response.statusCode)
+	}
+	if count := countTestRequests(looped, "INVITE", 200*time.Millisecond); count != 2 {
+		t.Errorf("expect the contact is tried once but get %d INVITEs", count)
+	}
+
+	startTestRedirectBackend(t, 16203, 16202, "<sip:bob@127.0.0.1:16204>")
+	startTestRedirectBackend(t, 16204, 16202, "<sip:bob@127.0.0.1:16205>")
+	notTried := startTestBackend(t, 16205, 16202, 200, "OK")
+	proxy = createForkTestProxy(t, 16202, "", 0, 16203)
+	if err := proxy.SetRedirect(&RedirectConfig{MaxRedirects: 1}); err != nil {
+		t.Fatal(err)
+	}
+	responses = sendTestInviteAndCancel(t, 16202, 0)
+	if last := responses[len(responses)-1]; last.response.statusCode != 302 {
+		t.Errorf("expect the redirect is relayed after the recursion limit but get %d", last.response.statusCode)
+	}
+	if count := countTestRequests(notTried, "INVITE", 200*time.Millisecond); count != 0 {
+		t.Errorf("the request is redirected over the recursion limit")
+	}
+}
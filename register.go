@@ -1,27 +1,630 @@
 package main
 
 import (
-	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTrunkExpires = 3600
+	// the registration is refreshed this long before it expires, or at the half of the
+	// expires if it is shorter
+	trunkRefreshMargin = time.Minute
+	// the failed registration is retried after the interval which is doubled on every
+	// failure up to the max, see RFC 5626 4.5
+	trunkRetryInterval    = 30 * time.Second
+	trunkMaxRetryInterval = 30 * time.Minute
+)
+
+// the states of the registration of a trunk
+const (
+	trunkUnregistered = "unregistered"
+	trunkRegistering  = "registering"
+	trunkRegistered   = "registered"
+	trunkFailed       = "failed"
 )
 
+// Register register the proxy to the registrar of an upstream carrier as a UAC, see
+// RFC 3261 10.2. The registration is refreshed before it expires, the digest challenges
+// are answered with the credentials of the trunk and the failed registration is retried
+// with backoff
 type Register struct {
-	transport ClientTransport
-	//register server address in domain:port or ip:port
-	registerServer string
-	// my address in domain:port or ip:port
-	from *NameAddr
+	sync.Mutex
+	proxyName string
+	config    TrunkConfig
+	// the registrar to which the REGISTER is sent
+	host      string
+	port      int
+	transport string
+	aor       *SIPURI
+	username  string
+	// find the listening transport of the protocol, the REGISTER is sent from it
+	findTransport func(protocol string) (ServerTransport, error)
+	// find the transport to send the REGISTER over the connection oriented protocols
+	findClientTransport func(host string, port int, protocol string) (ClientTransport, error)
+	transactions        *ClientTransactionMgr
+	callId              string
+	fromTag             string
+	cseq                int
+	// the expires of the REGISTER, it is 0 if the trunk is stopped
+	requestExpires int
+	// the Via branch of the REGISTER waiting for the final response
+	pending string
+	// the last digest challenge, it is answered in the following REGISTERs
+	challenge       map[string]string
+	challengeHeader string
+	nonceCount      int
+	// the REGISTER is sent again with the credentials of a new challenge
+	authRetried      bool
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+	state            string
+	since            time.Time
+	expires          time.Time
+	failures         int
+	lastError        string
+	timer            *time.Timer
+	stopped          bool
+}
+
+// TrunkInfo is the registration state of a trunk for the admin API
+type TrunkInfo struct {
+	Name      string     `json:"name"`
+	Registrar string     `json:"registrar"`
+	AOR       string     `json:"aor"`
+	State     string     `json:"state"`
+	Since     time.Time  `json:"since"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Failures  int        `json:"failures"`
+	LastError string     `json:"last-error,omitempty"`
+}
+
+// registerRequest is a REGISTER created with the lock held, it is sent after the lock
+// is released
+type registerRequest struct {
+	msg         *Message
+	serverTrans ServerTransport
+}
+
+func NewRegister(proxyName string,
+	config TrunkConfig,
+	findTransport func(protocol string) (ServerTransport, error),
+	findClientTransport func(host string, port int, protocol string) (ClientTransport, error)) (*Register, error) {
+	if err := validateTrunk(config); err != nil {
+		return nil, err
+	}
+	registrar, _ := NewPreRouteItem("", "", config.Registrar)
+	aor, _ := ParseSipURI(config.AOR)
+	transport := strings.ToLower(config.Transport)
+	if transport == "" {
+		transport = "udp"
+	}
+	username := config.Username
+	if username == "" {
+		username = aor.User
+	}
+	expires := config.Expires
+	if expires == 0 {
+		expires = defaultTrunkExpires
+	}
+	callId, _ := CreateTag()
+	fromTag, _ := CreateTag()
+	r := &Register{proxyName: proxyName,
+		config:              config,
+		host:                registrar.host,
+		port:                registrar.port,
+		transport:           transport,
+		aor:                 aor,
+		username:            username,
+		findTransport:       findTransport,
+		findClientTransport: findClientTransport,
+		callId:              callId,
+		fromTag:             fromTag,
+		requestExpires:      expires,
+		retryInterval:       trunkRetryInterval,
+		maxRetryInterval:    trunkMaxRetryInterval,
+		state:               trunkUnregistered,
+		since:               time.Now()}
+	r.transactions = NewClientTransactionMgr(r.transactionTimeout)
+	return r, nil
 }
 
-func NewRegister(transport ClientTransport,
-	registerServer string,
-	from *NameAddr) *Register {
-	return &Register{transport: transport, registerServer: registerServer, from: from}
+func validateTrunk(config TrunkConfig) error {
+	if config.Name == "" {
+		return fmt.Errorf("no name in trunk")
+	}
+	if config.Registrar == "" {
+		return fmt.Errorf("no registrar in trunk %s", config.Name)
+	}
+	if _, err := NewPreRouteItem("", "", config.Registrar); err != nil {
+		return fmt.Errorf("invalid registrar %s, expect host or host:port", config.Registrar)
+	}
+	aor, err := ParseSipURI(config.AOR)
+	if err != nil || aor.User == "" {
+		return fmt.Errorf("invalid aor %s, expect sip:user@domain", config.AOR)
+	}
+	if config.Expires < 0 {
+		return fmt.Errorf("expires must not be negative")
+	}
+	switch strings.ToLower(config.Transport) {
+	case "", "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("unsupported transport %s, expect udp, tcp or tls", config.Transport)
+	}
+	return nil
 }
 
+// Start register the trunk in background
 func (r *Register) Start() {
-	message, err := NewRequest("REGISTER", "sip:"+r.registerServer, "2.0")
+	zap.L().Info("start registration of trunk", zap.String("proxy", r.proxyName), zap.String("trunk", r.config.Name), zap.String("registrar", r.config.Registrar), zap.String("aor", r.config.AOR))
+	r.Lock()
+	defer r.Unlock()
+	r.schedule(0)
+}
+
+// Stop stop refreshing the registration, the registration is removed from the registrar
+// if unregister is true
+func (r *Register) Stop(unregister bool) {
+	r.send(r.stop(unregister))
+}
+
+func (r *Register) stop(unregister bool) *registerRequest {
+	r.Lock()
+	defer r.Unlock()
+	if r.stopped {
+		return nil
+	}
+	r.stopped = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if !unregister || r.state != trunkRegistered {
+		return nil
+	}
+	zap.L().Info("unregister trunk", zap.String("proxy", r.proxyName), zap.String("trunk", r.config.Name))
+	r.requestExpires, r.authRetried = 0, false
+	req, err := r.newRequest()
+	if err != nil {
+		zap.L().Error("Fail to unregister trunk", zap.String("trunk", r.config.Name), zap.String("error", err.Error()))
+	}
+	return req
+}
+
+func (r *Register) schedule(d time.Duration) {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(d, r.register)
+}
+
+func (r *Register) register() {
+	r.send(r.startRegister())
+}
+
+func (r *Register) startRegister() *registerRequest {
+	r.Lock()
+	defer r.Unlock()
+	if r.stopped {
+		return nil
+	}
+	if r.state != trunkRegistered {
+		r.setState(trunkRegistering)
+	}
+	r.authRetried = false
+	return r.newRequestOrFail()
+}
+
+// newRequest create a new REGISTER with the current expires and the credentials of the
+// last challenge and wait for its response, it must be called with the lock held
+func (r *Register) newRequest() (*registerRequest, error) {
+	serverTrans, err := r.findTransport(r.transport)
+	if err != nil {
+		return nil, fmt.Errorf("no %s transport to send REGISTER", r.transport)
+	}
+	msg, err := r.createRegister(serverTrans)
+	if err != nil {
+		return nil, err
+	}
+	r.pending, _ = msg.GetTopViaBranch()
+	return &registerRequest{msg: msg, serverTrans: serverTrans}, nil
+}
+
+// newRequestOrFail create a new REGISTER, the registration is retried later if it
+// cannot be created. It must be called with the lock held
+func (r *Register) newRequestOrFail() *registerRequest {
+	req, err := r.newRequest()
+	if err != nil {
+		r.registerFailed(err)
+	}
+	return req
+}
+
+// send locate the registrar and send the REGISTER without the lock, so the responses
+// and the trunk state are not blocked by the DNS queries and the network. Nothing is
+// sent if req is nil
+func (r *Register) send(req *registerRequest) {
+	if req == nil {
+		return
+	}
+	err := r.sendToRegistrar(req)
 	if err == nil {
-		buf := bytes.NewBuffer(make([]byte, 0))
-		message.Write(buf)
+		return
+	}
+	branch, _ := req.msg.GetTopViaBranch()
+	r.Lock()
+	defer r.Unlock()
+	if branch != r.pending {
+		return
+	}
+	r.pending = ""
+	r.registerFailed(err)
+}
+
+func (r *Register) sendToRegistrar(req *registerRequest) error {
+	msg, serverTrans := req.msg, req.serverTrans
+	err := fmt.Errorf("no server is found for %s", r.host)
+	for _, server := range sipServerLocator.Locate(r.host, r.port, r.transport) {
+		var send TransactionSendFunc
+		if server.Protocol == "udp" {
+			host, port := server.Host, server.Port
+			send = func(msg *Message) error {
+				return serverTrans.Send(host, port, msg)
+			}
+		} else {
+			var t ClientTransport
+			if t, err = r.findClientTransport(server.Host, server.Port, server.Protocol); err != nil {
+				continue
+			}
+			send = t.Send
+		}
+		if err = send(msg); err != nil {
+			continue
+		}
+		_, err = r.transactions.AddTransaction(msg, server.Protocol != "udp", send)
+		return err
+	}
+	return err
+}
+
+func (r *Register) createRegister(serverTrans ServerTransport) (*Message, error) {
+	requestURI := fmt.Sprintf("%s:%s", r.aor.Scheme, r.aor.Host)
+	msg, err := NewRequest("REGISTER", requestURI, "SIP/2.0")
+	if err != nil {
+		return nil, err
+	}
+	via, err := CreateVia(serverTrans.GetProtocol(), serverTrans.GetAddress(), serverTrans.GetPort())
+	if err != nil {
+		return nil, err
+	}
+	aor := r.aor.ToString(false, false)
+	contact := fmt.Sprintf("<sip:%s@%s:%d", r.aor.User, serverTrans.GetAddress(), serverTrans.GetPort())
+	if r.transport != "udp" {
+		contact += ";transport=" + r.transport
+	}
+	r.cseq++
+	msg.AddVia(via)
+	msg.AddHeader("Max-Forwards", "70")
+	msg.AddHeader("From", fmt.Sprintf("<%s>;tag=%s", aor, r.fromTag))
+	msg.AddHeader("To", fmt.Sprintf("<%s>", aor))
+	msg.AddHeader("Call-ID", r.callId)
+	msg.AddHeader("CSeq", fmt.Sprintf("%d REGISTER", r.cseq))
+	msg.AddHeader("Contact", contact+">")
+	msg.AddHeader("Expires", fmt.Sprint(r.requestExpires))
+	if r.challenge != nil {
+		msg.AddHeader(r.challengeHeader, r.createCredentials(requestURI))
+	}
+	return msg, nil
+}
+
+// createCredentials answer the last challenge for the REGISTER to the uri, see RFC 2617
+func (r *Register) createCredentials(uri string) string {
+	algorithm := r.challenge["algorithm"]
+	newHash := md5.New
+	if strings.EqualFold(algorithm, "SHA-256") {
+		newHash = sha256.New
+	}
+	realm, nonce := r.challenge["realm"], r.challenge["nonce"]
+	ha1 := digestHash(newHash, r.username+":"+realm+":"+r.config.Password)
+	ha2 := digestHash(newHash, "REGISTER:"+uri)
+	credentials := fmt.Sprintf("Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"%s\"", r.username, realm, nonce, uri)
+	if r.supportQopAuth() {
+		r.nonceCount++
+		nc := fmt.Sprintf("%08x", r.nonceCount)
+		cnonce, _ := CreateTag()
+		response := digestHash(newHash, strings.Join([]string{ha1, nonce, nc, cnonce, "auth", ha2}, ":"))
+		credentials += fmt.Sprintf(", response=\"%s\", cnonce=\"%s\", nc=%s, qop=auth", response, cnonce, nc)
+	} else {
+		credentials += fmt.Sprintf(", response=\"%s\"", digestHash(newHash, ha1+":"+nonce+":"+ha2))
+	}
+	if algorithm != "" {
+		credentials += ", algorithm=" + algorithm
+	}
+	if opaque, ok := r.challenge["opaque"]; ok {
+		credentials += fmt.Sprintf(", opaque=\"%s\"", opaque)
+	}
+	return credentials
+}
+
+func (r *Register) supportQopAuth() bool {
+	for _, qop := range strings.Split(r.challenge["qop"], ",") {
+		if strings.TrimSpace(qop) == "auth" {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleResponse return true if the response is the response of the REGISTER of the trunk
+func (r *Register) HandleResponse(msg *Message) bool {
+	if callId, _ := msg.GetCallID(); callId != r.callId {
+		return false
+	}
+	if _, forward := r.transactions.HandleResponse(msg); !forward || !msg.IsFinalResponse() {
+		return true
+	}
+	r.send(r.handleFinalResponse(msg))
+	return true
+}
+
+// handleFinalResponse update the registration state by the final response of the
+// pending REGISTER, the REGISTER to send again is returned
+func (r *Register) handleFinalResponse(msg *Message) *registerRequest {
+	branch, _ := msg.GetTopViaBranch()
+	r.Lock()
+	defer r.Unlock()
+	if branch != r.pending {
+		return nil
+	}
+	r.pending = ""
+	statusCode := msg.response.statusCode
+	switch {
+	case statusCode >= 200 && statusCode < 300:
+		r.registerSucceeded(msg)
+	case statusCode == 401 || statusCode == 407:
+		req, err := r.answerChallenge(msg)
+		if err != nil {
+			r.registerFailed(err)
+		}
+		return req
+	case statusCode == 423 && r.requestExpires > 0:
+		minExpires, err := msg.GetHeaderInt("Min-Expires")
+		if err != nil || minExpires <= r.requestExpires {
+			r.registerFailed(fmt.Errorf("%d %s", statusCode, msg.response.reason))
+			return nil
+		}
+		zap.L().Info("increase expires of trunk", zap.String("trunk", r.config.Name), zap.Int("expires", minExpires))
+		r.requestExpires = minExpires
+		return r.newRequestOrFail()
+	default:
+		r.registerFailed(fmt.Errorf("%d %s", statusCode, msg.response.reason))
+	}
+	return nil
+}
+
+// answerChallenge create the REGISTER again with the credentials for the challenge in
+// the 401 or 407, the credentials are rejected if they are challenged again
+func (r *Register) answerChallenge(msg *Message) (*registerRequest, error) {
+	header := "WWW-Authenticate"
+	if msg.response.statusCode == 407 {
+		header = "Proxy-Authenticate"
+	}
+	var challenge map[string]string
+	for _, h := range msg.headers {
+		if !msg.isSameHeader(h.name, header) {
+			continue
+		}
+		value, ok := h.value.(string)
+		if !ok {
+			continue
+		}
+		params, ok := parseDigestCredentials(value)
+		if ok && params["nonce"] != "" && (params["algorithm"] == "" || slices.ContainsFunc(SupportedDigestAlgorithms, func(s string) bool {
+			return strings.EqualFold(s, params["algorithm"])
+		})) {
+			challenge = params
+			break
+		}
+	}
+	if challenge == nil {
+		return nil, fmt.Errorf("no supported digest challenge in %d", msg.response.statusCode)
+	}
+	if r.config.Password == "" {
+		return nil, fmt.Errorf("no credentials for the challenge of realm %s", challenge["realm"])
+	}
+	if r.authRetried && !strings.EqualFold(challenge["stale"], "true") {
+		return nil, fmt.Errorf("credentials are rejected by realm %s", challenge["realm"])
+	}
+	r.challenge, r.challengeHeader, r.nonceCount = challenge, "Authorization", 0
+	if header == "Proxy-Authenticate" {
+		r.challengeHeader = "Proxy-Authorization"
+	}
+	r.authRetried = true
+	return r.newRequest()
+}
+
+func (r *Register) registerSucceeded(msg *Message) {
+	if r.requestExpires == 0 {
+		zap.L().Info("trunk is unregistered", zap.String("proxy", r.proxyName), zap.String("trunk", r.config.Name))
+		r.setState(trunkUnregistered)
+		return
+	}
+	expires := r.getGrantedExpires(msg)
+	r.expires = time.Now().Add(time.Duration(expires) * time.Second)
+	r.failures, r.lastError = 0, ""
+	if r.state != trunkRegistered {
+		zap.L().Info("trunk is registered", zap.String("proxy", r.proxyName), zap.String("trunk", r.config.Name), zap.String("aor", r.config.AOR), zap.Int("expires", expires))
+		r.setState(trunkRegistered)
+	}
+	if !r.stopped {
+		refresh := time.Duration(expires) * time.Second
+		r.schedule(refresh - min(refresh/2, trunkRefreshMargin))
+	}
+}
+
+// getGrantedExpires get the expires of the contact of the trunk in the 2xx, the Expires
+// header or the requested expires are used if the contact has no expires
+func (r *Register) getGrantedExpires(msg *Message) int {
+	expires := msg.GetExpires(r.requestExpires)
+	contacts, _ := msg.GetContacts()
+	for _, contact := range contacts {
+		for i := 0; i < contact.GetContactParamCount(); i++ {
+			param, _ := contact.GetContactParam(i)
+			addrSpec, err := param.GetAddrSpec()
+			if err != nil {
+				continue
+			}
+			if sipUri, err := addrSpec.GetSIPURI(); err == nil && sipUri.User == r.aor.User {
+				if serverTrans, err := r.findTransport(r.transport); err == nil && sipUri.GetPort() == serverTrans.GetPort() {
+					expires = param.GetExpires(expires)
+				}
+			}
+		}
+	}
+	if expires <= 0 {
+		expires = r.requestExpires
+	}
+	return expires
+}
+
+// registerFailed retry the registration after the backoff interval, it must be called
+// with the lock held
+func (r *Register) registerFailed(err error) {
+	r.failures++
+	r.lastError = err.Error()
+	if r.stopped {
+		zap.L().Error("Fail to unregister trunk", zap.String("trunk", r.config.Name), zap.String("error", err.Error()))
+		return
+	}
+	retry := r.maxRetryInterval
+	if r.failures < 32 {
+		retry = min(r.retryInterval<<(r.failures-1), r.maxRetryInterval)
+	}
+	zap.L().Error("Fail to register trunk", zap.String("proxy", r.proxyName), zap.String("trunk", r.config.Name), zap.String("error", err.Error()), zap.Int("failures", r.failures), zap.Duration("retry", retry))
+	if r.state == trunkRegistered && r.expires.After(time.Now()) {
+		// the current registration is still valid until it expires
+		r.schedule(min(retry, time.Until(r.expires)))
+		return
+	}
+	r.setState(trunkFailed)
+	r.schedule(retry)
+}
+
+func (r *Register) transactionTimeout(ct *ClientTransaction) {
+	branch, _ := ct.GetRequest().GetTopViaBranch()
+	r.Lock()
+	defer r.Unlock()
+	if branch != r.pending {
+		return
+	}
+	r.pending = ""
+	r.registerFailed(fmt.Errorf("no response from registrar %s", r.config.Registrar))
+}
+
+func (r *Register) setState(state string) {
+	if r.state != state {
+		r.state, r.since = state, time.Now()
+	}
+}
+
+// GetTrunkInfo get the registration state of the trunk
+func (r *Register) GetTrunkInfo() TrunkInfo {
+	r.Lock()
+	defer r.Unlock()
+	info := TrunkInfo{Name: r.config.Name,
+		Registrar: r.config.Registrar,
+		AOR:       r.config.AOR,
+		State:     r.state,
+		Since:     r.since,
+		Failures:  r.failures,
+		LastError: r.lastError}
+	if r.state == trunkRegistered {
+		expires := r.expires
+		info.Expires = &expires
+	}
+	return info
+}
+
+// SetTrunks start the registrations of the trunks, the trunks which are not changed keep
+// their registrations and the removed trunks are unregistered
+func (p *Proxy) SetTrunks(configs []TrunkConfig) error {
+	p.trunksLock.Lock()
+	defer p.trunksLock.Unlock()
+	running := make(map[string]*Register)
+	for _, trunk := range p.trunks {
+		running[trunk.config.Name] = trunk
+	}
+	trunks := make([]*Register, 0, len(configs))
+	var lastErr error
+	for _, config := range configs {
+		old, ok := running[config.Name]
+		if ok && old.config == config {
+			delete(running, config.Name)
+			trunks = append(trunks, old)
+			continue
+		}
+		trunk, err := NewRegister(p.name, config, p.findListenTransport, func(host string, port int, protocol string) (ClientTransport, error) {
+			return p.findClientTransport(host, port, protocol, "")
+		})
+		if err != nil {
+			zap.L().Error("Invalid trunk of proxy", zap.String("name", p.name), zap.String("error", err.Error()))
+			lastErr = err
+			continue
+		}
+		if ok {
+			// the binding is replaced by the new registration if the AOR is not changed
+			delete(running, config.Name)
+			old.Stop(old.config.Registrar != config.Registrar || old.config.AOR != config.AOR)
+		}
+		trunk.Start()
+		trunks = append(trunks, trunk)
+	}
+	for _, trunk := range running {
+		trunk.Stop(true)
+	}
+	p.trunks = trunks
+	return lastErr
+}
+
+// GetTrunkInfos get the registration states of the trunks of the proxy
+func (p *Proxy) GetTrunkInfos() []TrunkInfo {
+	p.trunksLock.Lock()
+	defer p.trunksLock.Unlock()
+	r := make([]TrunkInfo, 0, len(p.trunks))
+	for _, trunk := range p.trunks {
+		r = append(r, trunk.GetTrunkInfo())
+	}
+	return r
+}
+
+// isTrunkResponse check if the response is the response of the REGISTER of a trunk
+func (p *Proxy) isTrunkResponse(msg *Message) bool {
+	p.trunksLock.Lock()
+	trunks := p.trunks
+	p.trunksLock.Unlock()
+	for _, trunk := range trunks {
+		if trunk.HandleResponse(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// findListenTransport find a listening transport of the protocol
+func (p *Proxy) findListenTransport(protocol string) (ServerTransport, error) {
+	for _, item := range p.getItems() {
+		transport, err := item.FindTransport(func(t ServerTransport) bool {
+			return strings.EqualFold(t.GetProtocol(), protocol) && !t.IsExit()
+		})
+		if err == nil {
+			return transport, nil
+		}
 	}
+	return nil, fmt.Errorf("no %s transport is listened", protocol)
 }
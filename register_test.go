@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestRegistrar start a registrar which challenges the REGISTER without valid
+// credentials and answers 200 with the Contact of the REGISTER otherwise
+func startTestRegistrar(t *testing.T, port int, auth *DigestAuthenticator) chan *Message {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	received := make(chan *Message, 100)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			msg, err := ParseMessage(bufio.NewReader(bytes.NewBuffer(buf[0:n])))
+			if err != nil {
+				continue
+			}
+			var response *Message
+			if authorized, stale := auth.Verify(msg); !authorized {
+				response = auth.Challenge(msg, stale)
+			} else {
+				response = NewResponseOf(msg, 200, "OK")
+				if contact, err := msg.GetHeaderValue("Contact"); err == nil {
+					response.AddHeader("Contact", fmt.Sprintf("%s;expires=%d", contact, msg.GetExpires(0)))
+				}
+			}
+			if b, err := response.Bytes(); err == nil {
+				conn.WriteToUDP(b, addr)
+			}
+			received <- msg
+		}
+	}()
+	return received
+}
+
+func receiveTestRegister(t *testing.T, received chan *Message, timeout time.Duration) *Message {
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(timeout):
+		t.Fatalf("no REGISTER is received in %v", timeout)
+	}
+	return nil
+}
+
+func waitTrunkState(t *testing.T, trunk *Register, state string) TrunkInfo {
+	for i := 0; i < 100; i++ {
+		if info := trunk.GetTrunkInfo(); info.State == state {
+			return info
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("the trunk is not %s: %v", state, trunk.GetTrunkInfo())
+	return TrunkInfo{}
+}
+
+func TestRegisterTrunk(t *testing.T) {
+	received := startTestRegistrar(t, 16170, createTestAuthenticator(t, AuthConfig{}))
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16171}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	trunk := TrunkConfig{Name: "carrier", Registrar: "127.0.0.1:16170", AOR: "sip:alice@test.com", Password: "secret", Expires: 2}
+	if err := proxy.SetTrunks([]TrunkConfig{trunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receiveTestRegister(t, received, 2*time.Second)
+	if _, err := first.GetHeader("Proxy-Authorization"); err == nil {
+		t.Errorf("the credentials are sent before the challenge")
+	}
+	second := receiveTestRegister(t, received, 2*time.Second)
+	if _, err := second.GetHeader("Proxy-Authorization"); err != nil {
+		t.Errorf("the challenge is not answered")
+	}
+	if requestURI, _ := second.GetRequestURI(); requestURI.String() != "sip:test.com" {
+		t.Errorf("wrong Request-URI %s", requestURI)
+	}
+	if contact, _ := second.GetHeaderValue("Contact"); contact != "<sip:alice@127.0.0.1:16171>" {
+		t.Errorf("wrong Contact %v", contact)
+	}
+	firstCallId, _ := first.GetCallID()
+	secondCallId, _ := second.GetCallID()
+	if cseq, _ := second.GetCSeq(); firstCallId != secondCallId || cseq.Seq != 2 {
+		t.Errorf("the challenged REGISTER is not sent again in the same Call-ID with the next CSeq")
+	}
+	info := waitTrunkState(t, proxy.trunks[0], trunkRegistered)
+	if info.Expires == nil || time.Until(*info.Expires) > 2*time.Second {
+		t.Errorf("wrong expires of the registration %v", info.Expires)
+	}
+
+	admin := NewAdminServer(":0", []*Proxy{proxy})
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/proxies/0/trunks", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expect 200 but get %d", w.Code)
+	}
+	infos := make([]TrunkInfo, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != "carrier" || infos[0].State != trunkRegistered {
+		t.Errorf("wrong trunks %v", infos)
+	}
+
+	// the registration is refreshed at the half of the 2 seconds with the last challenge
+	refresh := receiveTestRegister(t, received, 3*time.Second)
+	if _, err := refresh.GetHeader("Proxy-Authorization"); err != nil {
+		t.Errorf("the credentials are not sent in the refresh")
+	}
+	if cseq, _ := refresh.GetCSeq(); cseq.Seq != 3 {
+		t.Errorf("expect CSeq 3 in the refresh but get %d", cseq.Seq)
+	}
+
+	proxy.SetTrunks(nil)
+	if unregister := receiveTestRegister(t, received, 2*time.Second); unregister.GetExpires(-1) != 0 {
+		t.Errorf("the trunk is not unregistered after it is removed")
+	}
+}
+
+func TestRegisterTrunkRetryWithBackoff(t *testing.T) {
+	received := startTestRegistrar(t, 16172, createTestAuthenticator(t, AuthConfig{}))
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16173}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	config := TrunkConfig{Name: "carrier", Registrar: "127.0.0.1:16172", AOR: "sip:alice@test.com", Password: "wrong"}
+	trunk, err := NewRegister(proxy.name, config, proxy.findListenTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trunk.retryInterval = 200 * time.Millisecond
+	proxy.trunks = []*Register{trunk}
+	trunk.Start()
+	defer trunk.Stop(false)
+
+	// the credentials are challenged again in each attempt of two REGISTERs
+	receiveTestRegister(t, received, 2*time.Second)
+	receiveTestRegister(t, received, 2*time.Second)
+	start := time.Now()
+	info := waitTrunkState(t, trunk, trunkFailed)
+	if info.Failures != 1 || !strings.Contains(info.LastError, "rejected") {
+		t.Errorf("wrong failure of the trunk %v", info)
+	}
+	receiveTestRegister(t, received, 2*time.Second)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("the registration is retried after %v", elapsed)
+	}
+	receiveTestRegister(t, received, 2*time.Second)
+	start = time.Now()
+	receiveTestRegister(t, received, 2*time.Second)
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("the retry interval is not doubled: %v", elapsed)
+	}
+	if info := trunk.GetTrunkInfo(); info.Failures != 2 {
+		t.Errorf("expect 2 failures but get %d", info.Failures)
+	}
+}
+
+func TestRegisterTrunkLocateWithoutLock(t *testing.T) {
+	// the DNS server never answers, the registrar is located until the query timeout
+	dnsConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 16234})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsConn.Close()
+	sipServerLocator.SetDNSServer(dnsConn.LocalAddr().String())
+	t.Cleanup(func() {
+		sipServerLocator.SetDNSServer("")
+	})
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16235}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	config := TrunkConfig{Name: "carrier", Registrar: "registrar.slow.test", AOR: "sip:alice@test.com", Password: "secret"}
+	trunk, err := NewRegister(proxy.name, config, proxy.findListenTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trunk.Start()
+	defer trunk.Stop(false)
+	time.Sleep(200 * time.Millisecond)
+
+	done := make(chan TrunkInfo)
+	go func() {
+		done <- trunk.GetTrunkInfo()
+	}()
+	select {
+	case info := <-done:
+		if info.State != trunkRegistering {
+			t.Errorf("expect the trunk is registering but it is %s", info.State)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the trunk state is blocked by locating the registrar")
+	}
+}
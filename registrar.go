@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRegisterExpires    = 3600
+	defaultMinRegisterExpires = 60
+	defaultMaxRegisterExpires = 7200
+)
+
+// Registrar accept the REGISTER for the hosted domains and keep the bindings of the AORs
+// in the location store, see RFC 3261 10.3
+type Registrar struct {
+	sync.Mutex
+	proxyName string
+	// the domains in lower case, the REGISTER is not handled if it is empty
+	domains        []string
+	defaultExpires int
+	minExpires     int
+	maxExpires     int
+	// parallel or sequential forking to the contacts
+	fork          string
+	branchTimeout time.Duration
+	store         LocationStore
+}
+
+func NewRegistrar(proxyName string, store LocationStore) *Registrar {
+	return &Registrar{proxyName: proxyName, store: store}
+}
+
+// Update replace the hosted domains and the expires limits, the bindings are kept. No
+// domain is hosted if config is nil
+func (r *Registrar) Update(config *RegistrarConfig) error {
+	domains := make([]string, 0)
+	defaultExpires, minExpires, maxExpires := defaultRegisterExpires, defaultMinRegisterExpires, defaultMaxRegisterExpires
+	fork, branchTimeout := forkParallel, time.Duration(0)
+	if config != nil {
+		if err := validateRegistrar(config); err != nil {
+			return err
+		}
+		for _, domain := range config.Domains {
+			domains = append(domains, strings.ToLower(domain))
+		}
+		if config.DefaultExpires > 0 {
+			defaultExpires = config.DefaultExpires
+		}
+		if config.MinExpires > 0 {
+			minExpires = config.MinExpires
+		}
+		if config.MaxExpires > 0 {
+			maxExpires = config.MaxExpires
+		}
+		if config.Fork != "" {
+			fork = strings.ToLower(config.Fork)
+		}
+		branchTimeout = time.Duration(config.BranchTimeout) * time.Second
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.domains, r.defaultExpires, r.minExpires, r.maxExpires = domains, defaultExpires, minExpires, maxExpires
+	r.fork, r.branchTimeout = fork, branchTimeout
+	return nil
+}
+
+func validateRegistrar(config *RegistrarConfig) error {
+	if len(config.Domains) == 0 {
+		return fmt.Errorf("no domain is hosted")
+	}
+	if config.DefaultExpires < 0 || config.MinExpires < 0 || config.MaxExpires < 0 {
+		return fmt.Errorf("expires must not be negative")
+	}
+	if config.MinExpires > 0 && config.MaxExpires > 0 && config.MinExpires > config.MaxExpires {
+		return fmt.Errorf("min-expires %d is greater than max-expires %d", config.MinExpires, config.MaxExpires)
+	}
+	return validateFork(config.Fork, config.BranchTimeout)
+}
+
+// isHostedDomain check if the host is one of the domains of the registrar
+func (r *Registrar) isHostedDomain(host string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return slices.Contains(r.domains, strings.ToLower(host))
+}
+
+func (r *Registrar) getExpiresLimits() (defaultExpires int, minExpires int, maxExpires int) {
+	r.Lock()
+	defer r.Unlock()
+	return r.defaultExpires, r.minExpires, r.maxExpires
+}
+
+// getAOR get the address of record in the canonical sip:user@host form of the SIP URI
+func getAOR(addrSpec *AddrSpec) (string, error) {
+	sipUri, err := addrSpec.GetSIPURI()
+	if err != nil {
+		return "", err
+	}
+	if sipUri.User == "" {
+		return "", fmt.Errorf("no user in %s", addrSpec)
+	}
+	return fmt.Sprintf("sip:%s@%s", sipUri.User, strings.ToLower(sipUri.Host)), nil
+}
+
+// getHostedAOR get the AOR of the URI if its domain is hosted by the registrar
+func (r *Registrar) getHostedAOR(addrSpec *AddrSpec) (string, bool) {
+	sipUri, err := addrSpec.GetSIPURI()
+	if err != nil || !r.isHostedDomain(sipUri.Host) {
+		return "", false
+	}
+	aor, err := getAOR(addrSpec)
+	return aor, err == nil
+}
+
+// Register update the bindings of the AOR in the To header with the Contact headers of
+// the REGISTER and create the response which lists all the current bindings
+func (r *Registrar) Register(msg *Message, source string, now time.Time) *Message {
+	to, err := msg.GetTo()
+	if err != nil {
+		return NewResponseOf(msg, 400, "Bad Request")
+	}
+	addrSpec, err := to.GetAddrSpec()
+	if err != nil {
+		return NewResponseOf(msg, 400, "Bad Request")
+	}
+	aor, ok := r.getHostedAOR(addrSpec)
+	if !ok {
+		return NewResponseOf(msg, 404, "Not Found")
+	}
+	contacts, err := msg.GetContacts()
+	if err != nil {
+		return NewResponseOf(msg, 400, "Bad Request")
+	}
+	if _, err := msg.GetCSeq(); err != nil {
+		return NewResponseOf(msg, 400, "Bad Request")
+	}
+	var bindings []*Binding
+	var rejection *Message
+	if len(contacts) == 0 {
+		bindings, err = r.store.GetBindings(aor)
+	} else {
+		// the bindings are read and updated atomically, the REGISTERs of the same AOR
+		// with different Call-IDs are processed by different workers
+		bindings, err = r.store.UpdateBindings(aor, func(bindings []*Binding) ([]*Binding, error) {
+			bindings, rejection = r.updateBindings(msg, aor, contacts, bindings, source, now)
+			if rejection != nil {
+				return nil, errBindingsNotUpdated
+			}
+			return bindings, nil
+		})
+	}
+	if rejection != nil {
+		return rejection
+	}
+	if err != nil {
+		return NewResponseOf(msg, 500, "Server Internal Error")
+	}
+	if len(contacts) != 0 {
+		zap.L().Info("bindings of the AOR are updated", zap.String("proxy", r.proxyName), zap.String("aor", aor), zap.Int("bindings", len(bindings)), zap.String("source", source))
+	}
+	response := NewResponseOf(msg, 200, "OK")
+	for _, binding := range bindings {
+		contact := fmt.Sprintf("<%s>;expires=%d", binding.Contact, int(binding.Expires.Sub(now).Round(time.Second).Seconds()))
+		if binding.Q != 1 {
+			contact += ";q=" + strconv.FormatFloat(binding.Q, 'f', -1, 64)
+		}
+		response.AddHeader("Contact", contact)
+	}
+	response.AddHeader("Date", now.UTC().Format(http.TimeFormat))
+	return response
+}
+
+// updateBindings apply the Contacts of the REGISTER to the current bindings of the AOR,
+// the response rejecting the REGISTER is returned if the Contacts are not valid
+func (r *Registrar) updateBindings(msg *Message, aor string, contacts []*Contact, bindings []*Binding, source string, now time.Time) ([]*Binding, *Message) {
+	callId, _ := msg.GetCallID()
+	cseq, _ := msg.GetCSeq()
+	defaultExpires, minExpires, maxExpires := r.getExpiresLimits()
+	headerExpires := msg.GetExpires(-1)
+	for _, contact := range contacts {
+		if contact.IsStar() {
+			// the "*" removes all the bindings and must be the only Contact with Expires 0
+			if len(contacts) != 1 || headerExpires != 0 {
+				return nil, NewResponseOf(msg, 400, "Bad Request")
+			}
+			for _, binding := range bindings {
+				if binding.CallId == callId && binding.CSeq >= cseq.Seq {
+					return nil, NewResponseOf(msg, 500, "Server Internal Error")
+				}
+			}
+			bindings = nil
+			continue
+		}
+		for i := 0; i < contact.GetContactParamCount(); i++ {
+			param, _ := contact.GetContactParam(i)
+			uri, err := param.GetAddrSpec()
+			if err != nil {
+				return nil, NewResponseOf(msg, 400, "Bad Request")
+			}
+			expires := param.GetExpires(headerExpires)
+			if expires < 0 {
+				expires = defaultExpires
+			}
+			if expires > 0 && expires < minExpires {
+				response := NewResponseOf(msg, 423, "Interval Too Brief")
+				response.AddHeader("Min-Expires", strconv.Itoa(minExpires))
+				return nil, response
+			}
+			expires = min(expires, maxExpires)
+			pos := slices.IndexFunc(bindings, func(b *Binding) bool {
+				return b.Contact == uri.String()
+			})
+			if pos != -1 && bindings[pos].CallId == callId && bindings[pos].CSeq >= cseq.Seq {
+				// the REGISTER is out of order
+				return nil, NewResponseOf(msg, 500, "Server Internal Error")
+			}
+			binding := &Binding{AOR: aor,
+				Contact: uri.String(),
+				Q:       param.GetQ(),
+				Expires: now.Add(time.Duration(expires) * time.Second),
+				CallId:  callId,
+				CSeq:    cseq.Seq,
+				Source:  source}
+			switch {
+			case pos != -1 && expires == 0:
+				bindings = slices.Delete(bindings, pos, pos+1)
+			case pos != -1:
+				bindings[pos] = binding
+			case expires > 0:
+				bindings = append(bindings, binding)
+			}
+		}
+	}
+	return bindings, nil
+}
+
+// GetTargets get the contacts of the AOR in the descending order of q
+func (r *Registrar) GetTargets(aor string) ([]*AddrSpec, error) {
+	bindings, err := r.getSortedBindings(aor)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]*AddrSpec, 0, len(bindings))
+	for _, binding := range bindings {
+		if target, err := ParseAddrSpec(binding.Contact); err == nil {
+			targets = append(targets, target)
+		}
+	}
+	return targets, nil
+}
+
+// GetTargetGroups get the contacts of the AOR to fork the request to, the groups are
+// tried one after another and the contacts in a group in parallel. All the contacts are
+// in one group in the parallel forking, and grouped by q-value in the decreasing order
+// in the sequential forking, see RFC 3261 16.6
+func (r *Registrar) GetTargetGroups(aor string) ([][]*AddrSpec, error) {
+	bindings, err := r.getSortedBindings(aor)
+	if err != nil {
+		return nil, err
+	}
+	r.Lock()
+	sequential := r.fork == forkSequential
+	r.Unlock()
+	groups := make([][]*AddrSpec, 0)
+	for i, binding := range bindings {
+		target, err := ParseAddrSpec(binding.Contact)
+		if err != nil {
+			continue
+		}
+		if len(groups) == 0 || (sequential && binding.Q != bindings[i-1].Q) {
+			groups = append(groups, make([]*AddrSpec, 0))
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], target)
+	}
+	return groups, nil
+}
+
+// getSortedBindings get the bindings of the AOR in the decreasing q-value order
+func (r *Registrar) getSortedBindings(aor string) ([]*Binding, error) {
+	bindings, err := r.store.GetBindings(aor)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(bindings, func(a, b *Binding) int {
+		if a.Q > b.Q {
+			return -1
+		} else if a.Q < b.Q {
+			return 1
+		}
+		return 0
+	})
+	return bindings, nil
+}
+
+func (r *Registrar) getBranchTimeout() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	return r.branchTimeout
+}
+
+// GetBindings get the bindings of all the AORs ordered by AOR
+func (r *Registrar) GetBindings() ([]*Binding, error) {
+	bindings, err := r.store.GetAllBindings()
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(bindings, func(a, b *Binding) int {
+		return strings.Compare(a.AOR, b.AOR)
+	})
+	return bindings, nil
+}
+
+// SetRegistrar update the domains hosted by the registrar of the proxy
+func (p *Proxy) SetRegistrar(config *RegistrarConfig) error {
+	if err := p.registrar.Update(config); err != nil {
+		zap.L().Error("Invalid registrar of proxy", zap.String("name", p.name), zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// GetBindings get the bindings registered to the proxy
+func (p *Proxy) GetBindings() ([]*Binding, error) {
+	return p.registrar.GetBindings()
+}
+
+// handleRegister answer the REGISTER whose Request-URI is a hosted domain, true is
+// returned if the REGISTER is answered by the registrar
+func (p *Proxy) handleRegister(msg *Message, peerAddr string) bool {
+	if method, _ := msg.GetMethod(); method != "REGISTER" {
+		return false
+	}
+	requestURI, err := msg.GetRequestURI()
+	if err != nil {
+		return false
+	}
+	sipUri, err := requestURI.GetSIPURI()
+	if err != nil || !p.registrar.isHostedDomain(sipUri.Host) {
+		return false
+	}
+	response := p.registrar.Register(msg, peerAddr, time.Now())
+	callId, _ := msg.GetCallID()
+	zap.L().Info("reply REGISTER", zap.Int("statusCode", response.response.statusCode), zap.String("call-id", callId))
+	p.sendProxyResponse(response)
+	return true
+}
+
+// routeToContacts fork the out-of-dialog request whose Request-URI is an AOR of the hosted
+// domains to the registered contacts, see RFC 3261 16.5. True is returned if the request
+// is processed by the registrar
+func (p *Proxy) routeToContacts(protocol string, msg *Message) bool {
+	requestURI, err := msg.GetRequestURI()
+	if err != nil {
+		return false
+	}
+	aor, ok := p.registrar.getHostedAOR(requestURI)
+	if !ok {
+		return false
+	}
+	if _, err := msg.GetHeader("Route"); err == nil || !isOutOfDialogRequest(msg) {
+		return false
+	}
+	callId, _ := msg.GetCallID()
+	groups, err := p.registrar.GetTargetGroups(aor)
+	if err != nil {
+		p.replyRequest(msg, 500, "Server Internal Error")
+		return true
+	}
+	if len(groups) == 0 {
+		zap.L().Info("no contact is registered for the AOR", zap.String("aor", aor), zap.String("call-id", callId))
+		p.replyRequest(msg, 480, "Temporarily Unavailable")
+		return true
+	}
+	targets := make([][]forkTarget, 0, len(groups))
+	for _, group := range groups {
+		contacts := make([]forkTarget, 0, len(group))
+		for _, contact := range group {
+			contacts = append(contacts, newContactForkTarget(contact))
+		}
+		targets = append(targets, contacts)
+	}
+	zap.L().Info("route the request to the registered contacts", zap.String("aor", aor), zap.Int("groups", len(groups)), zap.String("call-id", callId))
+	p.forkRequest(protocol, msg, targets, p.registrar.getBranchTimeout())
+	return true
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func createTestRegister(aor string, cseq int, contact string, expires int) *Message {
+	s := `REGISTER sip:test.com SIP/2.0
+Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bKnashds7
+Max-Forwards: 70
+From: <` + aor + `>;tag=456248
+To: <` + aor + `>
+Call-ID: 843817637684230@998sdasdh09
+CSeq: ` + fmt.Sprint(cseq) + ` REGISTER
+`
+	if contact != "" {
+		s += "Contact: " + contact + "\n"
+	}
+	if expires >= 0 {
+		s += fmt.Sprintf("Expires: %d\n", expires)
+	}
+	msg, _ := ParseMessage(create_reader_from_string(s + "Content-Length: 0\n\n"))
+	return msg
+}
+
+func getTestContacts(t *testing.T, response *Message) []string {
+	contacts, err := response.GetContacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := make([]string, 0)
+	for _, contact := range contacts {
+		for i := 0; i < contact.GetContactParamCount(); i++ {
+			param, _ := contact.GetContactParam(i)
+			r = append(r, param.String())
+		}
+	}
+	return r
+}
+
+func TestRegistrarRegister(t *testing.T) {
+	registrar := NewRegistrar("test.com", NewLocalLocationStore())
+	if err := registrar.Update(&RegistrarConfig{Domains: []string{"Test.com"}, MinExpires: 30, MaxExpires: 600}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	response := registrar.Register(createTestRegister("sip:bob@test.com", 1, "<sip:bob@10.0.0.1>, <sip:bob@10.0.0.2>;q=0.5;expires=60", 3600), "10.0.0.1", now)
+	if response.response.statusCode != 200 {
+		t.Fatalf("expect 200 but get %d", response.response.statusCode)
+	}
+	contacts := getTestContacts(t, response)
+	if len(contacts) != 2 || contacts[0] != "<sip:bob@10.0.0.1>;expires=600" || contacts[1] != "<sip:bob@10.0.0.2>;expires=60;q=0.5" {
+		t.Errorf("wrong contacts in 200: %v", contacts)
+	}
+	if response := registrar.Register(createTestRegister("sip:bob@test.com", 2, "<sip:bob@10.0.0.3>", 10), "10.0.0.3", now); response.response.statusCode != 423 {
+		t.Errorf("expect 423 for too short expires but get %d", response.response.statusCode)
+	} else if minExpires, _ := response.GetHeaderInt("Min-Expires"); minExpires != 30 {
+		t.Errorf("wrong Min-Expires %d", minExpires)
+	}
+	if response := registrar.Register(createTestRegister("sip:bob@test.com", 1, "<sip:bob@10.0.0.1>", 0), "10.0.0.1", now); response.response.statusCode != 500 {
+		t.Errorf("expect 500 for the REGISTER out of order but get %d", response.response.statusCode)
+	}
+	if response := registrar.Register(createTestRegister("sip:alice@other.com", 1, "<sip:alice@10.0.0.1>", 60), "10.0.0.1", now); response.response.statusCode != 404 {
+		t.Errorf("expect 404 for the AOR of other domain but get %d", response.response.statusCode)
+	}
+
+	targets, _ := registrar.GetTargets("sip:bob@test.com")
+	if len(targets) != 2 || targets[0].String() != "sip:bob@10.0.0.1" {
+		t.Errorf("wrong targets %v", targets)
+	}
+	response = registrar.Register(createTestRegister("sip:bob@test.com", 3, "<sip:bob@10.0.0.1>", 0), "10.0.0.1", now)
+	if contacts := getTestContacts(t, response); len(contacts) != 1 {
+		t.Errorf("the binding is not removed with expires 0: %v", contacts)
+	}
+	// query the bindings without Contact
+	response = registrar.Register(createTestRegister("sip:bob@test.com", 4, "", -1), "10.0.0.1", now)
+	if contacts := getTestContacts(t, response); len(contacts) != 1 {
+		t.Errorf("wrong bindings in the response of query: %v", contacts)
+	}
+	if targets, _ := registrar.GetTargets("sip:bob@test.com"); len(targets) != 1 {
+		t.Errorf("the removed binding is returned")
+	}
+
+	if response := registrar.Register(createTestRegister("sip:bob@test.com", 5, "*", 60), "10.0.0.1", now); response.response.statusCode != 400 {
+		t.Errorf("expect 400 for the star contact without Expires 0 but get %d", response.response.statusCode)
+	}
+	response = registrar.Register(createTestRegister("sip:bob@test.com", 6, "*", 0), "10.0.0.1", now)
+	if response.response.statusCode != 200 || len(getTestContacts(t, response)) != 0 {
+		t.Errorf("the bindings are not removed by the star contact")
+	}
+}
+
+func TestRegistrarTargetGroups(t *testing.T) {
+	registrar := NewRegistrar("test.com", NewLocalLocationStore())
+	config := &RegistrarConfig{Domains: []string{"test.com"}}
+	if err := registrar.Update(config); err != nil {
+		t.Fatal(err)
+	}
+	registrar.Register(createTestRegister("sip:bob@test.com", 1, "<sip:bob@10.0.0.1>;q=0.5, <sip:bob@10.0.0.2>, <sip:bob@10.0.0.3>;q=0.5", 600), "10.0.0.1", time.Now())
+	if groups, _ := registrar.GetTargetGroups("sip:bob@test.com"); len(groups) != 1 || len(groups[0]) != 3 {
+		t.Errorf("the contacts are not forked in parallel: %v", groups)
+	}
+	config.Fork = "Sequential"
+	if err := registrar.Update(config); err != nil {
+		t.Fatal(err)
+	}
+	groups, _ := registrar.GetTargetGroups("sip:bob@test.com")
+	if len(groups) != 2 || len(groups[0]) != 1 || groups[0][0].String() != "sip:bob@10.0.0.2" || len(groups[1]) != 2 {
+		t.Errorf("the contacts are not grouped in the decreasing q-value order: %v", groups)
+	}
+	config.Fork = "round-robin"
+	if err := registrar.Update(config); err == nil {
+		t.Errorf("the invalid fork is accepted")
+	}
+}
+
+func TestProxyRoutesToRegisteredContacts(t *testing.T) {
+	busy := startTestBackend(t, 16161, 16160, 486, "Busy Here")
+	declined := startTestBackend(t, 16162, 16160, 603, "Decline")
+	answered := startTestBackend(t, 16163, 16160, 200, "OK")
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: 16160}}
+	proxy := NewProxy("test.com", 60, listens, true, NewPreConfigRoute(), NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.SetRegistrar(&RegistrarConfig{Domains: []string{"test.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	register := "REGISTER sip:test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%%d;branch=z9hG4bK776asdhf%d\r\nMax-Forwards: 70\r\nFrom: <sip:%s@test.com>;tag=1928301810\r\nTo: <sip:%s@test.com>\r\nCall-ID: a84b4c76e66750%s@test.com\r\nCSeq: 1 REGISTER\r\nContact: %s\r\nExpires: 600\r\nContent-Length: 0\r\n\r\n"
+	response := sendTestRequest(t, 16160, fmt.Sprintf(register, 1, "bob", "bob", "bob", "<sip:bob@127.0.0.1:16161>,<sip:bob@127.0.0.1:16162>"))
+	if response.response.statusCode != 200 {
+		t.Fatalf("expect 200 for the REGISTER but get %d", response.response.statusCode)
+	}
+	response = sendTestRequest(t, 16160, fmt.Sprintf(register, 2, "alice", "alice", "alice", "<sip:alice@127.0.0.1:16163>"))
+	if response.response.statusCode != 200 {
+		t.Fatalf("expect 200 for the REGISTER but get %d", response.response.statusCode)
+	}
+
+	request := "OPTIONS sip:%s@test.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:%%d;branch=z9hG4bK776asdhg%d\r\nMax-Forwards: 70\r\nFrom: <sip:carol@test.com>;tag=1928301811\r\nTo: <sip:%s@test.com>\r\nCall-ID: a84b4c76e66751%d@test.com\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n"
+	response = sendTestRequest(t, 16160, fmt.Sprintf(request, "bob", 1, "bob", 1))
+	if response.response.statusCode != 603 {
+		t.Errorf("expect the 6xx is chosen from the forked responses but get %d", response.response.statusCode)
+	}
+	for _, received := range []chan *Message{busy, declined} {
+		select {
+		case msg := <-received:
+			if requestURI, _ := msg.GetRequestURI(); requestURI.String() != "sip:bob@127.0.0.1:16161" && requestURI.String() != "sip:bob@127.0.0.1:16162" {
+				t.Errorf("the request is not retargeted to the contact: %s", requestURI)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("the request is not forked to all the contacts")
+		}
+	}
+	if response := sendTestRequest(t, 16160, fmt.Sprintf(request, "alice", 2, "alice", 2)); response.response.statusCode != 200 {
+		t.Errorf("expect 200 from the registered contact but get %d", response.response.statusCode)
+	}
+	<-answered
+	if response := sendTestRequest(t, 16160, fmt.Sprintf(request, "dave", 3, "dave", 3)); response.response.statusCode != 480 {
+		t.Errorf("expect 480 for the AOR without binding but get %d", response.response.statusCode)
+	}
+
+	admin := NewAdminServer(":0", []*Proxy{proxy})
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/proxies/0/registrations", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expect 200 but get %d", w.Code)
+	}
+	bindings := make([]Binding, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &bindings); err != nil {
+		t.Fatal(err)
+	}
+	if len(bindings) != 3 || bindings[0].AOR != "sip:alice@test.com" || bindings[0].Contact != "sip:alice@127.0.0.1:16163" {
+		t.Errorf("wrong bindings %v", bindings)
+	}
+}
+
+func TestRegistrarConcurrentRegister(t *testing.T) {
+	registrar := NewRegistrar("test.com", NewLocalLocationStore())
+	if err := registrar.Update(&RegistrarConfig{Domains: []string{"test.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	// the devices of the same AOR register at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			registrar.Register(createTestRegister("sip:bob@test.com", 1, fmt.Sprintf("<sip:bob@10.0.0.%d>", i+1), 3600), "10.0.0.1", time.Now())
+		}()
+	}
+	wg.Wait()
+	if targets, err := registrar.GetTargets("sip:bob@test.com"); err != nil || len(targets) != 20 {
+		t.Errorf("the bindings are lost in the concurrent REGISTERs: %v", targets)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// ConfigReloader reload the configuration file on SIGHUP or the admin request and apply
+// the differences to the running proxies, the proxies are matched by name
+type ConfigReloader struct {
+	sync.Mutex
+	fileName string
+	config   *ProxiesConfigure
+	proxies  []*Proxy
+	admin    *AdminServer
+}
+
+func NewConfigReloader(fileName string, config *ProxiesConfigure, proxies []*Proxy) *ConfigReloader {
+	return &ConfigReloader{fileName: fileName, config: config, proxies: proxies}
+}
+
+// SetAdminServer set the admin server whose proxies are updated after reload
+func (r *ConfigReloader) SetAdminServer(admin *AdminServer) {
+	r.Lock()
+	defer r.Unlock()
+	r.admin = admin
+}
+
+// GetProxies get the running proxies
+func (r *ConfigReloader) GetProxies() []*Proxy {
+	r.Lock()
+	defer r.Unlock()
+	return r.proxies
+}
+
+// HandleSignal reload the configuration file when SIGHUP is received
+func (r *ConfigReloader) HandleSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			zap.L().Info("SIGHUP is received, reload configuration", zap.String("file", r.fileName))
+			r.Reload()
+		}
+	}()
+}
+
+// Reload load the configuration file again, start the new proxies, close the removed
+// proxies and reload the listens, routes and hosts of the other proxies. The running
+// configuration is not changed if the file can't be loaded
+func (r *ConfigReloader) Reload() error {
+	r.Lock()
+	defer r.Unlock()
+
+	config, err := loadConfig(r.fileName)
+	if err != nil {
+		zap.L().Error("Fail to reload configuration", zap.String("file", r.fileName), zap.String("error", err.Error()))
+		return err
+	}
+	if config.Admin.Addr != r.config.Admin.Addr {
+		zap.L().Warn("the change of admin address takes effect after restart", zap.String("addr", config.Admin.Addr))
+	}
+	if config.DNSServer != r.config.DNSServer {
+		sipServerLocator.SetDNSServer(config.DNSServer)
+	}
+
+	// the running proxies and their configurations by name, a proxy failed to start is
+	// not running and it is started again on the next reload
+	running := make(map[string]*Proxy)
+	for _, proxy := range r.proxies {
+		running[proxy.name] = proxy
+	}
+	runningConfigs := make(map[string]ProxyConfig)
+	for _, proxyConfig := range r.config.Proxies {
+		runningConfigs[proxyConfig.Name] = proxyConfig
+	}
+	proxies := make([]*Proxy, 0)
+	proxyConfigs := make([]ProxyConfig, 0)
+	var lastErr error
+	for _, proxyConfig := range config.Proxies {
+		preConfigRoute := createPreConfigRoute(proxyConfig)
+		resolver := createPreConfigHostResolver(config.Hosts, proxyConfig)
+		proxy, ok := running[proxyConfig.Name]
+		if !ok {
+			zap.L().Info("start sip proxy", zap.String("name", proxyConfig.Name))
+			proxy, err := startProxy(proxyConfig, preConfigRoute, resolver)
+			if err != nil {
+				// release the listens already started, the proxy is started on next reload
+				if proxy != nil {
+					proxy.Close()
+				}
+				lastErr = err
+				continue
+			}
+			proxies = append(proxies, proxy)
+			proxyConfigs = append(proxyConfigs, proxyConfig)
+			continue
+		}
+		delete(running, proxyConfig.Name)
+		if !isReloadableChangeOnly(runningConfigs[proxyConfig.Name], proxyConfig) {
+			zap.L().Warn("the change of proxy settings other than listens, route, hosts, acl, rate-limit, registrar, trunks, redirect and header-rules takes effect after restart", zap.String("name", proxyConfig.Name))
+		}
+		zap.L().Info("reload sip proxy", zap.String("name", proxyConfig.Name))
+		if err := proxy.Reload(proxyConfig.Listens, preConfigRoute, resolver); err != nil {
+			lastErr = err
+		}
+		if err := proxy.SetACL(proxyConfig.ACL); err != nil {
+			lastErr = err
+		}
+		if err := proxy.SetRateLimit(proxyConfig.RateLimit); err != nil {
+			lastErr = err
+		}
+		if err := proxy.SetRegistrar(proxyConfig.Registrar); err != nil {
+			lastErr = err
+		}
+		if err := proxy.SetTrunks(proxyConfig.Trunks); err != nil {
+			lastErr = err
+		}
+		if err := proxy.SetRedirect(proxyConfig.Redirect); err != nil {
+			lastErr = err
+		}
+		if err := proxy.SetHeaderRules(proxyConfig.HeaderRules); err != nil {
+			lastErr = err
+		}
+		proxies = append(proxies, proxy)
+		proxyConfigs = append(proxyConfigs, proxyConfig)
+	}
+	for _, proxy := range running {
+		proxy.Close()
+	}
+
+	config.Proxies = proxyConfigs
+	r.config = config
+	r.proxies = proxies
+	if r.admin != nil {
+		r.admin.SetProxies(proxies)
+	}
+	if lastErr != nil {
+		return fmt.Errorf("configuration is partially reloaded: %w", lastErr)
+	}
+	zap.L().Info("Succeed to reload configuration", zap.String("file", r.fileName))
+	return nil
+}
+
+// isReloadableChangeOnly check if only the listens, route, hosts, acl, rate-limit, registrar,
+// trunks, redirect and header-rules of the proxy are changed, the other settings can't be
+// changed without restart
+func isReloadableChangeOnly(old ProxyConfig, new ProxyConfig) bool {
+	old.Listens, new.Listens = nil, nil
+	old.ACL, new.ACL = nil, nil
+	old.RateLimit, new.RateLimit = nil, nil
+	old.Registrar, new.Registrar = nil, nil
+	old.Trunks, new.Trunks = nil, nil
+	old.Redirect, new.Redirect = nil, nil
+	old.HeaderRules, new.HeaderRules = nil, nil
+	old.Route, new.Route = nil, nil
+	old.Hosts, new.Hosts = nil, nil
+	return reflect.DeepEqual(old, new)
+}
+
+// isBackendsChangeOnly check if only the backends, policy, failover, acl or header-rules
+// of the listen are changed, they are changed without restarting the transports of the listen
+func isBackendsChangeOnly(old ListenConfig, new ListenConfig) bool {
+	if len(old.Backends) == 0 || len(new.Backends) == 0 {
+		return false
+	}
+	old.Backends, new.Backends = nil, nil
+	old.Policy, new.Policy = "", ""
+	old.Failover, new.Failover = nil, nil
+	return isACLOrHeaderRulesChangeOnly(old, new)
+}
+
+// isACLOrHeaderRulesChangeOnly check if only the acl or header-rules of the listen are
+// changed, they are changed without restarting the transports of the listen
+func isACLOrHeaderRulesChangeOnly(old ListenConfig, new ListenConfig) bool {
+	old.ACL, new.ACL = nil, nil
+	old.HeaderRules, new.HeaderRules = nil, nil
+	return reflect.DeepEqual(old, new)
+}
+
+// Reload swap the routes and hosts, keep the unchanged listens, update the listens whose
+// backends, acl or header-rules are changed and restart the other changed listens. The
+// sessions are kept
+func (p *Proxy) Reload(listenConfigs []ListenConfig, preConfigRoute *PreConfigRoute, resolver *PreConfigHostResolver) error {
+	p.preConfigRoute.Replace(preConfigRoute)
+	p.resolver.Replace(resolver)
+
+	oldItems := p.getItems()
+	kept := make(map[*ProxyItem]bool)
+	items := make([]*ProxyItem, len(listenConfigs))
+	var lastErr error
+	for i, listenConfig := range listenConfigs {
+		for _, item := range oldItems {
+			if !kept[item] && isACLOrHeaderRulesChangeOnly(item.getListenConfig(), listenConfig) {
+				if err := item.updateACL(listenConfig); err != nil {
+					lastErr = err
+				}
+				if err := item.updateHeaderRules(listenConfig); err != nil {
+					lastErr = err
+				}
+				items[i] = item
+				kept[item] = true
+				break
+			}
+		}
+	}
+	for i, listenConfig := range listenConfigs {
+		if items[i] != nil {
+			continue
+		}
+		for _, item := range oldItems {
+			if !kept[item] && isBackendsChangeOnly(item.getListenConfig(), listenConfig) {
+				zap.L().Info("update backends of listen", zap.String("address", listenConfig.Address))
+				if err := item.updateACL(listenConfig); err != nil {
+					lastErr = err
+				}
+				if err := item.updateHeaderRules(listenConfig); err != nil {
+					lastErr = err
+				}
+				if err := item.updateBackends(listenConfig); err != nil {
+					lastErr = err
+				}
+				items[i] = item
+				kept[item] = true
+				break
+			}
+		}
+	}
+	// stop the removed listens before the new listens are started on the same ports
+	for _, item := range oldItems {
+		if !kept[item] {
+			zap.L().Info("stop listen", zap.String("address", item.getListenConfig().Address))
+			item.Stop()
+		}
+	}
+	newItems := make([]*ProxyItem, 0)
+	for i, listenConfig := range listenConfigs {
+		if items[i] == nil {
+			item, err := NewProxyItem(listenConfig, p.receivedSupport, p, p.selfLearnRoute, p, p.acl)
+			if err == nil {
+				err = item.Start()
+			}
+			if err != nil {
+				zap.L().Error("Fail to start listen", zap.String("address", listenConfig.Address), zap.String("error", err.Error()))
+				lastErr = err
+				continue
+			}
+			items[i] = item
+		}
+		newItems = append(newItems, items[i])
+	}
+
+	p.itemsLock.Lock()
+	defer p.itemsLock.Unlock()
+	p.items = newItems
+	p.listenConfigs = listenConfigs
+	return lastErr
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testReloadConfig = `proxies:
+  - name: reload.test.com
+    workers: 1
+    listens:
+      - address: 127.0.0.1
+        udp-port: 15660
+        backends:
+          - address: udp://127.0.0.1:15661
+    route:
+      - dests:
+          - old.test.com
+        nexthop: 127.0.0.1:15671
+`
+
+const testReloadedConfig = `proxies:
+  - name: reload.test.com
+    workers: 1
+    acl:
+      deny:
+        - 10.0.0.1
+    rate-limit:
+      other:
+        rate: 10
+    listens:
+      - address: 127.0.0.1
+        udp-port: 15660
+        policy: call-id-hash
+        backends:
+          - address: udp://127.0.0.1:15661
+          - address: udp://127.0.0.1:15662
+      - address: 127.0.0.1
+        udp-port: 15663
+    route:
+      - dests:
+          - new.test.com
+        nexthop: 127.0.0.1:15672
+  - name: added.test.com
+    workers: 1
+    listens:
+      - address: 127.0.0.1
+        udp-port: 15664
+`
+
+func startTestReloader(t *testing.T, content string) (*ConfigReloader, string) {
+	fileName := filepath.Join(t.TempDir(), "sip-proxy.yaml")
+	os.WriteFile(fileName, []byte(content), 0600)
+	config, err := loadConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies := make([]*Proxy, 0)
+	for _, proxyConfig := range config.Proxies {
+		proxy, err := startProxy(proxyConfig, createPreConfigRoute(proxyConfig), createPreConfigHostResolver(config.Hosts, proxyConfig))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxies = append(proxies, proxy)
+	}
+	reloader := NewConfigReloader(fileName, config, proxies)
+	t.Cleanup(func() {
+		for _, proxy := range reloader.proxies {
+			proxy.Stop()
+		}
+	})
+	return reloader, fileName
+}
+
+func TestReloadConfig(t *testing.T) {
+	reloader, fileName := startTestReloader(t, testReloadConfig)
+	proxy := reloader.proxies[0]
+	item := proxy.getItems()[0]
+	backend, _ := item.backend.GetBackend("udp://127.0.0.1:15661")
+	proxy.sessionBackends.AddBackend("session-1", backend, 60)
+
+	os.WriteFile(fileName, []byte(testReloadedConfig), 0600)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloader.proxies) != 2 || reloader.proxies[0] != proxy {
+		t.Fatalf("the running proxy is not kept or the new proxy is not started")
+	}
+	items := proxy.getItems()
+	if len(items) != 2 || items[0] != item {
+		t.Fatalf("the listen with backends changed is restarted")
+	}
+	if len(item.backend.GetAllBackend()) != 2 || item.backend.GetPolicy() != PolicyCallIdHash {
+		t.Errorf("the backends are not updated")
+	}
+	if b, err := proxy.sessionBackends.GetBackend("session-1"); err != nil || b != backend {
+		t.Errorf("the session binding is lost")
+	}
+	if _, _, _, err := proxy.preConfigRoute.FindRoute("old.test.com"); err == nil {
+		t.Errorf("the removed route is still found")
+	}
+	if _, host, port, err := proxy.preConfigRoute.FindRoute("new.test.com"); err != nil || host != "127.0.0.1" || port != 15672 {
+		t.Errorf("the added route is not found")
+	}
+	if allowed, _ := proxy.acl.Check("10.0.0.1"); allowed {
+		t.Errorf("the acl of the proxy is not updated")
+	}
+	if !proxy.GetRateLimitInfo().Enabled {
+		t.Errorf("the rate limit of the proxy is not updated")
+	}
+}
+
+func TestReloadStopsRemovedListen(t *testing.T) {
+	reloader, fileName := startTestReloader(t, testReloadedConfig)
+	os.WriteFile(fileName, []byte(testReloadConfig), 0600)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloader.proxies) != 1 || len(reloader.proxies[0].getItems()) != 1 {
+		t.Fatalf("the removed proxy or listen is still running")
+	}
+	if len(reloader.proxies[0].getItems()[0].backend.GetAllBackend()) != 1 {
+		t.Errorf("the removed backend is still in rotation")
+	}
+	for _, port := range []int{15663, 15664} {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+		if err != nil {
+			t.Errorf("the removed listen on port %d is not stopped", port)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	reloader, fileName := startTestReloader(t, testReloadConfig)
+	admin := NewAdminServer(":0", reloader.proxies)
+	admin.EnableReload(reloader.Reload)
+	reloader.SetAdminServer(admin)
+
+	os.WriteFile(fileName, []byte("proxies: ["), 0600)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "/reload", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("the invalid configuration is reloaded")
+	}
+
+	os.WriteFile(fileName, []byte(testReloadedConfig), 0600)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "/reload", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if len(admin.getProxies()) != 2 {
+		t.Errorf("the proxies of the admin server are not updated")
+	}
+}
+
+func TestReloadProxyFailedToStart(t *testing.T) {
+	reloader, fileName := startTestReloader(t, testReloadConfig)
+	proxy := reloader.proxies[0]
+	// the listen of the added proxy can't be started while the port is in use
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 15664})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(fileName, []byte(testReloadedConfig), 0600)
+	if err := reloader.Reload(); err == nil {
+		t.Errorf("the proxy failed to start is not reported")
+	}
+	if len(reloader.proxies) != 1 || reloader.proxies[0] != proxy || len(reloader.config.Proxies) != 1 {
+		t.Fatalf("the proxy failed to start is kept")
+	}
+
+	conn.Close()
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reloader.proxies) != 2 || reloader.proxies[0] != proxy || reloader.proxies[1].name != "added.test.com" {
+		t.Errorf("the proxy failed to start is not started on next reload")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,6 +17,7 @@ type PreConfigSolvedHost struct {
 	IPs             []string
 }
 type PreConfigHostResolver struct {
+	sync.Mutex
 	// Name to IP mapping
 	hostIPs map[string]*PreConfigSolvedHost
 }
@@ -25,6 +27,8 @@ func NewPreConfigHostResolver() *PreConfigHostResolver {
 }
 
 func (hr *PreConfigHostResolver) AddHostIP(name string, ip string) {
+	hr.Lock()
+	defer hr.Unlock()
 	if _, ok := hr.hostIPs[name]; !ok {
 		hr.hostIPs[name] = &PreConfigSolvedHost{
 			nextResolveTime: 0,
@@ -34,13 +38,14 @@ func (hr *PreConfigHostResolver) AddHostIP(name string, ip string) {
 	hr.hostIPs[name].IPs = append(hr.hostIPs[name].IPs, ip)
 }
 
-// GetIp get the IP by hostname
+// GetIp get the IP by hostname, the lock is not held when resolving the hostname
 func (hr *PreConfigHostResolver) GetIps(name string) ([]string, error) {
 
 	if net.ParseIP(name) != nil {
 		return []string{name}, nil
 	}
 
+	hr.Lock()
 	if _, ok := hr.hostIPs[name]; !ok {
 		hr.hostIPs[name] = &PreConfigSolvedHost{
 			nextResolveTime: time.Now().Unix(),
@@ -48,33 +53,47 @@ func (hr *PreConfigHostResolver) GetIps(name string) ([]string, error) {
 		}
 	}
 
-	if hr.hostIPs[name].nextResolveTime > 0 && hr.hostIPs[name].nextResolveTime <= time.Now().Unix() {
-		hr.hostIPs[name].nextResolveTime = time.Now().Unix() + 10
+	solvedHost := hr.hostIPs[name]
+	needResolve := solvedHost.nextResolveTime > 0 && solvedHost.nextResolveTime <= time.Now().Unix()
+	if needResolve {
+		solvedHost.nextResolveTime = time.Now().Unix() + 10
+	}
+	hr.Unlock()
+
+	if needResolve {
 		ips, err := hr.doResolve(name)
 		if err == nil {
-			hr.hostIPs[name].IPs = ips
+			hr.Lock()
+			solvedHost.IPs = ips
+			hr.Unlock()
 		}
 	}
 
-	if ip, ok := hr.hostIPs[name]; ok && len(ip.IPs) > 0 {
-		return ip.IPs, nil
+	hr.Lock()
+	defer hr.Unlock()
+	if len(solvedHost.IPs) > 0 {
+		return slices.Clone(solvedHost.IPs), nil
 	}
 
 	return []string{name}, nil
 }
 
+// Replace replace all the configured hosts with the hosts of other resolver at once
+func (hr *PreConfigHostResolver) Replace(other *PreConfigHostResolver) {
+	other.Lock()
+	hostIPs := other.hostIPs
+	other.Unlock()
+	hr.Lock()
+	defer hr.Unlock()
+	hr.hostIPs = hostIPs
+}
+
 func (hr *PreConfigHostResolver) doResolve(name string) ([]string, error) {
-	ips, err := net.LookupIP(name)
+	ips, err := sipServerLocator.LookupHost(name)
 	if err != nil {
 		return []string{name}, nil
 	}
-
-	r := make([]string, 0)
-	for _, ip := range ips {
-		r = append(r, ip.String())
-	}
-
-	return r, nil
+	return ips, nil
 }
 
 type IPResolvedCallback = func(hostname string, newIPs []string, removedIPs []string)
@@ -226,7 +245,7 @@ func (r *DynamicHostResolver) notifyAddressChanged(hostname string, entry *Addre
 }
 func (r *DynamicHostResolver) doResolve(hostname string) ([]string, error) {
 
-	ips, err := net.LookupIP(hostname)
+	ips, err := sipServerLocator.LookupHost(hostname)
 
 	if err != nil {
 		zap.L().Error("fail to find ip address", zap.String("hostname", hostname))
@@ -234,8 +253,7 @@ func (r *DynamicHostResolver) doResolve(hostname string) ([]string, error) {
 	}
 
 	result := make([]string, 0)
-	for _, ip := range ips {
-		s := ip.String()
+	for _, s := range ips {
 		if strings.Contains(s, ":") {
 			s = fmt.Sprintf("[%s]", s)
 		}
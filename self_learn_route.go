@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,6 +13,16 @@ type SelfLearnItem struct {
 	serverTransport ServerTransport
 	expire          int64
 }
+
+// SelfLearnRouteInfo is a learned route for the admin API
+type SelfLearnRouteInfo struct {
+	Destination string    `json:"destination"`
+	Protocol    string    `json:"protocol"`
+	Address     string    `json:"address"`
+	Port        int       `json:"port"`
+	Expire      time.Time `json:"expire"`
+}
+
 type SelfLearnRoute struct {
 	sync.Mutex
 	// cleanInterval is the interval to clean the expired items
@@ -85,6 +96,23 @@ func (sl *SelfLearnRoute) GetRouteAddress(ip string, protocol string) string {
 	}
 }
 
+// GetRoutes returns a snapshot of all the learned routes
+func (sl *SelfLearnRoute) GetRoutes() []SelfLearnRouteInfo {
+	sl.Lock()
+	defer sl.Unlock()
+
+	r := make([]SelfLearnRouteInfo, 0)
+	for key, item := range sl.route {
+		pos := strings.LastIndex(key, ":")
+		r = append(r, SelfLearnRouteInfo{Destination: key[0:pos],
+			Protocol: item.serverTransport.GetProtocol(),
+			Address:  item.serverTransport.GetAddress(),
+			Port:     item.serverTransport.GetPort(),
+			Expire:   time.Unix(item.expire, 0)})
+	}
+	return r
+}
+
 func (sl *SelfLearnRoute) cleanExpires() {
 	now := time.Now().Unix()
 
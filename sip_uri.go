@@ -130,15 +130,30 @@ func (s *SIPURI) SetParameter(name string, value string) {
 	s.AddParameter(name, value)
 }
 
+// GetTransport get the transport parameter, the sips URI is sent over TLS if
+// no transport parameter is present
 func (s *SIPURI) GetTransport() string {
 	transport, err := s.GetParameter("transport")
 	if err == nil {
 		return transport
+	} else if s.Scheme == "sips" {
+		return "tls"
 	} else {
 		return "udp"
 	}
 }
 
+// HasPort return true if the port is present in the URI
+func (s *SIPURI) HasPort() bool {
+	return s.port != 0
+}
+
+// HasTransport return true if the transport parameter is present in the URI
+func (s *SIPURI) HasTransport() bool {
+	_, err := s.GetParameter("transport")
+	return err == nil
+}
+
 func (s *SIPURI) GetPort() int {
 	if s.port != 0 {
 		return s.port
@@ -36,3 +36,13 @@ func TestSIPURIAddParameter(t *testing.T) {
 }
 
 
+
+func TestSIPSURITransport(t *testing.T) {
+	sipUri, err := ParseSipURI("sips:alice@atlanta.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sipUri.GetTransport() != "tls" || sipUri.GetPort() != 5061 {
+		t.Fail()
+	}
+}
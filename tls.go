@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ServerTLSConfig create the tls.Config for the TLS listener
+func (c *TLSConfig) ServerTLSConfig() (*tls.Config, error) {
+	if c.Cert == "" || c.Key == "" {
+		return nil, fmt.Errorf("cert and key are required by the TLS listener")
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.CA != "" {
+		tlsConfig.ClientCAs, err = loadCertPool(c.CA)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.VerifyClient {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// ClientTLSConfig create the tls.Config to connect the TLS peer, the certificate
+// is presented to the peer if it is configured
+func (c *TLSConfig) ClientTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12}
+	if c.Cert != "" && c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.CA != "" {
+		pool, err := loadCertPool(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate is found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// clientTLSConfigFor get the tls.Config to connect the host, the host is used to
+// verify the server certificate if no server name is configured
+func clientTLSConfigFor(tlsConfig *tls.Config, host string) *tls.Config {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if tlsConfig.ServerName != "" {
+		return tlsConfig
+	}
+	r := tlsConfig.Clone()
+	r.ServerName = host
+	return r
+}
+
+// getConnProtocol get the sip transport protocol of the connection, tls or tcp
+func getConnProtocol(conn net.Conn) string {
+	if _, ok := conn.(*tls.Conn); ok {
+		return "tls"
+	}
+	return "tcp"
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type rawMessageCollector struct {
+	messages chan *RawMessage
+}
+
+func (c *rawMessageCollector) HandleRawMessage(msg *RawMessage) {
+	c.messages <- msg
+}
+
+func (c *rawMessageCollector) ConnectionAccepted(conn net.Conn) {
+}
+
+// createTestCertificate create a self-signed certificate for 127.0.0.1 and return
+// the certificate and key file names
+func createTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sipproxy"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestTLSTransport(t *testing.T) {
+	certFile, keyFile := createTestCertificate(t)
+	conf := &TLSConfig{Cert: certFile, Key: keyFile, CA: certFile, VerifyClient: true}
+	serverTLSConfig, err := conf.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLSConfig, err := conf.ClientTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := &rawMessageCollector{messages: make(chan *RawMessage, 1)}
+	server := NewTLSServerTransport("127.0.0.1", 15361, false, collector, NewSelfLearnRoute(), nil, nil, serverTLSConfig)
+	if err := server.Start(collector); err != nil {
+		t.Fatal(err)
+	}
+	if server.GetProtocol() != "tls" {
+		t.Errorf("unexpected protocol %s", server.GetProtocol())
+	}
+	client, _ := NewTLSClientTransport(nil, "127.0.0.1", 15361, "", clientTLSConfigFor(clientTLSConfig, "127.0.0.1"), nil)
+	if err := client.Send(createTestRequest("OPTIONS")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-collector.messages:
+		if callId, _ := msg.Message.GetCallID(); callId != "3848276298220188511@atlanta.example.com" {
+			t.Errorf("unexpected message %v", msg.Message)
+		}
+		if getConnProtocol(msg.TcpConn) != "tls" {
+			t.Errorf("the message is not received from TLS connection")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("no message is received from TLS transport")
+	}
+}
+
+func TestTLSTransportRejectUnknownServer(t *testing.T) {
+	certFile, keyFile := createTestCertificate(t)
+	serverTLSConfig, err := (&TLSConfig{Cert: certFile, Key: keyFile}).ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := &rawMessageCollector{messages: make(chan *RawMessage, 1)}
+	server := NewTLSServerTransport("127.0.0.1", 15362, false, collector, NewSelfLearnRoute(), nil, nil, serverTLSConfig)
+	if err := server.Start(collector); err != nil {
+		t.Fatal(err)
+	}
+	// the self-signed server certificate is not trusted by the system CAs
+	client, _ := NewTLSClientTransport(nil, "127.0.0.1", 15362, "", clientTLSConfigFor(nil, "127.0.0.1"), nil)
+	if err := client.Send(createTestRequest("OPTIONS")); err == nil {
+		t.Errorf("the untrusted server is connected")
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// the peer accepts the connection but never answers the TLS handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(2 * time.Second)
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := tlsHandshake(conn, &tls.Config{InsecureSkipVerify: true}, 100*time.Millisecond); err == nil {
+		t.Fatalf("the TLS handshake with the silent peer succeeds")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("the TLS handshake is not timeout in time")
+	}
+}
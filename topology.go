@@ -0,0 +1,556 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	// the hidden topology is kept in the key with this prefix in Redis
+	redisTopologyKeyPrefix = "sipproxy:topology:"
+	// the expired topologies are removed from the local topology store in this interval
+	topologyCleanInterval = time.Minute
+	// the URI parameter carrying the token of the hidden topology in the Record-Route
+	// and Contact sent by the proxy
+	topologyTokenParam = "th"
+)
+
+// HiddenTopology is the internal Via, Record-Route and Contact entries removed from a
+// message sent through a listener hiding the topology
+type HiddenTopology struct {
+	// the Vias below the Via of the proxy in the request
+	Vias []string `json:"vias,omitempty"`
+	// the Record-Routes hidden from the peer, in the order of the Route headers of the
+	// requests received from the peer after the Route of the proxy
+	Routes []string `json:"routes,omitempty"`
+	// the original contact-params, the Contact sent to the peer has the address of the
+	// proxy and the token followed by the index of the contact-param
+	Contacts []string `json:"contacts,omitempty"`
+}
+
+func (t *HiddenTopology) isEmpty() bool {
+	return len(t.Vias) == 0 && len(t.Routes) == 0 && len(t.Contacts) == 0
+}
+
+// TopologyStore keep the hidden topologies by token, the expired topology is never returned
+type TopologyStore interface {
+	// GetTopology get the topology of the token, nil is returned if it is not found
+	GetTopology(token string) (*HiddenTopology, error)
+	SetTopology(token string, topology *HiddenTopology, expire time.Duration) error
+}
+
+type expireTopology struct {
+	topology *HiddenTopology
+	expires  time.Time
+}
+
+// LocalTopologyStore keep the hidden topologies in memory
+type LocalTopologyStore struct {
+	sync.Mutex
+	topologies    map[string]expireTopology
+	nextCleanTime time.Time
+}
+
+func NewLocalTopologyStore() *LocalTopologyStore {
+	return &LocalTopologyStore{topologies: make(map[string]expireTopology), nextCleanTime: time.Now().Add(topologyCleanInterval)}
+}
+
+func (l *LocalTopologyStore) GetTopology(token string) (*HiddenTopology, error) {
+	l.Lock()
+	defer l.Unlock()
+	if t, ok := l.topologies[token]; ok && t.expires.After(time.Now()) {
+		return t.topology, nil
+	}
+	return nil, nil
+}
+
+func (l *LocalTopologyStore) SetTopology(token string, topology *HiddenTopology, expire time.Duration) error {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.topologies[token] = expireTopology{topology: topology, expires: now.Add(expire)}
+	if l.nextCleanTime.After(now) {
+		return nil
+	}
+	l.nextCleanTime = now.Add(topologyCleanInterval)
+	for token, t := range l.topologies {
+		if !t.expires.After(now) {
+			delete(l.topologies, token)
+		}
+	}
+	return nil
+}
+
+// RedisTopologyStore keep the hidden topologies in Redis, so the in-dialog requests can
+// be restored by any proxy using the same Redis. The Redis clients of the session store
+// are used
+type RedisTopologyStore struct {
+	sessionStore *MasterSlaveRedisSessionBasedBackend
+}
+
+func NewRedisTopologyStore(sessionStore *MasterSlaveRedisSessionBasedBackend) *RedisTopologyStore {
+	return &RedisTopologyStore{sessionStore: sessionStore}
+}
+
+func (r *RedisTopologyStore) GetTopology(token string) (*HiddenTopology, error) {
+	var topology *HiddenTopology
+	err := r.sessionStore.ForEachRedis(func(rdb *redis.Client) error {
+		value, err := rdb.Get(redisTopologyKeyPrefix + token).Bytes()
+		if err == redis.Nil {
+			topology = nil
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		topology = &HiddenTopology{}
+		return json.Unmarshal(value, topology)
+	})
+	if err != nil {
+		zap.L().Error("Fail to get hidden topology from redis", zap.String("token", token), zap.Error(err))
+		return nil, err
+	}
+	return topology, nil
+}
+
+func (r *RedisTopologyStore) SetTopology(token string, topology *HiddenTopology, expire time.Duration) error {
+	value, err := json.Marshal(topology)
+	if err != nil {
+		return err
+	}
+	err = r.sessionStore.ForEachRedis(func(rdb *redis.Client) error {
+		return rdb.Set(redisTopologyKeyPrefix+token, value, expire).Err()
+	})
+	if err != nil {
+		zap.L().Error("Fail to save hidden topology to redis", zap.String("token", token), zap.Error(err))
+	}
+	return err
+}
+
+// hidesTopology check if the transport belongs to a listener hiding the topology
+func (p *Proxy) hidesTopology(transport ServerTransport) bool {
+	if transport == nil {
+		return false
+	}
+	item := p.findProxyItem(transport)
+	return item != nil && item.getListenConfig().TopologyHiding
+}
+
+// findHidingTransport find the transport of the first listener hiding the topology with
+// the protocol, it is used to forward the request from the internal peers to the next hop
+// which is not learned from any listener. Forwarding it statelessly without the Via of
+// the proxy would expose the internal Vias, Record-Routes and Contacts
+func (p *Proxy) findHidingTransport(msg *Message, protocol string) ServerTransport {
+	if p.hidesTopology(msg.ReceivedFrom) {
+		return nil
+	}
+	for _, item := range p.getItems() {
+		if !item.getListenConfig().TopologyHiding {
+			continue
+		}
+		transport, err := item.FindTransport(func(transport ServerTransport) bool {
+			return strings.EqualFold(transport.GetProtocol(), protocol)
+		})
+		if err == nil {
+			return transport
+		}
+	}
+	return nil
+}
+
+// findTopViaTransport find the transport with which the proxy added the top Via
+func (p *Proxy) findTopViaTransport(msg *Message) ServerTransport {
+	vias := getViaStrings(msg)
+	if len(vias) == 0 {
+		return nil
+	}
+	via, err := ParseVia(vias[0])
+	if err != nil {
+		return nil
+	}
+	viaParam, _ := via.GetParam(0)
+	for _, item := range p.getItems() {
+		transport, err := item.FindTransport(func(transport ServerTransport) bool {
+			return strings.EqualFold(transport.GetProtocol(), viaParam.Transport) &&
+				transport.GetAddress() == viaParam.Host &&
+				transport.GetPort() == viaParam.GetPort()
+		})
+		if err == nil {
+			return transport
+		}
+	}
+	return nil
+}
+
+// hideRequestTopology get the request sent to the peer through the transport in its top
+// Via. If the listener of the transport hides the topology, the Vias below the Via of the
+// proxy and the Record-Routes below the Record-Route of the proxy are removed, the
+// Contacts are replaced with the address of the proxy. The request itself is not changed
+func (p *Proxy) hideRequestTopology(msg *Message) *Message {
+	transport := p.findTopViaTransport(msg)
+	if !p.hidesTopology(transport) {
+		return msg
+	}
+	token := topologyToken(msg)
+	hidden := msg.Clone()
+	topology := &HiddenTopology{}
+	vias := getViaStrings(msg)
+	topology.Vias = vias[1:]
+	replaceHeaders(hidden, "Via", vias[:1])
+	if recordRoutes := getRecordRouteStrings(msg); len(recordRoutes) > 0 {
+		if isTransportRoute(recordRoutes[0], transport) {
+			topology.Routes = recordRoutes[1:]
+			replaceHeaders(hidden, "Record-Route", []string{createTopologyRecordRoute(transport, token)})
+		} else {
+			replaceHeaders(hidden, "Record-Route", nil)
+		}
+	}
+	topology.Contacts = hideContacts(hidden, transport, token)
+	if method, _ := msg.GetMethod(); method != "ACK" {
+		expire := p.getTopologyExpire(topology, msg.GetExpires(0))
+		p.saveHiddenTopology(msg, token, topology, expire)
+	}
+	return hidden
+}
+
+// hidingTopology get the function sending the requests with the topology hidden, the
+// transaction keeps the request with all its Vias to answer and cancel it
+func (p *Proxy) hidingTopology(send TransactionSendFunc) TransactionSendFunc {
+	return func(msg *Message) error {
+		return send(p.hideRequestTopology(msg))
+	}
+}
+
+// hideResponseTopology get the response sent to the peer through the listener hiding the
+// topology. The Record-Routes above the Record-Route of the proxy are removed and the
+// Record-Route of the proxy is replaced with the address of the listener, the Contacts
+// of the provisional and 2xx responses are replaced with the address of the listener
+func (p *Proxy) hideResponseTopology(msg *Message) *Message {
+	host, _, protocol, err := p.getNextReponseHop(msg)
+	if err != nil {
+		return msg
+	}
+	transport, ok := p.selfLearnRoute.GetRoute(strings.Trim(host, "[]"), strings.ToLower(protocol))
+	if !ok || !p.hidesTopology(transport) {
+		return msg
+	}
+	token := topologyToken(msg)
+	hidden := msg.Clone()
+	topology := &HiddenTopology{}
+	recordRoutes := getRecordRouteStrings(msg)
+	index := slices.IndexFunc(recordRoutes, p.isMyRoute)
+	if index >= 0 {
+		topology.Routes = slices.Clone(recordRoutes[0:index])
+		slices.Reverse(topology.Routes)
+		recordRoutes = append([]string{createTopologyRecordRoute(transport, token)}, recordRoutes[index+1:]...)
+		replaceHeaders(hidden, "Record-Route", recordRoutes)
+	}
+	method, _ := msg.GetMethod()
+	if statusCode := msg.response.statusCode; statusCode > 100 && statusCode < 300 && method != "REGISTER" {
+		topology.Contacts = hideContacts(hidden, transport, token)
+	}
+	if topology.isEmpty() {
+		return msg
+	}
+	p.saveHiddenTopology(msg, token, topology, p.getTopologyExpire(topology, 0))
+	return hidden
+}
+
+// restoreRequestTopology restore the Request-URI and the Routes of the request from the
+// peer to the Contact hidden by the proxy. The Routes hidden by the proxy are placed
+// after the Route of the proxy which is removed later
+func (p *Proxy) restoreRequestTopology(msg *Message) {
+	if !msg.IsRequest() || !p.hidesTopology(msg.ReceivedFrom) {
+		return
+	}
+	requestURI, err := msg.GetRequestURI()
+	if err != nil {
+		return
+	}
+	sipUri, err := requestURI.GetSIPURI()
+	if err != nil {
+		return
+	}
+	value, err := sipUri.GetParameter(topologyTokenParam)
+	if err != nil {
+		return
+	}
+	callId, _ := msg.GetCallID()
+	token, index := parseTopologyToken(value)
+	topology, err := p.topologyStore.GetTopology(token)
+	if err != nil || topology == nil || index >= len(topology.Contacts) {
+		zap.L().Error("Fail to find the hidden contact of the request", zap.String("token", value), zap.String("call-id", callId))
+		return
+	}
+	contact, err := ParseContactParam(topology.Contacts[index])
+	if err != nil {
+		return
+	}
+	addrSpec, err := contact.GetAddrSpec()
+	if err != nil {
+		return
+	}
+	msg.SetRequestURI(addrSpec)
+
+	routes := getRouteStrings(msg)
+	if len(routes) == 0 {
+		return
+	}
+	routeParam, err := parseRouteParam(routes[0])
+	if err != nil {
+		return
+	}
+	routeUri, err := routeParam.GetAddress().GetAddress().GetSIPURI()
+	if err != nil {
+		return
+	}
+	if routeToken, err := routeUri.GetParameter(topologyTokenParam); err == nil && routeToken != token {
+		if topology, err = p.topologyStore.GetTopology(routeToken); err != nil || topology == nil {
+			zap.L().Error("Fail to find the hidden routes of the request", zap.String("token", routeToken), zap.String("call-id", callId))
+			return
+		}
+	} else if err != nil {
+		return
+	}
+	if len(topology.Routes) > 0 {
+		zap.L().Info("restore the hidden routes of the request", zap.Int("routes", len(topology.Routes)), zap.String("call-id", callId))
+		replaceHeaders(msg, "Route", slices.Concat(routes[0:1], topology.Routes, routes[1:]))
+	}
+}
+
+// restoreResponseTopology restore the Vias and the Record-Routes hidden from the peer in
+// the response of the request sent by the proxy
+func (p *Proxy) restoreResponseTopology(msg *Message) {
+	if !p.hidesTopology(p.findTopViaTransport(msg)) {
+		return
+	}
+	token := topologyToken(msg)
+	topology, err := p.topologyStore.GetTopology(token)
+	if err != nil || topology == nil {
+		return
+	}
+	vias := getViaStrings(msg)
+	replaceHeaders(msg, "Via", slices.Concat(vias[0:1], topology.Vias))
+	if len(topology.Routes) == 0 {
+		return
+	}
+	recordRoutes := getRecordRouteStrings(msg)
+	index := slices.IndexFunc(recordRoutes, func(s string) bool {
+		return getRouteToken(s) == token
+	})
+	if index >= 0 {
+		replaceHeaders(msg, "Record-Route", slices.Concat(recordRoutes[0:index+1], topology.Routes, recordRoutes[index+1:]))
+	}
+}
+
+func (p *Proxy) saveHiddenTopology(msg *Message, token string, topology *HiddenTopology, expire time.Duration) {
+	if topology.isEmpty() {
+		return
+	}
+	if err := p.topologyStore.SetTopology(token, topology, expire); err != nil {
+		callId, _ := msg.GetCallID()
+		zap.L().Error("Fail to save the hidden topology", zap.String("call-id", callId), zap.String("error", err.Error()))
+	}
+}
+
+// getTopologyExpire get the expiration of the hidden topology, the Routes and Contacts
+// are kept for the dialog or the registration and the Vias for the transaction only
+func (p *Proxy) getTopologyExpire(topology *HiddenTopology, expires int) time.Duration {
+	if len(topology.Routes) == 0 && len(topology.Contacts) == 0 {
+		return defaultTransactionTimers.TimerC + defaultTransactionTimers.TimerB()
+	}
+	return max(p.dialogExpire, time.Duration(expires)*time.Second)
+}
+
+// isMyRoute check if the Route or Record-Route entry is the address of the proxy
+func (p *Proxy) isMyRoute(s string) bool {
+	routeParam, err := parseRouteParam(s)
+	return err == nil && p.isMyURI(routeParam.GetAddress().GetAddress())
+}
+
+// topologyToken get the token of the topology hidden in the message, it is the same for
+// the request with the Via of the proxy on top and its responses
+func topologyToken(msg *Message) string {
+	branch := ""
+	if vias := getViaStrings(msg); len(vias) > 0 {
+		if via, err := ParseVia(vias[0]); err == nil {
+			viaParam, _ := via.GetParam(0)
+			branch, _ = viaParam.GetBranch()
+		}
+	}
+	callId, _ := msg.GetCallID()
+	sum := sha256.Sum256([]byte(callId + " " + branch))
+	return hex.EncodeToString(sum[0:16])
+}
+
+// parseTopologyToken get the token and the contact index from the token parameter
+func parseTopologyToken(value string) (string, int) {
+	token, s, found := strings.Cut(value, "-")
+	if !found {
+		return token, 0
+	}
+	index, err := strconv.Atoi(s)
+	if err != nil {
+		return token, 0
+	}
+	return token, index
+}
+
+func getRouteToken(s string) string {
+	routeParam, err := parseRouteParam(s)
+	if err != nil {
+		return ""
+	}
+	sipUri, err := routeParam.GetAddress().GetAddress().GetSIPURI()
+	if err != nil {
+		return ""
+	}
+	token, _ := sipUri.GetParameter(topologyTokenParam)
+	return token
+}
+
+// isTransportRoute check if the Record-Route entry is added with the transport
+func isTransportRoute(s string, transport ServerTransport) bool {
+	routeParam, err := parseRouteParam(s)
+	if err != nil {
+		return false
+	}
+	sipUri, err := routeParam.GetAddress().GetAddress().GetSIPURI()
+	return err == nil && sipUri.Host == transport.GetAddress() && sipUri.GetPort() == transport.GetPort()
+}
+
+func createTopologyRecordRoute(transport ServerTransport, token string) string {
+	recordRoute := CreateRecordRoute(transport.GetAddress(), transport.GetPort(), transport.GetProtocol())
+	recRoute, _ := recordRoute.GetRecRoute(0)
+	sipUri, _ := recRoute.GetNameAddr().Addr.GetSIPURI()
+	sipUri.SetParameter(topologyTokenParam, token)
+	return recordRoute.String()
+}
+
+// hideContacts replace the SIP URIs of the Contacts with the address of the transport
+// and the token, the original contact-params are returned
+func hideContacts(msg *Message, transport ServerTransport, token string) []string {
+	values := getHeaderStrings(msg, "Contact")
+	if len(values) == 0 {
+		return nil
+	}
+	hidden := make([]string, 0)
+	contacts := make([]string, 0)
+	for _, value := range values {
+		contact, err := ParseContact(value)
+		if err != nil || contact.IsStar() {
+			contacts = append(contacts, value)
+			continue
+		}
+		params := make([]string, 0)
+		for i := 0; i < contact.GetContactParamCount(); i++ {
+			param, _ := contact.GetContactParam(i)
+			original := param.String()
+			addrSpec, err := param.GetAddrSpec()
+			if err != nil || !addrSpec.IsSIPURI() {
+				params = append(params, original)
+				continue
+			}
+			sipUri, _ := addrSpec.GetSIPURI()
+			sipUri.Host = transport.GetAddress()
+			sipUri.port = transport.GetPort()
+			sipUri.Password = ""
+			sipUri.Parameters = nil
+			sipUri.Headers = nil
+			if protocol := transport.GetProtocol(); !strings.EqualFold(protocol, "udp") {
+				sipUri.AddParameter("transport", strings.ToLower(protocol))
+			}
+			value := token
+			if len(hidden) > 0 {
+				value = fmt.Sprintf("%s-%d", token, len(hidden))
+			}
+			sipUri.AddParameter(topologyTokenParam, value)
+			hidden = append(hidden, original)
+			params = append(params, param.String())
+		}
+		contacts = append(contacts, strings.Join(params, ","))
+	}
+	replaceHeaders(msg, "Contact", contacts)
+	return hidden
+}
+
+func getViaStrings(msg *Message) []string {
+	r := make([]string, 0)
+	for _, value := range getHeaderStrings(msg, "Via") {
+		via, err := ParseVia(value)
+		if err != nil {
+			continue
+		}
+		for i := 0; i < via.Size(); i++ {
+			viaParam, _ := via.GetParam(i)
+			r = append(r, viaParam.String())
+		}
+	}
+	return r
+}
+
+func getRecordRouteStrings(msg *Message) []string {
+	r := make([]string, 0)
+	for _, value := range getHeaderStrings(msg, "Record-Route") {
+		recordRoute, err := ParseRecordRoute(value)
+		if err != nil {
+			continue
+		}
+		for i := 0; i < recordRoute.GetRecRouteCount(); i++ {
+			recRoute, _ := recordRoute.GetRecRoute(i)
+			r = append(r, recRoute.String())
+		}
+	}
+	return r
+}
+
+func getRouteStrings(msg *Message) []string {
+	r := make([]string, 0)
+	for _, value := range getHeaderStrings(msg, "Route") {
+		route, err := ParseRoute(value)
+		if err != nil {
+			continue
+		}
+		for i := 0; i < route.GetRouteParamCount(); i++ {
+			routeParam, _ := route.GetRouteParam(i)
+			r = append(r, routeParam.String())
+		}
+	}
+	return r
+}
+
+// replaceHeaders replace all the headers with the name by one header for each value,
+// the headers are placed where the first of the replaced headers is
+func replaceHeaders(msg *Message, name string, values []string) {
+	pos, err := msg.findHeaderPos(name)
+	if err != nil {
+		pos = len(msg.headers)
+	}
+	headers := make([]*Header, 0, len(msg.headers)+len(values))
+	for i, header := range msg.headers {
+		if i == pos {
+			for _, value := range values {
+				headers = append(headers, &Header{name: name, value: value})
+			}
+		}
+		if !msg.isSameHeader(header.name, name) {
+			headers = append(headers, header)
+		}
+	}
+	if pos == len(msg.headers) {
+		for _, value := range values {
+			headers = append(headers, &Header{name: name, value: value})
+		}
+	}
+	msg.headers = headers
+}
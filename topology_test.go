@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTopologyTestProxy create a proxy with an internal listener and an external
+// listener hiding the topology, the internal peers are on 127.0.0.1 and the external
+// peers on 127.0.0.2
+func createTopologyTestProxy(t *testing.T, internalPort int, externalPort int, routes map[string]string) *Proxy {
+	route := NewPreConfigRoute()
+	for dest, nextHop := range routes {
+		route.AddRouteItem("udp", dest, nextHop)
+	}
+	listens := []ListenConfig{{Address: "127.0.0.1", UdpPort: internalPort},
+		{Address: "127.0.0.1", UdpPort: externalPort, TopologyHiding: true}}
+	proxy := NewProxy("test.com", 60, listens, true, route, NewPreConfigHostResolver(), NewSelfLearnRoute(), true, false, nil)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	proxy.selfLearnRoute.AddRoute("127.0.0.1", proxy.items[0].transports[0])
+	proxy.selfLearnRoute.AddRoute("127.0.0.2", proxy.items[1].transports[0])
+	return proxy
+}
+
+func listenTestPeer(t *testing.T, ip string, port int) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+func sendTestMessage(t *testing.T, conn *net.UDPConn, port int, s string) {
+	if _, err := conn.WriteToUDP([]byte(s), &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiveTestMessage receive the first message with the method or the status code, the
+// raw message is also returned
+func receiveTestMessage(t *testing.T, conn *net.UDPConn, expected string) (*Message, string) {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("%s is not received: %v", expected, err)
+		}
+		msg, err := ParseMessage(bufio.NewReader(bytes.NewBuffer(buf[0:n])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if method, _ := msg.GetMethod(); (msg.IsRequest() && method == expected) || (msg.IsResponse() && fmt.Sprint(msg.response.statusCode) == expected) {
+			return msg, string(buf[0:n])
+		}
+	}
+}
+
+func getTestContact(t *testing.T, msg *Message) string {
+	contacts := getHeaderStrings(msg, "Contact")
+	if len(contacts) != 1 {
+		t.Fatalf("expect one Contact but get %v", contacts)
+	}
+	contact, err := ParseContactParam(contacts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrSpec, _ := contact.GetAddrSpec()
+	return addrSpec.String()
+}
+
+func sendTestBye(t *testing.T, conn *net.UDPConn, port int, requestURI string, route string, callId string) {
+	bye := "BYE %s SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.2:%d;branch=z9hG4bKth%s\r\nRoute: %s\r\nMax-Forwards: 70\r\nFrom: <sip:bob@carrier.com>;tag=carrier\r\nTo: <sip:alice@internal.com>;tag=internal\r\nCall-ID: %s\r\nCSeq: 2 BYE\r\nContent-Length: 0\r\n\r\n"
+	sendTestMessage(t, conn, port, fmt.Sprintf(bye, requestURI, conn.LocalAddr().(*net.UDPAddr).Port, callId, route, callId))
+}
+
+func TestTopologyHidingOfRequestToPeer(t *testing.T) {
+	internal := listenTestPeer(t, "127.0.0.1", 16210)
+	carrier := listenTestPeer(t, "127.0.0.2", 16211)
+	createTopologyTestProxy(t, 16208, 16209, map[string]string{"carrier.com": "127.0.0.2:16211"})
+
+	sendTestMessage(t, internal, 16208, "INVITE sip:bob@carrier.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:16210;branch=z9hG4bKth1\r\nVia: SIP/2.0/UDP 10.1.1.1:5060;branch=z9hG4bKth0\r\nRecord-Route: <sip:127.0.0.1:16210;lr>\r\nMax-Forwards: 70\r\nFrom: <sip:alice@internal.com>;tag=internal\r\nTo: <sip:bob@carrier.com>\r\nCall-ID: th1@test.com\r\nCSeq: 1 INVITE\r\nContact: <sip:alice@10.1.1.50:5060>\r\nContent-Length: 0\r\n\r\n")
+	invite, raw := receiveTestMessage(t, carrier, "INVITE")
+	if strings.Contains(raw, "10.1.1.") || strings.Contains(raw, "16210") {
+		t.Errorf("the internal topology is sent to the peer:\n%s", raw)
+	}
+	if vias := getViaStrings(invite); len(vias) != 1 || !strings.Contains(vias[0], "127.0.0.1:16209") {
+		t.Errorf("expect the Via of the proxy only but get %v", vias)
+	}
+	recordRoutes := getRecordRouteStrings(invite)
+	if len(recordRoutes) != 1 || getRouteToken(recordRoutes[0]) == "" {
+		t.Fatalf("expect the Record-Route of the proxy with token but get %v", recordRoutes)
+	}
+	contact := getTestContact(t, invite)
+	if !strings.HasPrefix(contact, "sip:alice@127.0.0.1:16209;th=") {
+		t.Errorf("the Contact is not replaced with the proxy: %s", contact)
+	}
+
+	response := NewResponseOf(invite, 200, "OK")
+	response.AddHeader("Record-Route", recordRoutes[0])
+	response.AddHeader("Contact", "<sip:bob@127.0.0.2:16211>")
+	sendTestMessage(t, carrier, 16209, response.String())
+	answered, _ := receiveTestMessage(t, internal, "200")
+	if vias := getViaStrings(answered); len(vias) != 2 || !strings.Contains(vias[1], "10.1.1.1:5060") {
+		t.Errorf("the Vias are not restored in the response: %v", vias)
+	}
+	if recordRoutes := getRecordRouteStrings(answered); len(recordRoutes) != 2 || recordRoutes[1] != "<sip:127.0.0.1:16210;lr>" {
+		t.Errorf("the Record-Routes are not restored in the response: %v", recordRoutes)
+	}
+
+	sendTestBye(t, carrier, 16209, contact, recordRoutes[0], "th1@test.com")
+	bye, _ := receiveTestMessage(t, internal, "BYE")
+	if requestURI, _ := bye.GetRequestURI(); requestURI.String() != "sip:alice@10.1.1.50:5060" {
+		t.Errorf("the Request-URI is not restored: %s", requestURI)
+	}
+	if routes := getRouteStrings(bye); len(routes) != 1 || routes[0] != "<sip:127.0.0.1:16210;lr>" {
+		t.Errorf("the Routes are not restored: %v", routes)
+	}
+}
+
+func TestTopologyHidingOfResponseToPeer(t *testing.T) {
+	internal := listenTestPeer(t, "127.0.0.1", 16214)
+	carrier := listenTestPeer(t, "127.0.0.2", 16215)
+	createTopologyTestProxy(t, 16212, 16213, map[string]string{"internal.com": "127.0.0.1:16214"})
+
+	sendTestMessage(t, carrier, 16213, "INVITE sip:alice@internal.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.2:16215;branch=z9hG4bKth3\r\nMax-Forwards: 70\r\nFrom: <sip:bob@carrier.com>;tag=carrier\r\nTo: <sip:alice@internal.com>\r\nCall-ID: th3@test.com\r\nCSeq: 1 INVITE\r\nContact: <sip:bob@127.0.0.2:16215>\r\nContent-Length: 0\r\n\r\n")
+	invite, _ := receiveTestMessage(t, internal, "INVITE")
+	recordRoutes := getRecordRouteStrings(invite)
+	if len(recordRoutes) != 1 || !strings.Contains(recordRoutes[0], "127.0.0.1:16212") {
+		t.Fatalf("the dialog from the peer is not record-routed: %v", recordRoutes)
+	}
+
+	response := NewResponseOf(invite, 200, "OK")
+	response.AddHeader("Record-Route", "<sip:127.0.0.1:16214;lr>")
+	response.AddHeader("Record-Route", recordRoutes[0])
+	response.AddHeader("Contact", "<sip:alice@10.2.2.50:5060>")
+	sendTestMessage(t, internal, 16212, response.String())
+	answered, raw := receiveTestMessage(t, carrier, "200")
+	if strings.Contains(raw, "10.2.2.") || strings.Contains(raw, "16214") || strings.Contains(raw, "16212") {
+		t.Errorf("the internal topology is sent to the peer:\n%s", raw)
+	}
+	recordRoutes = getRecordRouteStrings(answered)
+	if len(recordRoutes) != 1 || !strings.Contains(recordRoutes[0], "127.0.0.1:16213") || getRouteToken(recordRoutes[0]) == "" {
+		t.Fatalf("expect the Record-Route of the external listener but get %v", recordRoutes)
+	}
+	contact := getTestContact(t, answered)
+	if !strings.HasPrefix(contact, "sip:alice@127.0.0.1:16213;th=") {
+		t.Errorf("the Contact is not replaced with the proxy: %s", contact)
+	}
+
+	sendTestBye(t, carrier, 16213, contact, recordRoutes[0], "th3@test.com")
+	bye, _ := receiveTestMessage(t, internal, "BYE")
+	if requestURI, _ := bye.GetRequestURI(); requestURI.String() != "sip:alice@10.2.2.50:5060" {
+		t.Errorf("the Request-URI is not restored: %s", requestURI)
+	}
+	if routes := getRouteStrings(bye); len(routes) != 1 || routes[0] != "<sip:127.0.0.1:16214;lr>" {
+		t.Errorf("the Routes are not restored: %v", routes)
+	}
+}
+
+func TestLocalTopologyStoreExpires(t *testing.T) {
+	store := NewLocalTopologyStore()
+	store.SetTopology("expired", &HiddenTopology{Vias: []string{"SIP/2.0/UDP 10.0.0.1:5060"}}, -time.Second)
+	store.SetTopology("valid", &HiddenTopology{Contacts: []string{"<sip:alice@10.0.0.1>"}}, time.Minute)
+	if topology, _ := store.GetTopology("expired"); topology != nil {
+		t.Errorf("the expired topology is returned")
+	}
+	if topology, _ := store.GetTopology("valid"); topology == nil || topology.Contacts[0] != "<sip:alice@10.0.0.1>" {
+		t.Errorf("the topology is not returned")
+	}
+	if token, index := parseTopologyToken("abc-2"); token != "abc" || index != 2 {
+		t.Errorf("wrong token %s and index %d", token, index)
+	}
+}
+
+func TestTopologyHidingOfRequestToUnlearnedPeer(t *testing.T) {
+	internal := listenTestPeer(t, "127.0.0.1", 16220)
+	carrier := listenTestPeer(t, "127.0.0.3", 16221)
+	createTopologyTestProxy(t, 16218, 16219, map[string]string{"carrier.com": "127.0.0.3:16221"})
+
+	sendTestMessage(t, internal, 16218, "INVITE sip:bob@carrier.com SIP/2.0\r\nVia: SIP/2.0/UDP 127.0.0.1:16220;branch=z9hG4bKth5\r\nVia: SIP/2.0/UDP 10.1.1.1:5060;branch=z9hG4bKth4\r\nMax-Forwards: 70\r\nFrom: <sip:alice@internal.com>;tag=internal\r\nTo: <sip:bob@carrier.com>\r\nCall-ID: th5@test.com\r\nCSeq: 1 INVITE\r\nContact: <sip:alice@10.1.1.50:5060>\r\nContent-Length: 0\r\n\r\n")
+	invite, raw := receiveTestMessage(t, carrier, "INVITE")
+	if strings.Contains(raw, "10.1.1.") || strings.Contains(raw, "16220") {
+		t.Errorf("the internal topology is sent to the peer:\n%s", raw)
+	}
+	if vias := getViaStrings(invite); len(vias) != 1 || !strings.Contains(vias[0], "127.0.0.1:16219") {
+		t.Errorf("expect the Via of the hiding listener only but get %v", vias)
+	}
+
+	sendTestMessage(t, carrier, 16219, NewResponseOf(invite, 486, "Busy Here").String())
+	answered, _ := receiveTestMessage(t, internal, "486")
+	if vias := getViaStrings(answered); len(vias) != 2 || !strings.Contains(vias[1], "10.1.1.1:5060") {
+		t.Errorf("the Vias are not restored in the response: %v", vias)
+	}
+}
@@ -2,27 +2,148 @@ package main
 
 import (
 	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
 )
 
+// TransactionTimers are the RFC 3261 timer values
+type TransactionTimers struct {
+	// T1 is the RTT estimate
+	T1 time.Duration
+	// T2 is the maximum retransmit interval for non-INVITE requests and INVITE responses
+	T2 time.Duration
+	// T4 is the maximum duration a message will remain in the network
+	T4 time.Duration
+	// TimerC is the proxy INVITE transaction timeout, it must be greater than 3 minutes
+	TimerC time.Duration
+	// TimerD is the wait time for response retransmits of INVITE client transaction over unreliable transport
+	TimerD time.Duration
+}
+
+var defaultTransactionTimers = &TransactionTimers{T1: 500 * time.Millisecond,
+	T2:     4 * time.Second,
+	T4:     5 * time.Second,
+	TimerC: 3*time.Minute + 10*time.Second,
+	TimerD: 32 * time.Second}
+
+// TimerB is also the value of Timer F, H, J, L and M
+func (t *TransactionTimers) TimerB() time.Duration {
+	return 64 * t.T1
+}
+
+type TransactionState int
+
+const (
+	TransactionCalling TransactionState = iota
+	TransactionTrying
+	TransactionProceeding
+	TransactionCompleted
+	// RFC 6026, the INVITE transaction is not terminated after a 2xx response
+	TransactionAccepted
+	TransactionConfirmed
+	TransactionTerminated
+)
+
+func (s TransactionState) String() string {
+	switch s {
+	case TransactionCalling:
+		return "Calling"
+	case TransactionTrying:
+		return "Trying"
+	case TransactionProceeding:
+		return "Proceeding"
+	case TransactionCompleted:
+		return "Completed"
+	case TransactionAccepted:
+		return "Accepted"
+	case TransactionConfirmed:
+		return "Confirmed"
+	case TransactionTerminated:
+		return "Terminated"
+	}
+	return "Unknown"
+}
+
+// TransactionSendFunc sends a message of the transaction to the network
+type TransactionSendFunc func(msg *Message) error
+
+// ClientTransactionTimeoutFunc is called when a client transaction gets no final response in time
+type ClientTransactionTimeoutFunc func(ct *ClientTransaction)
+
 type ClientTransactionMgr struct {
+	sync.Mutex
+	transactions   map[string]*ClientTransaction
+	timeoutHandler ClientTransactionTimeoutFunc
+	timers         *TransactionTimers
 }
 
 type ClientTransaction struct {
+	sync.Mutex
 	// it is the client generated branch parameter in Via header
 	TransId string
 	// method in CSeq
 	Method string
+
+	mgr      *ClientTransactionMgr
+	timers   *TransactionTimers
+	request  *Message
+	reliable bool
+	state    TransactionState
+	send     TransactionSendFunc
+	// the ACK sent for the non-2xx final response of INVITE
+	ack *Message
+	// the time the request is sent
+	start time.Time
+
+	retransmitInterval time.Duration
+	// Timer A or E
+	retransmitTimer *time.Timer
+	// Timer B, C or F
+	timeoutTimer *time.Timer
+	// Timer D, K or M
+	terminateTimer *time.Timer
+}
+
+type ServerTransactionMgr struct {
+	sync.Mutex
+	transactions map[string]*ServerTransaction
+	timers       *TransactionTimers
 }
 
 type ServerTransaction struct {
+	sync.Mutex
 	TransId string
 	SentBy  string
 	Method  string
+
+	mgr          *ServerTransactionMgr
+	timers       *TransactionTimers
+	request      *Message
+	reliable     bool
+	state        TransactionState
+	send         TransactionSendFunc
+	lastResponse *Message
+
+	retransmitInterval time.Duration
+	// Timer G
+	retransmitTimer *time.Timer
+	// Timer H
+	timeoutTimer *time.Timer
+	// Timer I, J or L
+	terminateTimer *time.Timer
+	// Timer C for INVITE or 64*T1 for the other methods, the transaction is terminated
+	// if no final response is sent in it
+	lifetimeTimer *time.Timer
 }
 
-func NewClientTransactionMgr() *ClientTransactionMgr {
-	return &ClientTransactionMgr{}
+func NewClientTransactionMgr(timeoutHandler ClientTransactionTimeoutFunc) *ClientTransactionMgr {
+	return &ClientTransactionMgr{transactions: make(map[string]*ClientTransaction),
+		timeoutHandler: timeoutHandler,
+		timers:         defaultTransactionTimers}
 }
+
 func NewClientTransaction(branch string, method string) *ClientTransaction {
 	return &ClientTransaction{TransId: branch, Method: method}
 }
@@ -30,3 +151,496 @@ func NewClientTransaction(branch string, method string) *ClientTransaction {
 func (ct *ClientTransaction) String() string {
 	return fmt.Sprintf("%s-%s", ct.Method, ct.TransId)
 }
+
+// AddTransaction creates a client transaction for the request which has been sent
+// once with the send function. The send function is used for the retransmissions
+// and the ACK of the non-2xx final response. No transaction is created for ACK.
+func (m *ClientTransactionMgr) AddTransaction(request *Message, reliable bool, send TransactionSendFunc) (*ClientTransaction, error) {
+	method, err := request.GetMethod()
+	if err != nil {
+		return nil, err
+	}
+	if method == "ACK" {
+		return nil, fmt.Errorf("no client transaction for ACK")
+	}
+	branch, err := request.GetTopViaBranch()
+	if err != nil {
+		return nil, err
+	}
+	ct := NewClientTransaction(branch, method)
+	ct.mgr = m
+	ct.timers = m.timers
+	ct.request = request
+	ct.reliable = reliable
+	ct.send = send
+	ct.start = time.Now()
+	ct.retransmitInterval = ct.timers.T1
+
+	m.Lock()
+	m.transactions[ct.String()] = ct
+	m.Unlock()
+
+	ct.Lock()
+	defer ct.Unlock()
+	if method == "INVITE" {
+		ct.state = TransactionCalling
+	} else {
+		ct.state = TransactionTrying
+	}
+	if !reliable {
+		ct.retransmitTimer = time.AfterFunc(ct.retransmitInterval, ct.retransmit)
+	}
+	ct.timeoutTimer = time.AfterFunc(ct.timers.TimerB(), ct.timeout)
+	zap.L().Debug("client transaction is created", zap.String("transaction", ct.String()), zap.Bool("reliable", reliable))
+	return ct, nil
+}
+
+// GetTransaction get the client transaction by the id returned from Message.GetClientTransaction()
+func (m *ClientTransactionMgr) GetTransaction(transId string) (*ClientTransaction, bool) {
+	m.Lock()
+	defer m.Unlock()
+	ct, ok := m.transactions[transId]
+	return ct, ok
+}
+
+// HandleResponse matches the response to its client transaction and returns
+// true if the response should be forwarded. Responses without matched client
+// transaction are forwarded statelessly.
+func (m *ClientTransactionMgr) HandleResponse(response *Message) (*ClientTransaction, bool) {
+	transId, err := response.GetClientTransaction()
+	if err != nil {
+		return nil, true
+	}
+	ct, ok := m.GetTransaction(transId)
+	if !ok {
+		return nil, true
+	}
+	return ct, ct.handleResponse(response)
+}
+
+// Size returns the number of the alive client transactions
+func (m *ClientTransactionMgr) Size() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.transactions)
+}
+
+func (m *ClientTransactionMgr) removeTransaction(ct *ClientTransaction) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.transactions, ct.String())
+}
+
+// GetRequest get the request which creates the transaction
+func (ct *ClientTransaction) GetRequest() *Message {
+	return ct.request
+}
+
+func (ct *ClientTransaction) GetState() TransactionState {
+	ct.Lock()
+	defer ct.Unlock()
+	return ct.state
+}
+
+func (ct *ClientTransaction) handleResponse(response *Message) bool {
+	ct.Lock()
+	defer ct.Unlock()
+
+	statusCode := response.response.statusCode
+	switch ct.state {
+	case TransactionCalling, TransactionTrying, TransactionProceeding:
+		if statusCode < 200 {
+			ct.enterProceeding()
+			return true
+		}
+		observeTransactionDuration(ct.Method, getStatusClass(statusCode), ct.start)
+		if ct.Method == "INVITE" && statusCode < 300 {
+			ct.enterAccepted()
+			return true
+		}
+		ct.enterCompleted(response)
+		return true
+	case TransactionAccepted:
+		// the 2xx from the other forked UAS and the retransmitted 2xx are forwarded
+		return statusCode >= 200 && statusCode < 300
+	case TransactionCompleted:
+		// retransmission of the final response
+		if ct.ack != nil {
+			ct.send(ct.ack)
+		}
+		return false
+	}
+	return false
+}
+
+func (ct *ClientTransaction) enterProceeding() {
+	if ct.state == TransactionProceeding {
+		return
+	}
+	ct.state = TransactionProceeding
+	if ct.Method == "INVITE" {
+		// Timer A and B are not needed after a provisional response,
+		// Timer C protects the proxy from a never answered INVITE
+		stopTimer(ct.retransmitTimer)
+		stopTimer(ct.timeoutTimer)
+		ct.timeoutTimer = time.AfterFunc(ct.timers.TimerC, ct.timeout)
+	}
+}
+
+func (ct *ClientTransaction) enterAccepted() {
+	ct.state = TransactionAccepted
+	stopTimer(ct.retransmitTimer)
+	stopTimer(ct.timeoutTimer)
+	ct.terminateTimer = time.AfterFunc(ct.timers.TimerB(), func() {
+		ct.Lock()
+		defer ct.Unlock()
+		ct.terminate()
+	})
+}
+
+func (ct *ClientTransaction) enterCompleted(response *Message) {
+	ct.state = TransactionCompleted
+	stopTimer(ct.retransmitTimer)
+	stopTimer(ct.timeoutTimer)
+	wait := ct.timers.T4
+	if ct.Method == "INVITE" {
+		ct.ack = NewAckOf(ct.request, response)
+		ct.send(ct.ack)
+		wait = ct.timers.TimerD
+	}
+	if ct.reliable {
+		ct.terminate()
+	} else {
+		ct.terminateTimer = time.AfterFunc(wait, func() {
+			ct.Lock()
+			defer ct.Unlock()
+			ct.terminate()
+		})
+	}
+}
+
+func (ct *ClientTransaction) terminate() {
+	if ct.state == TransactionTerminated {
+		return
+	}
+	ct.state = TransactionTerminated
+	stopTimer(ct.retransmitTimer)
+	stopTimer(ct.timeoutTimer)
+	stopTimer(ct.terminateTimer)
+	ct.mgr.removeTransaction(ct)
+	zap.L().Debug("client transaction is terminated", zap.String("transaction", ct.String()))
+}
+
+// retransmit is Timer A for INVITE and Timer E for non-INVITE
+func (ct *ClientTransaction) retransmit() {
+	ct.Lock()
+	defer ct.Unlock()
+
+	if ct.state != TransactionCalling && ct.state != TransactionTrying && !(ct.state == TransactionProceeding && ct.Method != "INVITE") {
+		return
+	}
+	callId, _ := ct.request.GetCallID()
+	zap.L().Info("retransmit request of client transaction", zap.String("transaction", ct.String()), zap.String("call-id", callId))
+	ct.send(ct.request)
+	if ct.Method == "INVITE" {
+		ct.retransmitInterval = 2 * ct.retransmitInterval
+	} else if ct.state == TransactionProceeding {
+		ct.retransmitInterval = ct.timers.T2
+	} else {
+		ct.retransmitInterval = min(2*ct.retransmitInterval, ct.timers.T2)
+	}
+	ct.retransmitTimer = time.AfterFunc(ct.retransmitInterval, ct.retransmit)
+}
+
+// timeout is Timer B or C for INVITE and Timer F for non-INVITE
+func (ct *ClientTransaction) timeout() {
+	ct.Lock()
+	if ct.state == TransactionCompleted || ct.state == TransactionAccepted || ct.state == TransactionTerminated {
+		ct.Unlock()
+		return
+	}
+	callId, _ := ct.request.GetCallID()
+	zap.L().Error("client transaction timeout", zap.String("transaction", ct.String()), zap.String("state", ct.state.String()), zap.String("call-id", callId))
+	observeTransactionDuration(ct.Method, "timeout", ct.start)
+	ct.terminate()
+	ct.Unlock()
+
+	if ct.mgr.timeoutHandler != nil {
+		ct.mgr.timeoutHandler(ct)
+	}
+}
+
+func NewServerTransactionMgr() *ServerTransactionMgr {
+	return &ServerTransactionMgr{transactions: make(map[string]*ServerTransaction), timers: defaultTransactionTimers}
+}
+
+// getServerTransactionKey get the key of the server transaction. The CANCEL
+// shares the key of the INVITE in Message.GetServerTransaction(), but it is a
+// transaction by itself
+func getServerTransactionKey(msg *Message) (string, error) {
+	key, err := msg.GetServerTransaction()
+	if err != nil {
+		return "", err
+	}
+	if method, _ := msg.GetMethod(); method == "CANCEL" {
+		return "CANCEL-" + key, nil
+	}
+	return key, nil
+}
+
+// HandleRequest matches the request to a server transaction and returns true
+// if the request should be forwarded. A new server transaction is created for
+// a request which is not a retransmission, the send function is used to send
+// the responses of the transaction.
+func (m *ServerTransactionMgr) HandleRequest(request *Message, reliable bool, send TransactionSendFunc) (*ServerTransaction, bool) {
+	key, err := getServerTransactionKey(request)
+	if err != nil {
+		return nil, true
+	}
+	method, _ := request.GetMethod()
+
+	m.Lock()
+	st, ok := m.transactions[key]
+	if ok {
+		m.Unlock()
+		if method == "ACK" {
+			return st, st.handleAck()
+		}
+		st.handleRetransmission()
+		return st, false
+	}
+	// the ACK for 2xx response is a separated transaction
+	if method == "ACK" {
+		m.Unlock()
+		return nil, true
+	}
+
+	sentBy, _ := request.GetTopViaSentBy()
+	st = &ServerTransaction{TransId: key,
+		SentBy:   sentBy,
+		Method:   method,
+		mgr:      m,
+		timers:   m.timers,
+		request:  request,
+		reliable: reliable,
+		send:     send}
+	lifetime := m.timers.TimerB()
+	if method == "INVITE" {
+		st.state = TransactionProceeding
+		lifetime = m.timers.TimerC
+	} else {
+		st.state = TransactionTrying
+	}
+	st.Lock()
+	st.lifetimeTimer = time.AfterFunc(lifetime, st.expire)
+	st.Unlock()
+	m.transactions[key] = st
+	m.Unlock()
+	zap.L().Debug("server transaction is created", zap.String("transaction", key), zap.Bool("reliable", reliable))
+	return st, true
+}
+
+// GetTransaction get the server transaction of the message
+func (m *ServerTransactionMgr) GetTransaction(msg *Message) (*ServerTransaction, bool) {
+	key, err := getServerTransactionKey(msg)
+	if err != nil {
+		return nil, false
+	}
+	m.Lock()
+	defer m.Unlock()
+	st, ok := m.transactions[key]
+	return st, ok
+}
+
+// SendResponse sends the response through its server transaction. It returns
+// false if no server transaction is found and the response should be sent
+// statelessly.
+func (m *ServerTransactionMgr) SendResponse(response *Message) bool {
+	st, ok := m.GetTransaction(response)
+	if !ok {
+		return false
+	}
+	st.sendResponse(response)
+	return true
+}
+
+// Size returns the number of the alive server transactions
+func (m *ServerTransactionMgr) Size() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.transactions)
+}
+
+// PendingSize returns the number of the server transactions which are not answered
+// with a final response
+func (m *ServerTransactionMgr) PendingSize() int {
+	m.Lock()
+	transactions := make([]*ServerTransaction, 0, len(m.transactions))
+	for _, st := range m.transactions {
+		transactions = append(transactions, st)
+	}
+	m.Unlock()
+	n := 0
+	for _, st := range transactions {
+		if state := st.GetState(); state == TransactionTrying || state == TransactionProceeding {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *ServerTransactionMgr) removeTransaction(st *ServerTransaction) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.transactions, st.TransId)
+}
+
+// GetRequest get the request which creates the transaction
+func (st *ServerTransaction) GetRequest() *Message {
+	return st.request
+}
+
+func (st *ServerTransaction) GetState() TransactionState {
+	st.Lock()
+	defer st.Unlock()
+	return st.state
+}
+
+func (st *ServerTransaction) handleRetransmission() {
+	st.Lock()
+	defer st.Unlock()
+
+	callId, _ := st.request.GetCallID()
+	zap.L().Info("absorb retransmitted request", zap.String("transaction", st.TransId), zap.String("state", st.state.String()), zap.String("call-id", callId))
+	if st.lastResponse != nil && (st.state == TransactionProceeding || st.state == TransactionCompleted) {
+		st.send(st.lastResponse)
+	}
+}
+
+func (st *ServerTransaction) handleAck() bool {
+	st.Lock()
+	defer st.Unlock()
+
+	if st.state != TransactionCompleted {
+		return st.state != TransactionConfirmed
+	}
+	st.state = TransactionConfirmed
+	stopTimer(st.retransmitTimer)
+	stopTimer(st.timeoutTimer)
+	if st.reliable {
+		st.terminate()
+	} else {
+		st.terminateTimer = time.AfterFunc(st.timers.T4, func() {
+			st.Lock()
+			defer st.Unlock()
+			st.terminate()
+		})
+	}
+	return false
+}
+
+func (st *ServerTransaction) sendResponse(response *Message) {
+	st.Lock()
+	defer st.Unlock()
+
+	statusCode := response.response.statusCode
+	if st.state == TransactionAccepted && statusCode >= 200 && statusCode < 300 {
+		st.send(response)
+		return
+	}
+	if st.state != TransactionTrying && st.state != TransactionProceeding {
+		callId, _ := response.GetCallID()
+		zap.L().Info("absorb response in server transaction", zap.String("transaction", st.TransId), zap.String("state", st.state.String()), zap.String("call-id", callId))
+		return
+	}
+	st.lastResponse = response
+	st.send(response)
+	if statusCode < 200 {
+		st.state = TransactionProceeding
+		return
+	}
+	stopTimer(st.lifetimeTimer)
+	if st.Method == "INVITE" && statusCode < 300 {
+		st.state = TransactionAccepted
+		st.terminateTimer = time.AfterFunc(st.timers.TimerB(), func() {
+			st.Lock()
+			defer st.Unlock()
+			st.terminate()
+		})
+		return
+	}
+	st.state = TransactionCompleted
+	if st.Method == "INVITE" {
+		if !st.reliable {
+			st.retransmitInterval = st.timers.T1
+			st.retransmitTimer = time.AfterFunc(st.retransmitInterval, st.retransmit)
+		}
+		st.timeoutTimer = time.AfterFunc(st.timers.TimerB(), st.timeout)
+	} else if st.reliable {
+		st.terminate()
+	} else {
+		st.terminateTimer = time.AfterFunc(st.timers.TimerB(), func() {
+			st.Lock()
+			defer st.Unlock()
+			st.terminate()
+		})
+	}
+}
+
+// retransmit is Timer G
+func (st *ServerTransaction) retransmit() {
+	st.Lock()
+	defer st.Unlock()
+
+	if st.state != TransactionCompleted {
+		return
+	}
+	st.send(st.lastResponse)
+	st.retransmitInterval = min(2*st.retransmitInterval, st.timers.T2)
+	st.retransmitTimer = time.AfterFunc(st.retransmitInterval, st.retransmit)
+}
+
+// timeout is Timer H
+func (st *ServerTransaction) timeout() {
+	st.Lock()
+	defer st.Unlock()
+
+	if st.state != TransactionCompleted {
+		return
+	}
+	callId, _ := st.request.GetCallID()
+	zap.L().Error("no ACK is received for the final response", zap.String("transaction", st.TransId), zap.String("call-id", callId))
+	st.terminate()
+}
+
+// expire terminates the transaction in which no final response is sent in its lifetime
+func (st *ServerTransaction) expire() {
+	st.Lock()
+	defer st.Unlock()
+
+	if st.state != TransactionTrying && st.state != TransactionProceeding {
+		return
+	}
+	callId, _ := st.request.GetCallID()
+	zap.L().Error("no final response is sent in the server transaction", zap.String("transaction", st.TransId), zap.String("state", st.state.String()), zap.String("call-id", callId))
+	st.terminate()
+}
+
+func (st *ServerTransaction) terminate() {
+	if st.state == TransactionTerminated {
+		return
+	}
+	st.state = TransactionTerminated
+	stopTimer(st.retransmitTimer)
+	stopTimer(st.timeoutTimer)
+	stopTimer(st.terminateTimer)
+	stopTimer(st.lifetimeTimer)
+	st.mgr.removeTransaction(st)
+	zap.L().Debug("server transaction is terminated", zap.String("transaction", st.TransId))
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
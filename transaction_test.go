@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type messageRecorder struct {
+	sync.Mutex
+	messages []*Message
+}
+
+func (r *messageRecorder) send(msg *Message) error {
+	r.Lock()
+	defer r.Unlock()
+	r.messages = append(r.messages, msg)
+	return nil
+}
+
+func (r *messageRecorder) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.messages)
+}
+
+func (r *messageRecorder) last() *Message {
+	r.Lock()
+	defer r.Unlock()
+	return r.messages[len(r.messages)-1]
+}
+
+var shortTransactionTimers = &TransactionTimers{T1: 10 * time.Millisecond,
+	T2:     40 * time.Millisecond,
+	T4:     50 * time.Millisecond,
+	TimerC: 2 * time.Second,
+	TimerD: 200 * time.Millisecond}
+
+func createTestRequest(method string) *Message {
+	s := method + ` sip:bob@biloxi.example.com SIP/2.0
+Via: SIP/2.0/UDP client.atlanta.example.com:5060;branch=z9hG4bK74bf9
+Max-Forwards: 70
+From: Alice <sip:alice@atlanta.example.com>;tag=9fxced76sl
+To: Bob <sip:bob@biloxi.example.com>
+Call-ID: 3848276298220188511@atlanta.example.com
+CSeq: 1 ` + method + `
+Content-Length: 0
+
+`
+	msg, _ := ParseMessage(create_reader_from_string(s))
+	return msg
+}
+
+func createTestResponse(request *Message, statusCode int, reason string) *Message {
+	cseq, _ := request.GetCSeq()
+	method := cseq.Method
+	if method == "ACK" {
+		method = "INVITE"
+	}
+	s := "SIP/2.0 " + reason + `
+Via: SIP/2.0/UDP client.atlanta.example.com:5060;branch=z9hG4bK74bf9
+From: Alice <sip:alice@atlanta.example.com>;tag=9fxced76sl
+To: Bob <sip:bob@biloxi.example.com>;tag=8321234356
+Call-ID: 3848276298220188511@atlanta.example.com
+CSeq: 1 ` + method + `
+Content-Length: 0
+
+`
+	msg, _ := ParseMessage(create_reader_from_string(s))
+	msg.response.statusCode = statusCode
+	return msg
+}
+
+func TestClientNonInviteTransaction(t *testing.T) {
+	recorder := &messageRecorder{}
+	mgr := NewClientTransactionMgr(nil)
+	mgr.timers = shortTransactionTimers
+	request := createTestRequest("OPTIONS")
+	ct, err := mgr.AddTransaction(request, false, recorder.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if recorder.count() < 2 {
+		t.Errorf("the request is not retransmitted")
+	}
+	if _, forward := mgr.HandleResponse(createTestResponse(request, 200, "200 OK")); !forward {
+		t.Errorf("the first final response should be forwarded")
+	}
+	if ct.GetState() != TransactionCompleted {
+		t.Errorf("unexpected state %v", ct.GetState())
+	}
+	n := recorder.count()
+	if _, forward := mgr.HandleResponse(createTestResponse(request, 200, "200 OK")); forward {
+		t.Errorf("the retransmitted final response should be absorbed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if recorder.count() != n {
+		t.Errorf("the request is retransmitted in Completed state")
+	}
+	if mgr.Size() != 0 {
+		t.Errorf("the transaction is not terminated after Timer K")
+	}
+}
+
+func TestClientInviteTransactionAck(t *testing.T) {
+	recorder := &messageRecorder{}
+	mgr := NewClientTransactionMgr(nil)
+	mgr.timers = shortTransactionTimers
+	request := createTestRequest("INVITE")
+	mgr.AddTransaction(request, true, recorder.send)
+	mgr.HandleResponse(createTestResponse(request, 180, "180 Ringing"))
+	if _, forward := mgr.HandleResponse(createTestResponse(request, 486, "486 Busy Here")); !forward {
+		t.Errorf("the final response should be forwarded")
+	}
+	ack := recorder.last()
+	if method, _ := ack.GetMethod(); method != "ACK" {
+		t.Fatalf("no ACK is sent for the non-2xx response")
+	}
+	to, _ := ack.GetTo()
+	if tag, _ := to.GetTag(); tag != "8321234356" {
+		t.Errorf("the To tag of ACK is not from the response")
+	}
+	if branch, _ := ack.GetTopViaBranch(); branch != "z9hG4bK74bf9" {
+		t.Errorf("the branch of ACK is not the branch of the INVITE")
+	}
+}
+
+func TestClientTransactionTimeout(t *testing.T) {
+	timeout := make(chan *ClientTransaction, 1)
+	mgr := NewClientTransactionMgr(func(ct *ClientTransaction) {
+		timeout <- ct
+	})
+	mgr.timers = shortTransactionTimers
+	request := createTestRequest("INVITE")
+	mgr.AddTransaction(request, false, (&messageRecorder{}).send)
+	select {
+	case ct := <-timeout:
+		if ct.GetRequest() != request {
+			t.Errorf("the timeout transaction is not created by the request")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timer B is not fired")
+	}
+}
+
+func TestServerInviteTransaction(t *testing.T) {
+	recorder := &messageRecorder{}
+	mgr := NewServerTransactionMgr()
+	mgr.timers = shortTransactionTimers
+	request := createTestRequest("INVITE")
+	if _, forward := mgr.HandleRequest(request, false, recorder.send); !forward {
+		t.Fatalf("the new request should be forwarded")
+	}
+	mgr.SendResponse(createTestResponse(request, 100, "100 Trying"))
+	if _, forward := mgr.HandleRequest(createTestRequest("INVITE"), false, recorder.send); forward {
+		t.Errorf("the retransmitted request should be absorbed")
+	}
+	if recorder.count() != 2 {
+		t.Errorf("the provisional response is not sent again for the retransmitted request")
+	}
+	mgr.SendResponse(createTestResponse(request, 486, "486 Busy Here"))
+	time.Sleep(50 * time.Millisecond)
+	if recorder.count() < 4 {
+		t.Errorf("the final response is not retransmitted")
+	}
+	st, forward := mgr.HandleRequest(createTestRequest("ACK"), false, recorder.send)
+	if forward || st == nil || st.GetState() != TransactionConfirmed {
+		t.Errorf("the ACK of the non-2xx response should be absorbed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if mgr.Size() != 0 {
+		t.Errorf("the transaction is not terminated after Timer I")
+	}
+}
+
+func TestServerTransactionLifetime(t *testing.T) {
+	recorder := &messageRecorder{}
+	mgr := NewServerTransactionMgr()
+	mgr.timers = &TransactionTimers{T1: time.Millisecond,
+		T2:     4 * time.Millisecond,
+		T4:     5 * time.Millisecond,
+		TimerC: 200 * time.Millisecond,
+		TimerD: 200 * time.Millisecond}
+	mgr.HandleRequest(createTestRequest("OPTIONS"), false, recorder.send)
+	invite := createTestRequest("INVITE")
+	mgr.HandleRequest(invite, false, recorder.send)
+	mgr.SendResponse(createTestResponse(invite, 100, "100 Trying"))
+	time.Sleep(100 * time.Millisecond)
+	if st, ok := mgr.GetTransaction(invite); mgr.Size() != 1 || !ok || st.GetState() != TransactionProceeding {
+		t.Errorf("expect only the INVITE transaction is alive after 64*T1 but get %d", mgr.Size())
+	}
+	time.Sleep(200 * time.Millisecond)
+	if mgr.Size() != 0 {
+		t.Errorf("the INVITE transaction without final response is not terminated after Timer C")
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +29,9 @@ type RawMessage struct {
 	// the prefered backend
 	Backend Backend
 	Via     *ViaConfig
+	// ConnTransport is used to send message back to the peer when the message
+	// is received from a connection which can't be made by the proxy, e.g. WebSocket
+	ConnTransport ClientTransport
 }
 
 func NewRawMessage(peerAddr string, peerPort int, from ServerTransport, receivedSupport bool, msg *Message, backend Backend, via *ViaConfig) *RawMessage {
@@ -71,6 +77,9 @@ type ServerTransport interface {
 
 	// return True if the transport exit
 	IsExit() bool
+
+	// Stop listening, the accepted connections are not closed
+	Stop()
 }
 
 type SizedByteArray struct {
@@ -88,14 +97,25 @@ type UDPServerTransport struct {
 	msgHandler      MessageHandler
 	msgBufPool      *ByteArrayPool
 	msgParseChannel chan SizedByteArray
+	queueDepthId    int
+	// the sources allowed to send to the transport, nil if all are allowed
+	acl *AccessList
 }
 
 type ConnectionAcceptedListener interface {
 	ConnectionAccepted(conn net.Conn)
 }
+
+// ConnTransportClosedListener is notified when the connection of the ConnTransport of the
+// received messages is closed
+type ConnTransportClosedListener interface {
+	ConnTransportClosed(client ClientTransport)
+}
 type TCPServerTransport struct {
 	addr            string
 	port            int
+	protocol        string
+	tlsConfig       *tls.Config
 	conn            net.Conn
 	receivedSupport bool
 	selfLearnRoute  *SelfLearnRoute
@@ -105,20 +125,28 @@ type TCPServerTransport struct {
 	msgHandler           MessageHandler
 	connAcceptedListener ConnectionAcceptedListener
 	exit                 bool
+	listener             net.Listener
+	// the sources allowed to connect the transport, nil if all are allowed
+	acl *AccessList
 }
 
 type ClientTransport interface {
 	Send(msg *Message) error
 	IsExpired() bool
+	// close the connection to the peer
+	Close()
 }
 
 type FailOverClientTransport struct {
+	sync.Mutex
 	primary     ClientTransport
 	secondaries []ClientTransport
 }
 
 type ClientTransportFactory struct {
+	sync.Mutex
 	resolver         *PreConfigHostResolver
+	tlsConfig        *tls.Config
 	clientTransports map[string]ClientTransport
 }
 
@@ -129,7 +157,8 @@ func NewClientTransportFactory(resolver *PreConfigHostResolver) *ClientTransport
 // CreateUDPClientTransport create a UDP client transport with host and port
 // localAddress is the local address to bind to
 func (ctf *ClientTransportFactory) CreateUDPClientTransport(host string, port int, localAddress string) (ClientTransport, error) {
-
+	ctf.Lock()
+	defer ctf.Unlock()
 	key := fmt.Sprintf("udp:%s:%d:%s", host, port, localAddress)
 	if client, ok := ctf.clientTransports[key]; ok {
 		return client, nil
@@ -143,6 +172,8 @@ func (ctf *ClientTransportFactory) CreateUDPClientTransport(host string, port in
 }
 
 func (ctf *ClientTransportFactory) CreateUDPClientTransportWithConn(host string, port int, conn *net.UDPConn) (ClientTransport, error) {
+	ctf.Lock()
+	defer ctf.Unlock()
 	key := fmt.Sprintf("udp:%s:%d:%p", host, port, conn)
 	if client, ok := ctf.clientTransports[key]; ok {
 		return client, nil
@@ -157,6 +188,8 @@ func (ctf *ClientTransportFactory) CreateUDPClientTransportWithConn(host string,
 // CreateTCPClientTransport create a TCP client transport with host and port
 // localAddress is the local address to be bind
 func (ctf *ClientTransportFactory) CreateTCPClientTransport(host string, port int, localAddress string, connectionEstablished ConnectionEstablishedFunc) (ClientTransport, error) {
+	ctf.Lock()
+	defer ctf.Unlock()
 	key := fmt.Sprintf("tcp:%s:%d:%s", host, port, localAddress)
 	if client, ok := ctf.clientTransports[key]; ok {
 		return client, nil
@@ -169,9 +202,35 @@ func (ctf *ClientTransportFactory) CreateTCPClientTransport(host string, port in
 	return clientTransport, err
 }
 
+// SetTLSConfig set the tls.Config used by the TLS client transports
+func (ctf *ClientTransportFactory) SetTLSConfig(tlsConfig *tls.Config) {
+	ctf.Lock()
+	defer ctf.Unlock()
+	ctf.tlsConfig = tlsConfig
+}
+
+// CreateTLSClientTransport create a TLS client transport with host and port
+// localAddress is the local address to be bind
+func (ctf *ClientTransportFactory) CreateTLSClientTransport(host string, port int, localAddress string, connectionEstablished ConnectionEstablishedFunc) (ClientTransport, error) {
+	ctf.Lock()
+	defer ctf.Unlock()
+	key := fmt.Sprintf("tls:%s:%d:%s", host, port, localAddress)
+	if client, ok := ctf.clientTransports[key]; ok {
+		return client, nil
+	}
+
+	clientTransport, err := NewTLSClientTransport(ctf.resolver, host, port, localAddress, clientTLSConfigFor(ctf.tlsConfig, host), connectionEstablished)
+	if err == nil {
+		ctf.clientTransports[key] = clientTransport
+	}
+	return clientTransport, err
+}
+
 // RemoveUDPClientTransport remove the UDP client transport with host and port
 // localAddress is the local address to bind to
 func (ctf *ClientTransportFactory) RemoveUDPClientTransport(host string, port int, localAddress string) {
+	ctf.Lock()
+	defer ctf.Unlock()
 	key := fmt.Sprintf("udp:%s:%d:%s", host, port, localAddress)
 	delete(ctf.clientTransports, key)
 }
@@ -179,6 +238,8 @@ func (ctf *ClientTransportFactory) RemoveUDPClientTransport(host string, port in
 // RemoveTCPClientTransport remove the TCP client transport with host and port
 // localAddress is the local address to bind to
 func (ctf *ClientTransportFactory) RemoveTCPClientTransport(host string, port int, localAddress string) {
+	ctf.Lock()
+	defer ctf.Unlock()
 	key := fmt.Sprintf("tcp:%s:%d:%s", host, port, localAddress)
 	delete(ctf.clientTransports, key)
 }
@@ -191,28 +252,47 @@ func NewFailOverClientTransport(primary ClientTransport, secondaries []ClientTra
 
 // Set primary client transport
 func (fct *FailOverClientTransport) SetPrimary(client ClientTransport) {
+	fct.Lock()
+	defer fct.Unlock()
 	fct.primary = client
 }
 
+func (fct *FailOverClientTransport) GetPrimary() ClientTransport {
+	fct.Lock()
+	defer fct.Unlock()
+	return fct.primary
+}
+
 // AddSecondary add the cient to back
 func (fct *FailOverClientTransport) AddSecondary(client ClientTransport) {
+	fct.Lock()
+	defer fct.Unlock()
 	fct.secondaries = append(fct.secondaries, client)
 }
 
 func (fct *FailOverClientTransport) SetSecondaries(clients []ClientTransport) {
+	fct.Lock()
+	defer fct.Unlock()
 	fct.secondaries = clients
 }
 
+func (fct *FailOverClientTransport) GetSecondaries() []ClientTransport {
+	fct.Lock()
+	defer fct.Unlock()
+	return slices.Clone(fct.secondaries)
+}
+
 // Send send message to the primary client transport, if failed, send to the secondary client transport
 // if both failed, return error
 func (fct *FailOverClientTransport) Send(msg *Message) error {
-	if fct.primary != nil {
-		err := fct.primary.Send(msg)
+	primary := fct.GetPrimary()
+	if primary != nil {
+		err := primary.Send(msg)
 		if err == nil {
 			return nil
 		}
 	}
-	for _, client := range fct.secondaries {
+	for _, client := range fct.GetSecondaries() {
 		err := client.Send(msg)
 		if err == nil {
 			return nil
@@ -223,11 +303,27 @@ func (fct *FailOverClientTransport) Send(msg *Message) error {
 
 // IsConnected return true if the primary or secondary client transport is connected
 func (fct *FailOverClientTransport) IsConnected() bool {
+	fct.Lock()
+	defer fct.Unlock()
 	return fct.primary != nil || len(fct.secondaries) > 0
 }
 
+// Close close the primary and secondary client transports
+func (fct *FailOverClientTransport) Close() {
+	fct.Lock()
+	defer fct.Unlock()
+	if fct.primary != nil {
+		fct.primary.Close()
+	}
+	for _, client := range fct.secondaries {
+		client.Close()
+	}
+}
+
 // IsExpired return true if the primary or secondary client transport is expired
 func (fct *FailOverClientTransport) IsExpired() bool {
+	fct.Lock()
+	defer fct.Unlock()
 	if fct.primary != nil && fct.primary.IsExpired() {
 		return true
 	}
@@ -240,6 +336,7 @@ func (fct *FailOverClientTransport) IsExpired() bool {
 }
 
 type UDPClientTransport struct {
+	sync.Mutex
 	resolver *PreConfigHostResolver
 	host     string
 	port     int
@@ -254,6 +351,8 @@ type UDPClientTransport struct {
 }
 
 type TCPClientTransport struct {
+	// serialize the writes to the connection
+	sync.Mutex
 	resolver              *PreConfigHostResolver
 	host                  string
 	port                  string
@@ -262,9 +361,15 @@ type TCPClientTransport struct {
 	conn                  net.Conn
 	expire                int64
 	connectionEstablished ConnectionEstablishedFunc
+	// not nil if the connection is a TLS connection
+	tlsConfig *tls.Config
 }
 
-var SupportedProtocol = map[string]string{"udp": "udp", "tcp": "tcp"}
+var SupportedProtocol = map[string]string{"udp": "udp", "tcp": "tcp", "tls": "tls", "ws": "ws", "wss": "wss"}
+
+// DialableProtocol is the protocols of the connections made by the proxy, the ws and wss
+// connections can only be accepted from the WebSocket clients
+var DialableProtocol = map[string]string{"udp": "udp", "tcp": "tcp", "tls": "tls"}
 
 // NewUDPClientTransport create a UDP client transport with host and port
 func NewUDPClientTransport(resolver *PreConfigHostResolver, host string, port int, localAddress string) (*UDPClientTransport, error) {
@@ -295,6 +400,8 @@ func NewUDPClientTransportWithConn(resolver *PreConfigHostResolver, host string,
 }
 
 func (u *UDPClientTransport) connect() error {
+	u.Lock()
+	defer u.Unlock()
 	if u.conn != nil {
 		return nil
 	}
@@ -358,6 +465,7 @@ func (u *UDPClientTransport) Send(msg *Message) error {
 	err = u.sendData(b)
 	remoteAddr := net.JoinHostPort(u.host, strconv.Itoa(u.port))
 	if err == nil {
+		messageSent("udp", getListenLabel(u.conn.LocalAddr(), u.preConnected), msg)
 		if zap.L().Core().Enabled(zap.DebugLevel) {
 			zap.L().Debug("Succeed to send message through UDP", zap.String("localAddr", u.conn.LocalAddr().String()), zap.String("remoteAddr", remoteAddr), zap.String("message", msg.String()))
 		} else {
@@ -391,6 +499,14 @@ func (u *UDPClientTransport) IsExpired() bool {
 	return false
 }
 
+func (u *UDPClientTransport) Close() {
+	u.Lock()
+	defer u.Unlock()
+	if u.conn != nil {
+		u.conn.Close()
+	}
+}
+
 type ClientTransportMgr struct {
 	sync.Mutex
 	transports             map[string]*FailOverClientTransport
@@ -442,6 +558,33 @@ func (c *ClientTransportMgr) GetTransport(protocol string, host string, port int
 	return trans, nil
 }
 
+// AddTransport add the client transport of the connection accepted from the host and port,
+// the messages to the host and port are sent through it
+func (c *ClientTransportMgr) AddTransport(protocol string, host string, port int, client ClientTransport) {
+	c.Lock()
+	defer c.Unlock()
+	// the connection is closed before the message received from it is processed
+	if client.IsExpired() {
+		return
+	}
+	protocol = strings.ToLower(protocol)
+	fullAddr := c.getFullAddr(protocol, host, port, "")
+	zap.L().Info("add client transport of accepted connection", zap.String("fullAddr", fullAddr))
+	c.transports[fullAddr] = NewFailOverClientTransport(client, make([]ClientTransport, 0))
+}
+
+// RemoveConnTransport remove all the addresses added for the client transport of the
+// accepted connection after the connection is closed
+func (c *ClientTransportMgr) RemoveConnTransport(client ClientTransport) {
+	c.Lock()
+	defer c.Unlock()
+	for fullAddr, trans := range c.transports {
+		if trans.GetPrimary() == client {
+			delete(c.transports, fullAddr)
+		}
+	}
+}
+
 // RemoveTransport remove the client transport by the protocol, host and port
 // transId is used to identify the transport
 func (c *ClientTransportMgr) RemoveTransport(protocol string, host string, port int, transId string) {
@@ -456,10 +599,20 @@ func (c *ClientTransportMgr) RemoveTransport(protocol string, host string, port
 	delete(c.transports, fullAddr)
 }
 
+// CloseAll close all the client transports
+func (c *ClientTransportMgr) CloseAll() {
+	c.Lock()
+	defer c.Unlock()
+	for fullAddr, trans := range c.transports {
+		trans.Close()
+		delete(c.transports, fullAddr)
+	}
+}
+
 func (c *ClientTransportMgr) getFullAddr(protocol string, host string, port int, transId string) string {
 	fullAddr := fmt.Sprintf("%s://%s", protocol, net.JoinHostPort(host, strconv.Itoa(port)))
 
-	if protocol == "tcp" && transId != "" {
+	if (protocol == "tcp" || protocol == "tls") && transId != "" {
 		fullAddr = fmt.Sprintf("%s-%s", fullAddr, transId)
 	}
 
@@ -490,12 +643,16 @@ func (c *ClientTransportMgr) createClientTransport(protocol string, host string,
 		} else {
 			return nil, err
 		}
-	case "tcp":
+	case "tcp", "tls":
 		addr := c.getFullAddr(protocol, host, port, "")
 		if trans, ok := c.transports[addr]; ok {
-			return NewFailOverClientTransport(nil, trans.secondaries), nil
+			return NewFailOverClientTransport(nil, trans.GetSecondaries()), nil
 		} else {
-			client, err = c.clientTransportFactory.CreateTCPClientTransport(host, port, localAddress, c.connectionEstablished)
+			if protocol == "tls" {
+				client, err = c.clientTransportFactory.CreateTLSClientTransport(host, port, localAddress, c.connectionEstablished)
+			} else {
+				client, err = c.clientTransportFactory.CreateTCPClientTransport(host, port, localAddress, c.connectionEstablished)
+			}
 			if err == nil {
 				c.transports[addr] = NewFailOverClientTransport(nil, []ClientTransport{client})
 				return c.transports[addr], nil
@@ -504,6 +661,8 @@ func (c *ClientTransportMgr) createClientTransport(protocol string, host string,
 			}
 		}
 
+	case "ws", "wss":
+		return nil, fmt.Errorf("no %s connection from %s", protocol, net.JoinHostPort(host, strconv.Itoa(port)))
 	default:
 		return nil, fmt.Errorf("not support %s", protocol)
 	}
@@ -550,6 +709,15 @@ func NewTCPClientTransport(resolver *PreConfigHostResolver, host string, port in
 	}, nil
 }
 
+// NewTLSClientTransport create a TLS client transport with the specified host and port
+func NewTLSClientTransport(resolver *PreConfigHostResolver, host string, port int, localAddress string, tlsConfig *tls.Config, connectionEstablished ConnectionEstablishedFunc) (*TCPClientTransport, error) {
+	t, err := NewTCPClientTransport(resolver, host, port, localAddress, connectionEstablished)
+	if err == nil {
+		t.tlsConfig = tlsConfig
+	}
+	return t, err
+}
+
 func NewTCPClientTransportWithConn(conn net.Conn) (*TCPClientTransport, error) {
 	zap.L().Info("create TCPClientTransportWithConn", zap.String("remoteAddr", conn.RemoteAddr().String()))
 	host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
@@ -570,6 +738,8 @@ func (t *TCPClientTransport) Send(msg *Message) error {
 	}
 
 	callId, _ := msg.GetCallID()
+	t.Lock()
+	defer t.Unlock()
 	for range 2 {
 		if t.conn == nil && t.reconnectable {
 			if t.createConnection() != nil {
@@ -581,6 +751,7 @@ func (t *TCPClientTransport) Send(msg *Message) error {
 		}
 		_, err := t.conn.Write(b)
 		if err == nil {
+			messageSent(getConnProtocol(t.conn), getListenLabel(t.conn.LocalAddr(), t.reconnectable), msg)
 			zap.L().Info("Succeed to send message to TCP server", zap.String("host", t.host), zap.String("port", t.port), zap.Bool("request", msg.IsRequest()), zap.String("call-id", callId))
 			return nil
 		}
@@ -607,12 +778,22 @@ func (t *TCPClientTransport) createConnection() error {
 			continue
 		}
 		zap.L().Info("Try to connect TCP server with ip", zap.String("host", t.host), zap.String("port", t.port), zap.String("hostIp", ip), zap.String("localAddress", t.localAddress))
-		conn, err := net.DialTCP("tcp", laddr, raddr)
+		var conn net.Conn
+		conn, err = net.DialTCP("tcp", laddr, raddr)
 		if err != nil {
 			zap.L().Error("Fail to make TCP dial to remote address", zap.String("remoteAddress", raddr.String()))
 			continue
 		}
-		zap.L().Info("Succeed to connect tcp server", zap.String("host", t.host), zap.String("port", t.port), zap.String("hostIp", ip))
+		if t.tlsConfig != nil {
+			tlsConn, err := tlsHandshake(conn, t.tlsConfig, tlsHandshakeTimeout)
+			if err != nil {
+				zap.L().Error("Fail to make TLS handshake with remote address", zap.String("remoteAddress", raddr.String()), zap.String("error", err.Error()))
+				conn.Close()
+				continue
+			}
+			conn = tlsConn
+		}
+		zap.L().Info("Succeed to connect tcp server", zap.String("host", t.host), zap.String("port", t.port), zap.String("hostIp", ip), zap.Bool("tls", t.tlsConfig != nil))
 		t.conn = conn
 		if t.connectionEstablished != nil {
 			t.connectionEstablished(conn)
@@ -623,6 +804,23 @@ func (t *TCPClientTransport) createConnection() error {
 	zap.L().Error("Fail to connect tcp server", zap.String("host", t.host), zap.String("port", t.port))
 	return fmt.Errorf("fail to connect tcp server " + t.host + ":" + t.port)
 }
+
+// tlsHandshakeTimeout is the max time to make the TLS handshake with the peer, the
+// sender is blocked during the handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsHandshake make the client TLS handshake on the connection in the timeout, the
+// deadline is cleared after the handshake
+func tlsHandshake(conn net.Conn, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
 func (t *TCPClientTransport) resolveHost() ([]string, error) {
 	if t.resolver != nil {
 		return t.resolver.GetIps(t.host)
@@ -633,6 +831,17 @@ func (t *TCPClientTransport) IsExpired() bool {
 	return t.expire > 0 && time.Now().Unix() > t.expire
 }
 
+// Close close the connection and it is not reconnected anymore
+func (t *TCPClientTransport) Close() {
+	t.Lock()
+	defer t.Unlock()
+	t.reconnectable = false
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
 func NewUDPServerTransport(addr string, port int, receivedSupport bool, selfLearnRoute *SelfLearnRoute, via *ViaConfig, backend Backend) (*UDPServerTransport, error) {
 
 	zap.L().Info("Create new UDP server transport", zap.String("addr", addr), zap.Int("port", port))
@@ -666,6 +875,7 @@ func (u *UDPServerTransport) Send(host string, port int, msg *Message) error {
 	n, err := u.conn.WriteToUDP(b, remoteAddr)
 	callId, _ := msg.GetCallID()
 	if err == nil {
+		messageSent("udp", fmt.Sprintf("%s:%d", u.GetAddress(), u.GetPort()), msg)
 		zap.L().Info("Succeed to send message through UDP", zap.Int("length", n), zap.String("localAddr", u.conn.LocalAddr().String()), zap.String("remoteAddress", remoteAddr.String()), zap.String("call-id", callId))
 	} else {
 		zap.L().Error("Fail to send message", zap.String("localAddr", u.localAddr.String()), zap.String("remoteAddress", remoteAddr.String()), zap.String("call-id", callId), zap.String("error", err.Error()))
@@ -682,6 +892,9 @@ func (u *UDPServerTransport) Start(msgHandler MessageHandler) error {
 	}
 	u.conn = conn
 	zap.L().Info("Success to listen on UDP", zap.String("localAddr", u.localAddr.String()))
+	u.queueDepthId = queueDepths.Add(func() float64 {
+		return float64(len(u.msgParseChannel))
+	}, "udp-parse", u.localAddr.String())
 	go u.startParseMessage()
 	go u.receiveMessage()
 	return nil
@@ -691,6 +904,10 @@ func (u *UDPServerTransport) receiveMessage() {
 	for {
 		buf := u.msgBufPool.Alloc()
 		n, peerAddr, err := u.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			zap.L().Info("UDP server transport is stopped", zap.String("localAddr", u.localAddr.String()))
+			break
+		}
 		if err != nil {
 			zap.L().Error("Fail to read data", zap.String("localAddr", u.localAddr.String()), zap.String("error", err.Error()))
 			break
@@ -698,16 +915,41 @@ func (u *UDPServerTransport) receiveMessage() {
 		address := peerAddr.IP.String()
 		port := peerAddr.Port
 		zap.L().Info("a UDP packet is received", zap.Int("length", n), zap.String("localAddr", u.localAddr.String()), zap.String("remoteAddr", peerAddr.String()))
+		if allowed, drop := u.acl.Check(address); !allowed {
+			if drop {
+				zap.L().Info("drop the packet from denied source", zap.String("localAddr", u.localAddr.String()), zap.String("remoteAddr", peerAddr.String()))
+				u.msgBufPool.Free(buf)
+				continue
+			}
+			u.msgParseChannel <- SizedByteArray{b: buf, n: n, msgHandler: func(msg *Message) {
+				u.rejectDenied(msg, peerAddr)
+			}}
+			continue
+		}
 		u.msgParseChannel <- SizedByteArray{b: buf, n: n, msgHandler: func(msg *Message) {
 			u.msgHandler.HandleRawMessage(NewRawMessage(address, port, u, u.receivedSupport, msg, u.backend, u.via))
 		}}
 
 	}
+	close(u.msgParseChannel)
+}
+
+// rejectDenied answer the request from the denied source with 403 without passing it
+// to the proxy
+func (u *UDPServerTransport) rejectDenied(msg *Message, peerAddr *net.UDPAddr) {
+	if b, ok := createForbiddenResponse(msg); ok {
+		zap.L().Info("reject the request from denied source", zap.String("localAddr", u.localAddr.String()), zap.String("remoteAddr", peerAddr.String()))
+		u.conn.WriteToUDP(b, peerAddr)
+	}
+}
+
+// SetAccessList set the sources allowed to send to the transport
+func (u *UDPServerTransport) SetAccessList(acl *AccessList) {
+	u.acl = acl
 }
 
 func (u *UDPServerTransport) startParseMessage() {
-	for {
-		sized_byte_array := <-u.msgParseChannel
+	for sized_byte_array := range u.msgParseChannel {
 		reader := bufio.NewReaderSize(bytes.NewBuffer(sized_byte_array.b), sized_byte_array.n)
 		msg, err := ParseMessage(reader)
 		u.msgBufPool.Free(sized_byte_array.b)
@@ -736,6 +978,13 @@ func (u *UDPServerTransport) IsExit() bool {
 	return false
 }
 
+func (u *UDPServerTransport) Stop() {
+	if u.conn != nil {
+		u.conn.Close()
+		queueDepths.Remove(u.queueDepthId)
+	}
+}
+
 func NewTCPServerTransport(addr string,
 	port int,
 	receivedSupport bool,
@@ -745,6 +994,7 @@ func NewTCPServerTransport(addr string,
 	backend Backend) *TCPServerTransport {
 	return &TCPServerTransport{addr: addr,
 		port:                 port,
+		protocol:             "tcp",
 		conn:                 nil,
 		receivedSupport:      receivedSupport,
 		connAcceptedListener: connAcceptedListener,
@@ -756,6 +1006,21 @@ func NewTCPServerTransport(addr string,
 	}
 }
 
+// NewTLSServerTransport create a server transport which accepts the TLS connections
+func NewTLSServerTransport(addr string,
+	port int,
+	receivedSupport bool,
+	connAcceptedListener ConnectionAcceptedListener,
+	selfLearnRoute *SelfLearnRoute,
+	via *ViaConfig,
+	backend Backend,
+	tlsConfig *tls.Config) *TCPServerTransport {
+	t := NewTCPServerTransport(addr, port, receivedSupport, connAcceptedListener, selfLearnRoute, via, backend)
+	t.protocol = "tls"
+	t.tlsConfig = tlsConfig
+	return t
+}
+
 func NewTCPServerTransportWithConn(conn net.Conn,
 	receivedSupport bool,
 	selfLearnRoute *SelfLearnRoute,
@@ -767,6 +1032,7 @@ func NewTCPServerTransportWithConn(conn net.Conn,
 		zap.L().Info("Create new TCP server transport", zap.String("remoteAddr", conn.RemoteAddr().String()), zap.String("localAddr", conn.LocalAddr().String()))
 		return &TCPServerTransport{addr: addr,
 			port:                 port_i,
+			protocol:             getConnProtocol(conn),
 			conn:                 conn,
 			receivedSupport:      receivedSupport,
 			connAcceptedListener: nil,
@@ -789,7 +1055,11 @@ func (t *TCPServerTransport) Start(msgHandler MessageHandler) error {
 			zap.L().Error("Fail to listen", zap.String("hostPort", hostPort))
 			return err
 		}
-		zap.L().Info("Succeed to listen on TCP", zap.String("hostPort", hostPort))
+		if t.tlsConfig != nil {
+			ln = tls.NewListener(ln, t.tlsConfig)
+		}
+		zap.L().Info("Succeed to listen on TCP", zap.String("hostPort", hostPort), zap.String("protocol", t.protocol))
+		t.listener = ln
 		go t.acceptConnection(ln)
 	} else {
 		go t.receiveMessage(t.conn)
@@ -802,6 +1072,16 @@ func (t *TCPServerTransport) acceptConnection(ln net.Listener) {
 		conn, err := ln.Accept()
 		if err == nil {
 			zap.L().Info("Accept a connection", zap.String("localAddr", ln.Addr().String()), zap.String("remoteAddr", conn.RemoteAddr().String()))
+			peerAddr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if allowed, drop := t.acl.Check(peerAddr); !allowed {
+				if drop {
+					zap.L().Info("close the connection from denied source", zap.String("localAddr", ln.Addr().String()), zap.String("remoteAddr", conn.RemoteAddr().String()))
+					conn.Close()
+				} else {
+					go t.rejectConnection(conn)
+				}
+				continue
+			}
 			t.connAcceptedListener.ConnectionAccepted(conn)
 			go t.receiveMessage(conn)
 		} else {
@@ -812,6 +1092,30 @@ func (t *TCPServerTransport) acceptConnection(ln net.Listener) {
 
 }
 
+// deniedConnectionTimeout is the time given to the denied source to send its request
+const deniedConnectionTimeout = 5 * time.Second
+
+// rejectConnection answer the first request from the denied source with 403 and close
+// the connection, it is closed without answer if no request is received in
+// deniedConnectionTimeout. The messages are not passed to the proxy
+func (t *TCPServerTransport) rejectConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(deniedConnectionTimeout))
+	msg, err := ParseMessage(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	if b, ok := createForbiddenResponse(msg); ok {
+		zap.L().Info("reject the request from denied source", zap.String("localAddr", conn.LocalAddr().String()), zap.String("remoteAddr", conn.RemoteAddr().String()))
+		conn.Write(b)
+	}
+}
+
+// SetAccessList set the sources allowed to connect the transport
+func (t *TCPServerTransport) SetAccessList(acl *AccessList) {
+	t.acl = acl
+}
+
 func (t *TCPServerTransport) receiveMessage(conn net.Conn) {
 	reader := bufio.NewReader(conn)
 	peerAddr, remotePort, _ := net.SplitHostPort(conn.RemoteAddr().String())
@@ -844,7 +1148,7 @@ func (t *TCPServerTransport) Send(host string, port int, message *Message) error
 }
 
 func (t *TCPServerTransport) GetProtocol() string {
-	return "tcp"
+	return t.protocol
 }
 
 func (t *TCPServerTransport) GetAddress() string {
@@ -859,3 +1163,9 @@ func (u *TCPServerTransport) IsExit() bool {
 	return u.conn != nil && u.exit
 }
 
+func (t *TCPServerTransport) Stop() {
+	if t.listener != nil {
+		t.listener.Close()
+	}
+}
+
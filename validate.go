@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError is an error in the configuration file at the line
+type ConfigError struct {
+	Line    int
+	Message string
+}
+
+// ConfigErrors is all the errors found in the configuration file
+type ConfigErrors []ConfigError
+
+func (e ConfigError) Error() string {
+	if e.Line <= 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+func (e ConfigErrors) Error() string {
+	s := make([]string, 0, len(e))
+	for _, err := range e {
+		s = append(s, err.Error())
+	}
+	return strings.Join(s, "\n")
+}
+
+// configValidator check the loaded configuration, the line of the error is found in
+// the yaml node tree by the path of the invalid value
+type configValidator struct {
+	root   *yaml.Node
+	errors ConfigErrors
+	// the first path of every listener, used to find the duplicate listeners
+	listeners map[string][]any
+}
+
+// parseConfig parse the configuration and reject the unknown keys and the invalid values
+func parseConfig(data []byte) (*ProxiesConfigure, error) {
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(data, root); err != nil {
+		return nil, err
+	}
+	config := &ProxiesConfigure{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		var typeError *yaml.TypeError
+		if errors.As(err, &typeError) {
+			return nil, toConfigErrors(typeError)
+		}
+		return nil, err
+	}
+	v := &configValidator{root: root, listeners: make(map[string][]any)}
+	v.validate(config)
+	if len(v.errors) > 0 {
+		return nil, v.errors
+	}
+	return config, nil
+}
+
+// toConfigErrors convert the "line N: message" errors of yaml to ConfigErrors
+func toConfigErrors(typeError *yaml.TypeError) ConfigErrors {
+	r := make(ConfigErrors, 0)
+	for _, s := range typeError.Errors {
+		var line int
+		if n, err := fmt.Sscanf(s, "line %d:", &line); n == 1 && err == nil {
+			r = append(r, ConfigError{Line: line, Message: strings.TrimSpace(s[strings.Index(s, ":")+1:])})
+		} else {
+			r = append(r, ConfigError{Message: s})
+		}
+	}
+	return r
+}
+
+// getLine get the line of the node at the path, the path is made of the keys of the
+// mappings and the indexes of the sequences. The line of the deepest existing node is
+// returned if the path is not complete
+func (v *configValidator) getLine(path []any) int {
+	node := v.root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, p := range path {
+		var next *yaml.Node
+		switch key := p.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == key {
+						next = node.Content[i+1]
+						break
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && key < len(node.Content) {
+				next = node.Content[key]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
+
+func (v *configValidator) addError(path []any, format string, args ...any) {
+	v.errors = append(v.errors, ConfigError{Line: v.getLine(path), Message: fmt.Sprintf(format, args...)})
+}
+
+// subPath create a new path under the path
+func subPath(path []any, sub ...any) []any {
+	return append(slices.Clone(path), sub...)
+}
+
+func (v *configValidator) validate(config *ProxiesConfigure) {
+	if config.Admin.Addr != "" {
+		if _, _, err := net.SplitHostPort(config.Admin.Addr); err != nil {
+			v.addError([]any{"admin", "addr"}, "invalid admin address %s, expect host:port", config.Admin.Addr)
+		}
+	}
+	v.validateHosts([]any{"hosts"}, config.Hosts)
+	names := make(map[string]bool)
+	for i, proxyConfig := range config.Proxies {
+		path := []any{"proxies", i}
+		if names[proxyConfig.Name] {
+			v.addError(subPath(path, "name"), "duplicate proxy name %s", proxyConfig.Name)
+		}
+		names[proxyConfig.Name] = true
+		v.validateProxy(path, proxyConfig)
+	}
+}
+
+func (v *configValidator) validateProxy(path []any, config ProxyConfig) {
+	if config.Name == "" {
+		v.addError(path, "the name of proxy is empty")
+	}
+	for _, name := range strings.Split(config.Name, ",") {
+		if _, err := regexp.Compile(strings.TrimSpace(name)); err != nil {
+			v.addError(subPath(path, "name"), "invalid regular expression %s in name: %v", name, err)
+		}
+	}
+	if config.DialogTimeout < 0 {
+		v.addError(subPath(path, "dialog-timeout"), "dialog-timeout must not be negative")
+	}
+	if config.Workers < 0 {
+		v.addError(subPath(path, "workers"), "workers must not be negative")
+	}
+	if config.RedisSessionStore != nil && len(config.RedisSessionStore.Addresses) == 0 {
+		v.addError(subPath(path, "redis-session-store"), "no addresses in redis-session-store")
+	}
+	if config.ACL != nil {
+		v.validateACL(subPath(path, "acl"), config.ACL)
+	}
+	v.validateHeaderRules(subPath(path, "header-rules"), config.HeaderRules)
+	if config.RateLimit != nil {
+		v.validateRateLimit(subPath(path, "rate-limit"), config.RateLimit)
+	}
+	if config.Registrar != nil {
+		v.validateRegistrar(subPath(path, "registrar"), config.Registrar)
+	}
+	v.validateTrunks(subPath(path, "trunks"), config.Trunks, config.Listens)
+	if config.Redirect != nil {
+		v.validateRedirect(subPath(path, "redirect"), config.Redirect)
+	}
+	for i, listen := range config.Listens {
+		v.validateListen(subPath(path, "listens", i), listen)
+	}
+	preConfigRoute := NewPreConfigRoute()
+	for i, route := range config.Route {
+		routePath := subPath(path, "route", i)
+		if route.Protocol != "" {
+			if _, ok := DialableProtocol[strings.ToLower(route.Protocol)]; !ok {
+				v.addError(subPath(routePath, "protocol"), "unsupported protocol %s", route.Protocol)
+			}
+		}
+		if route.NextHop == "" && len(route.NextHops) == 0 {
+			v.addError(routePath, "no nexthop in route")
+		}
+		for j, dest := range route.Dests {
+			if _, err := regexp.Compile(preConfigRoute.toRegularExp(dest)); err != nil {
+				v.addError(subPath(routePath, "dests", j), "invalid dest %s: %v", dest, err)
+			}
+		}
+		if _, err := NewPreRouteItem(route.Protocol, "", route.NextHop); route.NextHop != "" && err != nil {
+			v.addError(subPath(routePath, "nexthop"), "invalid nexthop %s, expect host or host:port", route.NextHop)
+		}
+		for j, nextHop := range route.NextHops {
+			if _, err := NewPreRouteItem(route.Protocol, "", nextHop); nextHop == "" || err != nil {
+				v.addError(subPath(routePath, "nexthops", j), "invalid nexthop %s, expect host or host:port", nextHop)
+			}
+		}
+		v.validateFork(routePath, route.Fork, route.BranchTimeout)
+	}
+	v.validateHosts(subPath(path, "hosts"), config.Hosts)
+}
+
+func (v *configValidator) validateListen(path []any, listen ListenConfig) {
+	if listen.Address == "" {
+		v.addError(path, "no address in listen")
+	}
+	if listen.Via != "" && createViaConfig(listen.Via) == nil {
+		v.addError(subPath(path, "via"), "invalid via %s, expect protocol://host:port and protocol is one of udp, tcp, tls", listen.Via)
+	}
+	ports := []struct {
+		key      string
+		protocol string
+		port     int
+	}{{"udp-port", "udp", listen.UdpPort},
+		{"tcp-port", "tcp", listen.TcpPort},
+		{"tls-port", "tls", listen.TlsPort},
+		{"ws-port", "ws", listen.WsPort},
+		{"wss-port", "wss", listen.WssPort}}
+	listening := false
+	for _, p := range ports {
+		if p.port == 0 {
+			continue
+		}
+		if p.port < 0 || p.port > 65535 {
+			v.addError(subPath(path, p.key), "invalid %s %d", p.key, p.port)
+			continue
+		}
+		listening = true
+		// tcp, tls, ws and wss listen on tcp ports
+		network := p.protocol
+		if network != "udp" {
+			network = "tcp"
+		}
+		key := fmt.Sprintf("%s/%s", network, net.JoinHostPort(listen.Address, strconv.Itoa(p.port)))
+		if first, ok := v.listeners[key]; ok {
+			v.addError(subPath(path, p.key), "duplicate listener %s %s:%d, it is also listened at line %d", p.protocol, listen.Address, p.port, v.getLine(first))
+		} else {
+			v.listeners[key] = subPath(path, p.key)
+		}
+		if (p.protocol == "tls" || p.protocol == "wss") && (listen.TLS == nil || listen.TLS.Cert == "" || listen.TLS.Key == "") {
+			v.addError(subPath(path, p.key), "no tls cert and key for %s", p.key)
+		}
+	}
+	if !listening {
+		v.addError(path, "no port is listened")
+	}
+	if _, err := ParseBackendPolicy(listen.Policy); err != nil {
+		v.addError(subPath(path, "policy"), "%v", err)
+	}
+	for i, backend := range listen.Backends {
+		backendPath := subPath(path, "backends", i)
+		if err := validateBackendAddress(backend.Address); err != nil {
+			v.addError(subPath(backendPath, "address"), "%v", err)
+		}
+		if backend.Weight < 0 {
+			v.addError(subPath(backendPath, "weight"), "weight must not be negative")
+		}
+	}
+	for i, origin := range listen.WsAllowedOrigins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || u.Scheme == "" || u.Host == "") {
+			v.addError(subPath(path, "ws-allowed-origins", i), "invalid WebSocket origin %s", origin)
+		}
+	}
+	if listen.HealthCheck != nil {
+		for i, code := range listen.HealthCheck.FailureCodes {
+			if code < 200 || code > 699 {
+				v.addError(subPath(path, "health-check", "failure-codes", i), "invalid health check status code %d", code)
+			}
+		}
+	}
+	if listen.Failover != nil {
+		for i, code := range listen.Failover.Codes {
+			if code < 300 || code > 699 {
+				v.addError(subPath(path, "failover", "codes", i), "invalid failover status code %d", code)
+			}
+		}
+	}
+	if listen.Auth != nil {
+		v.validateAuth(subPath(path, "auth"), listen.Auth)
+	}
+	if listen.ACL != nil {
+		v.validateACL(subPath(path, "acl"), listen.ACL)
+	}
+	v.validateHeaderRules(subPath(path, "header-rules"), listen.HeaderRules)
+}
+
+func (v *configValidator) validateHeaderRules(path []any, rules []HeaderRuleConfig) {
+	for i, rule := range rules {
+		rulePath := subPath(path, i)
+		if _, err := parseHeaderRuleDirection(rule.Direction); err != nil {
+			v.addError(subPath(rulePath, "direction"), "%v", err)
+		}
+		for j, source := range rule.Sources {
+			if _, err := parseIPNets([]string{source}); err != nil {
+				v.addError(subPath(rulePath, "sources", j), "%v", err)
+			}
+		}
+		for _, header := range slices.Sorted(maps.Keys(rule.Headers)) {
+			pattern := rule.Headers[header]
+			if _, err := regexp.Compile(pattern); err != nil {
+				v.addError(subPath(rulePath, "headers", header), "invalid pattern %s of header %s: %v", pattern, header, err)
+			}
+		}
+		if len(rule.Actions) == 0 {
+			v.addError(rulePath, "no actions in header rule")
+		}
+		for j, action := range rule.Actions {
+			if _, err := compileHeaderAction(action); err != nil {
+				v.addError(subPath(rulePath, "actions", j), "%v", err)
+			}
+		}
+	}
+}
+
+func (v *configValidator) validateACL(path []any, acl *ACLConfig) {
+	lists := []struct {
+		key   string
+		addrs []string
+	}{{"allow", acl.Allow}, {"deny", acl.Deny}}
+	for _, list := range lists {
+		for i, addr := range list.addrs {
+			if _, err := parseIPNets([]string{addr}); err != nil {
+				v.addError(subPath(path, list.key, i), "%v", err)
+			}
+		}
+	}
+	if _, err := parseACLAction(acl.Action); err != nil {
+		v.addError(subPath(path, "action"), "%v", err)
+	}
+}
+
+func (v *configValidator) validateAuth(path []any, auth *AuthConfig) {
+	if auth.Realm == "" {
+		v.addError(path, "no realm in auth")
+	}
+	if auth.CredentialsFile == "" && auth.LookupURL == "" {
+		v.addError(path, "no credentials-file or lookup-url in auth")
+	}
+	if auth.CredentialsFile != "" {
+		if _, err := loadCredentials(auth.CredentialsFile); err != nil {
+			v.addError(subPath(path, "credentials-file"), "%v", err)
+		}
+	}
+	if auth.LookupURL != "" {
+		if u, err := url.Parse(auth.LookupURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.addError(subPath(path, "lookup-url"), "invalid lookup-url %s, expect http or https url", auth.LookupURL)
+		}
+	}
+	for i, algorithm := range auth.Algorithms {
+		if _, err := parseDigestAlgorithms([]string{algorithm}); err != nil {
+			v.addError(subPath(path, "algorithms", i), "%v", err)
+		}
+	}
+	for i, source := range auth.Trusted {
+		if _, err := parseIPNets([]string{source}); err != nil {
+			v.addError(subPath(path, "trusted", i), "%v", err)
+		}
+	}
+	if auth.NonceExpire < 0 {
+		v.addError(subPath(path, "nonce-expire"), "nonce-expire must not be negative")
+	}
+	if auth.LookupCacheExpire < 0 {
+		v.addError(subPath(path, "lookup-cache-expire"), "lookup-cache-expire must not be negative")
+	}
+}
+
+func (v *configValidator) validateRateLimit(path []any, config *RateLimitConfig) {
+	limits := []*RateLimit{config.Invite, config.Register, config.Other}
+	for i, class := range RateLimitClasses {
+		if limits[i] == nil {
+			continue
+		}
+		if err := validateRateLimit(limits[i]); err != nil {
+			v.addError(subPath(path, class), "invalid rate limit of %s: %v", class, err)
+		}
+	}
+	for i, addr := range config.Exempt {
+		if _, err := parseIPNets([]string{addr}); err != nil {
+			v.addError(subPath(path, "exempt", i), "%v", err)
+		}
+	}
+	settings := []struct {
+		key   string
+		value int
+	}{{"retry-after", config.RetryAfter},
+		{"block-threshold", config.BlockThreshold},
+		{"block-window", config.BlockWindow},
+		{"block-time", config.BlockTime}}
+	for _, setting := range settings {
+		if setting.value < 0 {
+			v.addError(subPath(path, setting.key), "%s must not be negative", setting.key)
+		}
+	}
+}
+
+func (v *configValidator) validateHosts(path []any, hosts []HostIp) {
+	for i, host := range hosts {
+		if host.Name == "" {
+			v.addError(subPath(path, i), "no name in host")
+		}
+		if net.ParseIP(host.Ip) == nil {
+			v.addError(subPath(path, i, "ip"), "invalid ip %s of host %s", host.Ip, host.Name)
+		}
+	}
+}
+
+// validateBackendAddress check the backend address is in protocol://host[:port] format
+func validateBackendAddress(address string) error {
+	u, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("invalid backend address %s: %v", address, err)
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "tls" {
+		return fmt.Errorf("unsupported protocol of backend address %s, must be udp, tcp or tls", address)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("no host in backend address %s", address)
+	}
+	if pos := strings.LastIndex(u.Host, ":"); pos != -1 && !strings.HasSuffix(u.Host, "]") {
+		if port, err := strconv.Atoi(u.Host[pos+1:]); err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port in backend address %s", address)
+		}
+	}
+	return nil
+}
+
+func (v *configValidator) validateRegistrar(path []any, config *RegistrarConfig) {
+	if len(config.Domains) == 0 {
+		v.addError(path, "no domains in registrar")
+	}
+	settings := []struct {
+		key   string
+		value int
+	}{{"default-expires", config.DefaultExpires},
+		{"min-expires", config.MinExpires},
+		{"max-expires", config.MaxExpires}}
+	for _, setting := range settings {
+		if setting.value < 0 {
+			v.addError(subPath(path, setting.key), "%s must not be negative", setting.key)
+		}
+	}
+	if config.MinExpires > 0 && config.MaxExpires > 0 && config.MinExpires > config.MaxExpires {
+		v.addError(subPath(path, "min-expires"), "min-expires %d is greater than max-expires %d", config.MinExpires, config.MaxExpires)
+	}
+	v.validateFork(path, config.Fork, config.BranchTimeout)
+}
+
+// validateFork check the fork mode and the branch timeout of the route or registrar
+func (v *configValidator) validateFork(path []any, fork string, branchTimeout int) {
+	if fork != "" && !strings.EqualFold(fork, forkParallel) && !strings.EqualFold(fork, forkSequential) {
+		v.addError(subPath(path, "fork"), "invalid fork %s, expect %s or %s", fork, forkParallel, forkSequential)
+	}
+	if branchTimeout < 0 {
+		v.addError(subPath(path, "branch-timeout"), "branch-timeout must not be negative")
+	}
+}
+
+func (v *configValidator) validateRedirect(path []any, config *RedirectConfig) {
+	if config.MaxRedirects < 0 {
+		v.addError(subPath(path, "max-redirects"), "max-redirects must not be negative")
+	}
+	for i, code := range config.Codes {
+		if code < 300 || code > 399 {
+			v.addError(subPath(path, "codes", i), "invalid redirect code %d, expect 3xx", code)
+		}
+	}
+}
+
+func (v *configValidator) validateTrunks(path []any, trunks []TrunkConfig, listens []ListenConfig) {
+	names := make(map[string]bool)
+	for i, trunk := range trunks {
+		trunkPath := subPath(path, i)
+		if trunk.Name == "" {
+			v.addError(trunkPath, "no name in trunk")
+		} else if names[trunk.Name] {
+			v.addError(subPath(trunkPath, "name"), "duplicate trunk name %s", trunk.Name)
+		}
+		names[trunk.Name] = true
+		if trunk.Registrar == "" {
+			v.addError(trunkPath, "no registrar in trunk")
+		} else if _, err := NewPreRouteItem("", "", trunk.Registrar); err != nil {
+			v.addError(subPath(trunkPath, "registrar"), "invalid registrar %s, expect host or host:port", trunk.Registrar)
+		}
+		if aor, err := ParseSipURI(trunk.AOR); err != nil || aor.User == "" {
+			v.addError(subPath(trunkPath, "aor"), "invalid aor %s, expect sip:user@domain", trunk.AOR)
+		}
+		if trunk.Expires < 0 {
+			v.addError(subPath(trunkPath, "expires"), "expires must not be negative")
+		}
+		transport := strings.ToLower(trunk.Transport)
+		if transport == "" {
+			transport = "udp"
+		}
+		listening := slices.ContainsFunc(listens, func(listen ListenConfig) bool {
+			return (transport == "udp" && listen.UdpPort > 0) || (transport == "tcp" && listen.TcpPort > 0) || (transport == "tls" && listen.TlsPort > 0)
+		})
+		if transport != "udp" && transport != "tcp" && transport != "tls" {
+			v.addError(subPath(trunkPath, "transport"), "unsupported transport %s, expect udp, tcp or tls", trunk.Transport)
+		} else if !listening {
+			v.addError(trunkPath, "no %s listen to register the trunk", transport)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseConfigRejectsUnknownKey(t *testing.T) {
+	s := `proxies:
+- name: test.com
+  listens:
+  - address: 127.0.0.1
+    udp_port: 5060
+`
+	_, err := parseConfig([]byte(s))
+	var configErrors ConfigErrors
+	if !errors.As(err, &configErrors) || len(configErrors) != 1 || configErrors[0].Line != 5 {
+		t.Errorf("the unknown key is not rejected at line 5: %v", err)
+	}
+}
+
+func TestParseConfigRejectsInvalidValues(t *testing.T) {
+	s := `proxies:
+- name: test(.com
+  listens:
+  - address: 127.0.0.1
+    udp-port: 5060
+    via: udp//127.0.0.1
+    backends:
+    - address: sctp://127.0.0.1:5070
+    - address: udp://127.0.0.1:50x
+  - address: 127.0.0.1
+    udp-port: 5060
+  route:
+  - dests:
+    - a(b
+    protocol: sctp
+    nexthop: 10.0.0.1:5060
+  - dests:
+    - b.com
+    protocol: ws
+    nexthop: 10.0.0.1:5060
+`
+	_, err := parseConfig([]byte(s))
+	var configErrors ConfigErrors
+	if !errors.As(err, &configErrors) {
+		t.Fatalf("the invalid values are not rejected: %v", err)
+	}
+	lines := make(map[int]bool)
+	for _, e := range configErrors {
+		lines[e.Line] = true
+	}
+	// name, via, backend protocol, backend port, duplicate listener, route dest and protocols
+	for _, line := range []int{2, 6, 8, 9, 11, 14, 15, 19} {
+		if !lines[line] {
+			t.Errorf("no error at line %d: %v", line, err)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	s := `admin:
+  addr: 127.0.0.1:8899
+proxies:
+- name: test.com,.+\.example\.com
+  listens:
+  - address: 127.0.0.1
+    udp-port: 5060
+    tcp-port: 5060
+    via: udp://10.0.0.1:5060
+    backends:
+    - address: udp://127.0.0.1:5070
+    - address: tcp://backend.test.com
+  - address: 10.0.0.1
+    udp-port: 5060
+    topology-hiding: true
+  route:
+  - dests:
+    - "*.test.com"
+    protocol: udp
+    nexthop: 10.0.0.1
+  - dests:
+    - default
+    nexthops:
+    - 10.0.0.2:5060
+    - 10.0.0.3:5060
+    fork: sequential
+    branch-timeout: 20
+`
+	if _, err := parseConfig([]byte(s)); err != nil {
+		t.Errorf("the valid configuration is rejected: %v", err)
+	}
+}
+
+func TestParseConfigRejectsInvalidAuth(t *testing.T) {
+	s := `proxies:
+- name: test.com
+  listens:
+  - address: 127.0.0.1
+    udp-port: 5060
+    auth:
+      algorithms:
+      - SHA-512
+      trusted:
+      - 10.0.0.0/33
+      lookup-url: ftp://users.test.com
+`
+	_, err := parseConfig([]byte(s))
+	var configErrors ConfigErrors
+	if !errors.As(err, &configErrors) {
+		t.Fatalf("the invalid auth is not rejected: %v", err)
+	}
+	lines := make(map[int]bool)
+	for _, e := range configErrors {
+		lines[e.Line] = true
+	}
+	// realm, algorithm, trusted source and lookup-url
+	for _, line := range []int{7, 8, 10, 11} {
+		if !lines[line] {
+			t.Errorf("no error at line %d: %v", line, err)
+		}
+	}
+}
+
+func TestParseConfigRejectsInvalidACL(t *testing.T) {
+	s := `proxies:
+- name: test.com
+  acl:
+    deny:
+    - 10.0.0.0/40
+    action: block
+  listens:
+  - address: 127.0.0.1
+    udp-port: 5060
+    acl:
+      allow:
+      - 192.168.1.x
+`
+	_, err := parseConfig([]byte(s))
+	var configErrors ConfigErrors
+	if !errors.As(err, &configErrors) || len(configErrors) != 3 {
+		t.Fatalf("the invalid acl is not rejected: %v", err)
+	}
+	for i, line := range []int{5, 6, 12} {
+		if configErrors[i].Line != line {
+			t.Errorf("expect error at line %d but get %v", line, configErrors[i])
+		}
+	}
+}
+
+func TestParseConfigRejectsInvalidRateLimit(t *testing.T) {
+	s := `proxies:
+- name: test.com
+  rate-limit:
+    invite:
+      rate: 0
+    other:
+      rate: 10
+      burst: -1
+    block-time: -5
+  listens:
+  - address: 127.0.0.1
+    udp-port: 5060
+`
+	_, err := parseConfig([]byte(s))
+	var configErrors ConfigErrors
+	if !errors.As(err, &configErrors) || len(configErrors) != 3 {
+		t.Fatalf("the invalid rate-limit is not rejected: %v", err)
+	}
+	for i, line := range []int{5, 7, 9} {
+		if configErrors[i].Line != line {
+			t.Errorf("expect error at line %d but get %v", line, configErrors[i])
+		}
+	}
+}
+
+func TestParseConfigRejectsInvalidRegistrar(t *testing.T) {
+	s := `proxies:
+- name: test.com
+  registrar:
+    domains: []
+    min-expires: 600
+    max-expires: 60
+  listens:
+  - address: 127.0.0.1
+    udp-port: 5060
+`
+	_, err := parseConfig([]byte(s))
+	var configErrors ConfigErrors
+	if !errors.As(err, &configErrors) || len(configErrors) != 2 {
+		t.Fatalf("the invalid registrar is not rejected: %v", err)
+	}
+	for i, line := range []int{4, 5} {
+		if configErrors[i].Line != line {
+			t.Errorf("expect error at line %d but get %v", line, configErrors[i])
+		}
+	}
+}
+
+func TestParseConfigRejectsInvalidFork(t *testing.T) {
+	s := `proxies:
+- name: test.com
+  registrar:
+    domains:
+    - test.com
+    fork: round-robin
+  listens:
+  - address: 127.0.0.1
+    udp-port: 5060
+  route:
+  - dests:
+    - default
+    nexthops:
+    - 10.0.0.1:abc
+    - 10.0.0.2
+    fork: parallel
+    branch-timeout: -1
+`
+	_, err := parseConfig([]byte(s))
+	var configErrors ConfigErrors
+	if !errors.As(err, &configErrors) || len(configErrors) != 3 {
+		t.Fatalf("the invalid fork is not rejected: %v", err)
+	}
+	for i, line := range []int{6, 14, 17} {
+		if configErrors[i].Line != line {
+			t.Errorf("expect error at line %d but get %v", line, configErrors[i])
+		}
+	}
+}
+
+func TestParseConfigRejectsInvalidRedirect(t *testing.T) {
+	s := `proxies:
+- name: test.com
+  redirect:
+    max-redirects: -1
+    codes:
+    - 302
+    - 486
+  listens:
+  - address: 127.0.0.1
+    udp-port: 5060
+`
+	_, err := parseConfig([]byte(s))
+	var configErrors ConfigErrors
+	if !errors.As(err, &configErrors) || len(configErrors) != 2 {
+		t.Fatalf("the invalid redirect is not rejected: %v", err)
+	}
+	for i, line := range []int{4, 7} {
+		if configErrors[i].Line != line {
+			t.Errorf("expect error at line %d but get %v", line, configErrors[i])
+		}
+	}
+}
+
+func TestParseConfigRejectsInvalidHeaderRules(t *testing.T) {
+	s := `proxies:
+- name: test.com
+  header-rules:
+  - direction: inbound
+    actions:
+    - action: remove
+      header: User-Agent
+  listens:
+  - address: 127.0.0.1
+    udp-port: 5060
+    header-rules:
+    - sources:
+      - 10.0.0.300
+      headers:
+        User-Agent: "a(b"
+      actions:
+      - action: rewrite
+        header: From
+      - action: add
+        header: request-uri
+        value: sip:bob@test.com
+`
+	_, err := parseConfig([]byte(s))
+	var configErrors ConfigErrors
+	if !errors.As(err, &configErrors) || len(configErrors) != 5 {
+		t.Fatalf("the invalid header rules are not rejected: %v", err)
+	}
+	for i, line := range []int{4, 13, 15, 17, 19} {
+		if configErrors[i].Line != line {
+			t.Errorf("expect error at line %d but get %v", line, configErrors[i])
+		}
+	}
+}
+
+func TestParseConfigRejectsInvalidTrunks(t *testing.T) {
+	s := `proxies:
+- name: test.com
+  trunks:
+  - name: carrier
+    registrar: carrier.com:abc
+    aor: sip:carrier.com
+  - name: carrier
+    registrar: carrier.com
+    aor: sip:alice@carrier.com
+    transport: tcp
+  listens:
+  - address: 127.0.0.1
+    udp-port: 5060
+`
+	_, err := parseConfig([]byte(s))
+	var configErrors ConfigErrors
+	if !errors.As(err, &configErrors) || len(configErrors) != 4 {
+		t.Fatalf("the invalid trunks are not rejected: %v", err)
+	}
+	for i, line := range []int{5, 6, 7, 7} {
+		if configErrors[i].Line != line {
+			t.Errorf("expect error at line %d but get %v", line, configErrors[i])
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// WSServerTransport accept the SIP over WebSocket (RFC 7118) connections from the
+// WebRTC clients, each WebSocket message carries one SIP message
+type WSServerTransport struct {
+	addr            string
+	port            int
+	protocol        string
+	tlsConfig       *tls.Config
+	receivedSupport bool
+	selfLearnRoute  *SelfLearnRoute
+	via             *ViaConfig
+	backend         Backend
+	msgHandler      MessageHandler
+	upgrader        websocket.Upgrader
+	listener        net.Listener
+	// the sources allowed to connect the transport, nil if all are allowed
+	acl *AccessList
+	// the Origins of the browsers allowed to connect the transport, only the Origin with
+	// the same host as the request is allowed if it is empty
+	allowedOrigins []string
+}
+
+// WSClientTransport send the SIP message back to the peer over the accepted WebSocket
+// connection, the proxy can't connect the WebSocket clients by itself
+type WSClientTransport struct {
+	sync.Mutex
+	conn *websocket.Conn
+	// ws or wss
+	protocol string
+	closed   bool
+}
+
+// NewWSServerTransport create a ws server transport, it is a wss server transport
+// if tlsConfig is not nil
+func NewWSServerTransport(addr string,
+	port int,
+	receivedSupport bool,
+	selfLearnRoute *SelfLearnRoute,
+	via *ViaConfig,
+	backend Backend,
+	tlsConfig *tls.Config) *WSServerTransport {
+	protocol := "ws"
+	if tlsConfig != nil {
+		protocol = "wss"
+	}
+	t := &WSServerTransport{addr: addr,
+		port:            port,
+		protocol:        protocol,
+		tlsConfig:       tlsConfig,
+		receivedSupport: receivedSupport,
+		selfLearnRoute:  selfLearnRoute,
+		via:             via,
+		backend:         backend,
+		msgHandler:      nil,
+		upgrader:        websocket.Upgrader{Subprotocols: []string{"sip"}},
+	}
+	t.upgrader.CheckOrigin = t.checkOrigin
+	return t
+}
+
+func (t *WSServerTransport) Start(msgHandler MessageHandler) error {
+	t.msgHandler = msgHandler
+	hostPort := net.JoinHostPort(t.addr, strconv.Itoa(t.port))
+	ln, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		zap.L().Error("Fail to listen", zap.String("hostPort", hostPort))
+		return err
+	}
+	if t.tlsConfig != nil {
+		ln = tls.NewListener(ln, t.tlsConfig)
+	}
+	zap.L().Info("Succeed to listen on WebSocket", zap.String("hostPort", hostPort), zap.String("protocol", t.protocol))
+	t.listener = ln
+	go func() {
+		err := http.Serve(ln, t)
+		if err != nil {
+			zap.L().Error("WebSocket server exits", zap.String("hostPort", hostPort), zap.String("error", err.Error()))
+		}
+	}()
+	return nil
+}
+
+// ServeHTTP upgrade the http connection to WebSocket and receive the SIP messages from it
+func (t *WSServerTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	peerAddr, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if allowed, drop := t.acl.Check(peerAddr); !allowed {
+		zap.L().Info("reject the WebSocket connection from denied source", zap.String("remoteAddr", r.RemoteAddr), zap.Bool("drop", drop))
+		if hijacker, ok := w.(http.Hijacker); ok && drop {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	conn, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		zap.L().Error("Fail to upgrade to WebSocket", zap.String("remoteAddr", r.RemoteAddr), zap.String("error", err.Error()))
+		return
+	}
+	// RFC 7118 5.1: the "sip" subprotocol must be negotiated
+	if conn.Subprotocol() != "sip" {
+		zap.L().Error("The sip subprotocol is not negotiated", zap.String("remoteAddr", r.RemoteAddr))
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, "sip subprotocol is required"))
+		conn.Close()
+		return
+	}
+	t.receiveMessage(conn)
+}
+
+// SetAccessList set the sources allowed to connect the transport
+func (t *WSServerTransport) SetAccessList(acl *AccessList) {
+	t.acl = acl
+}
+
+// SetAllowedOrigins set the Origins of the browsers allowed to connect the transport,
+// "*" allows all the Origins
+func (t *WSServerTransport) SetAllowedOrigins(origins []string) {
+	t.allowedOrigins = origins
+}
+
+// checkOrigin check the Origin header of the WebSocket handshake. The clients other
+// than the browsers don't send the Origin and they are always allowed
+func (t *WSServerTransport) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(t.allowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range t.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	zap.L().Info("reject the WebSocket connection from not allowed origin", zap.String("remoteAddr", r.RemoteAddr), zap.String("origin", origin))
+	return false
+}
+
+func (t *WSServerTransport) receiveMessage(conn *websocket.Conn) {
+	peerAddr, remotePort, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	peerPort, _ := strconv.Atoi(remotePort)
+	client := NewWSClientTransport(conn, t.protocol)
+	zap.L().Info("start to receive sip message from WebSocket", zap.String("peerAddr", peerAddr), zap.String("peerPort", remotePort), zap.String("protocol", t.protocol))
+	defer func() {
+		client.Close()
+		if listener, ok := t.msgHandler.(ConnTransportClosedListener); ok {
+			listener.ConnTransportClosed(client)
+		}
+	}()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			zap.L().Info("WebSocket connection closed", zap.String("peerAddr", peerAddr), zap.String("peerPort", remotePort), zap.String("error", err.Error()))
+			return
+		}
+		msg, err := ParseMessage(bufio.NewReader(bytes.NewBuffer(data)))
+		if err != nil {
+			zap.L().Error("Fail to parse message from WebSocket", zap.String("peerAddr", peerAddr), zap.String("peerPort", remotePort), zap.String("error", err.Error()))
+			continue
+		}
+		msg.ReceivedFrom = t
+		rawMsg := NewRawMessage(peerAddr, peerPort, t, t.receivedSupport, msg, t.backend, t.via)
+		rawMsg.ConnTransport = client
+		t.msgHandler.HandleRawMessage(rawMsg)
+	}
+}
+
+// Send the message can only be sent through the WSClientTransport of the connection
+func (t *WSServerTransport) Send(host string, port int, message *Message) error {
+	return fmt.Errorf("no WebSocket connection to %s", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+func (t *WSServerTransport) GetProtocol() string {
+	return t.protocol
+}
+
+func (t *WSServerTransport) GetAddress() string {
+	return t.addr
+}
+
+func (t *WSServerTransport) GetPort() int {
+	return t.port
+}
+
+func (t *WSServerTransport) IsExit() bool {
+	return false
+}
+
+func (t *WSServerTransport) Stop() {
+	if t.listener != nil {
+		t.listener.Close()
+	}
+}
+
+func NewWSClientTransport(conn *websocket.Conn, protocol string) *WSClientTransport {
+	return &WSClientTransport{conn: conn, protocol: protocol, closed: false}
+}
+
+// Send send one SIP message in one WebSocket text message
+func (c *WSClientTransport) Send(msg *Message) error {
+	b, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return fmt.Errorf("WebSocket connection to %s is closed", c.conn.RemoteAddr().String())
+	}
+	callId, _ := msg.GetCallID()
+	err = c.conn.WriteMessage(websocket.TextMessage, b)
+	if err == nil {
+		messageSent(c.protocol, getListenLabel(c.conn.LocalAddr(), false), msg)
+		zap.L().Info("Succeed to send message through WebSocket", zap.String("remoteAddr", c.conn.RemoteAddr().String()), zap.String("call-id", callId))
+	} else {
+		zap.L().Error("Fail to send message through WebSocket", zap.String("remoteAddr", c.conn.RemoteAddr().String()), zap.String("call-id", callId), zap.String("error", err.Error()))
+	}
+	return err
+}
+
+// IsExpired the transport is expired after the WebSocket connection is closed
+func (c *WSClientTransport) IsExpired() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
+func (c *WSClientTransport) Close() {
+	c.Lock()
+	defer c.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.conn.Close()
+	}
+}
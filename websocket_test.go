@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWSServerTransport(t *testing.T) {
+	collector := &rawMessageCollector{messages: make(chan *RawMessage, 1)}
+	server := NewWSServerTransport("127.0.0.1", 15461, false, NewSelfLearnRoute(), nil, nil, nil)
+	if err := server.Start(collector); err != nil {
+		t.Fatal(err)
+	}
+	dialer := websocket.Dialer{Subprotocols: []string{"sip"}}
+	conn, _, err := dialer.Dial("ws://127.0.0.1:15461", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := createTestRequest("REGISTER")
+	b, _ := request.Bytes()
+	conn.WriteMessage(websocket.TextMessage, b)
+
+	var rawMsg *RawMessage
+	select {
+	case rawMsg = <-collector.messages:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message is received from WebSocket")
+	}
+	if rawMsg.From.GetProtocol() != "ws" || rawMsg.ConnTransport == nil {
+		t.Fatalf("the message is not received from WebSocket")
+	}
+	// the response is sent back over the same connection
+	if err := rawMsg.ConnTransport.Send(createTestResponse(request, 200, "200 OK")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := ParseMessage(bufio.NewReader(bytes.NewBuffer(data)))
+	if err != nil || response.response.statusCode != 200 {
+		t.Errorf("the response is not received from WebSocket")
+	}
+}
+
+func TestWSServerTransportRequiresSipSubprotocol(t *testing.T) {
+	collector := &rawMessageCollector{messages: make(chan *RawMessage, 1)}
+	server := NewWSServerTransport("127.0.0.1", 15462, false, NewSelfLearnRoute(), nil, nil, nil)
+	if err := server.Start(collector); err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:15462", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Errorf("the connection without sip subprotocol is not closed, %v", err)
+	}
+}
+
+func TestRouteBackToWebSocketClient(t *testing.T) {
+	clientTransMgr := NewClientTransportMgr(NewClientTransportFactory(NewPreConfigHostResolver()), NewSelfLearnRoute(), nil)
+	if _, err := clientTransMgr.GetTransport("ws", "df7jal23ls0d.invalid", 5060, ""); err == nil {
+		t.Errorf("the proxy can't connect the WebSocket client")
+	}
+	client := &WSClientTransport{}
+	clientTransMgr.AddTransport("WS", "df7jal23ls0d.invalid", 5060, client)
+	trans, err := clientTransMgr.GetTransport("ws", "df7jal23ls0d.invalid", 5060, "z9hG4bK74bf9")
+	if err != nil || trans.GetPrimary() != client {
+		t.Errorf("the request is not routed back over the WebSocket connection")
+	}
+}
+
+func TestWSServerTransportChecksOrigin(t *testing.T) {
+	server := NewWSServerTransport("127.0.0.1", 15463, false, NewSelfLearnRoute(), nil, nil, nil)
+	if err := server.Start(&rawMessageCollector{messages: make(chan *RawMessage, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	dialer := websocket.Dialer{Subprotocols: []string{"sip"}}
+	dial := func(origin string) error {
+		conn, _, err := dialer.Dial("ws://127.0.0.1:15463", http.Header{"Origin": []string{origin}})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := dial("http://127.0.0.1:15463"); err != nil {
+		t.Errorf("the connection from the same origin is rejected: %v", err)
+	}
+	if err := dial("https://evil.example.com"); err == nil {
+		t.Errorf("the connection from the other origin is accepted")
+	}
+
+	server.SetAllowedOrigins([]string{"https://webrtc.example.com"})
+	if err := dial("https://webrtc.example.com"); err != nil {
+		t.Errorf("the connection from the allowed origin is rejected: %v", err)
+	}
+	if err := dial("https://evil.example.com"); err == nil {
+		t.Errorf("the connection from the not allowed origin is accepted")
+	}
+}
+
+type connClosedCollector struct {
+	rawMessageCollector
+	closed chan ClientTransport
+}
+
+func (c *connClosedCollector) ConnTransportClosed(client ClientTransport) {
+	c.closed <- client
+}
+
+func TestWSConnTransportRemovedOnClose(t *testing.T) {
+	collector := &connClosedCollector{rawMessageCollector: rawMessageCollector{messages: make(chan *RawMessage, 1)}, closed: make(chan ClientTransport, 1)}
+	server := NewWSServerTransport("127.0.0.1", 15464, false, NewSelfLearnRoute(), nil, nil, nil)
+	if err := server.Start(collector); err != nil {
+		t.Fatal(err)
+	}
+	dialer := websocket.Dialer{Subprotocols: []string{"sip"}}
+	conn, _, err := dialer.Dial("ws://127.0.0.1:15464", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := createTestRequest("REGISTER").Bytes()
+	conn.WriteMessage(websocket.TextMessage, b)
+	var rawMsg *RawMessage
+	select {
+	case rawMsg = <-collector.messages:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message is received from WebSocket")
+	}
+	clientTransMgr := NewClientTransportMgr(NewClientTransportFactory(NewPreConfigHostResolver()), NewSelfLearnRoute(), nil)
+	clientTransMgr.AddTransport("ws", "df7jal23ls0d.invalid", 5060, rawMsg.ConnTransport)
+
+	conn.Close()
+	select {
+	case client := <-collector.closed:
+		clientTransMgr.RemoveConnTransport(client)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the closed connection is not notified")
+	}
+	if _, err := clientTransMgr.GetTransport("ws", "df7jal23ls0d.invalid", 5060, ""); err == nil {
+		t.Errorf("the transport of the closed connection is kept")
+	}
+	clientTransMgr.AddTransport("ws", "df7jal23ls0d.invalid", 5060, rawMsg.ConnTransport)
+	if _, err := clientTransMgr.GetTransport("ws", "df7jal23ls0d.invalid", 5060, ""); err == nil {
+		t.Errorf("the transport of the closed connection is added")
+	}
+}